@@ -5,6 +5,7 @@ package client
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
@@ -113,3 +114,24 @@ func (c HTTPClient) GetPing() error {
 	}
 	return nil
 }
+
+// GetStatus makes a request to the status endpoint of the ContainerPilot
+// control socket, and returns the JSON body reporting the health status
+// of each job
+func (c HTTPClient) GetStatus() (string, error) {
+	resp, err := c.Get("http://control/v3/status")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status received by control server: %v",
+			resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
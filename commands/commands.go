@@ -6,6 +6,8 @@ package commands
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"sync"
 	"syscall"
@@ -22,8 +24,60 @@ type Command struct {
 	Exec    string
 	Args    []string
 	Timeout time.Duration
-	logger  log.Entry
-	lock    *sync.Mutex
+
+	// KillGracePeriod is how long to wait after sending SIGTERM to a
+	// Command that has timed out before sending SIGKILL. If zero, a timed
+	// out Command is sent SIGKILL immediately.
+	KillGracePeriod time.Duration
+
+	// StopGracePeriod is how long to wait after sending SIGTERM to a
+	// Command whose context was canceled before sending SIGKILL. If
+	// zero, a canceled Command is only sent SIGTERM.
+	StopGracePeriod time.Duration
+
+	// Env is added on top of the environment inherited from ContainerPilot
+	Env []string
+
+	// OutputLimit is the number of bytes at the end of the process'
+	// stderr to keep in its Result, in addition to logging it. If zero,
+	// stderr is only logged.
+	OutputLimit int
+
+	// StdoutLimit is the number of bytes at the end of the process'
+	// stdout to keep in its Result, in addition to logging it. If zero,
+	// stdout is only logged.
+	StdoutLimit int
+
+	// RawOutput passes the process' stdout and stderr through to
+	// ContainerPilot's own instead of logging each line
+	RawOutput bool
+
+	// Forward sends the process' stdout and stderr to a syslog server or
+	// a file instead of logging each line
+	Forward *Forwarder
+
+	logger     log.Entry
+	lock       *sync.Mutex
+	resultLock sync.Mutex
+	result     Result
+
+	// pid is saved under pidLock once the process has started, because
+	// the process can be signaled from other goroutines while Start and
+	// Wait are still writing to Cmd
+	pidLock sync.Mutex
+	pid     int
+	exited  bool
+}
+
+// Result is the outcome of the last run of a Command
+type Result struct {
+	Duration time.Duration
+	ExitCode int    // -1 if the process couldn't start or was killed
+	Signal   string // the signal that killed the process, if any (ex. "killed")
+	Output   string // the end of stderr, up to the OutputLimit
+	Stdout   string // the end of stdout, up to the StdoutLimit
+	Error    string // empty if the process exited without error
+	Time     time.Time
 }
 
 // NewCommand parses JSON config into a Command
@@ -58,11 +112,35 @@ func (c *Command) Run(pctx context.Context, bus *events.EventBus) {
 	log.Debugf("%s.Run start", c.Name)
 
 	cmd := ArgsToCmd(c.Exec, c.Args)
-	cmd.Stdout = c.logger.Writer()
-	cmd.Stderr = c.logger.Writer()
+	var streams []io.WriteCloser
+	switch {
+	case c.RawOutput:
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	case c.Forward != nil:
+		streams = []io.WriteCloser{c.Forward.Stream(), c.Forward.Stream()}
+		cmd.Stdout = streams[0]
+		cmd.Stderr = streams[1]
+	default:
+		cmd.Stdout = c.logger.WithField("stream", "stdout").Writer()
+		cmd.Stderr = c.logger.WithField("stream", "stderr").Writer()
+	}
+	var output, stdout *tailBuffer
+	if c.OutputLimit > 0 {
+		output = newTailBuffer(c.OutputLimit)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, output)
+	}
+	if c.StdoutLimit > 0 {
+		stdout = newTailBuffer(c.StdoutLimit)
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, stdout)
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
 	c.Cmd = cmd
 	ctx, cancel := getContext(pctx, c.Timeout)
+	running, exited := make(chan struct{}), make(chan struct{})
 
 	go func() {
 		// Children may have side-effects so we don't want to wait for them
@@ -72,37 +150,110 @@ func (c *Command) Run(pctx context.Context, bus *events.EventBus) {
 		// all child processes.
 		<-ctx.Done()
 		defer c.lock.Unlock()
+		// wait for Start so that we don't miss a process that's just
+		// about to run
+		<-running
 		if ctx.Err() == context.DeadlineExceeded {
 			log.Warnf("%s timeout after %s: '%s'", c.Name, c.Timeout, c.Args)
-			c.Kill()
+			c.stop(exited, c.KillGracePeriod)
+			return
+		}
+		if c.StopGracePeriod > 0 {
+			c.stop(exited, c.StopGracePeriod)
 			return
 		}
 		c.Term()
 	}()
 
 	go func() {
+		defer close(exited)
 		defer cancel()
 		defer log.Debugf("%s.Run end", c.Name)
-		if err := c.Cmd.Start(); err != nil {
+		defer func() {
+			for _, stream := range streams {
+				stream.Close()
+			}
+		}()
+		started := time.Now()
+		err := c.Cmd.Start()
+		if err == nil {
+			c.setPid(c.Cmd.Process.Pid, false)
+		} else {
+			c.setPid(0, true)
+		}
+		close(running)
+		if err != nil {
 			log.Errorf("unable to start %s: %v", c.Name, err)
+			c.setResult(started, -1, "", output, stdout, err)
 			bus.Publish(events.Event{events.ExitFailed, c.Name})
 			bus.Publish(events.Event{events.Error, err.Error()})
 			return
 		}
 		// blocks this goroutine here; if the context gets cancelled
 		// we'll return from Wait() and publish events
-		if err := c.Cmd.Wait(); err != nil {
-			log.Errorf("%s exited with error: %v", c.Name, err)
+		err = c.Cmd.Wait()
+		c.setPid(c.Cmd.Process.Pid, true)
+		if err == nil && ctx.Err() == context.DeadlineExceeded {
+			// the process may have exited cleanly on SIGTERM, but it
+			// didn't finish in time so it has still failed
+			err = fmt.Errorf("timeout after %s", c.Timeout)
+		}
+		exitCode, sig := exitStatus(c.Cmd.ProcessState)
+		c.setResult(started, exitCode, sig, output, stdout, err)
+		fields := log.Fields{"exitCode": exitCode}
+		if sig != "" {
+			fields["signal"] = sig
+		}
+		if err != nil {
+			log.WithFields(fields).Errorf("%s exited with error: %v", c.Name, err)
 			bus.Publish(events.Event{events.ExitFailed, c.Name})
 			bus.Publish(events.Event{events.Error,
 				fmt.Errorf("%s: %s", c.Name, err).Error()})
 		} else {
-			log.Debugf("%s exited without error", c.Name)
+			log.WithFields(fields).Debugf("%s exited without error", c.Name)
 			bus.Publish(events.Event{events.ExitSuccess, c.Name})
 		}
 	}()
 }
 
+// LastResult returns the Result of the last run of the Command, which is
+// updated before its exit event is published
+func (c *Command) LastResult() Result {
+	c.resultLock.Lock()
+	defer c.resultLock.Unlock()
+	return c.result
+}
+
+// exitStatus returns the exit code of the process, or -1 and the signal
+// that killed it if it didn't exit on its own
+func exitStatus(state *os.ProcessState) (int, string) {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return -1, status.Signal().String()
+	}
+	return state.ExitCode(), ""
+}
+
+func (c *Command) setResult(started time.Time, exitCode int, sig string, output, stdout *tailBuffer, err error) {
+	result := Result{
+		Duration: time.Since(started),
+		ExitCode: exitCode,
+		Signal:   sig,
+		Time:     time.Now(),
+	}
+	if output != nil {
+		result.Output = output.String()
+	}
+	if stdout != nil {
+		result.Stdout = stdout.String()
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	c.resultLock.Lock()
+	c.result = result
+	c.resultLock.Unlock()
+}
+
 func getContext(pctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
 	if timeout > 0 {
 		return context.WithTimeout(pctx, timeout)
@@ -110,13 +261,55 @@ func getContext(pctx context.Context, timeout time.Duration) (context.Context, c
 	return context.WithCancel(pctx)
 }
 
+// stop terminates a Command that has timed out or been canceled. If
+// there's a grace period we send SIGTERM first and only send SIGKILL if
+// the process hasn't exited by the end of the grace period.
+func (c *Command) stop(exited <-chan struct{}, grace time.Duration) {
+	if grace > 0 {
+		c.Term()
+		select {
+		case <-exited:
+			return
+		case <-time.After(grace):
+			log.Warnf("%s did not exit %s after SIGTERM, killing",
+				c.Name, grace)
+		}
+	}
+	c.Kill()
+}
+
+// Pid returns the process ID of the running process, or 0 if it hasn't
+// started or has exited
+func (c *Command) Pid() int {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	if c.exited {
+		return 0
+	}
+	return c.pid
+}
+
+// processGroup returns the process group ID of the last process, which is
+// its pid, or 0 if it never started. Its children may outlive it.
+func (c *Command) processGroup() int {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	return c.pid
+}
+
+func (c *Command) setPid(pid int, exited bool) {
+	c.pidLock.Lock()
+	c.pid, c.exited = pid, exited
+	c.pidLock.Unlock()
+}
+
 // Kill sends a kill signal to the underlying process if it still exists,
 // as well as all its children
 func (c *Command) Kill() {
 	log.Debugf("%s.kill", c.Name)
-	if c.Cmd != nil && c.Cmd.Process != nil {
-		log.Debugf("killing command '%v' at pid: %d", c.Name, c.Cmd.Process.Pid)
-		syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGKILL)
+	if pid := c.processGroup(); pid != 0 {
+		log.Debugf("killing command '%v' at pid: %d", c.Name, pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
 	}
 }
 
@@ -124,8 +317,20 @@ func (c *Command) Kill() {
 // as well as all its children
 func (c *Command) Term() {
 	log.Debugf("%s.term", c.Name)
-	if c.Cmd != nil && c.Cmd.Process != nil {
-		log.Debugf("terminating command '%v' at pid: %d", c.Name, c.Cmd.Process.Pid)
-		syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGTERM)
+	if pid := c.processGroup(); pid != 0 {
+		log.Debugf("terminating command '%v' at pid: %d", c.Name, pid)
+		syscall.Kill(-pid, syscall.SIGTERM)
+	}
+}
+
+// Signal sends the signal to the underlying process if it's still
+// running, but not to its children, so that a process like nginx can
+// handle the signal itself. It returns false if there was no process.
+func (c *Command) Signal(sig syscall.Signal) bool {
+	pid := c.Pid()
+	if pid == 0 {
+		return false
 	}
+	log.Debugf("sending %v to command '%v' at pid: %d", sig, c.Name, pid)
+	return syscall.Kill(pid, sig) == nil
 }
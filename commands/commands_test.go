@@ -3,9 +3,17 @@ package commands
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
 	"github.com/joyent/containerpilot/events"
 )
 
@@ -43,6 +51,192 @@ func TestCommandRunChildrenKilled(t *testing.T) {
 	}
 }
 
+func TestCommandRunWithTimeoutTerminated(t *testing.T) {
+	cmd, _ := NewCommand("sleep 2", time.Duration(50*time.Millisecond), nil)
+	cmd.Name = t.Name()
+	cmd.KillGracePeriod = time.Duration(100 * time.Millisecond)
+	got := runtestCommandRun(cmd)
+	expired := events.Event{events.ExitFailed, t.Name()}
+	errMsg := events.Event{events.Error, fmt.Sprintf("%s: signal: terminated", cmd.Name)}
+	if got[expired] != 1 || got[errMsg] != 1 {
+		t.Fatalf("expected:\n%v\n%v\ngot events:\n%v", expired, errMsg, got)
+	}
+	if cmd.Cmd.ProcessState == nil {
+		t.Fatalf("expected process to be reaped")
+	}
+}
+
+func TestCommandRunWithTimeoutTermIgnored(t *testing.T) {
+	cmd, _ := NewCommand("./testdata/test.sh ignoreTerm",
+		time.Duration(50*time.Millisecond), nil)
+	cmd.Name = t.Name()
+	cmd.KillGracePeriod = time.Duration(100 * time.Millisecond)
+	got := runtestCommandRun(cmd)
+	expired := events.Event{events.ExitFailed, t.Name()}
+	errMsg := events.Event{events.Error, fmt.Sprintf("%s: signal: killed", cmd.Name)}
+	if got[expired] != 1 || got[errMsg] != 1 {
+		t.Fatalf("expected:\n%v\n%v\ngot events:\n%v", expired, errMsg, got)
+	}
+	if cmd.Cmd.ProcessState == nil {
+		t.Fatalf("expected process to be reaped")
+	}
+	result := cmd.LastResult()
+	if result.ExitCode != -1 || result.Signal != "killed" {
+		t.Fatalf("expected exit code -1 and signal 'killed' but got %d and '%s'",
+			result.ExitCode, result.Signal)
+	}
+}
+
+func TestCommandRunWithTimeoutCleanExit(t *testing.T) {
+	// exiting cleanly on SIGTERM is still a failure if we timed out
+	cmd, _ := NewCommand("./testdata/test.sh termCleanly",
+		time.Duration(50*time.Millisecond), nil)
+	cmd.Name = t.Name()
+	cmd.KillGracePeriod = time.Duration(100 * time.Millisecond)
+	got := runtestCommandRun(cmd)
+	expired := events.Event{events.ExitFailed, t.Name()}
+	success := events.Event{events.ExitSuccess, t.Name()}
+	if got[expired] != 1 || got[success] != 0 {
+		t.Fatalf("expected %v but got events:\n%v", expired, got)
+	}
+}
+
+func TestCommandRunCanceledTermIgnored(t *testing.T) {
+	cmd, _ := NewCommand("./testdata/test.sh ignoreTerm", time.Duration(0), nil)
+	cmd.Name = t.Name()
+	cmd.StopGracePeriod = time.Duration(100 * time.Millisecond)
+	bus := events.NewEventBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd.Run(ctx, bus)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(300 * time.Millisecond)
+	bus.Wait()
+	got := map[events.Event]int{}
+	for _, result := range bus.DebugEvents() {
+		got[result]++
+	}
+	failed := events.Event{events.ExitFailed, t.Name()}
+	errMsg := events.Event{events.Error, fmt.Sprintf("%s: signal: killed", cmd.Name)}
+	if got[failed] != 1 || got[errMsg] != 1 {
+		t.Fatalf("expected:\n%v\n%v\ngot events:\n%v", failed, errMsg, got)
+	}
+}
+
+func TestCommandRunOutput(t *testing.T) {
+	hook := test.NewGlobal()
+	cmd, _ := NewCommand([]interface{}{"sh", "-c", "echo out; echo err >&2"},
+		time.Duration(0), log.Fields{"job": t.Name()})
+	runtestCommandRun(cmd)
+
+	streams := map[string]string{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["job"] == t.Name() {
+			streams[entry.Data["stream"].(string)] = entry.Message
+		}
+	}
+	if streams["stdout"] != "out" || streams["stderr"] != "err" {
+		t.Fatalf("expected each line tagged with its stream but got %v", streams)
+	}
+
+	cmd.RawOutput = true
+	runtestCommandRun(cmd)
+	if cmd.Cmd.Stdout != os.Stdout || cmd.Cmd.Stderr != os.Stderr {
+		t.Fatalf("expected raw output to be passed through")
+	}
+}
+
+func TestCommandRunForwardFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	fwd, _ := NewForwarder(path, t.Name())
+	fwd.MaxSize = 8
+	fwd.MaxFiles = 2
+	cmd, _ := NewCommand([]interface{}{"printf", "111\\n222\\n333"},
+		time.Duration(0), log.Fields{"job": t.Name()})
+	cmd.Forward = fwd
+	runtestCommandRun(cmd)
+
+	// two lines fit into each file, and the last line ends without a
+	// newline but is still written when the process exits
+	runtestCommandRun(cmd)
+	expected := map[string]string{
+		path:        "222\n333\n",
+		path + ".1": "333\n111\n",
+		path + ".2": "111\n222\n",
+	}
+	for name, content := range expected {
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("expected rotated file %s: %v", name, err)
+		}
+		if string(got) != content {
+			t.Fatalf("expected %q in %s but got %q", content, name, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 rotated files to be kept")
+	}
+	if fwd.file != nil {
+		t.Fatalf("expected file to be closed after the process exited")
+	}
+}
+
+func TestCommandRunForwardSyslog(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer server.Close()
+	fwd, err := NewForwarder("syslog://"+server.LocalAddr().String(), "myjob")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cmd, _ := NewCommand([]interface{}{"echo", "hello"},
+		time.Duration(0), log.Fields{"job": t.Name()})
+	cmd.Forward = fwd
+	runtestCommandRun(cmd)
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unable to read syslog message: %v", err)
+	}
+	msg := string(buf[:n])
+	// LOG_DAEMON|LOG_INFO
+	if !strings.HasPrefix(msg, "<30>") ||
+		!strings.HasSuffix(msg, fmt.Sprintf(" myjob[%d]: hello", os.Getpid())) {
+		t.Fatalf("unexpected syslog message: %q", msg)
+	}
+}
+
+func TestNewForwarder(t *testing.T) {
+	testErr := func(output, expected string) {
+		_, err := NewForwarder(output, "myjob")
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected %q for output %q but got %v", expected, output, err)
+		}
+	}
+	testErr("syslog://localhost", "syslog address must be in the form 'host:port': 'localhost'")
+	testErr("http://localhost:80", "output 'http://localhost:80' must be a file path or "+
+		"a syslog address with one of the schemes 'syslog', 'syslog+tcp', or 'syslog+tls'")
+
+	for output, network := range map[string]string{"syslog": "",
+		"syslog://host:514": "udp", "syslog+tcp://host:514": "tcp",
+		"syslog+tls://host:6514": "tls"} {
+		fwd, err := NewForwarder(output, "myjob")
+		if err != nil || fwd.network != network || fwd.IsFile() {
+			t.Fatalf("expected %q to forward to syslog over %q but got %+v (%v)",
+				output, network, fwd, err)
+		}
+	}
+}
+
 func TestCommandRunExecFailed(t *testing.T) {
 	cmd, _ := NewCommand("./testdata/test.sh failStuff --debug", time.Duration(0), nil)
 	got := runtestCommandRun(cmd)
@@ -51,6 +245,11 @@ func TestCommandRunExecFailed(t *testing.T) {
 	if got[failed] != 1 || got[errMsg] != 1 {
 		t.Fatalf("expected:\n%v\n%v\ngot events:\n%v", failed, errMsg, got)
 	}
+	result := cmd.LastResult()
+	if result.ExitCode != 255 || result.Signal != "" {
+		t.Fatalf("expected exit code 255 and no signal but got %d and '%s'",
+			result.ExitCode, result.Signal)
+	}
 }
 
 func TestCommandRunExecInvalid(t *testing.T) {
@@ -76,6 +275,47 @@ func TestCommandRunReuseCmd(t *testing.T) {
 	runtestCommandRun(cmd)
 }
 
+func TestCommandRunResult(t *testing.T) {
+	cmd, _ := NewCommand([]string{"sh", "-c", "echo 0123456789 >&2; exit 3"},
+		time.Duration(0), nil)
+	cmd.OutputLimit = 5
+	runtestCommandRun(cmd)
+	result := cmd.LastResult()
+	if result.ExitCode != 3 || result.Error != "exit status 3" {
+		t.Fatalf("expected exit code 3 but got %+v", result)
+	}
+	if result.Output != "6789" {
+		t.Fatalf("expected the end of stderr to be kept but got %q", result.Output)
+	}
+	if result.Duration <= 0 || result.Time.IsZero() {
+		t.Fatalf("expected the duration and time to be set but got %+v", result)
+	}
+
+	cmd, _ = NewCommand("./testdata/invalidCommand", time.Duration(0), nil)
+	runtestCommandRun(cmd)
+	if result := cmd.LastResult(); result.ExitCode != -1 || result.Error == "" {
+		t.Fatalf("expected exit code -1 for a command that can't start but got %+v",
+			result)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buf := newTailBuffer(8)
+	buf.Write([]byte("abc"))
+	buf.Write([]byte("defgh"))
+	if got := buf.String(); got != "abcdefgh" {
+		t.Fatalf("expected 'abcdefgh' but got %q", got)
+	}
+	buf.Write([]byte("ij"))
+	if got := buf.String(); got != "cdefghij" {
+		t.Fatalf("expected 'cdefghij' but got %q", got)
+	}
+	buf.Write([]byte("0123456789"))
+	if got := buf.String(); got != "23456789" {
+		t.Fatalf("expected '23456789' but got %q", got)
+	}
+}
+
 // test helpers
 
 func runtestCommandRun(cmd *Command) map[events.Event]int {
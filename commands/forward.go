@@ -0,0 +1,277 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the local syslog sockets, in the order that log/syslog tries them
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// maxLineLength is how much of a line without a newline is buffered before
+// it's forwarded anyways
+const maxLineLength = 64 * 1024
+
+// Forwarder sends each line of a process' output to a syslog server or
+// appends it to a file, instead of ContainerPilot's logs. A file is
+// rotated when writing to it would make it larger than MaxSize, keeping
+// MaxFiles of the rotated files as "<path>.1", "<path>.2", etc. Nothing is
+// opened until the process writes its first line, and the file or syslog
+// connection is closed when the last process writing to it exits.
+type Forwarder struct {
+	Path     string // the file to write to, if not sending to syslog
+	MaxSize  int64  // if zero, the file is never rotated
+	MaxFiles int
+
+	network string // for syslog: "udp", "tcp", "tls", or "" for local
+	raddr   string
+	tag     string
+
+	lock    sync.Mutex
+	streams int
+	file    *os.File
+	size    int64
+	conn    net.Conn
+}
+
+// NewForwarder parses the output, which is either a path to a file or
+// one of "syslog" (the local syslog daemon), "syslog://host:port" (UDP),
+// "syslog+tcp://host:port", or "syslog+tls://host:port". The tag is the
+// name the syslog messages are sent under.
+func NewForwarder(output, tag string) (*Forwarder, error) {
+	fwd := &Forwarder{tag: tag, MaxFiles: 1}
+	schemes := map[string]string{
+		"syslog://": "udp", "syslog+tcp://": "tcp", "syslog+tls://": "tls",
+	}
+	switch {
+	case output == "":
+		return nil, fmt.Errorf("output must not be empty")
+	case output == "syslog":
+		return fwd, nil
+	case strings.Contains(output, "://"):
+		for scheme, network := range schemes {
+			if !strings.HasPrefix(output, scheme) {
+				continue
+			}
+			fwd.network, fwd.raddr = network, strings.TrimPrefix(output, scheme)
+			if _, _, err := net.SplitHostPort(fwd.raddr); err != nil {
+				return nil, fmt.Errorf("syslog address must be in the form "+
+					"'host:port': '%s'", fwd.raddr)
+			}
+			return fwd, nil
+		}
+		return nil, fmt.Errorf("output '%s' must be a file path or a syslog "+
+			"address with one of the schemes 'syslog', 'syslog+tcp', or "+
+			"'syslog+tls'", output)
+	}
+	fwd.Path = output
+	return fwd, nil
+}
+
+// IsFile returns whether output is written to a file rather than syslog
+func (f *Forwarder) IsFile() bool {
+	return f.Path != ""
+}
+
+// Stream returns a writer for one of the process' output streams, which
+// writes each complete line it gets to the Forwarder. Closing it writes
+// what's left of the last line.
+func (f *Forwarder) Stream() io.WriteCloser {
+	f.lock.Lock()
+	f.streams++
+	f.lock.Unlock()
+	return &lineWriter{fwd: f}
+}
+
+// release closes the file or syslog connection once the last stream is
+// closed, so that a Forwarder replaced on reload doesn't leave them open
+func (f *Forwarder) release() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.streams--
+	if f.streams > 0 {
+		return
+	}
+	f.close()
+}
+
+// close must be called with the lock held
+func (f *Forwarder) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *Forwarder) writeLine(line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.IsFile() {
+		return f.writeFile(line)
+	}
+	err := f.writeSyslog(line)
+	if err != nil {
+		// the connection may have been closed by the server, so try once
+		// more with a new one
+		f.close()
+		err = f.writeSyslog(line)
+	}
+	return err
+}
+
+func (f *Forwarder) writeFile(line []byte) error {
+	n := int64(len(line)) + 1
+	if f.file != nil && f.MaxSize > 0 && f.size > 0 && f.size+n > f.MaxSize {
+		f.close()
+		f.rotate()
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		f.file, f.size = file, info.Size()
+		if f.MaxSize > 0 && f.size > 0 && f.size+n > f.MaxSize {
+			// the file was already full when we got to it
+			f.close()
+			f.rotate()
+			return f.writeFile(line)
+		}
+	}
+	buf := make([]byte, 0, n)
+	written, err := f.file.Write(append(append(buf, line...), '\n'))
+	f.size += int64(written)
+	return err
+}
+
+// rotate shifts each rotated file up by one, dropping the oldest, and
+// moves the current file to "<path>.1"
+func (f *Forwarder) rotate() {
+	os.Remove(fmt.Sprintf("%s.%d", f.Path, f.MaxFiles))
+	for i := f.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+	}
+	os.Rename(f.Path, f.Path+".1")
+}
+
+func (f *Forwarder) writeSyslog(line []byte) error {
+	if f.conn == nil {
+		conn, err := f.dial()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+	priority := syslog.LOG_INFO | syslog.LOG_DAEMON
+	timestamp := time.Now().Format(time.RFC3339)
+	var msg string
+	if f.network == "" {
+		// the local daemon adds the hostname itself
+		msg = fmt.Sprintf("<%d>%s %s[%d]: %s", priority, timestamp,
+			f.tag, os.Getpid(), line)
+	} else {
+		hostname, _ := os.Hostname()
+		msg = fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, timestamp,
+			hostname, f.tag, os.Getpid(), line)
+	}
+	if f.network == "tcp" || f.network == "tls" {
+		// stream transports need each message to end in a newline
+		msg += "\n"
+	}
+	_, err := io.WriteString(f.conn, msg)
+	return err
+}
+
+func (f *Forwarder) dial() (net.Conn, error) {
+	switch f.network {
+	case "":
+		var err error
+		for _, path := range localSyslogSockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				var conn net.Conn
+				if conn, err = net.Dial(network, path); err == nil {
+					return conn, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unable to connect to local syslog: %v", err)
+	case "tls":
+		host, _, _ := net.SplitHostPort(f.raddr)
+		return tls.Dial("tcp", f.raddr, &tls.Config{ServerName: host})
+	default:
+		return net.Dial(f.network, f.raddr)
+	}
+}
+
+// lineWriter is an io.Writer that splits what's written to it into lines
+// for a Forwarder
+type lineWriter struct {
+	fwd    *Forwarder
+	buf    []byte
+	failed bool
+}
+
+// Write implements io.Writer for lineWriter. It never returns an error,
+// because that would stop os/exec copying the process' output and the
+// process could block writing to a full pipe.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.write(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) >= maxLineLength {
+		w.write(w.buf)
+		w.buf = w.buf[:0]
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer for lineWriter. It writes the last line if
+// the process didn't end it with a newline.
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.write(w.buf)
+		w.buf = nil
+	}
+	w.fwd.release()
+	return nil
+}
+
+func (w *lineWriter) write(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	err := w.fwd.writeLine(line)
+	if err != nil && !w.failed {
+		// only warn once per run so that we don't flood the logs
+		w.failed = true
+		destination := w.fwd.Path
+		if !w.fwd.IsFile() {
+			destination = "syslog"
+		}
+		log.Warnf("unable to forward output of %s to %s: %v",
+			w.fwd.tag, destination, err)
+	}
+}
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"strings"
+	"sync"
+)
+
+// tailBuffer is an io.Writer that keeps only the last limit bytes written
+// to it, so that a chatty process can't use up memory
+type tailBuffer struct {
+	limit int
+	buf   []byte
+	lock  sync.Mutex
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+// Write implements io.Writer for tailBuffer
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := len(p)
+	if n >= t.limit {
+		t.buf = append(t.buf[:0], p[n-t.limit:]...)
+		return n, nil
+	}
+	if overflow := len(t.buf) + n - t.limit; overflow > 0 {
+		t.buf = append(t.buf[:0], t.buf[overflow:]...)
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+// String returns the bytes that were kept, without surrounding whitespace
+func (t *tailBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
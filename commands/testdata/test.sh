@@ -29,6 +29,17 @@ sleepStuff() {
     sleep 10
 }
 
+ignoreTerm() {
+    # ignored signals are inherited by the sleep as well
+    trap '' SIGTERM
+    sleep 10
+}
+
+termCleanly() {
+    trap 'exit 0' SIGTERM
+    sleep 10
+}
+
 interruptSleep() {
   for i in {1..10}; do
     echo -n "."
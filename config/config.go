@@ -4,16 +4,27 @@ package config
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/flynn/json5"
+	"gopkg.in/yaml.v2"
 
 	"github.com/joyent/containerpilot/config/decode"
 	"github.com/joyent/containerpilot/config/logger"
 	"github.com/joyent/containerpilot/config/template"
+	"github.com/joyent/containerpilot/config/timing"
 	"github.com/joyent/containerpilot/control"
 	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/jobs"
@@ -22,24 +33,36 @@ import (
 )
 
 type rawConfig struct {
-	consul      interface{}
-	logConfig   *logger.Config
-	stopTimeout int
-	jobs        []interface{}
-	watches     []interface{}
-	telemetry   interface{}
-	control     interface{}
+	consul         interface{}
+	etcd           interface{}
+	kubernetes     interface{}
+	zookeeper      interface{}
+	dns            interface{}
+	discovery      interface{}
+	logConfig      *logger.Config
+	stopTimeout    int
+	startupTimeout string
+	jobs           []interface{}
+	watches        []interface{}
+	telemetry      interface{}
+	control        interface{}
+	signals        interface{}
 }
 
 // Config contains the parsed config elements
 type Config struct {
-	Discovery   discovery.Backend
-	LogConfig   *logger.Config
-	StopTimeout int
-	Jobs        []*jobs.Config
-	Watches     []*watches.Config
-	Telemetry   *telemetry.Config
-	Control     *control.Config
+	Discovery      discovery.Backend
+	LogConfig      *logger.Config
+	StopTimeout    int
+	StartupTimeout time.Duration
+	Jobs           []*jobs.Config
+	Watches        []*watches.Config
+	Telemetry      *telemetry.Config
+	Control        *control.Config
+	Signals        map[syscall.Signal]*SignalConfig
+
+	// the raw discovery config, for comparing configs on a reload
+	discoveryConfig interface{}
 }
 
 const (
@@ -64,14 +87,26 @@ func (cfg *rawConfig) parseStopTimeout() (int, error) {
 }
 
 // RenderConfig renders the templated config in configFlag to renderFlag.
+// A config directory is rendered as the JSON of its merged fragments.
 func RenderConfig(configFlag, renderFlag string) error {
-	configData, err := loadConfigFile(configFlag)
-	if err != nil {
-		return err
-	}
-	renderedConfig, err := renderConfigTemplate(configData)
-	if err != nil {
-		return err
+	var renderedConfig []byte
+	if isConfigDir(configFlag) {
+		configMap, err := loadConfigDir(configFlag)
+		if err != nil {
+			return err
+		}
+		if renderedConfig, err = json.MarshalIndent(configMap, "", "  "); err != nil {
+			return fmt.Errorf("could not render config directory: %s", err)
+		}
+	} else {
+		configData, err := loadConfigFile(configFlag)
+		if err != nil {
+			return err
+		}
+		renderedConfig, err = renderConfigTemplate(configData, configSource(configFlag))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Save the rendered template, either to stdout or to file
@@ -89,24 +124,95 @@ func RenderConfig(configFlag, renderFlag string) error {
 
 // LoadConfig loads, parses, and validates the configuration
 func LoadConfig(configFlag string) (*Config, error) {
-	configData, err := loadConfigFile(configFlag)
+	configMap, err := loadConfig(configFlag)
 	if err != nil {
 		return nil, err
 	}
-	renderedConfig, err := renderConfigTemplate(configData)
-	if err != nil {
-		return nil, err
-	}
-	config, err := newConfig(renderedConfig)
+	config, err := configFromMap(configMap)
 	if err != nil {
 		return nil, err
 	}
 	return config, nil
 }
 
+// the config can be read from stdin only once, so we keep it around for
+// reloads and for subcommands that need to read it again
+var (
+	stdin          io.Reader = os.Stdin
+	stdinOnce      sync.Once
+	stdinConfig    []byte
+	stdinConfigErr error
+)
+
+// isInlineConfig returns true if the -config flag (or CONTAINERPILOT
+// env var) holds the configuration itself rather than a file path
+func isInlineConfig(configFlag string) bool {
+	return strings.HasPrefix(strings.TrimSpace(configFlag), "{")
+}
+
+// configSource describes where the config came from for error messages
+func configSource(configFlag string) string {
+	switch {
+	case configFlag == "-":
+		return "config from stdin"
+	case isInlineConfig(configFlag):
+		return "inline config"
+	}
+	return fmt.Sprintf("config file %s", configFlag)
+}
+
+// EnvConfigFormat is the environment variable with the format of the
+// config, which the -config-format flag sets
+const EnvConfigFormat = "CONTAINERPILOT_CONFIG_FORMAT"
+
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+// configFormat returns whether the config is JSON5 or YAML. The format is
+// taken from the CONTAINERPILOT_CONFIG_FORMAT env var if it's set, or
+// else from the extension of the config file. Inline configs and configs
+// from stdin are JSON5 unless the env var says otherwise.
+func configFormat(configFlag string) (string, error) {
+	switch format := strings.ToLower(os.Getenv(EnvConfigFormat)); format {
+	case "json", "json5":
+		return formatJSON, nil
+	case "yaml", "yml":
+		return formatYAML, nil
+	case "":
+	default:
+		return "", fmt.Errorf(
+			"invalid config format '%s': must be 'json' or 'yaml'", format)
+	}
+	if configFlag == "-" || isInlineConfig(configFlag) {
+		return formatJSON, nil
+	}
+	switch strings.ToLower(filepath.Ext(configFlag)) {
+	case ".yaml", ".yml":
+		return formatYAML, nil
+	}
+	return formatJSON, nil
+}
+
+// loadConfigFile reads the raw config from the file at the path in the
+// -config flag. A flag of '-' reads the config from stdin instead, and a
+// flag starting with '{' is the config itself.
 func loadConfigFile(configFlag string) ([]byte, error) {
-	if configFlag == "" {
+	switch {
+	case configFlag == "":
 		return nil, errors.New("-config flag is required")
+	case configFlag == "-":
+		stdinOnce.Do(func() {
+			stdinConfig, stdinConfigErr = ioutil.ReadAll(stdin)
+		})
+		if stdinConfigErr != nil {
+			return nil, fmt.Errorf("could not read config from stdin: %s",
+				stdinConfigErr)
+		}
+		return stdinConfig, nil
+	case isInlineConfig(configFlag):
+		return []byte(configFlag), nil
 	}
 	data, err := ioutil.ReadFile(configFlag)
 	if err != nil {
@@ -115,10 +221,179 @@ func loadConfigFile(configFlag string) ([]byte, error) {
 	return data, nil
 }
 
-func renderConfigTemplate(configData []byte) ([]byte, error) {
+// loadConfig loads the config in the -config flag and parses it, whether
+// it's a file, stdin, an inline config, or a directory of fragments
+func loadConfig(configFlag string) (map[string]interface{}, error) {
+	if isConfigDir(configFlag) {
+		return loadConfigDir(configFlag)
+	}
+	configData, err := loadConfigFile(configFlag)
+	if err != nil {
+		return nil, err
+	}
+	format, err := configFormat(configFlag)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(configData, configSource(configFlag), format)
+}
+
+// isConfigDir returns true if the -config flag is the path of a directory
+// of config fragments
+func isConfigDir(configFlag string) bool {
+	if configFlag == "" || configFlag == "-" || isInlineConfig(configFlag) {
+		return false
+	}
+	info, err := os.Stat(configFlag)
+	return err == nil && info.IsDir()
+}
+
+// loadConfigDir loads the config fragments in the directory in lexical
+// order and merges them into one config. Only files ending in '.json',
+// '.json5', '.yaml', or '.yml' are loaded, and each one is parsed in the
+// format of its extension and has its templates rendered on its own.
+func loadConfigDir(dir string) (map[string]interface{}, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config directory: %s", err)
+	}
+	var configMap map[string]interface{}
+	for _, file := range files {
+		format := formatJSON
+		switch strings.ToLower(filepath.Ext(file.Name())) {
+		case ".json", ".json5":
+		case ".yaml", ".yml":
+			format = formatYAML
+		default:
+			continue
+		}
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		configData, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fragment, err := parseConfig(configData, configSource(path), format)
+		if err != nil {
+			return nil, err
+		}
+		if configMap == nil {
+			configMap = fragment
+			continue
+		}
+		mergeConfig(configMap, fragment)
+	}
+	if configMap == nil {
+		return nil, fmt.Errorf("no config files in config directory %s", dir)
+	}
+	return configMap, nil
+}
+
+// mergeConfig merges a config fragment into the config. Mappings are
+// merged key by key and sequences are appended to, so that each fragment
+// can add its own jobs and watches. Any other value in the fragment
+// replaces the one that was there.
+func mergeConfig(configMap, fragment map[string]interface{}) {
+	for key, value := range fragment {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if existing, ok := configMap[key].(map[string]interface{}); ok {
+				mergeConfig(existing, v)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := configMap[key].([]interface{}); ok {
+				configMap[key] = append(existing, v...)
+				continue
+			}
+		}
+		configMap[key] = value
+	}
+}
+
+// parseConfig parses the raw config and renders its templates. Each
+// string in the parsed config is rendered on its own, so that values from
+// the environment can't break the config syntax and so that errors point
+// at the field with the bad template. A config that only parses once it's
+// been rendered (ex. one that uses templates to generate its jobs, or
+// that has templates outside of strings) is rendered as a whole instead.
+func parseConfig(configData []byte, source, format string) (map[string]interface{}, error) {
+	if configMap, err := unmarshalConfig(configData, source, format); err == nil {
+		return renderConfigFields(configMap, source)
+	}
+	renderedConfig, err := renderConfigTemplate(configData, source)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalConfig(renderedConfig, source, format)
+}
+
+// renderConfigFields renders the templates in every string key and value
+// of the parsed config
+func renderConfigFields(configMap map[string]interface{}, source string) (map[string]interface{}, error) {
+	rendered, err := renderConfigValue(configMap, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not apply template to %s: %v", source, err)
+	}
+	return rendered.(map[string]interface{}), nil
+}
+
+func renderConfigValue(value interface{}, path string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return template.ApplyString(path, v)
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			renderedItem, err := renderConfigValue(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = renderedItem
+		}
+		return rendered, nil
+	case map[string]interface{}:
+		// sorted so that we always report the same field if more than
+		// one of them has a bad template
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rendered := make(map[string]interface{}, len(v))
+		for _, key := range keys {
+			renderedKey, err := template.ApplyString(fieldPath(path, key), key)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := rendered[renderedKey]; ok {
+				return nil, fmt.Errorf("%s: duplicate key after rendering",
+					fieldPath(path, renderedKey))
+			}
+			renderedVal, err := renderConfigValue(v[key], fieldPath(path, renderedKey))
+			if err != nil {
+				return nil, err
+			}
+			rendered[renderedKey] = renderedVal
+		}
+		return rendered, nil
+	}
+	return value, nil
+}
+
+func fieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func renderConfigTemplate(configData []byte, source string) ([]byte, error) {
 	templ, err := template.Apply(configData)
 	if err != nil {
-		err = fmt.Errorf("could not apply template to config: %v", err)
+		err = fmt.Errorf("could not apply template to %s: %v", source, err)
 	}
 	return templ, err
 }
@@ -126,22 +401,28 @@ func renderConfigTemplate(configData []byte) ([]byte, error) {
 // newConfig unmarshals the textual configuration data into the
 // validated Config struct that we'll use the run the application
 func newConfig(configData []byte) (*Config, error) {
-	configMap, err := unmarshalConfig(configData)
+	configMap, err := unmarshalConfig(configData, "config", formatJSON)
 	if err != nil {
 		return nil, err
 	}
+	return configFromMap(configMap)
+}
 
+// configFromMap decodes and validates the unmarshalled configuration
+func configFromMap(configMap map[string]interface{}) (*Config, error) {
 	raw := &rawConfig{}
-	if err = decodeConfig(configMap, raw); err != nil {
+	if err := decodeConfig(configMap, raw); err != nil {
 		return nil, err
 	}
 	cfg := &Config{}
 
-	disc, err := discovery.NewConsul(raw.consul)
+	disc, err := raw.newDiscoveryBackend()
 	if err != nil {
 		return nil, err
 	}
 	cfg.Discovery = disc
+	cfg.discoveryConfig = []interface{}{raw.consul, raw.etcd, raw.kubernetes,
+		raw.zookeeper, raw.dns, raw.discovery}
 
 	cfg.LogConfig = raw.logConfig
 
@@ -151,6 +432,13 @@ func newConfig(configData []byte) (*Config, error) {
 	}
 	cfg.StopTimeout = stopTimeout
 
+	startupTimeout, err := timing.GetTimeout(raw.startupTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse startupTimeout '%s': %v",
+			raw.startupTimeout, err)
+	}
+	cfg.StartupTimeout = startupTimeout
+
 	controlConfig, err := control.NewConfig(raw.control)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse control: %v", err)
@@ -177,27 +465,120 @@ func newConfig(configData []byte) (*Config, error) {
 		cfg.Telemetry = telemetry
 		cfg.Jobs = append(cfg.Jobs, telemetry.JobConfig)
 	}
+	if err := cfg.validateAgentOnly(); err != nil {
+		return nil, err
+	}
+
+	signals, err := newSignals(raw.signals, cfg.Jobs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signals: %v", err)
+	}
+	cfg.Signals = signals
 
 	return cfg, nil
 }
 
-func unmarshalConfig(data []byte) (map[string]interface{}, error) {
+// SameDiscovery returns true if the other Config has the same service
+// discovery config, in which case the Discovery backends are equivalent
+func (cfg *Config) SameDiscovery(other *Config) bool {
+	return reflect.DeepEqual(cfg.discoveryConfig, other.discoveryConfig)
+}
+
+// AgentOnly returns true if none of the jobs have an exec. In this mode
+// ContainerPilot only health checks, heartbeats, and watches on behalf of
+// an application supervised by something else, and it runs until it
+// receives a signal rather than until its child processes exit.
+func (cfg *Config) AgentOnly() bool {
+	if len(cfg.Jobs) == 0 {
+		return false
+	}
+	for _, job := range cfg.Jobs {
+		if job.Exec != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validateAgentOnly ensures that an agent-only configuration has at least
+// one service to advertise or one watch to poll; otherwise there would be
+// nothing for ContainerPilot to do.
+func (cfg *Config) validateAgentOnly() error {
+	if !cfg.AgentOnly() || len(cfg.Watches) > 0 {
+		return nil
+	}
+	for _, job := range cfg.Jobs {
+		if job.Port != 0 {
+			return nil
+		}
+	}
+	return errors.New("no job has an 'exec', so at least one job must " +
+		"have a 'port' or at least one watch must be configured")
+}
+
+func unmarshalConfig(data []byte, source, format string) (map[string]interface{}, error) {
+	if format == formatYAML {
+		return unmarshalYAMLConfig(data, source)
+	}
 	var config map[string]interface{}
 	if err := json5.Unmarshal(data, &config); err != nil {
 		syntax, ok := err.(*json5.SyntaxError)
 		if !ok {
 			return nil, fmt.Errorf(
-				"could not parse configuration: %s",
-				err)
+				"could not parse %s: %s", source, err)
 		}
-		return nil, newJSONparseError(data, syntax)
+		return nil, newParseError(data, syntax.Offset, syntax, source)
 	}
 	return config, nil
 }
 
-func newJSONparseError(js []byte, syntax *json5.SyntaxError) error {
-	line, col, err := highlightError(js, syntax.Offset)
-	return fmt.Errorf("parse error at line:col [%d:%d]: %s\n%s", line, col, syntax, err)
+// unmarshalYAMLConfig parses a YAML config into the same map that the
+// equivalent JSON5 config would have
+func unmarshalYAMLConfig(data []byte, source string) (map[string]interface{}, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", source, err)
+	}
+	switch config := fromYAML(value).(type) {
+	case map[string]interface{}:
+		return config, nil
+	case nil:
+		return map[string]interface{}{}, nil
+	}
+	return nil, fmt.Errorf("could not parse %s: must be a mapping", source)
+}
+
+// fromYAML converts a value decoded by the YAML parser into the types
+// that the JSON5 parser produces: maps with string keys, and float64
+// numbers
+func fromYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = fromYAML(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = fromYAML(item)
+		}
+		return converted
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return value
+}
+
+func newParseError(data []byte, offset int64, syntax error, source string) error {
+	line, col, err := highlightError(data, offset)
+	return fmt.Errorf("parse error at line:col [%d:%d] in %s: %s\n%s",
+		line, col, source, syntax, err)
 }
 
 func highlightError(data []byte, pos int64) (int, int, string) {
@@ -231,33 +612,113 @@ func highlightError(data []byte, pos int64) (int, int, string) {
 	return line, int(col), fmt.Sprintf("%s%s%s", prevLine, thisLine, highlight)
 }
 
+// newDiscoveryBackend creates the backend for the 'consul', 'etcd',
+// 'kubernetes', 'zookeeper', or 'dns' config, or the 'discovery' config
+// of a backend that runs commands. If more than one of them is set, the
+// backend is a MultiBackend that uses all of them.
+func (raw *rawConfig) newDiscoveryBackend() (discovery.Backend, error) {
+	if raw.consul == nil && raw.etcd == nil && raw.kubernetes == nil &&
+		raw.zookeeper == nil && raw.dns == nil && raw.discovery == nil {
+		return discovery.NewBackend(raw.consul)
+	}
+	var backends []discovery.Backend
+	if raw.consul != nil {
+		disc, err := discovery.NewBackend(raw.consul)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, disc)
+	}
+	if raw.etcd != nil {
+		disc, err := discovery.NewEtcd(raw.etcd)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, disc)
+	}
+	if raw.kubernetes != nil {
+		disc, err := discovery.NewKubernetes(raw.kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, disc)
+	}
+	if raw.zookeeper != nil {
+		disc, err := discovery.NewZookeeper(raw.zookeeper)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, disc)
+	}
+	if raw.dns != nil {
+		disc, err := discovery.NewDNS(raw.dns)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, disc)
+	}
+	if raw.discovery != nil {
+		cmds, ok := raw.discovery.(map[string]interface{})
+		if !ok || len(cmds) != 1 || cmds["exec"] == nil {
+			return nil, fmt.Errorf("discovery must have exactly one backend: 'exec'")
+		}
+		disc, err := discovery.NewExec(cmds["exec"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse discovery: %v", err)
+		}
+		backends = append(backends, disc)
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	return discovery.NewMultiBackend(backends...), nil
+}
+
 // We can't use mapstructure to decode our config map since we want the values
 // to also be raw interface{} types. mapstructure can only decode
 // into concrete structs and primitives
 func decodeConfig(configMap map[string]interface{}, result *rawConfig) error {
 	var logConfig logger.Config
 	var stopTimeout int
+	var startupTimeout string
 	if err := decode.ToStruct(configMap["logging"], &logConfig); err != nil {
 		return err
 	}
 	if err := decode.ToStruct(configMap["stopTimeout"], &stopTimeout); err != nil {
 		return err
 	}
+	if err := decode.ToStruct(configMap["startupTimeout"], &startupTimeout); err != nil {
+		return err
+	}
 	result.consul = configMap["consul"]
+	result.etcd = configMap["etcd"]
+	result.kubernetes = configMap["kubernetes"]
+	result.zookeeper = configMap["zookeeper"]
+	result.dns = configMap["dns"]
+	result.discovery = configMap["discovery"]
 	result.stopTimeout = stopTimeout
+	result.startupTimeout = startupTimeout
 	result.logConfig = &logConfig
 	result.control = configMap["control"]
 	result.jobs = decode.ToSlice(configMap["jobs"])
 	result.watches = decode.ToSlice(configMap["watches"])
 	result.telemetry = configMap["telemetry"]
+	result.signals = configMap["signals"]
 
 	delete(configMap, "consul")
+	delete(configMap, "etcd")
+	delete(configMap, "kubernetes")
+	delete(configMap, "zookeeper")
+	delete(configMap, "dns")
+	delete(configMap, "discovery")
 	delete(configMap, "logging")
 	delete(configMap, "control")
 	delete(configMap, "stopTimeout")
+	delete(configMap, "startupTimeout")
 	delete(configMap, "jobs")
 	delete(configMap, "watches")
 	delete(configMap, "telemetry")
+	delete(configMap, "signals")
 	var unused []string
 	for key := range configMap {
 		unused = append(unused, key)
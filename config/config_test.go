@@ -1,12 +1,19 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/joyent/containerpilot/discovery"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 /*
@@ -150,6 +157,211 @@ func TestCustomConfigControl(t *testing.T) {
 		"config for control.socket")
 }
 
+func TestAgentOnlyConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	"consul": "consul:8500",
+	jobs: [{name: "app", port: 80, interfaces: ["inet", "lo0"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.True(t, cfg.AgentOnly(), "expected agent-only mode")
+
+	cfg, err = newConfig([]byte(`{
+	"consul": "consul:8500",
+	jobs: [{name: "app", exec: "/bin/app"}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.False(t, cfg.AgentOnly(), "expected job exec to disable agent-only mode")
+
+	_, err = newConfig([]byte(`{
+	"consul": "consul:8500",
+	jobs: [{name: "app", health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	assert.Error(t, err, "expected error for agent-only mode without services")
+}
+
+func TestStartupTimeoutConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{"consul": "consul:8500"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.Equal(t, time.Duration(0), cfg.StartupTimeout, "default startupTimeout")
+
+	cfg, err = newConfig([]byte(`{"consul": "consul:8500", startupTimeout: 90}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.Equal(t, 90*time.Second, cfg.StartupTimeout, "startupTimeout in seconds")
+
+	cfg, err = newConfig([]byte(`{"consul": "consul:8500", startupTimeout: "2m"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.Equal(t, 2*time.Minute, cfg.StartupTimeout, "startupTimeout as duration")
+
+	_, err = newConfig([]byte(`{"consul": "consul:8500", startupTimeout: "x"}`))
+	assert.Error(t, err, "expected error for invalid startupTimeout")
+}
+
+func TestSignalsConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{"consul": "consul:8500"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.Equal(t, DefaultSignals(), cfg.Signals, "default signals")
+
+	cfg, err = newConfig([]byte(`{"consul": "consul:8500",
+	jobs: [{name: "nginx", exec: "nginx"}],
+	signals: {
+	  SIGQUIT: "stop",
+	  pipe: "ignore",
+	  SIGHUP: {action: "forward", jobs: ["nginx"]}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.Equal(t, SignalStop, cfg.Signals[syscall.SIGQUIT].Action)
+	assert.Equal(t, SignalIgnore, cfg.Signals[syscall.SIGPIPE].Action)
+	assert.Equal(t, &SignalConfig{Action: SignalForward, Jobs: []string{"nginx"}},
+		cfg.Signals[syscall.SIGHUP], "expected SIGHUP default to be replaced")
+	assert.Equal(t, SignalStop, cfg.Signals[syscall.SIGTERM].Action,
+		"expected other defaults to be kept")
+
+	testErr := func(signals, expected string) {
+		_, err := newConfig([]byte(`{"consul": "consul:8500",
+		jobs: [{name: "nginx", exec: "nginx"}], signals: ` + signals + `}`))
+		assert.EqualError(t, err, expected)
+	}
+	testErr(`{SIGKILL: "stop"}`,
+		"unable to parse signals: signals.SIGKILL is not a signal that can be handled")
+	testErr(`{SIGUSR2: "restart"}`,
+		`unable to parse signals: signals.SIGUSR2 action 'restart' invalid: `+
+			`accepts "stop", "reload", "maintenance", "forward", or "ignore"`)
+	testErr(`{SIGUSR2: {action: "stop", jobs: ["nginx"]}}`,
+		"unable to parse signals: signals.SIGUSR2.jobs can only be used with 'forward'")
+	testErr(`{SIGUSR2: {action: "forward", jobs: ["app"]}}`,
+		"unable to parse signals: signals.SIGUSR2.jobs has no job named 'app'")
+}
+
+func TestMultipleConsulConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	"consul": ["consul-old:8500", {address: "consul-new:8500"}],
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+
+	_, err = newConfig([]byte(`{"consul": ["consul:8500", 1]}`))
+	assert.EqualError(t, err, "consul[1]: no discovery backend defined")
+}
+
+func TestExecDiscoveryConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	discovery: {exec: {register: "register.sh", deregister: "deregister.sh"}},
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.Exec{}, cfg.Discovery)
+
+	cfg, err = newConfig([]byte(`{"consul": "consul:8500",
+	discovery: {exec: {register: "register.sh", deregister: "deregister.sh"}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+	_, err = newConfig([]byte(`{discovery: {etcd: {}}}`))
+	assert.EqualError(t, err, "discovery must have exactly one backend: 'exec'")
+	_, err = newConfig([]byte(`{discovery: {exec: {register: "register.sh"}}}`))
+	assert.EqualError(t, err,
+		"unable to parse discovery: exec: deregister must be set")
+}
+
+func TestEtcdDiscoveryConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	etcd: {endpoints: ["etcd-0:2379", "etcd-1:2379"], prefix: "/services"},
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.Etcd{}, cfg.Discovery)
+
+	cfg, err = newConfig([]byte(`{"consul": "consul:8500", etcd: "etcd:2379"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+	_, err = newConfig([]byte(`{etcd: {endpoints: []}}`))
+	assert.EqualError(t, err, "etcd: no endpoints defined")
+}
+
+func TestKubernetesDiscoveryConfig(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(token, []byte("secret"), 0600)
+	cfg, err := newConfig([]byte(fmt.Sprintf(`{
+	kubernetes: {host: "http://kubernetes:8080", namespace: "apps", tokenFile: %q},
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`, token)))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.Kubernetes{}, cfg.Discovery)
+
+	cfg, err = newConfig([]byte(fmt.Sprintf(`{etcd: "etcd:2379",
+	kubernetes: {host: "http://kubernetes:8080", namespace: "apps", tokenFile: %q}}`,
+		token)))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+	_, err = newConfig([]byte(`{kubernetes: false}`))
+	assert.EqualError(t, err, "kubernetes: must be true or a map of options")
+}
+
+func TestZookeeperDiscoveryConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	zookeeper: {hosts: "zk-0:2181,zk-1:2181", prefix: "/services", sessionTimeout: "30s"},
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.Zookeeper{}, cfg.Discovery)
+
+	cfg, err = newConfig([]byte(`{consul: "consul:8500", zookeeper: "zk:2181"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+	_, err = newConfig([]byte(`{zookeeper: {prefix: "/services"}}`))
+	assert.EqualError(t, err, "zookeeper: no hosts defined")
+}
+
+func TestDNSDiscoveryConfig(t *testing.T) {
+	cfg, err := newConfig([]byte(`{
+	dns: {resolver: "10.0.0.2", domain: "apps.svc.cluster.local"},
+	jobs: [{name: "app", port: 80, interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}],
+	watches: [{name: "db", interval: 5}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.DNS{}, cfg.Discovery)
+
+	cfg, err = newConfig([]byte(`{dns: true, zookeeper: "zk:2181"}`))
+	if err != nil {
+		t.Fatalf("unexpected error in LoadConfig: %v", err)
+	}
+	assert.IsType(t, &discovery.MultiBackend{}, cfg.Discovery)
+	_, err = newConfig([]byte(`{dns: {timeout: "x"}}`))
+	assert.EqualError(t, err,
+		"dns: unable to parse timeout 'x': time: invalid duration \"x\"")
+}
+
 func TestInvalidRenderConfigFileMissing(t *testing.T) {
 	err := RenderConfig("/xxxx", "-")
 	assert.Error(t, err,
@@ -191,6 +403,264 @@ func TestRenderConfigFileStdout(t *testing.T) {
 	}
 }
 
+func TestLoadConfigSources(t *testing.T) {
+	os.Setenv("TESTLOADCONFIGSOURCES", "-ok")
+	defer os.Unsetenv("TESTLOADCONFIGSOURCES")
+	raw := `{consul: "consul:8500",
+	watches: [{name: "upstream{{.TESTLOADCONFIGSOURCES}}", interval: 1}]}`
+
+	defer func() { stdin = os.Stdin; stdinOnce = sync.Once{} }()
+	stdin = strings.NewReader(raw)
+	stdinOnce = sync.Once{}
+	for i := 0; i < 2; i++ {
+		// the second load is from what we read from stdin the first time
+		cfg, err := LoadConfig("-")
+		if err != nil {
+			t.Fatalf("unexpected error loading config from stdin: %v", err)
+		}
+		assert.Equal(t, "watch.upstream-ok", cfg.Watches[0].Name)
+	}
+
+	cfg, err := LoadConfig(raw)
+	if err != nil {
+		t.Fatalf("unexpected error loading inline config: %v", err)
+	}
+	assert.Equal(t, "watch.upstream-ok", cfg.Watches[0].Name)
+
+	_, err = LoadConfig("{consul: }")
+	assert.Contains(t, err.Error(), "parse error at line:col [1:10] in inline config")
+	stdin = strings.NewReader("{consul: }")
+	stdinOnce = sync.Once{}
+	_, err = LoadConfig("-")
+	assert.Contains(t, err.Error(), "in config from stdin")
+	f, _ := ioutil.TempFile("", "invalid-")
+	defer os.Remove(f.Name())
+	f.WriteString("{consul: }")
+	f.Close()
+	_, err = LoadConfig(f.Name())
+	assert.Contains(t, err.Error(), "in config file "+f.Name())
+}
+
+func TestLoadConfigFieldTemplates(t *testing.T) {
+	os.Setenv("TEST_FIELD_APP", "app")
+	os.Setenv("TEST_FIELD_PORT", "8080")
+	os.Setenv("TEST_FIELD_ARGS", `--greeting "hello, world"`)
+	defer os.Unsetenv("TEST_FIELD_APP")
+	defer os.Unsetenv("TEST_FIELD_PORT")
+	defer os.Unsetenv("TEST_FIELD_ARGS")
+
+	cfg, err := LoadConfig(`{consul: '{{ default "consul:8500" .Env.TEST_FIELD_UNSET }}',
+	jobs: [{name: "{{ .Env.TEST_FIELD_APP }}", exec: "/bin/app {{ .TEST_FIELD_ARGS }}",
+	        port: "{{ .Env.TEST_FIELD_PORT }}", interfaces: ["inet", "lo0"],
+	        health: {exec: "true", interval: 1, ttl: 5},
+	        tags: ['{{ .Env.TEST_FIELD_APP | split "p" | join "-" }}']}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := cfg.Jobs[0]
+	assert.Equal(t, "app", job.Name)
+	assert.Equal(t, 8080, job.Port)
+	assert.Equal(t, []string{"a--"}, job.Tags)
+	assert.Equal(t, `/bin/app --greeting "hello, world"`, job.Exec,
+		"expected quotes in an env var not to break the config")
+
+	// templates outside of strings, or with quotes that end the string
+	// they're in, are rendered before the config is parsed
+	cfg, err = LoadConfig(`{consul: "{{ default "consul:8500" .Env.TEST_FIELD_UNSET }}",
+	jobs: [{name: "app", exec: "true", port: {{ .Env.TEST_FIELD_PORT }},
+	        interfaces: ["inet", "lo0"], health: {exec: "true", interval: 1, ttl: 5}}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, 8080, cfg.Jobs[0].Port)
+
+	_, err = LoadConfig(`{consul: "consul:8500",
+	jobs: [{name: "app", exec: "true"},
+	       {name: "other", exec: "{{ nope .Env.TEST_FIELD_APP }}"}]}`)
+	assert.EqualError(t, err, "could not apply template to inline config: "+
+		"template: jobs[1].exec:1: function \"nope\" not defined")
+
+	_, err = LoadConfig(`{consul: "consul:8500",
+	jobs: [{name: "app", exec: '{{ regexReplaceAll "(" "" .Env.TEST_FIELD_APP }}'}]}`)
+	assert.Contains(t, err.Error(), "template: jobs[0].exec:1:")
+}
+
+func TestLoadConfigEnvTemplates(t *testing.T) {
+	defer os.Setenv("HOSTNAME", os.Getenv("HOSTNAME"))
+	os.Setenv("HOSTNAME", "app-7f9c")
+	os.Setenv("TEST_ENV_PEERS", "consul-0:8500,consul-1:8500")
+	defer os.Unsetenv("TEST_ENV_PEERS")
+
+	// every string is rendered, however deep it is in the config
+	cfg, err := LoadConfig(`{
+	consul: '{{ index (.Env.TEST_ENV_PEERS | split ",") 1 }}',
+	jobs: [{name: "{{ .Env.HOSTNAME }}", port: '{{ default "8080" .Env.TEST_ENV_UNSET }}',
+	        exec: ["/bin/app", "--id={{ .Env.HOSTNAME }}"], interfaces: ["inet", "lo0"],
+	        health: {exec: "true", interval: 1, ttl: 5}}],
+	watches: [{name: "db", tag: '{{ .Env.HOSTNAME | split "-" | join "" }}', interval: 1}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := cfg.Jobs[0]
+	assert.Equal(t, "app-7f9c", job.Name)
+	assert.Equal(t, 8080, job.Port)
+	assert.Equal(t, []interface{}{"/bin/app", "--id=app-7f9c"}, job.Exec)
+	assert.Equal(t, "app7f9c", cfg.Watches[0].Tag)
+}
+
+func TestFromYAML(t *testing.T) {
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(`
+stopTimeout: 5
+jobs:
+  - {name: app, port: 8080, restarts: 1.5}
+1: one
+`), &value); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"stopTimeout": 5.0,
+		"jobs": []interface{}{
+			map[string]interface{}{"name": "app", "port": 8080.0, "restarts": 1.5},
+		},
+		"1": "one",
+	}, fromYAML(value))
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	// the YAML test config is the same as the JSON5 one
+	parse := func(path string) map[string]interface{} {
+		data, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		format, _ := configFormat(path)
+		configMap, err := parseConfig(data, configSource(path), format)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", path, err)
+		}
+		return configMap
+	}
+	assert.Equal(t, parse("./testdata/test.json5"), parse("./testdata/test.yaml"))
+	cfg, err := LoadConfig("./testdata/test.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "serviceA", cfg.Jobs[0].Name)
+	assert.Equal(t, "watch.upstreamA", cfg.Watches[0].Name)
+
+	os.Setenv("TEST_YAML_APP", "app")
+	os.Setenv("TEST_YAML_PORT", "8080")
+	defer os.Unsetenv("TEST_YAML_APP")
+	defer os.Unsetenv("TEST_YAML_PORT")
+	dir, _ := ioutil.TempDir("", "yaml-")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "containerpilot.yml")
+	ioutil.WriteFile(path, []byte(`
+consul: '{{ default "consul:8500" .Env.TEST_YAML_UNSET }}'
+jobs:
+  - name: "{{ .Env.TEST_YAML_APP }}"
+    exec: /bin/app
+    port: {{ .TEST_YAML_PORT }}
+    interfaces: [inet, lo0]
+    health: {exec: "true", interval: 1, ttl: 5}
+`), 0644)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "app", cfg.Jobs[0].Name)
+	assert.Equal(t, 8080, cfg.Jobs[0].Port)
+
+	ioutil.WriteFile(path, []byte("consul: consul:8500\njobs: [\n"), 0644)
+	_, err = LoadConfig(path)
+	assert.EqualError(t, err, "could not parse config file "+path+
+		": yaml: line 2: did not find expected node content")
+	ioutil.WriteFile(path, []byte("- consul:8500\n"), 0644)
+	_, err = LoadConfig(path)
+	assert.EqualError(t, err, "could not parse config file "+path+": must be a mapping")
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	os.Setenv("TEST_DIR_SIDECAR", "sidecar")
+	defer os.Unsetenv("TEST_DIR_SIDECAR")
+	dir, _ := ioutil.TempDir("", "conf.d-")
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+	write("00-base.json5", `{consul: "consul:8500", stopTimeout: 2,
+	jobs: [{name: "app", exec: "/bin/app", port: 80, interfaces: ["inet", "lo0"],
+	        health: {exec: "true", interval: 1, ttl: 5}}],
+	control: {socket: "/tmp/base.socket"}}`)
+	write("10-sidecar.yaml", `
+stopTimeout: 7
+jobs:
+  - name: "{{ .Env.TEST_DIR_SIDECAR }}"
+    exec: /bin/sidecar
+watches:
+  - name: db
+    interval: 5
+`)
+	write("README.md", "not a config")
+	write(".20-hidden.json", "not a config")
+	os.Mkdir(filepath.Join(dir, "30-subdir.json"), 0755)
+
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, 2, len(cfg.Jobs), "expected the jobs of both fragments")
+	assert.Equal(t, "app", cfg.Jobs[0].Name)
+	assert.Equal(t, "sidecar", cfg.Jobs[1].Name)
+	assert.Equal(t, "watch.db", cfg.Watches[0].Name)
+	assert.Equal(t, 7, cfg.StopTimeout, "expected the later fragment to win")
+	assert.Equal(t, "/tmp/base.socket", cfg.Control.SocketPath)
+
+	out := filepath.Join(dir, "rendered.out")
+	if err := RenderConfig(dir, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rendered, _ := ioutil.ReadFile(out)
+	cfg, err = newConfig(rendered)
+	if err != nil {
+		t.Fatalf("expected the rendered config directory to be parseable: %v", err)
+	}
+	assert.Equal(t, "sidecar", cfg.Jobs[1].Name)
+
+	write("20-bad.json", `{jobs: [}`)
+	_, err = LoadConfig(dir)
+	assert.Contains(t, err.Error(), "in config file "+filepath.Join(dir, "20-bad.json"))
+
+	empty, _ := ioutil.TempDir("", "conf.d-")
+	defer os.RemoveAll(empty)
+	_, err = LoadConfig(empty)
+	assert.EqualError(t, err, "no config files in config directory "+empty)
+}
+
+func TestConfigFormat(t *testing.T) {
+	for path, expected := range map[string]string{
+		"containerpilot.json5": formatJSON,
+		"containerpilot.yaml":  formatYAML,
+		"/etc/cp/config.YML":   formatYAML,
+		"containerpilot":       formatJSON,
+		"-":                    formatJSON,
+		"{consul: 'x.yaml'}":   formatJSON,
+	} {
+		format, err := configFormat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, format, path)
+	}
+
+	defer os.Unsetenv(EnvConfigFormat)
+	os.Setenv(EnvConfigFormat, "YAML")
+	format, _ := configFormat("containerpilot.json5")
+	assert.Equal(t, formatYAML, format, "expected the env var to override the extension")
+	os.Setenv(EnvConfigFormat, "toml")
+	_, err := LoadConfig("./testdata/test.json5")
+	assert.EqualError(t, err, "invalid config format 'toml': must be 'json' or 'yaml'")
+}
+
 func TestRenderedConfigIsParseable(t *testing.T) {
 
 	var testJSON = `{
@@ -198,7 +668,7 @@ func TestRenderedConfigIsParseable(t *testing.T) {
 	watches: [{"name": "upstreamA{{.TESTRENDERCONFIGISPARSEABLE}}", "interval": 11}]}`
 
 	os.Setenv("TESTRENDERCONFIGISPARSEABLE", "-ok")
-	template, _ := renderConfigTemplate([]byte(testJSON))
+	template, _ := renderConfigTemplate([]byte(testJSON), "config")
 	config, err := newConfig(template)
 	if err != nil {
 		t.Fatalf("unexpected error in LoadConfig: %v", err)
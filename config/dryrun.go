@@ -0,0 +1,27 @@
+package config
+
+import (
+	"github.com/hashicorp/consul/api"
+
+	"github.com/joyent/containerpilot/jobs"
+)
+
+// DryRunConfig loads the configuration the same way as LoadConfig,
+// including selecting the IP of each service from the interfaces on this
+// host, and returns the registration that each service would send to the
+// discovery backend. Unlike ValidateConfig, an interface that doesn't
+// match is an error here. No requests are made to the discovery backend
+// and no jobs are run.
+func DryRunConfig(configFlag string) ([]*api.AgentServiceRegistration, error) {
+	cfg, err := LoadConfig(configFlag)
+	if err != nil {
+		return nil, err
+	}
+	registrations := []*api.AgentServiceRegistration{}
+	for _, job := range jobs.FromConfigs(cfg.Jobs) {
+		if job.Service != nil {
+			registrations = append(registrations, job.Service.Registration())
+		}
+	}
+	return registrations, nil
+}
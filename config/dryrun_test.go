@@ -0,0 +1,40 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunConfig(t *testing.T) {
+	registrations, err := DryRunConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	jobs: [
+	  {name: "app", exec: "/bin/app", port: 80, interfaces: ["static:192.0.2.10"],
+	   tags: ["web"], health: {exec: "/bin/true", interval: 1, ttl: 5}},
+	  {name: "worker", exec: "/bin/worker"}
+	],
+	telemetry: {port: 9090, interfaces: ["static:192.0.2.11"]}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(registrations) != 2 {
+		t.Fatalf("expected 2 registrations, got %d", len(registrations))
+	}
+	app := registrations[0]
+	assert.Equal(t, "app", app.Name)
+	assert.Equal(t, "192.0.2.10", app.Address)
+	assert.Equal(t, 80, app.Port)
+	assert.Equal(t, []string{"web"}, app.Tags)
+	assert.Equal(t, "5s", app.Check.TTL)
+	assert.Equal(t, "containerpilot", registrations[1].Name)
+	assert.Equal(t, "192.0.2.11", registrations[1].Address)
+
+	// unlike ValidateConfig, an interface missing on this host is an error
+	_, err = DryRunConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	jobs: [{name: "app", exec: "/bin/app", port: 80,
+	        interfaces: ["198.51.100.0/24"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`))
+	assert.Error(t, err)
+}
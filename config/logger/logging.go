@@ -5,7 +5,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/syslog"
+	"net"
 	"os"
 	"strings"
 	"os/signal"
@@ -13,6 +16,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
 	"github.com/client9/reopen"
 )
 
@@ -21,6 +25,7 @@ type Config struct {
 	Level  string `json:"level"`
 	Format string `json:"format"`
 	Output string `json:"output"`
+	Events string `json:"events"`
 }
 
 var defaultLog = &Config{
@@ -35,9 +40,8 @@ func init() {
 	}
 }
 
-// Init initializes the logger and sets default values if not provided
-func (l *Config) Init() error {
-	// Set defaults
+// setDefaults sets default values if not provided
+func (l *Config) setDefaults() {
 	if l.Level == "" {
 		l.Level = defaultLog.Level
 	}
@@ -47,12 +51,61 @@ func (l *Config) Init() error {
 	if l.Output == "" {
 		l.Output = defaultLog.Output
 	}
+}
+
+// Validate checks the logging config without initializing the logger,
+// so that it doesn't open any log files
+func (l *Config) Validate() error {
+	l.setDefaults()
+	if _, err := logrus.ParseLevel(strings.ToLower(l.Level)); err != nil {
+		return fmt.Errorf("Unknown log level '%s': %s", l.Level, err)
+	}
+	switch strings.ToLower(l.Format) {
+	case "text", "json", "default":
+	default:
+		return fmt.Errorf("Unknown log format '%s'", l.Format)
+	}
+	switch strings.ToLower(l.Events) {
+	case "", "stdout", "stderr":
+	default:
+		return fmt.Errorf("Unknown events output '%s'", l.Events)
+	}
+	if _, raddr, ok := syslogAddress(l.Output); ok && raddr != "" {
+		if _, _, err := net.SplitHostPort(raddr); err != nil {
+			return fmt.Errorf("Invalid syslog address '%s': %s", l.Output, err)
+		}
+	}
+	return nil
+}
+
+// syslogAddress returns the network and address of the syslog daemon if
+// the output is "syslog" (the local daemon), "syslog://host:port" (UDP),
+// or "syslog+tcp://host:port"
+func syslogAddress(output string) (string, string, bool) {
+	lower := strings.ToLower(output)
+	switch {
+	case lower == "syslog":
+		return "", "", true
+	case strings.HasPrefix(lower, "syslog://"):
+		return "udp", output[len("syslog://"):], true
+	case strings.HasPrefix(lower, "syslog+tcp://"):
+		return "tcp", output[len("syslog+tcp://"):], true
+	}
+	return "", "", false
+}
+
+// Init initializes the logger and sets default values if not provided
+func (l *Config) Init() error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
 	level, err := logrus.ParseLevel(strings.ToLower(l.Level))
 	if err != nil {
 		return fmt.Errorf("Unknown log level '%s': %s", l.Level, err)
 	}
 	var formatter logrus.Formatter
 	var output io.Writer
+	var hook *logrus_syslog.SyslogHook
 	switch strings.ToLower(l.Format) {
 	case "text":
 		formatter = &logrus.TextFormatter{}
@@ -71,6 +124,17 @@ func (l *Config) Init() error {
 	case "":
 		return fmt.Errorf("Unknown output type '%s'", l.Output)
 	default:
+		if network, raddr, ok := syslogAddress(l.Output); ok {
+			// syslog gets each message with the priority of its level,
+			// so it doesn't need to also be written anywhere else
+			hook, err = logrus_syslog.NewSyslogHook(network, raddr,
+				syslog.LOG_INFO|syslog.LOG_DAEMON, "containerpilot")
+			if err != nil {
+				return fmt.Errorf("Error connecting to syslog '%s': %s", l.Output, err)
+			}
+			output = ioutil.Discard
+			break
+		}
 		f, err := reopen.NewFileWriter(l.Output)
 		if err != nil {
 			return fmt.Errorf("Error initializing log file '%s': %s", l.Output, err)
@@ -81,9 +145,26 @@ func (l *Config) Init() error {
 	logrus.SetLevel(level)
 	logrus.SetFormatter(formatter)
 	logrus.SetOutput(output)
+	replaceSyslogHook(hook)
 	return nil
 }
 
+// the hook of the syslog output, if any, which is replaced when the
+// logging config is reloaded
+var currentSyslogHook *logrus_syslog.SyslogHook
+
+func replaceSyslogHook(hook *logrus_syslog.SyslogHook) {
+	hooks := make(logrus.LevelHooks)
+	if hook != nil {
+		hooks.Add(hook)
+	}
+	logrus.StandardLogger().Hooks = hooks
+	if currentSyslogHook != nil {
+		currentSyslogHook.Writer.Close()
+	}
+	currentSyslogHook = hook
+}
+
 // DefaultLogFormatter delegates formatting to standard go log package
 type DefaultLogFormatter struct {
 }
@@ -1,9 +1,13 @@
 package logger
 
 import (
+	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -43,6 +47,59 @@ func TestLoggingConfigInit(t *testing.T) {
 	defaultLog.Init()
 }
 
+func TestLoggingConfigEvents(t *testing.T) {
+	testLog := &Config{Events: "stdout"}
+	if err := testLog.Init(); err != nil {
+		t.Errorf("Did not expect error: %v", err)
+	}
+	testLog = &Config{Events: "syslog"}
+	if err := testLog.Init(); err == nil {
+		t.Errorf("Expected error for unknown events output")
+	}
+	// Reset to defaults
+	defaultLog.Init()
+}
+
+func TestLoggingConfigSyslog(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer server.Close()
+	testLog := &Config{Format: "json",
+		Output: "syslog://" + server.LocalAddr().String()}
+	if err := testLog.Init(); err != nil {
+		t.Fatalf("Did not expect error: %v", err)
+	}
+	// Reset to defaults
+	defer defaultLog.Init()
+	std := logrus.StandardLogger()
+	if std.Out != ioutil.Discard {
+		t.Errorf("Expected output to only go to syslog")
+	}
+	logrus.Warn("syslog test")
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected log message at syslog: %v", err)
+	}
+	// <28> is the warning priority of the daemon facility
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<28>") || !strings.Contains(msg, `"msg":"syslog test"`) {
+		t.Errorf("Unexpected syslog message: %s", msg)
+	}
+
+	defaultLog.Init()
+	if len(std.Hooks) != 0 {
+		t.Errorf("Expected syslog hook to be removed, but got: %v", std.Hooks)
+	}
+	testLog = &Config{Output: "syslog+tcp://localhost"}
+	if err := testLog.Validate(); err == nil {
+		t.Errorf("Expected error for syslog address without port")
+	}
+}
+
 func TestDefaultFormatterEmptyMessage(t *testing.T) {
 	formatter := &DefaultLogFormatter{}
 	_, err := formatter.Format(logrus.WithFields(
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// netInterfaces lists the host's network interfaces. It's a variable so
+// that the benchmarks can count how often we enumerate them.
+var netInterfaces = net.Interfaces
+
+// interfaceCache is shared by every IP lookup in the process, so that the
+// jobs and telemetry resolving their IPs in the same window only read the
+// interfaces once between them
+var interfaceCache = &ipCache{now: time.Now}
+
+// ipCache holds the interface IPs read for each set of named interfaces
+// (the named interfaces are read even if they are down) until they
+// expire. Only reads without errors are cached, so that a host whose
+// interfaces are still coming up is read again on the next lookup.
+type ipCache struct {
+	lock    sync.Mutex
+	entries map[string]ipCacheEntry
+	now     func() time.Time
+}
+
+type ipCacheEntry struct {
+	ips     []interfaceIP
+	expires time.Time
+}
+
+// ResetInterfaceCache drops every cached interface IP, so that the next
+// lookup reads the interfaces again. This should be called when the
+// configuration is reloaded, because that's when a changed network is
+// expected to be picked up.
+func ResetInterfaceCache() {
+	interfaceCache.reset()
+}
+
+func (c *ipCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// get returns the cached interface IPs for the named interfaces, or calls
+// read and caches the result for the ttl. A ttl of 0 disables the cache.
+// We hold the lock while reading so that concurrent lookups for the same
+// interfaces wait on a single read rather than all reading at once.
+func (c *ipCache) get(named []string, ttl time.Duration,
+	read func() ([]interfaceIP, error)) ([]interfaceIP, error) {
+	if ttl <= 0 {
+		return read()
+	}
+	key := strings.Join(named, ",")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		return copyInterfaceIPs(entry.ips), nil
+	}
+	ips, err := read()
+	if err != nil {
+		return ips, err
+	}
+	if c.entries == nil {
+		c.entries = map[string]ipCacheEntry{}
+	}
+	c.entries[key] = ipCacheEntry{ips: copyInterfaceIPs(ips), expires: now.Add(ttl)}
+	return ips, nil
+}
+
+// copyInterfaceIPs keeps callers from changing the order of a cached
+// slice out from under each other
+func copyInterfaceIPs(ips []interfaceIP) []interfaceIP {
+	result := make([]interfaceIP, len(ips))
+	copy(result, ips)
+	return result
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := &ipCache{now: func() time.Time { return now }}
+	reads := 0
+	read := func() ([]interfaceIP, error) {
+		reads++
+		return []interfaceIP{{Name: "eth0", IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+
+	// a zero TTL reads every time
+	cache.get(nil, 0, read)
+	cache.get(nil, 0, read)
+	assert.Equal(t, 2, reads)
+
+	reads = 0
+	ips, _ := cache.get(nil, time.Second, read)
+	ips[0].Name = "changed"
+	ips, _ = cache.get(nil, time.Second, read)
+	assert.Equal(t, 1, reads, "expected the second lookup to be cached")
+	assert.Equal(t, "eth0", ips[0].Name, "expected callers not to share the cache")
+
+	cache.get([]string{"eth1"}, time.Second, read)
+	assert.Equal(t, 2, reads, "expected different named interfaces to be read")
+
+	now = now.Add(time.Second)
+	cache.get(nil, time.Second, read)
+	assert.Equal(t, 3, reads, "expected the entry to expire")
+
+	cache.reset()
+	cache.get(nil, time.Second, read)
+	assert.Equal(t, 4, reads, "expected reset to drop the entry")
+
+	reads = 0
+	failing := func() ([]interfaceIP, error) {
+		reads++
+		return nil, errors.New("interfaces aren't up yet")
+	}
+	cache.reset()
+	cache.get(nil, time.Second, failing)
+	cache.get(nil, time.Second, failing)
+	assert.Equal(t, 2, reads, "expected errors not to be cached")
+}
+
+func TestIPCacheConcurrent(t *testing.T) {
+	cache := &ipCache{now: time.Now}
+	var lock sync.Mutex
+	reads := 0
+	read := func() ([]interfaceIP, error) {
+		lock.Lock()
+		reads++
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return []interfaceIP{{Name: "eth0", IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := cache.get(nil, time.Minute, read)
+			assert.Nil(t, err)
+			assert.Len(t, ips, 1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, reads, "expected concurrent lookups to share one read")
+}
+
+// countInterfaceReads replaces netInterfaces with a wrapper that counts
+// how often the interfaces are enumerated, and returns a func to undo it
+func countInterfaceReads(count *int) func() {
+	netInterfaces = func() ([]net.Interface, error) {
+		*count++
+		return net.Interfaces()
+	}
+	return func() { netInterfaces = net.Interfaces }
+}
+
+func TestGetIPWithCacheTTL(t *testing.T) {
+	reads := 0
+	defer countInterfaceReads(&reads)()
+	defer ResetInterfaceCache()
+
+	opts := IPOptions{CacheTTL: time.Minute, Overlap: OverlapIgnore}
+	first, err := GetIPWithOptions([]string{lo}, opts)
+	assert.Nil(t, err)
+	second, err := GetIPWithOptions([]string{lo}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, reads, "expected the interfaces to be read once")
+
+	ResetInterfaceCache()
+	GetIPWithOptions([]string{lo}, opts)
+	assert.Equal(t, 2, reads, "expected a reset to read the interfaces again")
+
+	GetIPWithOptions([]string{lo}, IPOptions{Overlap: OverlapIgnore})
+	assert.Equal(t, 3, reads, "expected no caching without a TTL")
+}
+
+// The benchmarks report the number of times the interfaces are enumerated
+// per lookup; each enumeration costs a netlink dump of the interfaces
+// plus one of the addresses for every interface.
+func benchmarkGetIP(b *testing.B, ttl time.Duration) {
+	reads := 0
+	defer countInterfaceReads(&reads)()
+	defer ResetInterfaceCache()
+	opts := IPOptions{CacheTTL: ttl, Overlap: OverlapIgnore}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetIPWithOptions([]string{"inet", lo}, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "enumerations/op")
+}
+
+func BenchmarkGetIPUncached(b *testing.B) { benchmarkGetIP(b, 0) }
+
+func BenchmarkGetIPCached(b *testing.B) { benchmarkGetIP(b, time.Minute) }
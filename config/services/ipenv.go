@@ -0,0 +1,111 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables that override the IP selection configuration,
+// so that an image can be reused across environments without editing
+// its config file. Lists are comma-separated.
+const (
+	EnvIPSpec              = "CONTAINERPILOT_IP_SPEC"
+	EnvIPPreferredNetworks = "CONTAINERPILOT_IP_PREFERRED_NETWORKS"
+	EnvIPOverlap           = "CONTAINERPILOT_IP_OVERLAP"
+	EnvIPOrder             = "CONTAINERPILOT_IP_ORDER"
+	EnvIPSelection         = "CONTAINERPILOT_IP_SELECTION"
+	EnvIPCacheTTL          = "CONTAINERPILOT_IP_CACHE_TTL"
+)
+
+// applyIPEnvironment overrides the specList and opts with any values set
+// in the environment. The environment takes precedence over the config
+// file because it's the more deployment-specific of the two.
+func applyIPEnvironment(specList []string, opts IPOptions) ([]string, IPOptions, error) {
+	overridden := false
+	if specs, ok := lookupEnvList(EnvIPSpec); ok {
+		specList = specs
+		overridden = true
+	}
+	if networks, ok := lookupEnvList(EnvIPPreferredNetworks); ok {
+		opts.PreferredNetworks = networks
+		overridden = true
+	}
+	if policy := strings.TrimSpace(os.Getenv(EnvIPOverlap)); policy != "" {
+		overlap, err := ParseOverlapPolicy(policy)
+		if err != nil {
+			return nil, opts, fmt.Errorf("%s: %v", EnvIPOverlap, err)
+		}
+		opts.Overlap = overlap
+		overridden = true
+	}
+	if order := strings.TrimSpace(os.Getenv(EnvIPOrder)); order != "" {
+		specOrder, err := ParseSpecOrder(order)
+		if err != nil {
+			return nil, opts, fmt.Errorf("%s: %v", EnvIPOrder, err)
+		}
+		opts.Order = specOrder
+		overridden = true
+	}
+	if selection := strings.TrimSpace(os.Getenv(EnvIPSelection)); selection != "" {
+		ipSelection, err := ParseIPSelection(selection)
+		if err != nil {
+			return nil, opts, fmt.Errorf("%s: %v", EnvIPSelection, err)
+		}
+		opts.Selection = ipSelection
+		overridden = true
+	}
+	if ttl := strings.TrimSpace(os.Getenv(EnvIPCacheTTL)); ttl != "" {
+		// the cache doesn't change which IP is selected, so it doesn't
+		// count as overriding the config
+		cacheTTL, err := timing.GetTimeout(ttl)
+		if err != nil || cacheTTL < 0 {
+			return nil, opts, fmt.Errorf(
+				"%s: invalid interface cache TTL '%s'", EnvIPCacheTTL, ttl)
+		}
+		opts.CacheTTL = cacheTTL
+	}
+	if overridden {
+		log.WithFields(log.Fields{
+			"interfaces": specList, "preferredNetworks": opts.PreferredNetworks}).
+			Infof("using IP selection from environment: interfaces=%v preferredNetworks=%v",
+				specList, opts.PreferredNetworks)
+	}
+	return specList, opts, nil
+}
+
+// lookupEnvList splits a comma-separated environment variable, dropping
+// empty elements. Returns false if the variable is unset or empty.
+func lookupEnvList(key string) ([]string, bool) {
+	var result []string
+	for _, val := range strings.Split(os.Getenv(key), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			result = append(result, val)
+		}
+	}
+	return result, len(result) > 0
+}
+
+// expandSpec expands $VAR and ${VAR} in an interface spec from the
+// environment. If any of the variables are unset or empty the spec can't
+// mean what was intended, so it returns false and the spec is dropped.
+func expandSpec(spec string) (string, bool) {
+	var missing []string
+	expanded := os.Expand(spec, func(key string) string {
+		val := os.Getenv(key)
+		if val == "" {
+			missing = append(missing, key)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		log.WithFields(log.Fields{"spec": spec, "missing": missing}).
+			Warnf("dropping interface specification %s: unset environment variables %v",
+				spec, missing)
+		return "", false
+	}
+	return expanded, true
+}
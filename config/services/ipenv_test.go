@@ -0,0 +1,102 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetIPWithEnvironment(t *testing.T) {
+	defer os.Unsetenv(EnvIPSpec)
+	defer os.Unsetenv(EnvIPPreferredNetworks)
+	defer os.Unsetenv(EnvIPOverlap)
+	defer os.Unsetenv(EnvIPOrder)
+	defer os.Unsetenv(EnvIPSelection)
+	defer os.Unsetenv(EnvIPCacheTTL)
+
+	os.Setenv(EnvIPSpec, " 198.51.100.0/24, "+lo)
+	ip, err := GetIPWithOptions([]string{"inet6"}, IPOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip, "expected env spec to override config")
+
+	os.Setenv(EnvIPSpec, "inet")
+	os.Setenv(EnvIPPreferredNetworks, "127.0.0.0/8")
+	ip, err = GetIPWithOptions(nil, IPOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip, "expected env preferred networks")
+
+	os.Setenv(EnvIPSpec, lo+",127.0.0.0/8")
+	os.Unsetenv(EnvIPPreferredNetworks)
+	os.Setenv(EnvIPOverlap, "error")
+	err = CheckOverlappingSpecs(nil, IPOptions{Overlap: OverlapIgnore})
+	assert.Error(t, err, "expected env overlap policy to override config")
+
+	os.Setenv(EnvIPOverlap, "fail")
+	_, err = GetIPWithOptions(nil, IPOptions{})
+	assert.Error(t, err, "expected error for invalid env overlap policy")
+
+	os.Unsetenv(EnvIPOverlap)
+	os.Setenv(EnvIPSpec, "inet6,"+lo)
+	os.Setenv(EnvIPOrder, "specific")
+	ip, err = GetIPWithOptions(nil, IPOptions{Overlap: OverlapIgnore})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip, "expected env order to override config")
+
+	os.Setenv(EnvIPOrder, "first")
+	_, err = GetIPWithOptions(nil, IPOptions{})
+	assert.Error(t, err, "expected error for invalid env order")
+
+	os.Unsetenv(EnvIPOrder)
+	os.Setenv(EnvIPSelection, "newest")
+	_, err = GetIPWithOptions(nil, IPOptions{})
+	assert.EqualError(t, err, "CONTAINERPILOT_IP_SELECTION: invalid interface "+
+		"selection 'newest': must be one of 'first', 'last', 'lowest', or 'highest'")
+
+	os.Unsetenv(EnvIPSelection)
+	os.Setenv(EnvIPCacheTTL, "soon")
+	_, err = GetIPWithOptions(nil, IPOptions{})
+	assert.EqualError(t, err,
+		"CONTAINERPILOT_IP_CACHE_TTL: invalid interface cache TTL 'soon'")
+}
+
+func TestLookupEnvList(t *testing.T) {
+	defer os.Unsetenv(t.Name())
+	_, ok := lookupEnvList(t.Name())
+	assert.False(t, ok, "expected unset variable to be ignored")
+
+	os.Setenv(t.Name(), " , ")
+	_, ok = lookupEnvList(t.Name())
+	assert.False(t, ok, "expected empty list to be ignored")
+
+	os.Setenv(t.Name(), "eth0:inet, inet,")
+	vals, ok := lookupEnvList(t.Name())
+	assert.True(t, ok)
+	assert.Equal(t, []string{"eth0:inet", "inet"}, vals)
+}
+
+func TestExpandSpec(t *testing.T) {
+	os.Setenv("TEST_PREFERRED_IFACE", lo)
+	defer os.Unsetenv("TEST_PREFERRED_IFACE")
+	os.Unsetenv("TEST_MISSING_IFACE")
+
+	spec, ok := expandSpec("$TEST_PREFERRED_IFACE:inet")
+	assert.True(t, ok)
+	assert.Equal(t, lo+":inet", spec)
+
+	spec, ok = expandSpec("${TEST_PREFERRED_IFACE}[0]")
+	assert.True(t, ok)
+	assert.Equal(t, lo+"[0]", spec)
+
+	_, ok = expandSpec("$TEST_MISSING_IFACE:inet")
+	assert.False(t, ok, "expected spec with unset variable to be dropped")
+
+	ip, err := GetIP([]string{"${TEST_PREFERRED_IFACE}:inet", "198.51.100.0/24"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip, "expected interface from environment")
+
+	os.Unsetenv("TEST_PREFERRED_IFACE")
+	ip, err = GetIP([]string{"${TEST_PREFERRED_IFACE}:inet", "static:198.51.100.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "198.51.100.1", ip, "expected unset interface to be skipped")
+}
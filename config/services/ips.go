@@ -2,17 +2,59 @@ package services
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joyent/containerpilot/config/decode"
 	log "github.com/sirupsen/logrus"
 )
 
+// Errors returned by GetIP and GetIPWithOptions wrap one of these, so
+// that callers can use errors.Is to branch on the failure mode. For
+// example, ErrNoMatch may succeed on retry once networking is up, but
+// ErrSpecParse never will. Errors wrapping ErrSpecParse also wrap a
+// *SpecParseError for each invalid spec, which errors.As can extract.
+var (
+	// ErrNoInterfaces means the container's interfaces couldn't be read
+	ErrNoInterfaces = errors.New("unable to read network interfaces")
+
+	// ErrSpecParse means an interface specification or preferred network
+	// is invalid
+	ErrSpecParse = errors.New("invalid interface specification")
+
+	// ErrNoMatch means no IP on any interface matched the specifications
+	ErrNoMatch = errors.New("none of the interface specifications were able to match")
+	// ErrRequiredNoMatch is wrapped with ErrNoMatch when a required ('+')
+	// interface specification doesn't match any IP
+	ErrRequiredNoMatch = errors.New("required interface specification didn't match")
+
+	// ErrInterfaceDown means no IP matched and an interface named by the
+	// specifications is down. Errors wrapping it also wrap ErrNoMatch.
+	ErrInterfaceDown = errors.New("interface is down")
+)
+
+// SpecParseError is an interface specification or preferred network that
+// couldn't be parsed. Its message is the reason, without the spec being
+// repeated, and errors.Is matches it with ErrSpecParse.
+type SpecParseError struct {
+	Spec string
+	Err  error
+}
+
+func (e *SpecParseError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the reason the spec couldn't be parsed
+func (e *SpecParseError) Unwrap() error { return e.Err }
+
+// Is reports whether the target is ErrSpecParse
+func (e *SpecParseError) Is(target error) bool { return target == ErrSpecParse }
+
 // IPFromInterfaces ...
 func IPFromInterfaces(raw interface{}) (string, error) {
 	interfaces, ifaceErr := decode.ToStrings(raw)
@@ -27,88 +69,630 @@ func IPFromInterfaces(raw interface{}) (string, error) {
 	return ipAddress, nil
 }
 
+// IPOptions tunes how an IP is chosen from the container's interfaces.
+// The zero value selects an IP using the interface specifications alone.
+type IPOptions struct {
+	// PreferredNetworks is an ordered list of CIDRs that are consulted
+	// before the interface specifications. The first IP that falls in the
+	// earliest-listed network is selected.
+	PreferredNetworks []string
+
+	// Overlap is the policy for interface specifications that match the
+	// same IP address, which usually means the config is redundant. It's
+	// only applied by CheckOverlappingSpecs, not on every lookup.
+	Overlap OverlapPolicy
+
+	// Order is how the interface specifications are ranked when more
+	// than one of them matches an IP
+	Order SpecOrder
+
+	// Selection is which IP is chosen when a spec matches more than one
+	// IP on the same interface
+	Selection IPSelection
+
+	// RetryTimeout is how long to keep re-reading the interfaces while no
+	// IP matches, ex. while DHCP hasn't finished. Zero tries only once.
+	RetryTimeout time.Duration
+
+	// RetryInterval is the time between retries. Defaults to one second.
+	RetryInterval time.Duration
+
+	// CacheTTL is how long the interfaces read by one lookup are reused
+	// by the lookups after it. Zero reads the interfaces every time.
+	CacheTTL time.Duration
+}
+
+const defaultIPRetryInterval = time.Second
+
+// OverlapPolicy is an enum of the ways we handle overlapping specs
+type OverlapPolicy int
+
+// OverlapPolicy enum
+const (
+	OverlapWarn OverlapPolicy = iota // default
+	OverlapIgnore
+	OverlapError
+)
+
+// ParseOverlapPolicy parses the config string for an OverlapPolicy.
+// An empty string defaults to OverlapWarn.
+func ParseOverlapPolicy(policy string) (OverlapPolicy, error) {
+	switch policy {
+	case "", "warn":
+		return OverlapWarn, nil
+	case "ignore":
+		return OverlapIgnore, nil
+	case "error":
+		return OverlapError, nil
+	}
+	return OverlapWarn, fmt.Errorf(
+		"invalid interface overlap policy '%s': must be one of 'warn', 'ignore', or 'error'",
+		policy)
+}
+
+// SpecOrder is an enum of the ways we rank interface specs
+type SpecOrder int
+
+// SpecOrder enum
+const (
+	OrderListed       SpecOrder = iota // default; the first listed spec wins
+	OrderMostSpecific                  // the most specific spec wins
+)
+
+// ParseSpecOrder parses the config string for a SpecOrder. An empty
+// string defaults to OrderListed.
+func ParseSpecOrder(order string) (SpecOrder, error) {
+	switch order {
+	case "", "listed":
+		return OrderListed, nil
+	case "specific":
+		return OrderMostSpecific, nil
+	}
+	return OrderListed, fmt.Errorf(
+		"invalid interface order '%s': must be one of 'listed' or 'specific'",
+		order)
+}
+
+// IPSelection is an enum of the ways we choose between the IPs that a
+// spec matches on the same interface
+type IPSelection int
+
+// IPSelection enum
+const (
+	SelectFirst   IPSelection = iota // default; the first in ByInterfaceThenIP order
+	SelectLast                       // the last in ByInterfaceThenIP order
+	SelectLowest                     // the numerically lowest, IPv4 before IPv6
+	SelectHighest                    // the numerically highest, IPv6 before IPv4
+)
+
+// ParseIPSelection parses the config string for an IPSelection. An empty
+// string defaults to SelectFirst.
+func ParseIPSelection(selection string) (IPSelection, error) {
+	switch selection {
+	case "", "first":
+		return SelectFirst, nil
+	case "last":
+		return SelectLast, nil
+	case "lowest":
+		return SelectLowest, nil
+	case "highest":
+		return SelectHighest, nil
+	}
+	return SelectFirst, fmt.Errorf(
+		"invalid interface selection '%s': must be one of 'first', 'last', "+
+			"'lowest', or 'highest'", selection)
+}
+
+// defaultInterfaceSpecs is used when no interface specifications are
+// given, or when all of them are exclusions
+var defaultInterfaceSpecs = []string{"eth0:inet", "inet"}
+
 // GetIP determines the IP address of the container
 func GetIP(specList []string) (string, error) {
+	return GetIPWithOptions(specList, IPOptions{})
+}
+
+// GetIPs returns every IP address of the container that matches the
+// specList, in the order of the specs and without duplicates
+func GetIPs(specList []string) ([]string, error) {
+	return GetIPsWithOptions(specList, IPOptions{})
+}
 
+// GetIPWithRetry determines the IP address of the container, retrying
+// every interval until an IP matches or the timeout elapses. A zero
+// timeout tries only once, like GetIP.
+func GetIPWithRetry(specList []string, timeout, interval time.Duration) (string, error) {
+	return GetIPWithOptions(specList,
+		IPOptions{RetryTimeout: timeout, RetryInterval: interval})
+}
+
+// GetIPWithOptions determines the IP address of the container, applying
+// the preferences in opts before falling back to the specList. Any of
+// the CONTAINERPILOT_IP_* environment variables override both.
+func GetIPWithOptions(specList []string, opts IPOptions) (string, error) {
+	ips, err := GetIPsWithOptions(specList, opts)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// GetIPsWithOptions returns every IP address of the container in the
+// preferred networks of opts and then every IP matching the specList,
+// without duplicates. It returns an error rather than an empty list.
+func GetIPsWithOptions(specList []string, opts IPOptions) ([]string, error) {
+
+	specList, opts, err := applyIPEnvironment(specList, opts)
+	if err != nil {
+		return nil, err
+	}
 	if specList == nil || len(specList) == 0 {
 		// Use a sane default
-		specList = []string{"eth0:inet", "inet"}
+		specList = defaultInterfaceSpecs
 	}
 
 	specs, err := parseInterfaceSpecs(specList)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if opts.Order == OrderMostSpecific {
+		specs = sortSpecsBySpecificity(specs)
+	}
+	preferred, err := parsePreferredNetworks(opts.PreferredNetworks)
+	if err != nil {
+		return nil, err
 	}
 
-	interfaces, interfacesErr := net.Interfaces()
-
-	if interfacesErr != nil {
-		return "", interfacesErr
+	interval := opts.RetryInterval
+	if interval <= 0 {
+		interval = defaultIPRetryInterval
+	}
+	deadline := time.Now().Add(opts.RetryTimeout)
+	for {
+		ips, err := findIPs(specs, preferred, opts)
+		// only the errors that can resolve themselves are worth retrying;
+		// a bad config will never match
+		retryable := errors.Is(err, ErrNoMatch) || errors.Is(err, ErrNoInterfaces)
+		if err == nil || !retryable || !time.Now().Add(interval).Before(deadline) {
+			return ips, err
+		}
+		log.WithFields(log.Fields{"retry": interval.String(), "error": err}).
+			Debugf("no IP found yet, retrying in %v: %v", interval, err)
+		time.Sleep(interval)
 	}
+}
 
-	interfaceIPs, interfaceIPsErr := getinterfaceIPs(interfaces)
+// findIPs reads the interfaces and returns the IPs in the preferred
+// networks and then the IPs matching the specs
+func findIPs(specs []interfaceSpec, preferred []*net.IPNet, opts IPOptions) ([]string, error) {
+	interfaceIPs, interfaceIPsErr := readInterfaceIPs(specs, opts.CacheTTL)
+	if errors.Is(interfaceIPsErr, ErrNoInterfaces) {
+		return nil, interfaceIPsErr
+	}
 
 	/* We had an error and there were no interfaces returned, this is clearly
 	 * an error state. */
 	if interfaceIPsErr != nil && len(interfaceIPs) < 1 {
-		return "", interfaceIPsErr
+		return nil, fmt.Errorf("%w: %v", ErrNoInterfaces, interfaceIPsErr)
 	}
 	/* We had error(s) and there were interfaces returned, this is potentially
 	 * recoverable. Let's pass on the parsed interfaces and log the error
 	 * state. */
 	if interfaceIPsErr != nil && len(interfaceIPs) > 0 {
-		log.Warnf("We had a problem reading information about some network "+
-			"interfaces. If everything works, it is safe to ignore this "+
-			"message. Details:\n%s\n", interfaceIPsErr)
+		log.WithField("error", interfaceIPsErr).Warnf(
+			"problem reading some network interfaces, which is safe to "+
+				"ignore if an IP is found: %v", interfaceIPsErr)
 	}
 
-	return findIPWithSpecs(specs, interfaceIPs)
+	ips, network := findIPsInNetworks(preferred, interfaceIPs)
+	if len(ips) > 0 {
+		log.WithFields(log.Fields{"ip": ips[0], "network": network.String()}).
+			Infof("selected IP %s from preferred network %s", ips[0], network)
+	}
+	specIPs, err := findIPsWithSpecs(specs, interfaceIPs, opts.Selection)
+	for _, ip := range specIPs {
+		if !containsString(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	// a required spec that didn't match fails even if we found an IP in the
+	// preferred networks
+	if len(ips) == 0 || errors.Is(err, ErrRequiredNoMatch) {
+		// this is only for the error message, so it's not worth caching
+		interfaces, _ := netInterfaces()
+		if name, ok := findDownInterface(specs, interfaces); ok {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInterfaceDown, name, err)
+		}
+		return nil, err
+	}
+	return ips, nil
 }
 
-// findIPWithSpecs will use the given interface specification list and will
-// find the first IP in the interfaceIPs that matches a spec
-func findIPWithSpecs(specs []interfaceSpec, interfaceIPs []interfaceIP) (string, error) {
-	// Find the interface matching the name given
+// readInterfaceIPs returns the IPs of the interfaces, reusing the IPs read
+// by an earlier lookup for up to the ttl
+func readInterfaceIPs(specs []interfaceSpec, ttl time.Duration) ([]interfaceIP, error) {
+	named := specInterfaceNames(specs)
+	return interfaceCache.get(named, ttl, func() ([]interfaceIP, error) {
+		interfaces, err := netInterfaces()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNoInterfaces, err)
+		}
+		return getinterfaceIPs(interfaces, named)
+	})
+}
+
+// CheckOverlappingSpecs applies the Overlap policy of the opts to the
+// interface specifications in the specList that match the same IP address,
+// logging a warning for each pair or returning an error. It reads the
+// interfaces, so it's run once when the configuration is validated rather
+// than on every lookup. The default specifications overlap deliberately
+// and are never checked.
+func CheckOverlappingSpecs(specList []string, opts IPOptions) error {
+	specList, opts, err := applyIPEnvironment(specList, opts)
+	if err != nil {
+		return err
+	}
+	if len(specList) == 0 || opts.Overlap == OverlapIgnore {
+		return nil
+	}
+	specs, err := parseInterfaceSpecs(specList)
+	if err != nil {
+		return err
+	}
+	// the lookup reports the interfaces that can't be read, so we only
+	// check the IPs that we have
+	interfaceIPs, _ := readInterfaceIPs(specs, opts.CacheTTL)
+	overlaps := findOverlappingSpecs(specs, interfaceIPs)
+	if len(overlaps) == 0 {
+		return nil
+	}
+	if opts.Overlap == OverlapError {
+		return fmt.Errorf("overlapping interface specifications:\n%s",
+			strings.Join(overlaps, "\n"))
+	}
+	for _, overlap := range overlaps {
+		log.Warn(overlap)
+	}
+	return nil
+}
+
+// findDownInterface returns the name of the first interface named by
+// the specs that exists but is down, if any
+func findDownInterface(specs []interfaceSpec, interfaces []net.Interface) (string, bool) {
+	for _, name := range specInterfaceNames(specs) {
+		for _, intf := range interfaces {
+			if intf.Name == name && intf.Flags&net.FlagUp == 0 {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// specInterfaceNames returns the interface names that the specs ask for
+// by exact name, in order
+func specInterfaceNames(specs []interfaceSpec) []string {
+	var names []string
 	for _, spec := range specs {
-		// Static IP given
-		origSpec, ok := spec.(staticInterfaceSpec)
-		if ok {
-			return origSpec.IP.String(), nil
+		if spec.Negated() {
+			continue
+		}
+		if required, ok := spec.(requiredInterfaceSpec); ok {
+			spec = required.Inner
+		}
+		var name string
+		switch s := spec.(type) {
+		case inetInterfaceSpec:
+			name = s.Name
+		case indexInterfaceSpec:
+			name = s.Name
+		default:
+			continue
+		}
+		if name != "*" && !containsString(names, name) {
+			names = append(names, name)
 		}
-		index := 0
-		iface := ""
+	}
+	return names
+}
+
+// findIPsInNetworks returns the interfaceIPs that fall in the preferred
+// networks, ordered by the earliest network they fall in, and the network
+// that the first of them matched
+func findIPsInNetworks(preferred []*net.IPNet, interfaceIPs []interfaceIP) ([]string, *net.IPNet) {
+	var ips []string
+	var first *net.IPNet
+	for _, network := range preferred {
 		for _, iip := range interfaceIPs {
-			// Since the interfaces are ordered by name
-			// a change in interface name can safely reset the index
-			if iface != iip.Name {
-				index = 0
-				iface = iip.Name
-			} else {
-				index++
+			if network.Contains(iip.IP) && !containsString(ips, iip.IPString()) {
+				ips = append(ips, iip.IPString())
+				if first == nil {
+					first = network
+				}
+			}
+		}
+	}
+	return ips, first
+}
+
+func parsePreferredNetworks(networks []string) ([]*net.IPNet, error) {
+	var preferred []*net.IPNet
+	for _, cidr := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrSpecParse, &SpecParseError{
+				Spec: cidr,
+				Err:  fmt.Errorf("Unable to parse preferred network: %s", cidr),
+			})
+		}
+		preferred = append(preferred, network)
+	}
+	return preferred, nil
+}
+
+// findOverlappingSpecs returns a description of each pair of specs that
+// match at least one IP in common
+func findOverlappingSpecs(specs []interfaceSpec, interfaceIPs []interfaceIP) []string {
+	var overlaps []string
+	specs, _ = splitNegatedSpecs(specs)
+	matches := make([][]string, len(specs))
+	for i, spec := range specs {
+		matches[i] = findIPsWithSpec(spec, interfaceIPs)
+	}
+	for i := range specs {
+		for j := i + 1; j < len(specs); j++ {
+			for _, ip := range matches[i] {
+				if containsString(matches[j], ip) {
+					overlaps = append(overlaps, fmt.Sprintf(
+						"interface specifications %s and %s both match %s",
+						specs[i], specs[j], ip))
+					break
+				}
+			}
+		}
+	}
+	return overlaps
+}
+
+// findIPsWithSpec returns every IP in the interfaceIPs that matches the spec
+func findIPsWithSpec(spec interfaceSpec, interfaceIPs []interfaceIP) []string {
+	if required, ok := spec.(requiredInterfaceSpec); ok {
+		spec = required.Inner
+	}
+	if static, ok := spec.(staticInterfaceSpec); ok {
+		return []string{static.IP.String()}
+	}
+	if route, ok := spec.(routeInterfaceSpec); ok {
+		return findRouteIP(route)
+	}
+	// negative indexes count back from the end of each interface's IPs,
+	// so we need to know how many IPs each interface has up front
+	counts := make(map[string]int)
+	for _, iip := range interfaceIPs {
+		counts[iip.Name]++
+	}
+	var ips []string
+	index := 0
+	iface := ""
+	for _, iip := range interfaceIPs {
+		// Since the interfaces are ordered by name
+		// a change in interface name can safely reset the index
+		if iface != iip.Name {
+			index = 0
+			iface = iip.Name
+		} else {
+			index++
+		}
+		if spec.Match(index, counts[iip.Name], iip) {
+			ips = append(ips, iip.IPString())
+		}
+	}
+	return ips
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// findIPWithSpecs will use the given interface specification list and will
+// find the first IP in the interfaceIPs that matches a spec
+func findIPWithSpecs(specs []interfaceSpec, interfaceIPs []interfaceIP) (string, error) {
+	ips, err := findIPsWithSpecs(specs, interfaceIPs, SelectFirst)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// findIPsWithSpecs returns every IP in the interfaceIPs that matches a
+// spec, in spec order and without duplicates. IPs matching any negated
+// spec are excluded; if every spec is negated then the default specs are
+// used for the remaining IPs. A required spec that matches none of the
+// remaining IPs is an error. The IPs a spec matches on each interface are
+// ordered by the selection.
+func findIPsWithSpecs(specs []interfaceSpec, interfaceIPs []interfaceIP, selection IPSelection) ([]string, error) {
+	positive, negated := splitNegatedSpecs(specs)
+	if len(positive) == 0 && len(negated) > 0 {
+		positive, _ = parseInterfaceSpecs(defaultInterfaceSpecs)
+	}
+	var excluded []string
+	for _, spec := range negated {
+		excluded = append(excluded, findIPsWithSpec(spec, interfaceIPs)...)
+	}
+
+	var ips []string
+	for _, spec := range positive {
+		matched := false
+		matches := selectIPs(findIPsWithSpec(spec, interfaceIPs), interfaceIPs, selection)
+		for _, ip := range matches {
+			if containsString(excluded, ip) {
+				continue
 			}
-			if spec.Match(index, iip) {
-				return iip.IPString(), nil
+			matched = true
+			if !containsString(ips, ip) {
+				ips = append(ips, ip)
 			}
 		}
+		if _, ok := spec.(requiredInterfaceSpec); ok && !matched {
+			// a missing required interface is an error even if other
+			// specs would have matched, so we don't try the rest
+			return nil, fmt.Errorf("%w: %w: %s\nInterfaces IPs: %s",
+				ErrNoMatch, ErrRequiredNoMatch, spec, interfaceIPs)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
 	}
 
 	// Interface not found, return error
-	return "", fmt.Errorf("none of the interface specifications were able to match\nSpecifications: %s\nInterfaces IPs: %s",
-		specs, interfaceIPs)
+	return nil, fmt.Errorf("%w\nSpecifications: %s\nInterfaces IPs: %s",
+		ErrNoMatch, specs, interfaceIPs)
+}
+
+// selectIPs reorders the IPs that a spec matched so that the IP chosen by
+// the selection comes first on each interface. The interfaces keep their
+// order, so a spec that matches several interfaces still prefers the IPs
+// of the first one.
+func selectIPs(ips []string, interfaceIPs []interfaceIP, selection IPSelection) []string {
+	if selection == SelectFirst || len(ips) < 2 {
+		return ips
+	}
+	names := make(map[string]string)
+	for _, iip := range interfaceIPs {
+		if _, ok := names[iip.IPString()]; !ok {
+			names[iip.IPString()] = iip.Name
+		}
+	}
+	var order []string
+	groups := make(map[string][]string)
+	for _, ip := range ips {
+		name := names[ip]
+		if _, ok := groups[name]; !ok {
+			order = append(order, name)
+		}
+		groups[name] = append(groups[name], ip)
+	}
+	selected := make([]string, 0, len(ips))
+	for _, name := range order {
+		group := groups[name]
+		switch selection {
+		case SelectLast:
+			for i := len(group) - 1; i >= 0; i-- {
+				selected = append(selected, group[i])
+			}
+			continue
+		case SelectLowest:
+			sort.SliceStable(group, func(i, j int) bool {
+				return compareIPs(group[i], group[j]) < 0
+			})
+		case SelectHighest:
+			sort.SliceStable(group, func(i, j int) bool {
+				return compareIPs(group[i], group[j]) > 0
+			})
+		}
+		selected = append(selected, group...)
+	}
+	return selected
+}
+
+// compareIPs compares two IPs numerically. IPv4 addresses (including
+// IPv4-mapped IPv6) are lower than every IPv6 address, and the zone of a
+// link-local address is ignored.
+func compareIPs(a, b string) int {
+	ipA := net.ParseIP(strings.SplitN(a, "%", 2)[0])
+	ipB := net.ParseIP(strings.SplitN(b, "%", 2)[0])
+	v4A, v4B := ipA.To4(), ipB.To4()
+	switch {
+	case v4A != nil && v4B != nil:
+		return bytes.Compare(v4A, v4B)
+	case v4A != nil:
+		return -1
+	case v4B != nil:
+		return 1
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
 }
 
-// Interface Spec
+// splitNegatedSpecs separates the negated specs from the rest, preserving
+// their order
+func splitNegatedSpecs(specs []interfaceSpec) ([]interfaceSpec, []interfaceSpec) {
+	var positive, negated []interfaceSpec
+	for _, spec := range specs {
+		if spec.Negated() {
+			negated = append(negated, spec)
+			continue
+		}
+		positive = append(positive, spec)
+	}
+	return positive, negated
+}
+
+// Interface Spec. Match is passed the index of the IP among the IPs of
+// its interface and the count of those IPs. Specificity ranks how narrowly
+// the spec picks an IP, for the OrderMostSpecific order. A Negated spec
+// (ex. !docker0) still matches its IPs, but they're excluded from the IPs
+// of the other specs instead of being selected.
 type interfaceSpec interface {
-	Match(index int, iip interfaceIP) bool
+	Match(index, count int, iip interfaceIP) bool
+	Specificity() int
+	Negated() bool
 }
 
-// -- matches inet, inet6, interface:inet, and interface:inet6
+// Specificity scores, from the most to the least specific
+const (
+	specificityAddress   = 6 // static:192.168.1.100
+	specificityIndex     = 5 // eth0[1]
+	specificityInterface = 4 // eth0:inet, mac:..., route:...
+	specificityNetwork   = 3 // 10.0.0.0/16
+	specificityScoped    = 2 // inet:private
+	specificityWildcard  = 1 // inet, inet6
+	specificityNone      = 0 // !eth0, which only excludes IPs
+)
+
+// sortSpecsBySpecificity orders the specs from the most to the least
+// specific, keeping the list order for specs that are equally specific
+func sortSpecsBySpecificity(specs []interfaceSpec) []interfaceSpec {
+	sorted := append([]interfaceSpec{}, specs...)
+	specificity := func(spec interfaceSpec) int {
+		if spec.Negated() {
+			return specificityNone
+		}
+		return spec.Specificity()
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return specificity(sorted[i]) > specificity(sorted[j])
+	})
+	return sorted
+}
+
+// -- matches inet, inet6, interface:inet, and interface:inet6, and
+// inet:private, inet:public, inet6:private, and inet6:public
 type inetInterfaceSpec struct {
-	Spec string
-	Name string
-	IPv6 bool
+	Spec   string
+	Name   string
+	IPv6   bool
+	Scope  ipScope
+	Negate bool
+
+	// AnyFamily matches both IPv4 and IPv6, for a negated bare interface
+	// name (ex. !docker0) that should exclude all of its IPs
+	AnyFamily bool
 }
 
+// ipScope restricts an inetInterfaceSpec to private or public IPs
+type ipScope int
+
+const (
+	anyScope ipScope = iota
+	privateScope
+	publicScope
+)
+
 // -- matches static
 type staticInterfaceSpec struct {
 	Spec string
@@ -116,12 +700,30 @@ type staticInterfaceSpec struct {
 	IP   net.IP
 }
 
-func (s staticInterfaceSpec) Match(index int, iip interfaceIP) bool {
+func (s staticInterfaceSpec) String() string { return s.Spec }
+func (s inetInterfaceSpec) String() string   { return s.Spec }
+
+func (s staticInterfaceSpec) Specificity() int { return specificityAddress }
+
+func (s staticInterfaceSpec) Negated() bool { return false }
+func (s inetInterfaceSpec) Negated() bool   { return s.Negate }
+
+func (s inetInterfaceSpec) Specificity() int {
+	switch {
+	case s.Name != "*":
+		return specificityInterface
+	case s.Scope != anyScope:
+		return specificityScoped
+	}
+	return specificityWildcard
+}
+
+func (s staticInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
 	// Never matches
 	return false
 }
 
-func (s inetInterfaceSpec) Match(index int, iip interfaceIP) bool {
+func (s inetInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
 	if s.Name != "*" && s.Name != iip.Name {
 		return false
 	}
@@ -129,63 +731,324 @@ func (s inetInterfaceSpec) Match(index int, iip interfaceIP) bool {
 	if s.Name == "*" && iip.IP.IsLoopback() {
 		return false
 	}
-	return s.IPv6 != iip.IsIPv4()
+	// Link-local IPv6 addresses are only usable with a zone, so they're
+	// only selected when asked for explicitly by index or CIDR
+	if s.IPv6 && iip.IP.IsLinkLocalUnicast() {
+		return false
+	}
+	switch s.Scope {
+	case privateScope:
+		if !isPrivateIP(iip.IP) {
+			return false
+		}
+	case publicScope:
+		if !isPublicIP(iip.IP) {
+			return false
+		}
+	}
+	return s.AnyFamily || s.IPv6 != iip.IsIPv4()
 }
 
-// -- Indexed Interface Spec : eth0[1]
-type indexInterfaceSpec struct {
-	Spec  string
-	Name  string
-	Index int
+// private address ranges: RFC1918 for IPv4 and RFC4193 for IPv6
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
 }
 
-func (spec indexInterfaceSpec) Match(index int, iip interfaceIP) bool {
-	if spec.Name == iip.Name {
-		return (spec.Index == index)
+// isPrivateIP returns true if the IP is in one of the RFC1918 or RFC4193
+// private ranges. Loopback and link-local addresses are not private.
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
 	}
 	return false
 }
 
+// isPublicIP returns true if the IP is globally routable: it's a global
+// unicast address that isn't in a private range
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !isPrivateIP(ip)
+}
+
+// -- Indexed Interface Spec : eth0[1], or eth0[-1] for the last IP
+type indexInterfaceSpec struct {
+	Spec   string
+	Name   string
+	Index  int
+	Negate bool
+}
+
+func (spec indexInterfaceSpec) String() string { return spec.Spec }
+
+func (spec indexInterfaceSpec) Specificity() int { return specificityIndex }
+
+func (spec indexInterfaceSpec) Negated() bool { return spec.Negate }
+
+func (spec indexInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
+	if spec.Name != iip.Name {
+		return false
+	}
+	if spec.Index < 0 {
+		return (count+spec.Index == index)
+	}
+	return (spec.Index == index)
+}
+
 // -- CIDR Interface Spec
 type cidrInterfaceSpec struct {
 	Spec    string
 	Network *net.IPNet
+	Negate  bool
 }
 
-func (spec cidrInterfaceSpec) Match(index int, iip interfaceIP) bool {
+func (spec cidrInterfaceSpec) String() string { return spec.Spec }
+
+func (spec cidrInterfaceSpec) Specificity() int { return specificityNetwork }
+
+func (spec cidrInterfaceSpec) Negated() bool { return spec.Negate }
+
+func (spec cidrInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
 	return spec.Network.Contains(iip.IP)
 }
 
+// -- Required Interface Spec : +eth1, +eth1:inet6
+// matches the same IPs as the Inner spec, but it's an error if it matches
+// none of them instead of falling through to the next spec
+type requiredInterfaceSpec struct {
+	Spec  string
+	Inner interfaceSpec
+}
+
+func (spec requiredInterfaceSpec) String() string { return spec.Spec }
+
+func (spec requiredInterfaceSpec) Specificity() int { return spec.Inner.Specificity() }
+
+func (spec requiredInterfaceSpec) Negated() bool { return false }
+
+func (spec requiredInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
+	return spec.Inner.Match(index, count, iip)
+}
+
+// -- MAC Interface Spec : mac:02:42:ac:11:00:02
+// matches the IPv4 addresses of the interface with the hardware address
+type macInterfaceSpec struct {
+	Spec   string
+	MAC    net.HardwareAddr
+	Negate bool
+}
+
+func (spec macInterfaceSpec) String() string { return spec.Spec }
+
+func (spec macInterfaceSpec) Specificity() int { return specificityInterface }
+
+func (spec macInterfaceSpec) Negated() bool { return spec.Negate }
+
+func (spec macInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
+	return bytes.Equal(spec.MAC, iip.HardwareAddr) && iip.IsIPv4()
+}
+
+// -- Route Interface Spec : route:10.0.0.5, route:consul:8500
+// matches the source IP that the kernel would use to reach the
+// destination, regardless of which interface it's on
+type routeInterfaceSpec struct {
+	Spec        string
+	Destination string // host:port
+}
+
+func (spec routeInterfaceSpec) String() string { return spec.Spec }
+
+func (spec routeInterfaceSpec) Specificity() int { return specificityInterface }
+
+func (spec routeInterfaceSpec) Negated() bool { return false }
+
+func (spec routeInterfaceSpec) Match(index, count int, iip interfaceIP) bool {
+	// Never matches; the IP comes from the routing table instead
+	return false
+}
+
+// defaultRoutePort is used for route specs without a port. Connecting a
+// UDP socket doesn't send any packets, so the port doesn't matter except
+// to routing policies that depend on it.
+const defaultRoutePort = "9"
+
+// routeSourceIP returns the local address of a UDP socket connected to
+// the destination. This lets the kernel pick the source IP for us without
+// sending anything. It's a variable so that tests can replace it.
+var routeSourceIP = func(destination string) (net.IP, error) {
+	conn, err := net.Dial("udp", destination)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP == nil {
+		return nil, fmt.Errorf("no local address for route to %s", destination)
+	}
+	return addr.IP, nil
+}
+
+// findRouteIP returns the source IP for the route spec, or nothing if
+// the destination is unreachable so that the next spec is tried
+func findRouteIP(spec routeInterfaceSpec) []string {
+	ip, err := routeSourceIP(spec.Destination)
+	if err != nil {
+		log.WithFields(log.Fields{"spec": spec.String(), "error": err}).
+			Debugf("no route for interface spec %s: %v", spec, err)
+		return nil
+	}
+	return []string{ip.String()}
+}
+
+func parseRouteSpec(spec string) (interfaceSpec, error) {
+	dest := strings.TrimPrefix(spec, "route:")
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		// no port, which may also be a bare IPv6 address
+		host, port = strings.Trim(dest, "[]"), defaultRoutePort
+	}
+	if host == "" || strings.ContainsAny(host, "[]/ ") {
+		return nil, fmt.Errorf("Unable to parse route destination in %s", spec)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("Unable to parse route port in %s", spec)
+	}
+	return routeInterfaceSpec{
+		Spec: spec, Destination: net.JoinHostPort(host, port)}, nil
+}
+
+// splitSpecList splits each element of the list on commas and newlines,
+// so that a single generated string can hold several specs. Empty
+// fragments, ex. from a trailing comma, are dropped.
+func splitSpecList(interfaces []string) []string {
+	var result []string
+	for _, element := range interfaces {
+		for _, spec := range strings.FieldsFunc(element, func(r rune) bool {
+			return r == ',' || r == '\n'
+		}) {
+			if spec = strings.TrimSpace(spec); spec != "" {
+				result = append(result, spec)
+			}
+		}
+	}
+	return result
+}
+
 func parseInterfaceSpecs(interfaces []string) ([]interfaceSpec, error) {
-	var errors []string
+	var errors []interface{}
 	var specs []interfaceSpec
-	for _, iface := range interfaces {
+	for _, iface := range splitSpecList(interfaces) {
+		iface, ok := expandSpec(iface)
+		if !ok {
+			continue
+		}
 		spec, err := parseInterfaceSpec(iface)
 		if err != nil {
-			errors = append(errors, err.Error())
+			// the caller reports the returned error, so this is only a
+			// debugging aid that points at each bad spec
+			log.WithFields(log.Fields{"spec": iface, "error": err}).
+				Debugf("%v: %v", ErrSpecParse, err)
+			errors = append(errors, &SpecParseError{Spec: iface, Err: err})
 			continue
 		}
 		specs = append(specs, spec)
 	}
 	if len(errors) > 0 {
-		err := fmt.Errorf(strings.Join(errors, "\n"))
-		log.Errorln(err)
-		return specs, err
+		// wrap each error rather than joining the messages, so that
+		// callers can find the bad specs with errors.As
+		format := "%w:" + strings.Repeat("\n%w", len(errors))
+		return specs, fmt.Errorf(format, append([]interface{}{ErrSpecParse}, errors...)...)
 	}
 	return specs, nil
 }
 
+// interface names can have up to IFNAMSIZ-1 characters. The Name is
+// matched lazily so that a trailing ':inet' or ':inet6' is the Version
+// rather than part of the Name.
 var (
-	ifaceSpec = regexp.MustCompile(`^(?P<Name>\w+)(?:(?:\[(?P<Index>\d+)\])|(?::(?P<Version>inet6?)))?$`)
+	scopedInetSpec = regexp.MustCompile(`^(inet6?):(private|public)$`)
+	ifaceSpec      = regexp.MustCompile(`^(?P<Name>[\w.:-]{1,15}?)(?:(?:\[(?P<Index>-?\d+)\])|(?::(?P<Version>inet6?)))?$`)
 )
 
+// reservedSpecPrefixes can't start an interface name with a colon in it,
+// so that a typo in one of those specs isn't taken for an interface
+var reservedSpecPrefixes = []string{"inet", "inet6", "mac", "route", "static"}
+
+// validInterfaceName checks the parts of an interface name that the
+// ifaceSpec regex can't. A colon is allowed in the name (ex. for an
+// alias like eth0:1), but not when the name looks like another spec or an
+// invalid ':inet' suffix.
+func validInterfaceName(name string) bool {
+	if !strings.Contains(name, ":") {
+		return true
+	}
+	first := name[:strings.Index(name, ":")]
+	last := name[strings.LastIndex(name, ":")+1:]
+	return !containsString(reservedSpecPrefixes, first) &&
+		!strings.HasPrefix(last, "inet")
+}
+
 func parseInterfaceSpec(spec string) (interfaceSpec, error) {
+	if strings.HasPrefix(spec, "!") {
+		inner := strings.TrimPrefix(spec, "!")
+		if strings.HasPrefix(inner, "!") || strings.HasPrefix(inner, "+") ||
+			strings.HasPrefix(inner, "static:") ||
+			strings.HasPrefix(inner, "route:") {
+			return nil, fmt.Errorf("Unable to negate interface spec: %s", spec)
+		}
+		innerSpec, err := parseInterfaceSpec(inner)
+		if err != nil {
+			return nil, err
+		}
+		return negateInterfaceSpec(spec, innerSpec)
+	}
+	if strings.HasPrefix(spec, "+") {
+		inner := strings.TrimPrefix(spec, "+")
+		if strings.HasPrefix(inner, "+") || strings.HasPrefix(inner, "!") {
+			return nil, fmt.Errorf("Unable to require interface spec: %s", spec)
+		}
+		innerSpec, err := parseInterfaceSpec(inner)
+		if err != nil {
+			return nil, err
+		}
+		return requiredInterfaceSpec{Spec: spec, Inner: innerSpec}, nil
+	}
 	if spec == "inet" {
 		return inetInterfaceSpec{Spec: spec, Name: "*", IPv6: false}, nil
 	}
 	if spec == "inet6" {
 		return inetInterfaceSpec{Spec: spec, Name: "*", IPv6: true}, nil
 	}
+	if match := scopedInetSpec.FindStringSubmatch(spec); match != nil {
+		scope := privateScope
+		if match[2] == "public" {
+			scope = publicScope
+		}
+		return inetInterfaceSpec{
+			Spec: spec, Name: "*", IPv6: match[1] == "inet6", Scope: scope}, nil
+	}
+	if strings.HasPrefix(spec, "mac:") {
+		// ParseMAC accepts upper or lower case and ':' or '-' separators
+		mac, err := net.ParseMAC(strings.TrimPrefix(spec, "mac:"))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse MAC address in %s", spec)
+		}
+		return macInterfaceSpec{Spec: spec, MAC: mac}, nil
+	}
+	if strings.HasPrefix(spec, "route:") {
+		return parseRouteSpec(spec)
+	}
 	if strings.HasPrefix(spec, "static:") {
 		ip := strings.SplitAfter(spec, "static:")
 		if _, err := strconv.Atoi(ip[1]); err != nil {
@@ -197,7 +1060,12 @@ func parseInterfaceSpec(spec string) (interfaceSpec, error) {
 		}
 	}
 
-	if match := ifaceSpec.FindStringSubmatch(spec); match != nil {
+	// a bare IP would otherwise match as an interface name, but it needs
+	// to be a CIDR or a static spec
+	if net.ParseIP(spec) != nil {
+		return nil, fmt.Errorf("Unable to parse interface spec: %s", spec)
+	}
+	if match := ifaceSpec.FindStringSubmatch(spec); match != nil && validInterfaceName(match[1]) {
 		name := match[1]
 		index := match[2]
 		inet := match[3]
@@ -222,9 +1090,34 @@ func parseInterfaceSpec(spec string) (interfaceSpec, error) {
 	return nil, fmt.Errorf("Unable to parse interface spec: %s", spec)
 }
 
+// negateInterfaceSpec returns the inner spec of a negated spec like
+// !docker0 or !172.17.0.0/16, marked as negated. A bare interface name only
+// matches IPv4 when it's selecting an IP, but it excludes every IP of the
+// interface when it's negated.
+func negateInterfaceSpec(spec string, inner interfaceSpec) (interfaceSpec, error) {
+	switch s := inner.(type) {
+	case inetInterfaceSpec:
+		s.AnyFamily = s.Spec == s.Name
+		s.Spec, s.Negate = spec, true
+		return s, nil
+	case indexInterfaceSpec:
+		s.Spec, s.Negate = spec, true
+		return s, nil
+	case cidrInterfaceSpec:
+		s.Spec, s.Negate = spec, true
+		return s, nil
+	case macInterfaceSpec:
+		s.Spec, s.Negate = spec, true
+		return s, nil
+	}
+	return nil, fmt.Errorf("Unable to negate interface spec: %s", spec)
+}
+
 type interfaceIP struct {
-	Name string
-	IP   net.IP
+	Name         string
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+	Zone         string // only set for link-local IPv6 addresses
 }
 
 func (iip interfaceIP) To16() net.IP {
@@ -239,10 +1132,15 @@ func (iip interfaceIP) IsIPv4() bool {
 	return iip.To4() != nil
 }
 
+// IPString returns the IP in its canonical form: dotted-decimal for IPv4
+// (including IPv4-mapped IPv6), and with the zone for link-local IPv6
 func (iip interfaceIP) IPString() string {
 	if v4 := iip.To4(); v4 != nil {
 		return v4.String()
 	}
+	if iip.Zone != "" {
+		return iip.IP.String() + "%" + iip.Zone
+	}
 	return iip.IP.String()
 }
 
@@ -250,30 +1148,61 @@ func (iip interfaceIP) String() string {
 	return fmt.Sprintf("%s:%s", iip.Name, iip.IPString())
 }
 
+// filterUpInterfaces drops the interfaces that are administratively down,
+// so that we never advertise their stale addresses, unless the interface
+// is one of the named interfaces that were asked for explicitly.
+func filterUpInterfaces(interfaces []net.Interface, named []string) []net.Interface {
+	var up []net.Interface
+	for _, intf := range interfaces {
+		if intf.Flags&net.FlagUp == 0 && !containsString(named, intf.Name) {
+			log.WithField("interface", intf.Name).
+				Debugf("skipping interface %s because it is down", intf.Name)
+			continue
+		}
+		up = append(up, intf)
+	}
+	return up
+}
+
 // Queries the network interfaces on the running machine and returns a list
-// of IPs for each interface.
-func getinterfaceIPs(interfaces []net.Interface) ([]interfaceIP, error) {
+// of IPs for each interface. Interfaces that are down are skipped unless
+// they are among the named interfaces.
+func getinterfaceIPs(interfaces []net.Interface, named []string) ([]interfaceIP, error) {
 	var ifaceIPs []interfaceIP
 	var errors []string
 
-	for _, intf := range interfaces {
+	for _, intf := range filterUpInterfaces(interfaces, named) {
 		ipAddrs, addrErr := intf.Addrs()
 
+		// as with the specs, the caller decides how to report the returned
+		// errors, so we only log each one for debugging
 		if addrErr != nil {
+			log.WithFields(log.Fields{"interface": intf.Name, "error": addrErr}).
+				Debugf("unable to read addresses of interface %s: %v",
+					intf.Name, addrErr)
 			errors = append(errors, addrErr.Error())
 			continue
 		}
 
 		for _, ipAddr := range ipAddrs {
-			// Addresses some times come in the form "192.168.100.1/24 2001:DB8::/48"
-			// so they must be split on whitespace
-			for _, splitIP := range strings.Split(ipAddr.String(), " ") {
-				ip, _, err := net.ParseCIDR(splitIP)
-				if err != nil {
-					errors = append(errors, err.Error())
-					continue
+			ips, zones, err := parseInterfaceAddr(ipAddr)
+			if err != nil {
+				log.WithFields(log.Fields{"interface": intf.Name, "error": err}).
+					Debugf("unable to parse address of interface %s: %v",
+						intf.Name, err)
+				errors = append(errors, err.Error())
+			}
+			for i, ip := range ips {
+				zone := zones[i]
+				if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+					zone = ""
+				} else if zone == "" {
+					// the zone of a link-local address is its interface
+					zone = intf.Name
 				}
-				intfIP := interfaceIP{Name: intf.Name, IP: ip}
+				intfIP := interfaceIP{
+					Name: intf.Name, IP: ip, HardwareAddr: intf.HardwareAddr,
+					Zone: zone}
 				ifaceIPs = append(ifaceIPs, intfIP)
 			}
 		}
@@ -286,14 +1215,51 @@ func getinterfaceIPs(interfaces []net.Interface) ([]interfaceIP, error) {
 	/* If we had any errors parsing interfaces, we accumulate them all and
 	 * then return them so that the caller can decide what they want to do. */
 	if len(errors) > 0 {
-		err := fmt.Errorf(strings.Join(errors, "\n"))
-		log.Errorln(err)
-		return ifaceIPs, err
+		return ifaceIPs, fmt.Errorf(strings.Join(errors, "\n"))
 	}
 
 	return ifaceIPs, nil
 }
 
+// parseInterfaceAddr returns the IPs and their zones (if any) for one of
+// the addresses of an interface
+func parseInterfaceAddr(addr net.Addr) ([]net.IP, []string, error) {
+	switch a := addr.(type) {
+	case *net.IPNet:
+		return []net.IP{a.IP}, []string{""}, nil
+	case *net.IPAddr:
+		return []net.IP{a.IP}, []string{a.Zone}, nil
+	}
+	var ips []net.IP
+	var zones []string
+	var errors []string
+	// Addresses some times come in the form "192.168.100.1/24 2001:DB8::/48"
+	// so they must be split on whitespace
+	for _, splitIP := range strings.Split(addr.String(), " ") {
+		// ParseCIDR doesn't accept zones, ex. "fe80::1%eth0/64"
+		zone := ""
+		if i := strings.Index(splitIP, "%"); i >= 0 {
+			end := strings.Index(splitIP, "/")
+			if end < i {
+				end = len(splitIP)
+			}
+			zone = splitIP[i+1 : end]
+			splitIP = splitIP[:i] + splitIP[end:]
+		}
+		ip, _, err := net.ParseCIDR(splitIP)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+		ips = append(ips, ip)
+		zones = append(zones, zone)
+	}
+	if len(errors) > 0 {
+		return ips, zones, fmt.Errorf(strings.Join(errors, "\n"))
+	}
+	return ips, zones, nil
+}
+
 // ByInterfaceThenIP implements the Sort with the following properties:
 // 1. Sort interfaces alphabetically
 // 2. Sort IPs by bytes (normalized to 16 byte form)
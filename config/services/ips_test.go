@@ -1,14 +1,21 @@
 package services
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
+	"os/exec"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -57,7 +64,7 @@ func TestGetIp(t *testing.T) {
 	// these tests can't pass if the test runner doesn't have a valid inet
 	// address, so we'll skip these tests in that environment.
 	interfaces, _ := net.Interfaces()
-	allIps, _ := getinterfaceIPs(interfaces)
+	allIps, _ := getinterfaceIPs(interfaces, nil)
 	for _, ip := range allIps {
 		if ip.IsIPv4() && !ip.IP.IsLoopback() {
 			if ip, err := GetIP([]string{}); ip == "" {
@@ -86,7 +93,7 @@ func TestInterfaceIpsLoopback(t *testing.T) {
 		Flags: net.FlagUp | net.FlagLoopback,
 	}
 
-	interfaceIps, err := getinterfaceIPs(interfaces)
+	interfaceIps, err := getinterfaceIPs(interfaces, nil)
 
 	if err != nil {
 		t.Error(err)
@@ -127,7 +134,7 @@ func TestInterfaceIpsError(t *testing.T) {
 		HardwareAddr: []byte{0x10, 0xC3, 0x7B, 0x45, 0xA2, 0xFF},
 	}
 
-	interfaceIps, err := getinterfaceIPs(interfaces)
+	interfaceIps, err := getinterfaceIPs(interfaces, nil)
 
 	if err != nil {
 		t.Error(err)
@@ -154,24 +161,114 @@ func TestInterfaceIpsError(t *testing.T) {
 	}
 }
 
+func TestInterfaceIpsDown(t *testing.T) {
+	interfaces := []net.Interface{
+		{Index: 1, Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast},
+		{Index: 2, Name: "eth1", Flags: net.FlagBroadcast},
+		{Index: 3, Name: "eth2", Flags: net.FlagUp},
+		{Index: 4, Name: "eth3"},
+	}
+	names := func(interfaces []net.Interface) []string {
+		result := []string{}
+		for _, intf := range interfaces {
+			result = append(result, intf.Name)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"eth0", "eth2"},
+		names(filterUpInterfaces(interfaces, nil)),
+		"expected down interfaces to be filtered")
+	assert.Equal(t, []string{"eth0", "eth2", "eth3"},
+		names(filterUpInterfaces(interfaces, []string{"eth3"})),
+		"expected down interface to be kept when named")
+
+	// a down copy of the real loopback interface is skipped by specs
+	// that match any interface but not when it is asked for by name
+	loIface, err := net.InterfaceByName(lo)
+	if err != nil {
+		t.Fatalf("unable to find loopback interface: %v", err)
+	}
+	down := *loIface
+	down.Flags = down.Flags &^ net.FlagUp
+	specs, _ := parseInterfaceSpecs([]string{"127.0.0.0/8"})
+	iips, _ := getinterfaceIPs([]net.Interface{down}, specInterfaceNames(specs))
+	testIPSpec(t, iips, "", "127.0.0.0/8")
+
+	specs, _ = parseInterfaceSpecs([]string{lo})
+	iips, _ = getinterfaceIPs([]net.Interface{down}, specInterfaceNames(specs))
+	testIPSpec(t, iips, "127.0.0.1", lo)
+}
+
 func TestInterfaceSpecParse(t *testing.T) {
 	// Test Error Cases
 	testSpecError(t, "")              // Nothing
 	testSpecError(t, "!")             // Nonsense
 	testSpecError(t, "127.0.0.1")     // No Network
 	testSpecError(t, "eth0:inet5")    // Invalid IP Version
-	testSpecError(t, "eth0[-1]")      // Invalid Index
+	testSpecError(t, "eth0[x]")       // Invalid Index
+	testSpecError(t, "eth0[--1]")     // Invalid Index
 	testSpecError(t, "static:abcdef") // Invalid IP
+	testSpecError(t, "inet:internal") // Invalid scope
+	testSpecError(t, "mac:02:42:ac")  // Invalid MAC
+	testSpecError(t, "!!eth0")        // Double negation
+	testSpecError(t, "!static:192.168.1.100")
+	testSpecError(t, "!route:10.0.0.5")
+	testSpecError(t, "route:")           // No destination
+	testSpecError(t, "route:10.0.0.5:x") // Invalid port
+	testSpecError(t, "!eth0:inet5")
+	testSpecError(t, "+")      // Nothing required
+	testSpecError(t, "++eth0") // Double requirement
+	testSpecError(t, "+!eth0") // Required negation
+	testSpecError(t, "!+eth0") // Negated requirement
+	testSpecError(t, "+eth0:inet5")
 
 	// Test Interface Case
 	testSpecInterfaceName(t, "eth0", "eth0", false, -1)
 	testSpecInterfaceName(t, "eth0:inet6", "eth0", true, -1)
 	testSpecInterfaceName(t, "eth0[1]", "eth0", false, 1)
 	testSpecInterfaceName(t, "eth0[2]", "eth0", false, 2)
+	if spec, err := parseInterfaceSpec("eth0[-1]"); err != nil {
+		t.Errorf("Expected parse to succeed, but got error: %s", err)
+	} else if indexSpec, ok := spec.(indexInterfaceSpec); !ok || indexSpec.Index != -1 {
+		t.Errorf("Expected eth0[-1] to parse as indexInterfaceSpec with index -1 but got %#v", spec)
+	}
 	testSpecInterfaceName(t, "inet", "*", false, -1)
 	testSpecInterfaceName(t, "inet6", "*", true, -1)
+	testSpecInterfaceName(t, "inet:private", "*", false, -1)
+	testSpecInterfaceName(t, "inet6:public", "*", true, -1)
 	testSpecInterfaceName(t, "static:192.168.1.100", "static", false, 1)
 
+	// VLAN, bond, and alias interface names
+	testSpecInterfaceName(t, "eth0.100", "eth0.100", false, -1)
+	testSpecInterfaceName(t, "eth0.100:inet", "eth0.100", false, -1)
+	testSpecInterfaceName(t, "bond0-1:inet6", "bond0-1", true, -1)
+	testSpecInterfaceName(t, "vlan.4094[0]", "vlan.4094", false, 0)
+	testSpecInterfaceName(t, "eth0:1", "eth0:1", false, -1)
+	testSpecInterfaceName(t, "br_lan", "br_lan", false, -1)
+	testSpecInterfaceName(t, "enp0s31f6.4094", "enp0s31f6.4094", false, -1)
+	testSpecError(t, "enp0s31f6-vlan.4094") // longer than IFNAMSIZ
+	testSpecError(t, "eth0.100:inet5")
+	testSpecError(t, "fd00::5") // bare IPv6 address
+
+	// Test Route Case
+	for specStr, dest := range map[string]string{
+		"route:10.0.0.5":        "10.0.0.5:9",
+		"route:10.0.0.5:8500":   "10.0.0.5:8500",
+		"route:consul:8500":     "consul:8500",
+		"route:fd00::5":         "[fd00::5]:9",
+		"route:[fd00::5]":       "[fd00::5]:9",
+		"route:[fd00::5]:8500":  "[fd00::5]:8500",
+		"route:consul.internal": "consul.internal:9",
+	} {
+		spec, err := parseInterfaceSpec(specStr)
+		if err != nil {
+			t.Errorf("Expected parse of %s to succeed, but got error: %s", specStr, err)
+		} else if route, ok := spec.(routeInterfaceSpec); !ok || route.Destination != dest {
+			t.Errorf("Expected %s to parse as routeInterfaceSpec to %s but got %#v",
+				specStr, dest, spec)
+		}
+	}
+
 	// Test CIDR Case
 	testSpecCIDR(t, "10.0.0.0/16")
 	testSpecCIDR(t, "fdc6:238c:c4bc::/48")
@@ -245,6 +342,119 @@ func testSpecCIDR(t *testing.T, specStr string) {
 	}
 }
 
+// Each invalid spec should be logged on its own line with the spec as a
+// field, so that structured log formats can pick it out, but only at debug
+// level because the error is returned as well
+func TestInterfaceSpecParseLogFields(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	log.SetLevel(log.DebugLevel)
+
+	_, err := parseInterfaceSpecs([]string{"inet", "eth0[x]", "127.0.0/8"})
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected ErrSpecParse")
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(entries))
+	}
+	for i, spec := range []string{"eth0[x]", "127.0.0/8"} {
+		assert.Equal(t, log.DebugLevel, entries[i].Level)
+		assert.Equal(t, spec, entries[i].Data["spec"])
+		assert.NotNil(t, entries[i].Data["error"])
+		assert.NotContains(t, entries[i].Message, "\n")
+	}
+
+	hook.Reset()
+	expandSpec("eth0:${CONTAINERPILOT_TEST_UNSET}")
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("expected a log entry for the dropped spec")
+	}
+	assert.Equal(t, log.WarnLevel, entry.Level)
+	assert.Equal(t, "eth0:${CONTAINERPILOT_TEST_UNSET}", entry.Data["spec"])
+	assert.Equal(t, []string{"CONTAINERPILOT_TEST_UNSET"}, entry.Data["missing"])
+}
+
+// The spec and interface parsers return their errors, so they must never
+// write to stderr themselves. A bare println writes to the stderr file
+// descriptor directly, so we run them in a subprocess to catch it.
+func TestInterfaceParsersNoStderr(t *testing.T) {
+	if os.Getenv("CONTAINERPILOT_TEST_STDERR") == "1" {
+		parseInterfaceSpecs([]string{"eth0[x]", "!inet", "static:x", "mac:x"})
+		getinterfaceIPs([]net.Interface{
+			{Index: -1, Name: "barf", Flags: net.FlagUp}}, nil)
+		findIPs(nil, nil, IPOptions{})
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInterfaceParsersNoStderr$")
+	cmd.Env = append(os.Environ(), "CONTAINERPILOT_TEST_STDERR=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("subprocess failed: %v: %s", err, stderr.String())
+	}
+	assert.Empty(t, stderr.String(), "expected no output on stderr")
+}
+
+func TestInterfaceSpecParseSeparators(t *testing.T) {
+	specStrings := func(list ...string) []string {
+		specs, err := parseInterfaceSpecs(list)
+		assert.Nil(t, err, "unexpected error for %q", list)
+		result := []string{}
+		for _, spec := range specs {
+			result = append(result, fmt.Sprint(spec))
+		}
+		return result
+	}
+	assert.Equal(t, []string{"eth0:inet", "eth1:inet"},
+		specStrings("eth0:inet,eth1:inet"))
+	assert.Equal(t, []string{"eth0:inet", "eth1:inet", "inet"},
+		specStrings("eth0:inet\neth1:inet,\n", "inet"))
+	assert.Equal(t, []string{"eth0", "10.0.0.0/8", "eth1[1]", "!lo"},
+		specStrings(" eth0 , 10.0.0.0/8,", "eth1[1]", ",!lo"))
+	assert.Equal(t, []string{"eth0", "eth1"}, specStrings("eth0", "eth1"),
+		"expected lists without separators to work as before")
+
+	_, err := parseInterfaceSpecs([]string{"eth0:inet,eth0:inet5"})
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected bad fragment to fail")
+
+	iips := getTestIPs()
+	specs, _ := parseInterfaceSpecs([]string{"eth3:inet,eth1[1],inet"})
+	ip, _ := findIPWithSpecs(specs, iips)
+	assert.Equal(t, "10.0.0.200", ip, "expected a fallback chain in one string")
+}
+
+// A required spec must match or the whole list fails, without falling
+// through to the later specs
+func TestFindIPWithRequiredSpec(t *testing.T) {
+	iips := getTestIPs()
+	spec, err := parseInterfaceSpec("+eth1:inet")
+	assert.Nil(t, err)
+	assert.Equal(t, requiredInterfaceSpec{Spec: "+eth1:inet",
+		Inner: inetInterfaceSpec{Spec: "eth1:inet", Name: "eth1"}}, spec)
+
+	testIPSpec(t, iips, "10.0.0.100", "+eth1:inet", "inet")
+	testIPSpec(t, iips, "10.2.0.1", "eth0", "+eth1")
+	testIPSpec(t, iips, "10.0.0.200", "+eth1[1]")
+
+	specs, _ := parseInterfaceSpecs([]string{"+eth3", "inet"})
+	_, err = findIPWithSpecs(specs, iips)
+	assert.True(t, errors.Is(err, ErrRequiredNoMatch), "expected ErrRequiredNoMatch")
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch")
+	assert.Contains(t, err.Error(), "+eth3")
+
+	// a required spec must match after exclusions, and a required spec
+	// fails even when an earlier spec has matched
+	testIPSpec(t, iips, "", "!10.0.0.0/16", "+eth1")
+	testIPSpec(t, iips, "", "eth0", "+eth3")
+
+	// a required spec fails even if we'd use an IP in a preferred network
+	_, err = GetIPsWithOptions([]string{"+eth3"},
+		IPOptions{PreferredNetworks: []string{"127.0.0.0/8"}})
+	assert.True(t, errors.Is(err, ErrRequiredNoMatch), "expected ErrRequiredNoMatch")
+}
+
 func TestFindIPWithSpecs(t *testing.T) {
 	iips := getTestIPs()
 
@@ -264,6 +474,21 @@ func TestFindIPWithSpecs(t *testing.T) {
 	testIPSpec(t, iips, "192.168.1.100", "eth0[1]")
 	testIPSpec(t, iips, "", "eth0[2]")
 
+	// Negative indexes count back from the last IP
+	testIPSpec(t, iips, "192.168.1.100", "eth0[-1]")
+	testIPSpec(t, iips, "10.2.0.1", "eth0[-2]")
+	testIPSpec(t, iips, "", "eth0[-3]")
+	threeIPs := []interfaceIP{
+		newInterfaceIP("eth0", "10.0.0.1"),
+		newInterfaceIP("eth0", "10.0.0.2"),
+		newInterfaceIP("eth0", "10.0.0.3"),
+		newInterfaceIP("eth1", "10.1.0.1"),
+	}
+	testIPSpec(t, threeIPs, "10.0.0.3", "eth0[-1]")
+	testIPSpec(t, threeIPs, "10.0.0.3", "eth0[2]")
+	testIPSpec(t, threeIPs, "10.1.0.1", "eth1[-1]")
+	testIPSpec(t, threeIPs, "", "eth0[-4]")
+
 	// IPv4 CIDR
 	testIPSpec(t, iips, "10.0.0.100", "10.0.0.0/16")
 	testIPSpec(t, iips, "10.1.0.200", "10.1.0.0/16")
@@ -282,6 +507,28 @@ func TestFindIPWithSpecs(t *testing.T) {
 	testIPSpec(t, iips, "fdc6:238c:c4bc::1", "eth3", "fdc6:238c:c4bc::/48", "inet", "inet6")
 	testIPSpec(t, iips, "10.0.0.100", "eth3", "10.0.0.0/16", "inet", "inet6", "fdc6:238c:c4bc::/48")
 
+	// Negated specs exclude IPs from the positive specs
+	testIPSpec(t, iips, "10.0.0.100", "!eth0", "inet")
+	testIPSpec(t, iips, "10.1.0.200", "!10.0.0.0/16", "!eth0", "inet")
+	testIPSpec(t, iips, "10.2.0.1", "inet", "!10.0.0.0/16")
+	testIPSpec(t, iips, "192.168.1.100", "!10.2.0.1/32", "eth0")
+	testIPSpec(t, iips, "", "!eth0", "eth0")
+
+	// Only negated specs fall back to the default specs
+	testIPSpec(t, iips, "192.168.1.100", "!10.2.0.1/32")
+	testIPSpec(t, iips, "10.0.0.100", "!eth0")
+
+	// A negated interface name excludes both its IPv4 and IPv6 addresses,
+	// unless it's limited to one of them
+	testIPSpec(t, iips, "", "!eth2", "eth2:inet6")
+	testIPSpec(t, iips, "", "!eth2", "fdc6:238c:c4bc::/48")
+	testIPSpec(t, iips, "fdc6:238c:c4bc::1", "!eth2:inet", "inet6")
+	testIPSpec(t, iips, "10.1.0.200", "!eth2:inet6", "eth2", "inet6")
+	spec, err := parseInterfaceSpec("!eth2")
+	assert.Nil(t, err)
+	assert.Equal(t, inetInterfaceSpec{Spec: "!eth2", Name: "eth2",
+		Negate: true, AnyFamily: true}, spec)
+
 	// Test that inet and inet6 will never find the loopback address
 	loopback := []interfaceIP{
 		newInterfaceIP(lo6, "::1"),
@@ -291,6 +538,483 @@ func TestFindIPWithSpecs(t *testing.T) {
 	testIPSpec(t, loopback, "", "inet6")
 }
 
+func TestFindIPWithRouteSpecs(t *testing.T) {
+	defer func(orig func(string) (net.IP, error)) { routeSourceIP = orig }(routeSourceIP)
+	routeSourceIP = func(destination string) (net.IP, error) {
+		switch destination {
+		case "10.0.0.5:9":
+			return net.ParseIP("10.2.0.1"), nil
+		case "[fd00::5]:9":
+			return nil, errors.New("connect: network is unreachable")
+		}
+		return nil, fmt.Errorf("unexpected destination %s", destination)
+	}
+	iips := getTestIPs()
+	testIPSpec(t, iips, "10.2.0.1", "route:10.0.0.5")
+	testIPSpec(t, iips, "10.2.0.1", "route:10.0.0.5", lo)
+	testIPSpec(t, iips, "127.0.0.1", "route:fd00::5", lo)
+	testIPSpec(t, iips, "", "route:fd00::5")
+}
+
+func TestGetIPWithRouteSpec(t *testing.T) {
+	// the route to a loopback address is through the loopback interface
+	ip, err := GetIP([]string{"route:127.0.0.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+}
+
+func TestFindIPWithSpecOrder(t *testing.T) {
+	iips := getTestIPs()
+	testOrder := func(listed, specific string, specList ...string) {
+		specs, err := parseInterfaceSpecs(specList)
+		if err != nil {
+			t.Fatalf("Fatal parse error of spec list: %s, %s", specList, err)
+		}
+		ip, _ := findIPWithSpecs(specs, iips)
+		assert.Equal(t, listed, ip, "listed order for %v", specList)
+		ip, _ = findIPWithSpecs(sortSpecsBySpecificity(specs), iips)
+		assert.Equal(t, specific, ip, "most specific order for %v", specList)
+	}
+	testOrder("10.2.0.1", "10.0.0.100", "inet", "eth1:inet")
+	testOrder("10.2.0.1", "10.0.0.200", "10.0.0.0/8", "eth1[1]")
+	testOrder("10.0.0.100", "10.0.0.200", "eth1:inet", "eth1[1]")
+	testOrder("10.2.0.1", "10.1.0.200", "inet", "10.1.0.0/16")
+	testOrder("10.2.0.1", "192.168.1.100", "eth0[0]", "static:192.168.1.100")
+	// equally specific specs keep their order
+	testOrder("10.1.0.200", "10.1.0.200", "eth2:inet", "eth1:inet")
+	// exclusions still apply
+	testOrder("10.1.0.200", "10.1.0.200", "inet", "!eth0", "!eth1")
+}
+
+func TestParseSpecOrder(t *testing.T) {
+	order, err := ParseSpecOrder("")
+	assert.Nil(t, err)
+	assert.Equal(t, OrderListed, order)
+	order, err = ParseSpecOrder("specific")
+	assert.Nil(t, err)
+	assert.Equal(t, OrderMostSpecific, order)
+	_, err = ParseSpecOrder("random")
+	assert.EqualError(t, err, "invalid interface order 'random': "+
+		"must be one of 'listed' or 'specific'")
+
+	ip, err := GetIPWithOptions([]string{"inet", lo}, IPOptions{Overlap: OverlapIgnore})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "127.0.0.1", ip, "expected listed order by default")
+	ip, err = GetIPWithOptions([]string{"inet6", lo},
+		IPOptions{Overlap: OverlapIgnore, Order: OrderMostSpecific})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip, "expected the named interface to win")
+}
+
+func TestFindIPWithScopedSpecs(t *testing.T) {
+	iips := []interfaceIP{
+		newInterfaceIP("eth0", "169.254.0.10"),
+		newInterfaceIP("eth0", "203.0.113.10"),
+		newInterfaceIP("eth0", "fe80::1"),
+		newInterfaceIP("eth0", "2001:db8::10"),
+		newInterfaceIP("eth1", "172.16.5.10"),
+		newInterfaceIP("eth1", "fd00::10"),
+		newInterfaceIP(lo, "127.0.0.1"),
+	}
+	testIPSpec(t, iips, "172.16.5.10", "inet:private")
+	testIPSpec(t, iips, "203.0.113.10", "inet:public")
+	testIPSpec(t, iips, "fd00::10", "inet6:private")
+	testIPSpec(t, iips, "2001:db8::10", "inet6:public")
+
+	// unscoped specs match any scope, except link-local IPv6
+	testIPSpec(t, iips, "169.254.0.10", "inet")
+	testIPSpec(t, iips, "2001:db8::10", "inet6")
+}
+
+func TestFindIPWithMACSpecs(t *testing.T) {
+	mac0, _ := net.ParseMAC("02:42:ac:11:00:02")
+	mac1, _ := net.ParseMAC("02:42:ac:11:00:03")
+	iips := []interfaceIP{
+		{Name: "ens3", IP: net.ParseIP("fd00::2"), HardwareAddr: mac0},
+		{Name: "ens3", IP: net.ParseIP("10.0.0.2"), HardwareAddr: mac0},
+		{Name: "ens4", IP: net.ParseIP("10.1.0.3"), HardwareAddr: mac1},
+		newInterfaceIP(lo, "127.0.0.1"),
+	}
+	testIPSpec(t, iips, "10.0.0.2", "mac:02:42:ac:11:00:02")
+	testIPSpec(t, iips, "10.0.0.2", "mac:02:42:AC:11:00:02")
+	testIPSpec(t, iips, "10.1.0.3", "mac:02-42-ac-11-00-03")
+	testIPSpec(t, iips, "", "mac:02:42:ac:11:00:04")
+}
+
+func TestFindIPWithIPv6Specs(t *testing.T) {
+	linkLocal := newInterfaceIP("eth0", "fe80::1")
+	linkLocal.Zone = "eth0"
+	mapped := interfaceIP{Name: "eth1", IP: net.ParseIP("::ffff:10.1.0.1")}
+	iips := []interfaceIP{
+		newInterfaceIP("eth0", "10.0.0.1"),
+		newInterfaceIP("eth0", "2001:db8::1"),
+		linkLocal,
+		mapped,
+		newInterfaceIP("eth1", "10.1.0.2"),
+		newInterfaceIP("eth1", "fd00::1"),
+		newInterfaceIP("eth2", "fe80::2"),
+	}
+	sort.Stable(ByInterfaceThenIP(iips))
+
+	testCases := []struct {
+		specs    []string
+		expected string
+	}{
+		{[]string{"inet"}, "10.0.0.1"},
+		{[]string{"inet6"}, "2001:db8::1"},
+		{[]string{"eth0:inet6"}, "2001:db8::1"},
+		{[]string{"eth2:inet6"}, ""},
+		{[]string{"eth1"}, "10.1.0.1"},
+		{[]string{"eth1:inet6"}, "fd00::1"},
+		{[]string{"eth0[-1]"}, "fe80::1%eth0"},
+		{[]string{"fe80::/10"}, "fe80::1%eth0"},
+		{[]string{"10.1.0.0/16"}, "10.1.0.1"},
+	}
+	for _, tc := range testCases {
+		testIPSpec(t, iips, tc.expected, tc.specs...)
+	}
+
+	// IPv4-mapped IPv6 addresses sort and match as IPv4
+	assert.Equal(t, "eth1:10.1.0.1", iips[3].String())
+	assert.Equal(t, "eth1:10.1.0.2", iips[4].String())
+}
+
+func TestParseInterfaceAddr(t *testing.T) {
+	testCases := []struct {
+		addr  net.Addr
+		ips   []string
+		zones []string
+	}{
+		{&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			[]string{"10.0.0.1"}, []string{""}},
+		{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+			[]string{"fe80::1"}, []string{"eth0"}},
+		{MockAddr{StringAttr: "192.168.100.1/24 2001:DB8::/48"},
+			[]string{"192.168.100.1", "2001:db8::"}, []string{"", ""}},
+		{MockAddr{StringAttr: "fe80::1%eth1/64"},
+			[]string{"fe80::1"}, []string{"eth1"}},
+	}
+	for _, tc := range testCases {
+		ips, zones, err := parseInterfaceAddr(tc.addr)
+		assert.Nil(t, err)
+		got := []string{}
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		assert.Equal(t, tc.ips, got, "IPs for %s", tc.addr)
+		assert.Equal(t, tc.zones, zones, "zones for %s", tc.addr)
+	}
+	_, _, err := parseInterfaceAddr(MockAddr{StringAttr: "nope"})
+	assert.Error(t, err)
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for ip, expected := range map[string]bool{
+		"10.1.2.3":       true,
+		"172.16.0.1":     true,
+		"172.31.255.255": true,
+		"172.32.0.1":     false,
+		"192.168.1.100":  true,
+		"fd12:3456::1":   true,
+		"fc00::1":        true,
+		"8.8.8.8":        false,
+		"127.0.0.1":      false,
+		"169.254.1.1":    false,
+		"fe80::1":        false,
+		"::1":            false,
+		"2001:db8::1":    false,
+	} {
+		assert.Equal(t, expected, isPrivateIP(net.ParseIP(ip)), "isPrivateIP(%s)", ip)
+	}
+	for ip, expected := range map[string]bool{
+		"8.8.8.8":     true,
+		"2001:db8::1": true,
+		"10.1.2.3":    false,
+		"127.0.0.1":   false,
+		"169.254.1.1": false,
+		"fe80::1":     false,
+		"fd00::1":     false,
+	} {
+		assert.Equal(t, expected, isPublicIP(net.ParseIP(ip)), "isPublicIP(%s)", ip)
+	}
+}
+
+func TestFindIPsWithSpecs(t *testing.T) {
+	iips := getTestIPs()
+	testIPs := func(expected []string, specList ...string) {
+		specs, err := parseInterfaceSpecs(specList)
+		if err != nil {
+			t.Fatalf("Fatal parse error of spec list: %s, %s", specList, err)
+		}
+		ips, err := findIPsWithSpecs(specs, iips, SelectFirst)
+		if expected == nil {
+			assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch for %v", specList)
+			return
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ips, "IPs for %v", specList)
+	}
+	testIPs([]string{"10.2.0.1", "192.168.1.100"}, "eth0")
+	testIPs([]string{"10.0.0.100", "10.0.0.200", "10.2.0.1", "10.1.0.200", "192.168.1.100"},
+		"eth1", "10.0.0.0/8", "eth0[1]")
+	testIPs([]string{"10.2.0.1", "192.168.1.100", "10.1.0.200"},
+		"!eth1", "inet")
+	testIPs(nil, "eth3")
+}
+
+func TestFindIPsWithSelection(t *testing.T) {
+	iips := []interfaceIP{
+		newInterfaceIP("eth0", "10.0.0.9"),
+		newInterfaceIP("eth0", "10.0.0.10"),
+		newInterfaceIP("eth0", "::ffff:10.0.0.11"),
+		newInterfaceIP("eth0", "fd00::1"),
+		newInterfaceIP("eth1", "10.1.0.1"),
+		newInterfaceIP("eth1", "10.1.0.2"),
+	}
+	sort.Sort(ByInterfaceThenIP(iips))
+	testIPs := func(selection IPSelection, expected []string, specList ...string) {
+		specs, err := parseInterfaceSpecs(specList)
+		if err != nil {
+			t.Fatalf("Fatal parse error of spec list: %s, %s", specList, err)
+		}
+		ips, err := findIPsWithSpecs(specs, iips, selection)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ips, "IPs for %v", specList)
+	}
+	testIPs(SelectFirst, []string{"10.0.0.9", "10.0.0.10", "10.0.0.11"}, "eth0:inet")
+	testIPs(SelectLast, []string{"10.0.0.11", "10.0.0.10", "10.0.0.9"}, "eth0:inet")
+	testIPs(SelectLowest, []string{"10.0.0.9", "10.0.0.10", "10.0.0.11"}, "eth0:inet")
+	testIPs(SelectHighest, []string{"10.0.0.11", "10.0.0.10", "10.0.0.9"}, "eth0:inet")
+
+	// the interfaces keep their order, and only the IPs on each one move
+	testIPs(SelectLast,
+		[]string{"10.0.0.11", "10.0.0.10", "10.0.0.9", "10.1.0.2", "10.1.0.1"},
+		"10.0.0.0/8")
+
+	testIPs(SelectHighest, []string{"fd00::1"}, "eth0:inet6")
+
+	// an index picks by position regardless of the selection
+	testIPs(SelectHighest, []string{"10.0.0.9"}, "eth0[0]")
+}
+
+func TestCompareIPs(t *testing.T) {
+	assert.Equal(t, -1, compareIPs("10.0.0.9", "10.0.0.10"))
+	assert.Equal(t, 0, compareIPs("10.0.0.9", "::ffff:10.0.0.9"))
+	assert.Equal(t, -1, compareIPs("127.0.0.1", "::1"),
+		"expected IPv4 to be lower than IPv6")
+	assert.Equal(t, 1, compareIPs("fe80::2%eth0", "fe80::1%eth1"),
+		"expected the zone to be ignored")
+}
+
+func TestParseIPSelection(t *testing.T) {
+	for config, expected := range map[string]IPSelection{
+		"": SelectFirst, "first": SelectFirst, "last": SelectLast,
+		"lowest": SelectLowest, "highest": SelectHighest,
+	} {
+		selection, err := ParseIPSelection(config)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, selection, "ParseIPSelection(%q)", config)
+	}
+	_, err := ParseIPSelection("random")
+	assert.EqualError(t, err, "invalid interface selection 'random': must be "+
+		"one of 'first', 'last', 'lowest', or 'highest'")
+}
+
+func TestGetIPs(t *testing.T) {
+	ips, err := GetIPs([]string{lo, "127.0.0.0/8", "198.51.100.0/24"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, ips, "expected deduplicated IPs")
+
+	ips, err = GetIPs([]string{lo, lo6})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1", "::1"}, ips, "expected IPs in spec order")
+
+	ip, err := GetIP([]string{lo6, lo})
+	assert.Nil(t, err)
+	assert.Equal(t, "::1", ip, "expected GetIP to return the first of GetIPs")
+
+	_, err = GetIPs([]string{"198.51.100.0/24"})
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+}
+
+func TestGetIPWithRetry(t *testing.T) {
+	start := time.Now()
+	_, err := GetIPWithRetry([]string{"198.51.100.0/24"}, 0, time.Millisecond)
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+	assert.True(t, time.Since(start) < 50*time.Millisecond,
+		"expected zero timeout to try only once")
+
+	start = time.Now()
+	_, err = GetIPWithRetry([]string{"198.51.100.0/24"},
+		200*time.Millisecond, 50*time.Millisecond)
+	elapsed := time.Since(start)
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < time.Second,
+		"expected retries until timeout but took %v", elapsed)
+
+	start = time.Now()
+	_, err = GetIPWithRetry([]string{"eth0[x]"}, time.Second, 50*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected ErrSpecParse, got %v", err)
+	assert.True(t, time.Since(start) < 50*time.Millisecond,
+		"expected no retries for an invalid spec")
+
+	start = time.Now()
+	ip, err := GetIPWithRetry([]string{lo}, time.Second, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+	assert.True(t, time.Since(start) < 50*time.Millisecond,
+		"expected first success to return promptly")
+}
+
+func TestFindIPInNetworks(t *testing.T) {
+	iips := getTestIPs()
+	testPreferred := func(expectedIP, expectedNetwork string, networks ...string) {
+		preferred, err := parsePreferredNetworks(networks)
+		if err != nil {
+			t.Fatalf("Fatal parse error of preferred networks: %s, %s", networks, err)
+		}
+		foundIP, foundNetwork := "", ""
+		if ips, network := findIPsInNetworks(preferred, iips); len(ips) > 0 {
+			foundIP, foundNetwork = ips[0], network.String()
+		}
+		if foundIP != expectedIP || foundNetwork != expectedNetwork {
+			t.Errorf("Expected to find IP %q in %q but found %q in %q instead",
+				expectedIP, expectedNetwork, foundIP, foundNetwork)
+		}
+	}
+	testPreferred("10.1.0.200", "10.1.0.0/16", "10.1.0.0/16", "10.0.0.0/8")
+	testPreferred("10.2.0.1", "10.0.0.0/8", "10.0.0.0/8", "10.1.0.0/16")
+	testPreferred("10.0.0.100", "10.0.0.0/16", "172.16.0.0/12", "10.0.0.0/16")
+	testPreferred("", "", "172.16.0.0/12")
+	testPreferred("", "")
+
+	preferred, _ := parsePreferredNetworks([]string{"10.1.0.0/16", "10.0.0.0/8"})
+	ips, _ := findIPsInNetworks(preferred, iips)
+	assert.Equal(t, []string{"10.1.0.200", "10.2.0.1", "10.0.0.100", "10.0.0.200"}, ips)
+
+	if _, err := parsePreferredNetworks([]string{"10.0.0.0"}); err == nil {
+		t.Errorf("Expected error parsing preferred network without a mask")
+	}
+}
+
+func TestGetIPWithOptions(t *testing.T) {
+	ip, _ := GetIPWithOptions([]string{"inet"},
+		IPOptions{PreferredNetworks: []string{"127.0.0.0/8"}})
+	assert.Equal(t, ip, "127.0.0.1", "expected preferred network to win over spec")
+
+	ip, _ = GetIPWithOptions([]string{lo},
+		IPOptions{PreferredNetworks: []string{"198.51.100.0/24"}})
+	assert.Equal(t, ip, "127.0.0.1", "expected fallback to spec list")
+
+	_, err := GetIPWithOptions([]string{lo},
+		IPOptions{PreferredNetworks: []string{"nope"}})
+	assert.Error(t, err, "expected error for unparseable preferred network")
+}
+
+func TestSpecParseError(t *testing.T) {
+	_, err := parseInterfaceSpecs([]string{"eth0", "eth0[x]", "mac:nope"})
+	assert.EqualError(t, err, "invalid interface specification:\n"+
+		"Unable to parse interface spec: eth0[x]\n"+
+		"Unable to parse MAC address in mac:nope")
+	var parseErr *SpecParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected SpecParseError, got %v", err)
+	}
+	assert.Equal(t, "eth0[x]", parseErr.Spec, "expected the first bad spec")
+	assert.True(t, errors.Is(parseErr, ErrSpecParse))
+
+	_, err = GetIP([]string{"!static:10.0.0.1"})
+	assert.True(t, errors.As(err, &parseErr), "expected SpecParseError, got %v", err)
+	assert.Equal(t, "!static:10.0.0.1", parseErr.Spec)
+	assert.EqualError(t, parseErr, "Unable to negate interface spec: !static:10.0.0.1")
+}
+
+func TestGetIPErrors(t *testing.T) {
+	_, err := GetIP([]string{"eth0[x]"})
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected ErrSpecParse, got %v", err)
+
+	_, err = GetIPWithOptions([]string{lo},
+		IPOptions{PreferredNetworks: []string{"nope"}})
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected ErrSpecParse, got %v", err)
+
+	var parseErr *SpecParseError
+	assert.True(t, errors.As(err, &parseErr), "expected SpecParseError, got %v", err)
+	assert.Equal(t, "nope", parseErr.Spec)
+
+	_, err = GetIP([]string{"198.51.100.0/24"})
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+	assert.False(t, errors.Is(err, ErrSpecParse), "unexpected ErrSpecParse")
+	assert.False(t, errors.Is(err, ErrInterfaceDown), "unexpected ErrInterfaceDown")
+}
+
+func TestFindDownInterface(t *testing.T) {
+	interfaces := []net.Interface{
+		{Name: "eth0", Flags: net.FlagUp},
+		{Name: "eth1"},
+	}
+	testDown := func(expected string, specList ...string) {
+		specs, err := parseInterfaceSpecs(specList)
+		if err != nil {
+			t.Fatalf("Fatal parse error of spec list: %s, %s", specList, err)
+		}
+		name, _ := findDownInterface(specs, interfaces)
+		assert.Equal(t, expected, name, "down interface for %v", specList)
+	}
+	testDown("", "eth0", "inet", "10.0.0.0/8", "static:192.168.1.100")
+	testDown("", "eth2:inet")
+	testDown("eth1", "eth0", "eth1[1]")
+	testDown("eth1", "eth1:inet6")
+}
+
+func TestFindOverlappingSpecs(t *testing.T) {
+	iips := getTestIPs()
+	testOverlap := func(expected int, specList ...string) {
+		specs, err := parseInterfaceSpecs(specList)
+		if err != nil {
+			t.Fatalf("Fatal parse error of spec list: %s, %s", specList, err)
+		}
+		if overlaps := findOverlappingSpecs(specs, iips); len(overlaps) != expected {
+			t.Errorf("Expected %d overlaps for %s but got: %v", expected, specList, overlaps)
+		}
+	}
+	testOverlap(0, "eth0", "eth1", "eth2:inet6")
+	testOverlap(1, "eth0:inet", "10.0.0.0/8")
+	testOverlap(1, "eth1[1]", "10.0.0.0/16")
+	testOverlap(0, "eth1[0]", "10.1.0.0/16")
+	testOverlap(1, "static:192.168.1.100", "eth0[1]")
+	testOverlap(3, "eth0", "inet", "10.0.0.0/8")
+	testOverlap(0, "!eth0", "eth0")
+}
+
+func TestCheckOverlappingSpecs(t *testing.T) {
+	err := CheckOverlappingSpecs([]string{lo, "127.0.0.0/8"},
+		IPOptions{Overlap: OverlapError})
+	assert.Error(t, err, "expected error for overlapping specs")
+	assert.Nil(t, CheckOverlappingSpecs([]string{lo, "127.0.0.0/8"},
+		IPOptions{Overlap: OverlapWarn}), "expected overlap warning only")
+	assert.Nil(t, CheckOverlappingSpecs(nil, IPOptions{Overlap: OverlapError}),
+		"expected the default specs not to be checked")
+
+	// the lookup itself doesn't check for overlaps
+	ip, err := GetIPWithOptions([]string{lo, "127.0.0.0/8"},
+		IPOptions{Overlap: OverlapError})
+	if err != nil || ip != "127.0.0.1" {
+		t.Errorf("Expected IP from overlapping specs but got %q, %v", ip, err)
+	}
+
+	for policy, expected := range map[string]OverlapPolicy{
+		"": OverlapWarn, "warn": OverlapWarn,
+		"ignore": OverlapIgnore, "error": OverlapError,
+	} {
+		if got, err := ParseOverlapPolicy(policy); err != nil || got != expected {
+			t.Errorf("Expected policy %q to parse as %v but got %v (%v)",
+				policy, expected, got, err)
+		}
+	}
+	_, err = ParseOverlapPolicy("fail")
+	assert.Error(t, err, "expected error for invalid policy")
+}
+
 func testIPSpec(t *testing.T, iips []interfaceIP, expectedIP string, specList ...string) {
 	specs, err := parseInterfaceSpecs(specList)
 	if err != nil {
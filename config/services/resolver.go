@@ -0,0 +1,149 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultResolveFailureLimit is the number of times in a row that an
+// IPResolver can fail to re-resolve its IP before Refresh returns an error
+const DefaultResolveFailureLimit = 3
+
+// IPResolver resolves the IP of the container once at startup and again
+// each time it's refreshed, keeping the last IP that resolved. A network
+// that's being reconfigured can have no interfaces for a moment, so a
+// refresh that fails only returns an error after failureLimit failures in
+// a row, and the last IP is used until then.
+type IPResolver struct {
+	specList     []string
+	opts         IPOptions
+	failureLimit int
+	dualStack    bool
+
+	lock     sync.Mutex
+	lastIP   string
+	lastIPv6 string
+	failures int
+}
+
+// NewIPResolver creates an IPResolver for the specList and opts, as for
+// GetIPWithOptions. A failureLimit of 0 uses DefaultResolveFailureLimit.
+func NewIPResolver(specList []string, opts IPOptions, failureLimit int) *IPResolver {
+	if failureLimit <= 0 {
+		failureLimit = DefaultResolveFailureLimit
+	}
+	return &IPResolver{specList: specList, opts: opts, failureLimit: failureLimit}
+}
+
+// NewDualStackIPResolver creates an IPResolver like NewIPResolver that
+// resolves both an IPv4 and an IPv6 address from everything the specList
+// matches. The IPv4 address is the IP, and the IPv6 address is returned
+// by IPv6. If only one family matches then that address is the IP and
+// the missing family is logged rather than being an error.
+func NewDualStackIPResolver(specList []string, opts IPOptions, failureLimit int) *IPResolver {
+	r := NewIPResolver(specList, opts, failureLimit)
+	r.dualStack = true
+	return r
+}
+
+// IPv6 returns the IPv6 address of a dual-stack IPResolver that resolved
+// both families as of the last Resolve or Refresh, or an empty string
+func (r *IPResolver) IPv6() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastIPv6
+}
+
+// resolve returns the IP and, for a dual-stack IPResolver, the IPv6
+// address to advertise along with it
+func (r *IPResolver) resolve(opts IPOptions) (string, string, error) {
+	if !r.dualStack {
+		ip, err := GetIPWithOptions(r.specList, opts)
+		return ip, "", err
+	}
+	ips, err := GetIPsWithOptions(r.specList, opts)
+	if err != nil {
+		return "", "", err
+	}
+	ipv4, ipv6 := SplitIPFamilies(ips)
+	switch {
+	case ipv4 == "":
+		log.WithField("ip", ipv6).Warnf(
+			"no IPv4 address found for dual-stack service, using only %s", ipv6)
+		return ipv6, "", nil
+	case ipv6 == "":
+		log.WithField("ip", ipv4).Warnf(
+			"no IPv6 address found for dual-stack service, using only %s", ipv4)
+	}
+	return ipv4, ipv6, nil
+}
+
+// SplitIPFamilies returns the first IPv4 and the first IPv6 address in
+// the ips, as returned by GetIPs. Either is empty if the ips don't have
+// an address of that family.
+func SplitIPFamilies(ips []string) (ipv4, ipv6 string) {
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		switch {
+		case parsed == nil:
+			continue
+		case parsed.To4() != nil && ipv4 == "":
+			ipv4 = ip
+		case parsed.To4() == nil && ipv6 == "":
+			ipv6 = ip
+		}
+	}
+	return ipv4, ipv6
+}
+
+// Resolve determines the IP of the container, retrying as configured in
+// the opts. Any error is returned as is, because we have no IP to fall
+// back to yet.
+func (r *IPResolver) Resolve() (string, error) {
+	ip, ipv6, err := r.resolve(r.opts)
+	if err != nil {
+		return "", err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastIP = ip
+	r.lastIPv6 = ipv6
+	r.failures = 0
+	return ip, nil
+}
+
+// Refresh determines the IP of the container again without retrying. If
+// that fails it returns the last IP that resolved, along with an error
+// once it has failed failureLimit times in a row.
+func (r *IPResolver) Refresh() (string, error) {
+	opts := r.opts
+	opts.RetryTimeout = 0
+	ip, ipv6, err := r.resolve(opts)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.failures++
+		if r.failures >= r.failureLimit {
+			return r.lastIP, fmt.Errorf(
+				"unable to resolve IP %d times in a row: %w", r.failures, err)
+		}
+		log.WithFields(log.Fields{"ip": r.lastIP, "failures": r.failures, "error": err}).
+			Warnf("unable to resolve IP, keeping %s: %v", r.lastIP, err)
+		return r.lastIP, nil
+	}
+	if r.failures > 0 {
+		log.Infof("resolved IP %s after %d failures", ip, r.failures)
+	}
+	r.failures = 0
+	if ip != r.lastIP && r.lastIP != "" {
+		log.WithFields(log.Fields{"ip": ip, "previous": r.lastIP}).
+			Infof("IP changed from %s to %s", r.lastIP, ip)
+	}
+	r.lastIP = ip
+	r.lastIPv6 = ipv6
+	return ip, nil
+}
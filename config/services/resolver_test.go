@@ -0,0 +1,96 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A refresh that finds no interfaces should keep the last IP until it
+// has failed failureLimit times in a row
+func TestIPResolverRefresh(t *testing.T) {
+	vanished := false
+	netInterfaces = func() ([]net.Interface, error) {
+		if vanished {
+			return []net.Interface{}, nil
+		}
+		return net.Interfaces()
+	}
+	defer func() { netInterfaces = net.Interfaces }()
+
+	resolver := NewIPResolver([]string{lo}, IPOptions{Overlap: OverlapIgnore}, 2)
+	ip, err := resolver.Resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	vanished = true
+	ip, err = resolver.Refresh()
+	assert.Nil(t, err, "expected the first failure to be tolerated")
+	assert.Equal(t, "127.0.0.1", ip, "expected the last IP to be kept")
+
+	ip, err = resolver.Refresh()
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+	assert.Equal(t, "127.0.0.1", ip, "expected the last IP along with the error")
+
+	vanished = false
+	ip, err = resolver.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	// the failures were reset by the last refresh
+	vanished = true
+	_, err = resolver.Refresh()
+	assert.Nil(t, err)
+}
+
+// The first resolution has no IP to fall back to, so it always fails
+func TestIPResolverResolve(t *testing.T) {
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{}, nil
+	}
+	defer func() { netInterfaces = net.Interfaces }()
+
+	resolver := NewIPResolver([]string{lo}, IPOptions{}, 0)
+	assert.Equal(t, DefaultResolveFailureLimit, resolver.failureLimit)
+	_, err := resolver.Resolve()
+	assert.True(t, errors.Is(err, ErrNoMatch), "expected ErrNoMatch, got %v", err)
+}
+
+// A dual-stack resolver advertises the first IP of each family, and only
+// the family that's there if the other is missing
+func TestDualStackIPResolver(t *testing.T) {
+	opts := IPOptions{Overlap: OverlapIgnore}
+	resolver := NewDualStackIPResolver(
+		[]string{"static:fd00::5", "static:10.0.0.5", "static:10.0.0.6"}, opts, 0)
+	ip, err := resolver.Resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.5", ip)
+	assert.Equal(t, "fd00::5", resolver.IPv6())
+
+	resolver = NewDualStackIPResolver([]string{"static:fd00::5"}, opts, 0)
+	ip, err = resolver.Resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00::5", ip, "expected only the IPv6 address")
+	assert.Equal(t, "", resolver.IPv6())
+
+	resolver = NewDualStackIPResolver([]string{"static:10.0.0.5"}, opts, 0)
+	ip, err = resolver.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.5", ip, "expected only the IPv4 address")
+	assert.Equal(t, "", resolver.IPv6())
+
+	resolver = NewIPResolver([]string{"static:10.0.0.5", "static:fd00::5"}, opts, 0)
+	resolver.Resolve()
+	assert.Equal(t, "", resolver.IPv6(), "expected no IPv6 unless dual-stack")
+}
+
+func TestSplitIPFamilies(t *testing.T) {
+	ipv4, ipv6 := SplitIPFamilies([]string{"fd00::5", "10.0.0.5", "fd00::6", "10.0.0.6"})
+	assert.Equal(t, "10.0.0.5", ipv4)
+	assert.Equal(t, "fd00::5", ipv6)
+	ipv4, ipv6 = SplitIPFamilies([]string{"10.0.0.5"})
+	assert.Equal(t, "10.0.0.5", ipv4)
+	assert.Equal(t, "", ipv6)
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultWatchIPSettle is how long a new IP has to stay selected before
+// WatchIP reports it, so that an interface flapping during a DHCP renew
+// doesn't send every intermediate address
+const defaultWatchIPSettle = 5 * time.Second
+
+// WatchIP resolves the IP of the container from the specList every
+// interval, like GetIP, and sends it on the returned channel whenever it
+// changes. The first IP is sent as soon as it's found, and a new IP is
+// only sent once it has been selected for the settle period (or for one
+// interval, if that's longer). Resolution errors are sent on the error
+// channel, dropping any the caller hasn't received yet; an invalid spec
+// can never resolve, so its error stops the watch. Both channels are
+// closed when the watch stops or the ctx is cancelled.
+func WatchIP(ctx context.Context, specList []string, interval time.Duration) (<-chan string, <-chan error) {
+	return watchIP(ctx, interval, defaultWatchIPSettle, func() (string, error) {
+		return GetIP(specList)
+	})
+}
+
+func watchIP(ctx context.Context, interval, settle time.Duration,
+	resolve func() (string, error)) (<-chan string, <-chan error) {
+	if interval <= 0 {
+		interval = defaultIPRetryInterval
+	}
+	ips := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(ips)
+		defer close(errs)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var current, candidate string
+		var candidateSince time.Time
+		for {
+			ip, err := resolve()
+			switch {
+			case errors.Is(err, ErrSpecParse):
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+				}
+				return
+			case err != nil:
+				// an IP that's interrupted by an error hasn't settled
+				candidate = ""
+				select {
+				case errs <- err:
+				default:
+				}
+			case ip == current:
+				candidate = ""
+			case current != "" && ip != candidate:
+				candidate, candidateSince = ip, time.Now()
+			case current == "" || time.Since(candidateSince) >= settle:
+				select {
+				case ips <- ip:
+				case <-ctx.Done():
+					return
+				}
+				current, candidate = ip, ""
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ips, errs
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver returns each of its results in turn, and then the last
+// result forever
+type fakeResolver struct {
+	lock    sync.Mutex
+	results []fakeResult
+}
+
+type fakeResult struct {
+	ip  string
+	err error
+}
+
+func (r *fakeResolver) resolve() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := r.results[0]
+	if len(r.results) > 1 {
+		r.results = r.results[1:]
+	}
+	return result.ip, result.err
+}
+
+func (r *fakeResolver) set(results ...fakeResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results = results
+}
+
+func receiveIP(t *testing.T, ips <-chan string) string {
+	select {
+	case ip := <-ips:
+		return ip
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an IP")
+	}
+	return ""
+}
+
+func TestWatchIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	resolver := &fakeResolver{results: []fakeResult{{ip: "10.0.0.1"}}}
+	ips, errs := watchIP(ctx, 5*time.Millisecond, 50*time.Millisecond, resolver.resolve)
+	assert.Equal(t, "10.0.0.1", receiveIP(t, ips), "expected the first IP at once")
+
+	// a brief flap to another IP and an error isn't reported
+	resolver.set(fakeResult{ip: "10.0.0.2"}, fakeResult{err: ErrNoMatch},
+		fakeResult{ip: "10.0.0.1"})
+	select {
+	case ip := <-ips:
+		t.Fatalf("expected no IP during a flap, got %s", ip)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.True(t, errors.Is(<-errs, ErrNoMatch))
+
+	start := time.Now()
+	resolver.set(fakeResult{ip: "10.0.0.3"})
+	assert.Equal(t, "10.0.0.3", receiveIP(t, ips))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond,
+		"expected the new IP only after it settled")
+
+	cancel()
+	_, ok := receiveIPOrClosed(ips)
+	assert.False(t, ok, "expected the IP channel to be closed")
+	_, ok = <-errs
+	assert.False(t, ok, "expected the error channel to be closed")
+}
+
+func TestWatchIPInvalidSpec(t *testing.T) {
+	ips, errs := WatchIP(context.Background(), []string{"eth0[x]"}, time.Millisecond)
+	err := <-errs
+	assert.True(t, errors.Is(err, ErrSpecParse), "expected ErrSpecParse, got %v", err)
+	_, ok := receiveIPOrClosed(ips)
+	assert.False(t, ok, "expected an invalid spec to stop the watch")
+}
+
+func receiveIPOrClosed(ips <-chan string) (string, bool) {
+	select {
+	case ip, ok := <-ips:
+		return ip, ok
+	case <-time.After(time.Second):
+		return "", true
+	}
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/jobs"
+)
+
+// The actions that ContainerPilot can take when it receives a signal
+const (
+	SignalStop        = "stop"
+	SignalReload      = "reload"
+	SignalMaintenance = "maintenance"
+	SignalForward     = "forward"
+	SignalIgnore      = "ignore"
+)
+
+// SignalConfig is the action to take on a signal. The 'forward' action
+// sends the signal on to the processes of the named Jobs, or to the
+// processes of every Job if there are no Jobs.
+type SignalConfig struct {
+	Action string   `mapstructure:"action"`
+	Jobs   []string `mapstructure:"jobs"`
+}
+
+// the signals that can be configured; SIGKILL and SIGSTOP can't be
+// caught, and SIGCHLD is how we reap child processes
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGPIPE":  syscall.SIGPIPE,
+	"SIGALRM":  syscall.SIGALRM,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGTTIN":  syscall.SIGTTIN,
+	"SIGTTOU":  syscall.SIGTTOU,
+}
+
+// HandledSignals returns every signal that can be configured, in a fixed
+// order. The supervisor only forwards these signals to the worker, and the
+// worker catches all of them so that a signal without an action is dropped
+// rather than stopping the worker.
+func HandledSignals() []syscall.Signal {
+	signals := make([]syscall.Signal, 0, len(signalNames))
+	for _, sig := range signalNames {
+		signals = append(signals, sig)
+	}
+	sort.Slice(signals, func(i, j int) bool { return signals[i] < signals[j] })
+	return signals
+}
+
+// DefaultSignals returns the actions for the signals that ContainerPilot
+// handles when the config doesn't say otherwise
+func DefaultSignals() map[syscall.Signal]*SignalConfig {
+	return map[syscall.Signal]*SignalConfig{
+		syscall.SIGTERM: {Action: SignalStop},
+		syscall.SIGINT:  {Action: SignalStop},
+		syscall.SIGHUP:  {Action: SignalReload},
+		syscall.SIGUSR1: {Action: SignalMaintenance},
+	}
+}
+
+// newSignals parses the 'signals' config on top of the DefaultSignals.
+// Each key is the name of a signal, with or without the 'SIG' prefix, and
+// each value is either the name of an action or a SignalConfig.
+func newSignals(raw interface{}, jobConfigs []*jobs.Config) (map[syscall.Signal]*SignalConfig, error) {
+	signals := DefaultSignals()
+	if raw == nil {
+		return signals, nil
+	}
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("signals must be a map of signal names to actions")
+	}
+	jobNames := map[string]bool{}
+	for _, job := range jobConfigs {
+		jobNames[job.Name] = true
+	}
+	// sorted so that we always report the same error first
+	keys := make([]string, 0, len(rawMap))
+	for key := range rawMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToUpper(key)
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		sig, ok := signalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("signals.%s is not a signal that can be handled", key)
+		}
+		cfg := &SignalConfig{}
+		if action, ok := rawMap[key].(string); ok {
+			cfg.Action = action
+		} else if err := decode.ToStruct(rawMap[key], cfg); err != nil {
+			return nil, fmt.Errorf("signals.%s configuration error: %v", name, err)
+		}
+		switch cfg.Action {
+		case SignalStop, SignalReload, SignalMaintenance, SignalForward, SignalIgnore:
+		default:
+			return nil, fmt.Errorf(`signals.%s action '%s' invalid: accepts `+
+				`"stop", "reload", "maintenance", "forward", or "ignore"`,
+				name, cfg.Action)
+		}
+		if len(cfg.Jobs) > 0 && cfg.Action != SignalForward {
+			return nil, fmt.Errorf("signals.%s.jobs can only be used with 'forward'", name)
+		}
+		for _, job := range cfg.Jobs {
+			if !jobNames[job] {
+				return nil, fmt.Errorf("signals.%s.jobs has no job named '%s'", name, job)
+			}
+		}
+		signals[sig] = cfg
+	}
+	return signals, nil
+}
@@ -53,12 +53,22 @@ func parseEnvironment(environ []string) Environment {
 		return env
 	}
 	for _, e := range environ {
-		kv := strings.Split(e, "=")
-		env[kv[0]] = kv[1]
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
 	}
 	return env
 }
 
+// Env makes each environment variable available as .Env.FOO as well as
+// .FOO in templates. Methods take precedence over map keys, so an
+// environment variable that's itself named Env is only available via the
+// env function.
+func (env Environment) Env() Environment {
+	return env
+}
+
 func envFunc(env string) string {
 	return os.Getenv(env)
 }
@@ -115,8 +125,14 @@ func defaultValue(defaultValue, templateValue interface{}) string {
 // NewTemplate creates a Template parsed from the configuration
 // and the current environment variables
 func NewTemplate(config []byte) (*Template, error) {
+	return newTemplate("", string(config))
+}
+
+// newTemplate creates a named Template, so that errors from parsing or
+// executing it say where the template came from
+func newTemplate(name, text string) (*Template, error) {
 	env := parseEnvironment(os.Environ())
-	tmpl, err := template.New("").Funcs(template.FuncMap{
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
 		"default":         defaultValue,
 		"env":             envFunc,
 		"split":           split,
@@ -124,7 +140,7 @@ func NewTemplate(config []byte) (*Template, error) {
 		"replaceAll":      replaceAll,
 		"regexReplaceAll": regexReplaceAll,
 		"loop":            loop,
-	}).Option("missingkey=zero").Parse(string(config))
+	}).Option("missingkey=zero").Parse(text)
 	if err != nil {
 		return nil, err
 	}
@@ -151,3 +167,21 @@ func Apply(config []byte) ([]byte, error) {
 	}
 	return template.Execute()
 }
+
+// ApplyString renders a single templated string, such as one field of
+// the parsed configuration. The name is used in any errors. Strings
+// without any template actions are returned as they are.
+func ApplyString(name, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	template, err := newTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	rendered, err := template.Execute()
+	if err != nil {
+		return "", err
+	}
+	return string(rendered), nil
+}
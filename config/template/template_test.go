@@ -44,6 +44,10 @@ func TestTemplate(t *testing.T) {
 	}
 
 	testTemplate("One var", `Hello, {{.NAME}}!`, "Hello, Template!")
+	testTemplate("Env var", `Hello, {{.Env.NAME}}!`, "Hello, Template!")
+	testTemplate("Env undefined", `Hello, {{.Env.NONAME}}!`, "Hello, !")
+	testTemplate("Env default", `Hello, {{ default "World" .Env.NONAME }}!`,
+		"Hello, World!")
 	testTemplate("Var undefined", `Hello, {{.NONAME}}!`, "Hello, !")
 	testTemplate("Loop double", `{{ loop 2 5 }}`, "[2 3 4]")
 	testTemplate("Loop inverse", `{{ loop 10 1 }}`, "[10 9 8 7 6 5 4 3 2]")
@@ -61,3 +65,20 @@ func TestTemplate(t *testing.T) {
 	testTemplate("Regex Replace All",
 		`Hello, {{.NAME | regexReplaceAll "[epa]+" "_" }}!`, "Hello, T_m_l_t_!")
 }
+
+func TestApplyString(t *testing.T) {
+	os.Setenv("TEST_APPLY_STRING", "a=b")
+	defer os.Unsetenv("TEST_APPLY_STRING")
+
+	rendered, err := ApplyString("field", "no template {here}")
+	assert.Nil(t, err)
+	assert.Equal(t, "no template {here}", rendered)
+
+	rendered, err = ApplyString("field", "value {{ .Env.TEST_APPLY_STRING }}")
+	assert.Nil(t, err)
+	assert.Equal(t, "value a=b", rendered)
+
+	_, err = ApplyString("jobs[0].exec", "{{ nope }}")
+	assert.EqualError(t, err,
+		`template: jobs[0].exec:1: function "nope" not defined`)
+}
@@ -0,0 +1,57 @@
+package timing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2024, time.February, 28, 10, 17, 30, 0, time.UTC)
+	expectNext := func(expr, expected string) {
+		schedule, err := ParseCron(expr)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %v", expr, err)
+		}
+		got := schedule.Next(start)
+		if expected == "" {
+			if !got.IsZero() {
+				t.Errorf("expected '%s' to never run but got %v", expr, got)
+			}
+			return
+		}
+		want, _ := time.Parse(time.RFC3339, expected)
+		if !got.Equal(want) {
+			t.Errorf("expected '%s' to next run at %v but got %v", expr, want, got)
+		}
+	}
+	expectNext("* * * * *", "2024-02-28T10:18:00Z")
+	expectNext("*/15 * * * *", "2024-02-28T10:30:00Z")
+	expectNext("0 3 * * *", "2024-02-29T03:00:00Z")
+	expectNext("5,10 9-11 * * *", "2024-02-28T11:05:00Z")
+	expectNext("0 0 1 * *", "2024-03-01T00:00:00Z")
+	expectNext("0 0 * * mon-fri", "2024-02-29T00:00:00Z")
+	expectNext("0 0 * * 7", "2024-03-03T00:00:00Z")
+	expectNext("0 12 * mar sun", "2024-03-03T12:00:00Z")
+	expectNext("0 0 29 2 *", "2024-02-29T00:00:00Z")
+	// with both days restricted, either one matches
+	expectNext("0 0 15 * fri", "2024-03-01T00:00:00Z")
+	expectNext("@hourly", "2024-02-28T11:00:00Z")
+	expectNext("@daily", "2024-02-29T00:00:00Z")
+	expectNext("@yearly", "2025-01-01T00:00:00Z")
+	expectNext("0 0 30 2 *", "")
+}
+
+func TestCronParseErrors(t *testing.T) {
+	expectErr := func(expr, expected string) {
+		_, err := ParseCron(expr)
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error '%s' for '%s' but got %v", expected, expr, err)
+		}
+	}
+	expectErr("* * * *", "expected 5 fields but got 4")
+	expectErr("60 * * * *", "invalid minute '60'")
+	expectErr("* * 0 * *", "invalid day of month '0'")
+	expectErr("* * * foo *", "invalid month 'foo'")
+	expectErr("*/0 * * * *", "invalid step in minute field '*/0'")
+	expectErr("* 10-5 * * *", "invalid range in hour field '10-5'")
+}
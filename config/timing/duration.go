@@ -5,6 +5,7 @@ package timing
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,3 +57,20 @@ func ParseDuration(duration interface{}) (time.Duration, error) {
 		return time.ParseDuration(t)
 	}
 }
+
+// ParseSplay parses a splay that's either a duration in the same formats
+// as GetTimeout, or a percentage of the interval it's added to (ex. "10%")
+func ParseSplay(splayFmt string, interval time.Duration) (time.Duration, error) {
+	if !strings.HasSuffix(splayFmt, "%") {
+		return GetTimeout(splayFmt)
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(splayFmt, "%"), 64)
+	if err != nil {
+		return time.Duration(0), fmt.Errorf("invalid percentage %s", splayFmt)
+	}
+	if percent < 0 || percent > 100 {
+		return time.Duration(0), fmt.Errorf(
+			"percentage %s must be between 0%% and 100%%", splayFmt)
+	}
+	return time.Duration(float64(interval) * percent / 100), nil
+}
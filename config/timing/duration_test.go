@@ -20,7 +20,7 @@ func TestGetTimeout(t *testing.T) {
 
 	dur, err = GetTimeout("x")
 	expectDurationCompare(t, dur, time.Duration(0),
-		err, errors.New("time: invalid duration x"))
+		err, errors.New(`time: invalid duration "x"`))
 
 	dur, err = GetTimeout("0")
 	expectDurationCompare(t, dur, time.Duration(0), err, nil)
@@ -67,12 +67,33 @@ func TestParseDuration(t *testing.T) {
 
 	// Some parse errors
 	expectError(t, "asf", "invalid duration")
-	expectError(t, "20yy", "unknown unit yy")
+	expectError(t, "20yy", `unknown unit "yy"`)
 
 	// Fractional
 	expectError(t, 10.10, "unexpected duration of type float")
 }
 
+func TestParseSplay(t *testing.T) {
+	var (
+		dur time.Duration
+		err error
+	)
+	dur, err = ParseSplay("2s", 10*time.Second)
+	expectDurationCompare(t, dur, 2*time.Second, err, nil)
+	dur, err = ParseSplay("", 10*time.Second)
+	expectDurationCompare(t, dur, time.Duration(0), err, nil)
+	dur, err = ParseSplay("10%", 10*time.Second)
+	expectDurationCompare(t, dur, time.Second, err, nil)
+	dur, err = ParseSplay("12.5%", 10*time.Second)
+	expectDurationCompare(t, dur, 1250*time.Millisecond, err, nil)
+	dur, err = ParseSplay("x%", 10*time.Second)
+	expectDurationCompare(t, dur, time.Duration(0),
+		err, errors.New("invalid percentage x%"))
+	dur, err = ParseSplay("150%", 10*time.Second)
+	expectDurationCompare(t, dur, time.Duration(0),
+		err, errors.New("percentage 150% must be between 0% and 100%"))
+}
+
 func expectDurationCompare(t *testing.T, actual, expected time.Duration,
 	err, expectedErr error) {
 
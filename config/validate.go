@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/joyent/containerpilot/config/services"
+	"github.com/joyent/containerpilot/config/timing"
+	"github.com/joyent/containerpilot/control"
+	"github.com/joyent/containerpilot/discovery"
+	"github.com/joyent/containerpilot/jobs"
+	"github.com/joyent/containerpilot/telemetry"
+	"github.com/joyent/containerpilot/watches"
+)
+
+// ValidationError is returned by ValidateConfig with every problem found
+// in the configuration
+type ValidationError struct {
+	Problems []error
+}
+
+// Error implements the error interface for ValidationError
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = "  - " + problem.Error()
+	}
+	return fmt.Sprintf("configuration has %d problem(s):\n%s",
+		len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// ValidateConfig loads and renders the configuration the same way as
+// LoadConfig and validates each section of it, without starting any
+// jobs, watches, or servers. Rather than stopping at the first problem it
+// returns a ValidationError listing all of them. Jobs whose interfaces
+// don't match an IP on this host are only warned about, because the
+// host running the validation usually isn't the one running the config.
+//
+// With strict set, the validation is meant to run where the config will
+// run (ex. in the container image), so interfaces that don't match an IP
+// are problems, and so are commands whose executables can't be found on
+// the PATH and a discovery backend that can't be reached.
+func ValidateConfig(configFlag string, strict bool) ([]string, error) {
+	configMap, err := loadConfig(configFlag)
+	if err != nil {
+		return nil, err
+	}
+	raw := &rawConfig{}
+	if err = decodeConfig(configMap, raw); err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	var problems []error
+	cfg := &Config{}
+
+	// we validate the jobs without a discovery backend if it's invalid
+	disc, err := raw.newDiscoveryBackend()
+	if err != nil {
+		problems = append(problems, err)
+		disc = nil
+	}
+	if err := raw.logConfig.Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("logging: %v", err))
+	}
+	if _, err := raw.parseStopTimeout(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := timing.GetTimeout(raw.startupTimeout); err != nil {
+		problems = append(problems, fmt.Errorf(
+			"unable to parse startupTimeout '%s': %v", raw.startupTimeout, err))
+	}
+	if _, err := control.NewConfig(raw.control); err != nil {
+		problems = append(problems, fmt.Errorf("unable to parse control: %v", err))
+	}
+
+	for _, rawJob := range raw.jobs {
+		jobConfig, err := jobs.NewConfig(rawJob, disc)
+		if isHostSpecific(err) {
+			if strict {
+				problems = append(problems, fmt.Errorf("unable to parse jobs: %v", err))
+			} else {
+				warnings = append(warnings, err.Error())
+			}
+			// validate everything but the service discovery config
+			jobConfig, err = jobs.NewConfig(rawJob, nil)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("unable to parse jobs: %v", err))
+			continue
+		}
+		cfg.Jobs = append(cfg.Jobs, jobConfig)
+	}
+	if err := jobs.LinkConfigs(cfg.Jobs); err != nil {
+		problems = append(problems, fmt.Errorf("unable to parse jobs: %v", err))
+	}
+	for _, rawWatch := range raw.watches {
+		watchConfigs, err := watches.NewConfigs([]interface{}{rawWatch}, disc)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("unable to parse watches: %v", err))
+			continue
+		}
+		cfg.Watches = append(cfg.Watches, watchConfigs...)
+	}
+	if _, err := telemetry.NewConfig(raw.telemetry, disc); err != nil {
+		if isHostSpecific(err) && !strict {
+			warnings = append(warnings, err.Error())
+		} else {
+			problems = append(problems, err)
+		}
+	}
+	if _, err := newSignals(raw.signals, cfg.Jobs); err != nil {
+		problems = append(problems, fmt.Errorf("unable to parse signals: %v", err))
+	}
+	if len(problems) == 0 {
+		if err := cfg.validateAgentOnly(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if strict {
+		for _, jobConfig := range cfg.Jobs {
+			problems = append(problems, checkExecutables(jobConfig.Executables())...)
+		}
+		if pinger, ok := disc.(discovery.Pinger); ok {
+			if err := pinger.Ping(); err != nil {
+				problems = append(problems, fmt.Errorf(
+					"unable to reach the discovery backend: %v", err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return warnings, &ValidationError{Problems: problems}
+	}
+	return warnings, nil
+}
+
+// checkExecutables returns an error for each executable that can't be
+// found, sorted by the field that configures it
+func checkExecutables(executables map[string]string) []error {
+	fields := make([]string, 0, len(executables))
+	for field := range executables {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var errs []error
+	for _, field := range fields {
+		if _, err := exec.LookPath(executables[field]); err != nil {
+			var execErr *exec.Error
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				err = pathErr.Err
+			} else if errors.As(err, &execErr) {
+				err = execErr.Err
+			}
+			errs = append(errs, fmt.Errorf("%s: unable to find '%s': %v",
+				field, executables[field], err))
+		}
+	}
+	return errs
+}
+
+// isHostSpecific returns true for errors that depend on the interfaces
+// of the host rather than on the configuration itself
+func isHostSpecific(err error) bool {
+	return errors.Is(err, services.ErrNoMatch) ||
+		errors.Is(err, services.ErrNoInterfaces)
+}
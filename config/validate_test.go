@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	warnings, err := ValidateConfig("./testdata/test.json5", false)
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+
+	warnings, err = ValidateConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	jobs: [{name: "app", exec: "/bin/app", port: 80,
+	        interfaces: ["198.51.100.0/24"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`), false)
+	assert.Nil(t, err, "expected interfaces missing on this host to be a warning")
+	assert.Len(t, warnings, 1)
+
+	_, err = ValidateConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	logging: {level: "LOUD"},
+	startupTimeout: "nope",
+	jobs: [
+	  {name: "app", exec: "/bin/app", port: 80, interfaces: ["eth0:inet7"],
+	   health: {exec: "/bin/true", interval: 1, ttl: 5}},
+	  {name: "db", exec: "/bin/db", port: 80, interfaces: ["inet"],
+	   health: {exec: "/bin/true", interval: 1}},
+	  {name: "ok", exec: "/bin/ok"}
+	],
+	watches: [{name: "upstream"}]}`), false)
+	if verr, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected ValidationError but got %v", err)
+	} else {
+		assert.Len(t, verr.Problems, 5, "problems: %v", verr)
+	}
+
+	_, err = ValidateConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	jobs: [
+	  {name: "front", exec: "/bin/front", port: 80, interfaces: ["inet"],
+	   health: {exec: "/bin/check-all", interval: 1, ttl: 5, aggregate: true}},
+	  {name: "api", port: 81, interfaces: ["inet"], health: {from: "front", ttl: 5}},
+	  {name: "web", port: 82, interfaces: ["inet"], health: {from: "nope", ttl: 5}}
+	]}`), false)
+	if verr, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected ValidationError but got %v", err)
+	} else {
+		assert.Len(t, verr.Problems, 1, "problems: %v", verr)
+		assert.Contains(t, verr.Error(), "job[web].health.from 'nope'")
+	}
+
+	_, err = ValidateConfig(writeValidateConfig(t, `{
+	consul: "consul:8500",
+	jobs: [{name: "web", exec: "/bin/web", port: "8O80", interfaces: ["inet"],
+	        health: {exec: "/bin/true", interval: 1, ttl: 5}}]}`), false)
+	if verr, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected ValidationError but got %v", err)
+	} else {
+		assert.Contains(t, verr.Error(), "job[web].port '8O80' is not a number")
+	}
+
+	_, err = ValidateConfig(writeValidateConfig(t, `{nope: true}`), false)
+	assert.Error(t, err, "expected error for unknown keys")
+}
+
+func TestValidateConfigStrict(t *testing.T) {
+	leader := `"10.0.0.2:8300"`
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, leader)
+	}))
+	defer consul.Close()
+	configPath := writeValidateConfig(t, fmt.Sprintf(`{
+	consul: "%s",
+	jobs: [{name: "app", exec: "sh -c true", port: 80, interfaces: ["inet", "lo0"],
+	        health: {exec: "true", interval: 1, ttl: 5}}]}`, consul.URL))
+	warnings, err := ValidateConfig(configPath, true)
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+
+	leader = `""`
+	_, err = ValidateConfig(writeValidateConfig(t, fmt.Sprintf(`{
+	consul: "%s",
+	jobs: [{name: "app", exec: "true", port: 80, interfaces: ["198.51.100.0/24"],
+	        health: {exec: "nope-check", interval: 1, ttl: 5},
+	        onHealthy: {exec: "true"}},
+	       {name: "db", exec: "/bin/nope-db"}]}`, consul.URL)), true)
+	if verr, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected ValidationError but got %v", err)
+	} else {
+		assert.Len(t, verr.Problems, 4, "problems: %v", verr)
+		assert.Contains(t, verr.Error(), "198.51.100.0/24",
+			"expected interfaces missing on this host to be a problem")
+		assert.Contains(t, verr.Error(),
+			"job[db].exec: unable to find '/bin/nope-db': no such file or directory")
+		assert.Contains(t, verr.Error(),
+			"job[app].health.exec: unable to find 'nope-check': executable file not found in $PATH")
+		assert.Contains(t, verr.Error(),
+			"unable to reach the discovery backend: consul: cluster has no leader")
+	}
+}
+
+// writeValidateConfig writes the configuration to a tempfile that's
+// removed when the test completes
+func writeValidateConfig(t *testing.T, text string) string {
+	f, err := ioutil.TempFile("", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
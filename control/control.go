@@ -36,6 +36,7 @@ type HTTPServer struct {
 	http.Server
 	Addr                string
 	events.EventHandler // Event handling
+	jobs                jobLister
 }
 
 // NewHTTPServer initializes a new control server for manipulating
@@ -86,6 +87,7 @@ func (srv *HTTPServer) Start() {
 	router.Handle("/v3/maintenance/disable",
 		PostHandler(endpoints.PostDisableMaintenanceMode))
 	router.HandleFunc("/v3/ping", GetPing)
+	router.HandleFunc("/v3/status", srv.GetStatus)
 
 	srv.Handler = router
 	srv.SetKeepAlivesEnabled(false)
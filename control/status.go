@@ -0,0 +1,89 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joyent/containerpilot/jobs"
+)
+
+// jobLister holds the Jobs that the '/v3/status' endpoint reports on.
+// The Jobs are replaced whenever the configuration is reloaded in place,
+// while the control server keeps running.
+type jobLister struct {
+	lock sync.RWMutex
+	jobs []*jobs.Job
+}
+
+// statusResponse is the body of a '/v3/status' response
+type statusResponse struct {
+	Jobs []*jobStatusResponse
+}
+
+type jobStatusResponse struct {
+	Name    string
+	Status  string
+	Address string `json:",omitempty"`
+	Port    int    `json:",omitempty"`
+
+	LastHealthCheckFailure *healthCheckFailure `json:",omitempty"`
+}
+
+// healthCheckFailure describes the last time a job's health check failed
+type healthCheckFailure struct {
+	Time     time.Time
+	Duration string
+	ExitCode int
+	Signal   string `json:",omitempty"`
+	Error    string
+	Output   string
+}
+
+// MonitorJobs sets the list of Jobs for the '/v3/status' endpoint to
+// report on, replacing any Jobs it was reporting on before
+func (srv *HTTPServer) MonitorJobs(jobList []*jobs.Job) {
+	srv.jobs.lock.Lock()
+	defer srv.jobs.lock.Unlock()
+	srv.jobs.jobs = jobList
+}
+
+// GetStatus reports the current health status of every Job, so that
+// scripts can check on ContainerPilot without the telemetry server
+func (srv *HTTPServer) GetStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		failedStatus := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(failedStatus), failedStatus)
+		collector.WithLabelValues("405", r.URL.Path).Inc()
+		return
+	}
+	srv.jobs.lock.RLock()
+	resp := &statusResponse{Jobs: []*jobStatusResponse{}}
+	for _, job := range srv.jobs.jobs {
+		status := &jobStatusResponse{
+			Name:   job.Name,
+			Status: job.GetStatus().String(),
+		}
+		if job.Service != nil {
+			status.Address = job.Service.IPAddress
+			status.Port = job.Service.Port
+		}
+		if result, ok := job.LastHealthCheckFailure(); ok {
+			status.LastHealthCheckFailure = &healthCheckFailure{
+				Time:     result.Time,
+				Duration: result.Duration.String(),
+				ExitCode: result.ExitCode,
+				Signal:   result.Signal,
+				Error:    result.Error,
+				Output:   result.Output,
+			}
+		}
+		resp.Jobs = append(resp.Jobs, status)
+	}
+	srv.jobs.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	collector.WithLabelValues("200", r.URL.Path).Inc()
+}
@@ -0,0 +1,62 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/jobs"
+	"github.com/joyent/containerpilot/tests"
+	"github.com/joyent/containerpilot/tests/mocks"
+)
+
+func TestGetStatus(t *testing.T) {
+	jobCfgs, err := jobs.NewConfigs(
+		tests.DecodeRawToSlice(
+			`[{name: "myjob1", exec: "sleep 10"},
+             {name: "myjob2", exec: "sleep 10",
+             port: 80, interfaces: ["inet", "lo0"],
+             health: { exec: "true", interval: 1, ttl: 2}}]`),
+		&mocks.NoopDiscoveryBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := SetupHTTPServer(t, `{}`)
+
+	get := func() statusResponse {
+		req := httptest.NewRequest("GET", "/v3/status", nil)
+		w := httptest.NewRecorder()
+		srv.GetStatus(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "expected HTTP 200 OK")
+		var out statusResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	out := get()
+	assert.Equal(t, 0, len(out.Jobs), "expected no jobs before monitoring")
+
+	srv.MonitorJobs(jobs.FromConfigs(jobCfgs))
+	out = get()
+	assert.Equal(t, 2, len(out.Jobs), "unexpected count of jobs")
+	assert.Equal(t, "myjob1", out.Jobs[0].Name)
+	assert.Equal(t, "unknown", out.Jobs[0].Status)
+	assert.Equal(t, 0, out.Jobs[0].Port, "expected no port without a service")
+	assert.Equal(t, "myjob2", out.Jobs[1].Name)
+	assert.Equal(t, 80, out.Jobs[1].Port, "unexpected job port")
+	assert.Nil(t, out.Jobs[1].LastHealthCheckFailure,
+		"expected no health check failure before the check has run")
+
+	req := httptest.NewRequest("POST", "/v3/status", nil)
+	w := httptest.NewRecorder()
+	srv.GetStatus(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode,
+		"expected HTTP 405 Method Not Allowed")
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joyent/containerpilot/config"
+	"github.com/joyent/containerpilot/config/logger"
+	"github.com/joyent/containerpilot/config/services"
 	"github.com/joyent/containerpilot/control"
 	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/events"
@@ -27,10 +31,21 @@ type App struct {
 	Jobs          []*jobs.Job
 	Watches       []*watches.Watch
 	Telemetry     *telemetry.Telemetry
+	EventSink     events.Sink
+	sinkHandler   *events.SinkHandler
 	StopTimeout   int
-	signalLock    *sync.RWMutex
-	ConfigFlag    string
-	Bus           *events.EventBus
+	// StartupTimeout bounds the startup sequence; zero means no limit
+	StartupTimeout time.Duration
+	startedAt      time.Time
+	loadedConfig   *config.Config
+	terminating    bool
+	signalLock     *sync.RWMutex
+	ConfigFlag     string
+	// Signals maps each signal we handle to its action
+	Signals        map[syscall.Signal]*config.SignalConfig
+	signalCh       chan os.Signal
+	ignoredSignals []os.Signal
+	Bus            *events.EventBus
 }
 
 // EmptyApp creates an empty application
@@ -44,10 +59,16 @@ func EmptyApp() *App {
 func NewApp(configFlag string) (*App, error) {
 	os.Setenv("CONTAINERPILOT_PID", fmt.Sprintf("%v", os.Getpid()))
 	a := EmptyApp()
+	a.startedAt = time.Now()
 	cfg, err := config.LoadConfig(configFlag)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.StartupTimeout > 0 && time.Since(a.startedAt) > cfg.StartupTimeout {
+		return nil, fmt.Errorf(
+			"startup timed out after %v while loading configuration",
+			cfg.StartupTimeout)
+	}
 
 	if err := cfg.InitLogging(); err != nil {
 		return nil, err
@@ -60,6 +81,10 @@ func NewApp(configFlag string) (*App, error) {
 		log.Debugf("loaded config: %v", string(configJSON))
 	}
 
+	if cfg.AgentOnly() {
+		log.Info("no job has an exec: running in agent-only mode")
+	}
+
 	cs, err := control.NewHTTPServer(cfg.Control)
 	if err != nil {
 		return nil, err
@@ -67,13 +92,15 @@ func NewApp(configFlag string) (*App, error) {
 	a.ControlServer = cs
 
 	a.StopTimeout = cfg.StopTimeout
+	a.StartupTimeout = cfg.StartupTimeout
+	a.Signals = cfg.Signals
+	a.EventSink = newEventSink(cfg.LogConfig)
 	a.Discovery = cfg.Discovery
 	a.Jobs = jobs.FromConfigs(cfg.Jobs)
 	a.Watches = watches.FromConfigs(cfg.Watches)
 	a.Telemetry = telemetry.NewTelemetry(cfg.Telemetry)
-	a.Telemetry.MonitorJobs(a.Jobs)
-	a.Telemetry.MonitorWatches(a.Watches)
 	a.ConfigFlag = configFlag // stash the old config
+	a.loadedConfig = cfg
 
 	// set an environment variable for each job IP address so that
 	// forked processes have access to this information
@@ -83,10 +110,60 @@ func NewApp(configFlag string) (*App, error) {
 			os.Setenv(envKey, job.Service.IPAddress)
 		}
 	}
+	setIPEnvironment(a.Jobs)
 
 	return a, nil
 }
 
+// newEventSink returns the Sink for the lifecycle event stream, or nil
+// if the event stream hasn't been enabled in the logging config.
+func newEventSink(logConfig *logger.Config) events.Sink {
+	if logConfig == nil {
+		return nil
+	}
+	switch strings.ToLower(logConfig.Events) {
+	case "stdout":
+		return events.NewJSONSink(os.Stdout)
+	case "stderr":
+		return events.NewJSONSink(os.Stderr)
+	}
+	return nil
+}
+
+// eventSinkName returns where the config sends the event stream, so
+// that we can tell whether it has changed on a reload
+func eventSinkName(cfg *config.Config) string {
+	if cfg.LogConfig == nil {
+		return ""
+	}
+	return strings.ToLower(cfg.LogConfig.Events)
+}
+
+// setIPEnvironment sets CONTAINERPILOT_IP (and CONTAINERPILOT_IP6) for
+// every process if all of the services advertise the same IP. Otherwise
+// it's ambiguous, so only the processes of the jobs with a service get
+// them, with the IP of their own service.
+func setIPEnvironment(jobList []*jobs.Job) {
+	os.Unsetenv("CONTAINERPILOT_IP")
+	os.Unsetenv("CONTAINERPILOT_IP6")
+	ip := ""
+	for _, job := range jobList {
+		if job.Service == nil {
+			continue
+		}
+		if ip != "" && job.Service.IPAddress != ip {
+			log.Debugf("services advertise more than one IP, so " +
+				"CONTAINERPILOT_IP is only set for their own jobs")
+			return
+		}
+		ip = job.Service.IPAddress
+	}
+	for _, kv := range jobs.IPEnvironment(ip) {
+		pair := strings.SplitN(kv, "=", 2)
+		os.Setenv(pair[0], pair[1])
+	}
+}
+
 // Normalize the validated service name as an environment variable
 func getEnvVarNameFromService(service string) string {
 	envKey := strings.ToUpper(service)
@@ -97,10 +174,19 @@ func getEnvVarNameFromService(service string) string {
 
 // Run starts the application and blocks until finished
 func (a *App) Run() {
+	var startup *startupMonitor
+	a.handleSignals()
 	for {
+		a.signalLock.Lock()
 		a.Bus = events.NewEventBus()
+		a.signalLock.Unlock()
 		a.ControlServer.Run(a.Bus)
-		a.handleSignals()
+		// the startup timeout only applies to the first run, not reloads
+		if startup == nil && a.StartupTimeout > 0 {
+			startup = newStartupMonitor(a.StartupTimeout, a.startedAt,
+				a.Jobs, a.Watches)
+			startup.Run(a.Bus)
+		}
 		a.handlePolling()
 		if !a.Bus.Wait() {
 			if a.StopTimeout > 0 {
@@ -112,6 +198,14 @@ func (a *App) Run() {
 				log.Infof("killing processes for job %#v", job.Name)
 				job.Kill()
 			}
+			if startup != nil && startup.TimedOut() {
+				log.Fatalf("startup did not complete within %v", a.StartupTimeout)
+			}
+			for _, job := range a.Jobs {
+				if job.CriticalFailure() {
+					log.Fatalf("critical job %s failed", job.Name)
+				}
+			}
 			break
 		}
 		if err := a.reload(); err != nil {
@@ -125,13 +219,125 @@ func (a *App) Run() {
 func (a *App) Terminate() {
 	a.signalLock.Lock()
 	defer a.signalLock.Unlock()
+	a.terminating = true
 	a.Bus.Shutdown()
 }
 
+// ToggleMaintenance enters maintenance mode if we're not in it and exits
+// it otherwise. Jobs in maintenance mode deregister their services and
+// stop their health checks, but their processes and the watches keep
+// running; the services are registered again when we exit it.
+func (a *App) ToggleMaintenance() {
+	a.signalLock.RLock()
+	defer a.signalLock.RUnlock()
+	if a.terminating {
+		return
+	}
+	if a.Bus.InMaintenance() {
+		log.Info("exiting maintenance mode")
+		a.Bus.Publish(events.GlobalExitMaintenance)
+	} else {
+		log.Info("entering maintenance mode")
+		a.Bus.Publish(events.GlobalEnterMaintenance)
+	}
+}
+
+// ReloadInPlace re-reads the configuration file and applies the changes
+// to the running App without restarting it. Jobs, watches, and the
+// discovery backend that haven't changed keep running; see jobs.Reload
+// for how changed jobs are handled. If the new configuration can't be
+// loaded we log the error and keep running the current configuration.
+func (a *App) ReloadInPlace() {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	if a.terminating {
+		return
+	}
+	log.Info("reload: reloading configuration")
+	// a reload is how a changed network gets picked up, so the new
+	// config always reads the interfaces again
+	services.ResetInterfaceCache()
+	newApp, err := NewApp(a.ConfigFlag)
+	if err != nil {
+		log.Errorf("reload: keeping the current configuration: %v", err)
+		return
+	}
+	discoveryChanged := a.loadedConfig == nil ||
+		!a.loadedConfig.SameDiscovery(newApp.loadedConfig)
+	if discoveryChanged {
+		log.Info("reload: discovery backend has changed")
+		a.Discovery = newApp.Discovery
+	}
+
+	a.Jobs = jobs.Reload(a.Jobs, newApp.Jobs, a.Bus, discoveryChanged)
+	if a.Bus.InMaintenance() {
+		// the jobs we kept are still in maintenance mode, but new
+		// jobs would register their services
+		a.Bus.Publish(events.GlobalEnterMaintenance)
+	}
+	a.Watches = watches.Reload(a.Watches, newApp.Watches, a.Bus, discoveryChanged)
+
+	// the metrics collectors were replaced when we loaded the new config,
+	// so the telemetry server and sensors always need to be restarted.
+	// we start the new sensors before stopping the old ones so that the
+	// bus never runs out of subscribers and shuts down
+	oldTelemetry := a.Telemetry
+	if oldTelemetry != nil {
+		oldTelemetry.Quit()
+	}
+	a.Telemetry = newApp.Telemetry
+	a.runTelemetry()
+	if oldTelemetry != nil {
+		for _, sensor := range oldTelemetry.Metrics {
+			sensor.Quit()
+		}
+	}
+
+	// the control server and event sink are internal subscribers, so
+	// they can be swapped in any order, but we only do it when their
+	// configuration has changed so that we don't drop any requests or
+	// events while they restart
+	if a.loadedConfig == nil ||
+		a.loadedConfig.Control.SocketPath != newApp.loadedConfig.Control.SocketPath {
+		log.Info("reload: control socket has changed")
+		// don't wait for the old server to stop, as it gives in-flight
+		// requests some time to finish
+		if a.ControlServer != nil {
+			a.ControlServer.Receive(events.QuitByClose)
+		}
+		a.ControlServer = newApp.ControlServer
+		a.ControlServer.Run(a.Bus)
+	}
+	a.ControlServer.MonitorJobs(a.Jobs)
+	if a.loadedConfig == nil ||
+		eventSinkName(a.loadedConfig) != eventSinkName(newApp.loadedConfig) {
+		log.Info("reload: event stream has changed")
+		if a.sinkHandler != nil {
+			a.sinkHandler.Quit()
+		}
+		a.EventSink = newApp.EventSink
+		a.runEventSink()
+	}
+
+	a.StopTimeout = newApp.StopTimeout
+	a.Signals = newApp.Signals
+	a.applySignals()
+	a.loadedConfig = newApp.loadedConfig
+	a.Bus.PublishWithFields(events.GlobalReloaded, map[string]string{
+		"jobs":             strconv.Itoa(len(a.Jobs)),
+		"watches":          strconv.Itoa(len(a.Watches)),
+		"discoveryChanged": strconv.FormatBool(discoveryChanged),
+	})
+	log.Info("reload: completed")
+}
+
 // reload does the actual work of reloading the configuration and
 // updating the App with those changes. The EventBus should be
 // already shut down before we call this.
 func (a *App) reload() error {
+	a.signalLock.Lock()
+	defer a.signalLock.Unlock()
+	services.ResetInterfaceCache()
 	newApp, err := NewApp(a.ConfigFlag)
 	if err != nil {
 		log.Errorf("error initializing config: %v", err)
@@ -141,6 +347,9 @@ func (a *App) reload() error {
 	a.Jobs = newApp.Jobs
 	a.Watches = newApp.Watches
 	a.StopTimeout = newApp.StopTimeout
+	a.Signals = newApp.Signals
+	a.applySignals()
+	a.EventSink = newApp.EventSink
 	a.Telemetry = newApp.Telemetry
 	a.ControlServer = newApp.ControlServer
 	return nil
@@ -150,6 +359,9 @@ func (a *App) reload() error {
 // back to our config
 func (a *App) handlePolling() {
 
+	a.runEventSink()
+	a.ControlServer.MonitorJobs(a.Jobs)
+
 	// we need to subscribe to events before we Run all the jobs
 	// to avoid races where a job finishes and fires events before
 	// other jobs are even subscribed to listen for them.
@@ -162,12 +374,28 @@ func (a *App) handlePolling() {
 	for _, watch := range a.Watches {
 		watch.Run(a.Bus)
 	}
+	a.runTelemetry()
+	// kick everything off, once the watches we wait on are healthy
+	newStartupGate(a.Watches).Run(a.Bus)
+}
+
+// runEventSink starts forwarding events to the EventSink, if any
+func (a *App) runEventSink() {
+	a.sinkHandler = nil
+	if a.EventSink != nil {
+		a.sinkHandler = events.NewSinkHandler(a.EventSink)
+		a.sinkHandler.Run(a.Bus)
+	}
+}
+
+// runTelemetry starts the telemetry server and its sensors, if any
+func (a *App) runTelemetry() {
 	if a.Telemetry != nil {
+		a.Telemetry.MonitorJobs(a.Jobs)
+		a.Telemetry.MonitorWatches(a.Watches)
 		for _, sensor := range a.Telemetry.Metrics {
 			sensor.Run(a.Bus)
 		}
 		a.Telemetry.Run(a.Bus)
 	}
-	// kick everything off
-	a.Bus.Publish(events.GlobalStartup)
 }
@@ -95,6 +95,23 @@ func TestMetricServiceCreation(t *testing.T) {
 	}
 }
 
+// CONTAINERPILOT_IP is only set for every process when all of the
+// services agree on the IP
+func TestSetIPEnvironment(t *testing.T) {
+	defer os.Unsetenv("CONTAINERPILOT_IP")
+	service := func(name, ip string) *jobs.Job {
+		return &jobs.Job{Name: name,
+			Service: &discovery.ServiceDefinition{IPAddress: ip}}
+	}
+	setIPEnvironment([]*jobs.Job{
+		service("a", "192.0.2.10"), {Name: "preStart"}, service("b", "192.0.2.10")})
+	assert.Equal(t, "192.0.2.10", os.Getenv("CONTAINERPILOT_IP"))
+
+	setIPEnvironment([]*jobs.Job{service("a", "192.0.2.10"), service("b", "192.0.2.11")})
+	_, ok := os.LookupEnv("CONTAINERPILOT_IP")
+	assert.False(t, ok, "expected no global IP when services disagree")
+}
+
 // Test configuration reload
 func TestReloadConfig(t *testing.T) {
 	cfg := &jobs.Config{
@@ -146,6 +163,106 @@ func TestReloadConfig(t *testing.T) {
 	}
 }
 
+// Test configuration reload without restarting
+func TestReloadInPlace(t *testing.T) {
+	f := testCfgToTempFile(t, `{
+    "consul": "consul:8500",
+    "jobs": [{"name": "app", "exec": "sleep 10"}]
+  }`)
+	defer os.Remove(f.Name())
+	app, err := NewApp(f.Name())
+	if err != nil {
+		t.Fatalf("got error while initializing config: %v", err)
+	}
+	app.Bus = events.NewEventBus()
+	app.handlePolling()
+	running := app.Jobs[0]
+
+	writeConfig := func(text string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`invalid`)
+	app.ReloadInPlace()
+	if len(app.Jobs) != 1 || app.Jobs[0] != running {
+		t.Fatalf("expected invalid config to keep current jobs: %v", app.Jobs)
+	}
+
+	writeConfig(`{
+    "consul": "consul:8500",
+    "jobs": [{"name": "app", "exec": "sleep 10"},
+             {"name": "sidecar", "exec": "sleep 10"}]
+  }`)
+	app.ReloadInPlace()
+	if len(app.Jobs) != 2 || app.Jobs[0] != running ||
+		app.Jobs[1].Name != "sidecar" {
+		t.Fatalf("expected unchanged job to keep running and new job: %v",
+			app.Jobs)
+	}
+	app.Terminate()
+	app.Bus.Wait()
+
+	// once we've started shutting down we don't reload anymore
+	app.ReloadInPlace()
+	if len(app.Jobs) != 2 {
+		t.Fatalf("expected no reload after shutdown: %v", app.Jobs)
+	}
+}
+
+// Test that reloading in place restarts the control server and event
+// sink only when their configuration has changed
+func TestReloadInPlaceControlAndEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerpilot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := `{
+    "consul": "consul:8500",
+    "control": {"socket": "%s/%s.socket"},
+    "logging": {"events": "%s"},
+    "jobs": [{"name": "app", "exec": "sleep 10"}]
+  }`
+	f := testCfgToTempFile(t, fmt.Sprintf(cfg, dir, "first", "stderr"))
+	defer os.Remove(f.Name())
+	app, err := NewApp(f.Name())
+	if err != nil {
+		t.Fatalf("got error while initializing config: %v", err)
+	}
+	app.Bus = events.NewEventBus()
+	app.ControlServer.Run(app.Bus)
+	app.handlePolling()
+	server, sink := app.ControlServer, app.sinkHandler
+	assert.NotNil(t, sink)
+
+	writeConfig := func(text string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(fmt.Sprintf(cfg, dir, "first", "stderr"))
+	app.ReloadInPlace()
+	assert.True(t, app.ControlServer == server, "expected same control server")
+	assert.True(t, app.sinkHandler == sink, "expected same event sink")
+	assert.Contains(t, app.Bus.DebugEvents(), events.GlobalReloaded,
+		"expected reload to be published")
+
+	writeConfig(fmt.Sprintf(cfg, dir, "second", "stdout"))
+	app.ReloadInPlace()
+	assert.Equal(t, dir+"/second.socket", app.ControlServer.Addr)
+	assert.False(t, app.sinkHandler == sink, "expected new event sink")
+	assert.NotNil(t, app.sinkHandler)
+
+	writeConfig(fmt.Sprintf(cfg, dir, "second", ""))
+	app.ReloadInPlace()
+	assert.Nil(t, app.sinkHandler)
+	assert.Nil(t, app.EventSink)
+
+	app.Terminate()
+	app.Bus.Wait()
+}
+
 // ----------------------------------------------------
 // test helpers
 
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/joyent/containerpilot/config"
 	"github.com/joyent/containerpilot/subcommands"
 	"github.com/joyent/containerpilot/version"
 )
@@ -49,10 +50,15 @@ func GetArgs() (subcommands.Handler, subcommands.Params) {
 
 	var versionFlag bool
 	var templateFlag bool
+	var validateFlag bool
+	var strictFlag bool
+	var dryRunFlag bool
 	var reloadFlag bool
 	var pingFlag bool
+	var statusFlag bool
 
 	var configPath string
+	var configFormat string
 	var renderFlag string
 	var maintFlag string
 
@@ -66,11 +72,31 @@ func GetArgs() (subcommands.Handler, subcommands.Params) {
 		flag.BoolVar(&templateFlag, "template", false,
 			"Render template and quit.")
 
+		flag.BoolVar(&validateFlag, "validate", false,
+			"Validate the configuration file without running it and quit.")
+
+		flag.BoolVar(&strictFlag, "strict", false,
+			`Used with '-validate' where the configuration will run: also fail if
+	interfaces don't match an IP, if an executable isn't on the PATH, or if
+	the discovery backend can't be reached.`)
+
+		flag.BoolVar(&dryRunFlag, "dry-run", false,
+			`Load the configuration, select each service's IP, and print the
+	registrations that would be sent to Consul without sending them, then quit.`)
+
 		flag.BoolVar(&reloadFlag, "reload", false,
 			"Reload a ContainerPilot process through its control socket.")
 
 		flag.StringVar(&configPath, "config", "",
-			"File path to JSON5 configuration file. Defaults to CONTAINERPILOT env var.")
+			`File path to JSON5 or YAML configuration file, or a directory of them
+	to merge, '-' to read it from stdin, or the configuration itself if it
+	starts with '{'.
+	Defaults to CONTAINERPILOT env var.`)
+
+		flag.StringVar(&configFormat, "config-format", "",
+			`Format of the configuration: 'json' or 'yaml'. Defaults to
+	CONTAINERPILOT_CONFIG_FORMAT env var, or else 'yaml' for files ending
+	in '.yaml' or '.yml' and 'json' for everything else.`)
 
 		flag.StringVar(&renderFlag, "out", "",
 			`File path where to save rendered config file when '-template' is used.
@@ -91,6 +117,9 @@ func GetArgs() (subcommands.Handler, subcommands.Params) {
 		flag.BoolVar(&pingFlag, "ping", false,
 			"Check that the ContainerPilot control socket is up.")
 
+		flag.BoolVar(&statusFlag, "status", false,
+			"Print the health status of each job through the control socket.")
+
 		flag.Parse()
 	}
 
@@ -103,12 +132,28 @@ func GetArgs() (subcommands.Handler, subcommands.Params) {
 	if configPath == "" {
 		configPath = os.Getenv("CONTAINERPILOT")
 	}
+	if configFormat != "" {
+		// the config is loaded again on reload, so the format has to
+		// outlive the flag
+		os.Setenv(config.EnvConfigFormat, configFormat)
+	}
 	if templateFlag {
 		return subcommands.RenderHandler, subcommands.Params{
 			ConfigPath: configPath,
 			RenderFlag: renderFlag,
 		}
 	}
+	if validateFlag {
+		return subcommands.ValidateHandler, subcommands.Params{
+			ConfigPath: configPath,
+			StrictFlag: strictFlag,
+		}
+	}
+	if dryRunFlag {
+		return subcommands.DryRunHandler, subcommands.Params{
+			ConfigPath: configPath,
+		}
+	}
 	if reloadFlag {
 		return subcommands.ReloadHandler, subcommands.Params{
 			ConfigPath: configPath,
@@ -137,6 +182,11 @@ func GetArgs() (subcommands.Handler, subcommands.Params) {
 			ConfigPath: configPath,
 		}
 	}
+	if statusFlag {
+		return subcommands.GetStatusHandler, subcommands.Params{
+			ConfigPath: configPath,
+		}
+	}
 
 	return nil, subcommands.Params{ConfigPath: configPath}
 }
@@ -60,6 +60,22 @@ func TestInvalidConfigParseTemplateError(t *testing.T) {
 		"parse error at line:col [1:10]")
 }
 
+func TestValidateFlag(t *testing.T) {
+	defer argTestCleanup(argTestSetup())
+	os.Args = []string{"this", "-validate", "-config", "test.json5"}
+	handler, p := GetArgs()
+	assert.NotNil(t, handler, "expected -validate subcommand")
+	assert.Equal(t, "test.json5", p.ConfigPath)
+}
+
+func TestDryRunFlag(t *testing.T) {
+	defer argTestCleanup(argTestSetup())
+	os.Args = []string{"this", "-dry-run", "-config", "test.json5"}
+	handler, p := GetArgs()
+	assert.NotNil(t, handler, "expected -dry-run subcommand")
+	assert.Equal(t, "test.json5", p.ConfigPath)
+}
+
 func TestControlServerCreation(t *testing.T) {
 	f1 := testCfgToTempFile(t, `{"consul": "consul:8500"}`)
 	defer os.Remove(f1.Name())
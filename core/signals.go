@@ -4,20 +4,102 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/joyent/containerpilot/config"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // HandleSignals listens for and captures signals used for orchestration
 func (a *App) handleSignals() {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	a.signalCh = make(chan os.Signal, 1)
+	a.applySignals()
 	go func() {
-		for signal := range sig {
-			switch signal {
-			case syscall.SIGINT:
-				a.Terminate()
-			case syscall.SIGTERM:
-				a.Terminate()
+		for sig := range a.signalCh {
+			if s, ok := sig.(syscall.Signal); ok {
+				a.handleSignal(s)
 			}
 		}
 	}()
 }
+
+// applySignals subscribes to every signal that can be configured, and
+// ignores the signals whose action is 'ignore'. The supervisor forwards
+// all of them, so a signal without an action is caught and dropped rather
+// than getting its default behavior, which would stop the worker. It's
+// called again after a reload, so it first undoes the signals of the last
+// config. The caller must hold the signalLock or be the only goroutine
+// using the App.
+func (a *App) applySignals() {
+	if a.signalCh == nil {
+		return
+	}
+	signal.Stop(a.signalCh)
+	if len(a.ignoredSignals) > 0 {
+		signal.Reset(a.ignoredSignals...)
+		a.ignoredSignals = nil
+	}
+	signals := a.signals()
+	for _, sig := range config.HandledSignals() {
+		if cfg, ok := signals[sig]; ok && cfg.Action == config.SignalIgnore {
+			a.ignoredSignals = append(a.ignoredSignals, sig)
+			continue
+		}
+		signal.Notify(a.signalCh, sig)
+	}
+	if len(a.ignoredSignals) > 0 {
+		signal.Ignore(a.ignoredSignals...)
+	}
+}
+
+// signals returns the actions for each signal, which are the defaults if
+// the App wasn't created from a config
+func (a *App) signals() map[syscall.Signal]*config.SignalConfig {
+	if a.Signals == nil {
+		return config.DefaultSignals()
+	}
+	return a.Signals
+}
+
+// handleSignal takes the configured action for the signal
+func (a *App) handleSignal(sig syscall.Signal) {
+	a.signalLock.RLock()
+	cfg, ok := a.signals()[sig]
+	a.signalLock.RUnlock()
+	if !ok {
+		log.Debugf("dropping %v: it has no action configured", sig)
+		return
+	}
+	switch cfg.Action {
+	case config.SignalStop:
+		a.Terminate()
+	case config.SignalReload:
+		a.ReloadInPlace()
+	case config.SignalMaintenance:
+		a.ToggleMaintenance()
+	case config.SignalForward:
+		a.forwardSignal(sig, cfg.Jobs)
+	}
+}
+
+// forwardSignal sends the signal to the processes of the named jobs, or
+// to the processes of every job if there are no names
+func (a *App) forwardSignal(sig syscall.Signal, names []string) {
+	a.signalLock.RLock()
+	defer a.signalLock.RUnlock()
+	forward := map[string]bool{}
+	for _, name := range names {
+		forward[name] = true
+	}
+	for _, job := range a.Jobs {
+		if len(forward) > 0 && !forward[job.Name] {
+			continue
+		}
+		if job.Signal(sig) {
+			log.Debugf("forwarded %v to job %s", sig, job.Name)
+		} else if len(forward) > 0 {
+			log.Warnf("unable to forward %v to job %s: it has no running process",
+				sig, job.Name)
+		}
+	}
+}
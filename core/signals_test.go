@@ -62,6 +62,41 @@ func TestTerminateSignal(t *testing.T) {
 	}
 }
 
+// Test that SIGUSR1 toggles maintenance mode without stopping the job
+func TestMaintenanceSignal(t *testing.T) {
+	app := getSignalTestConfig(t)
+	bus := app.Bus
+	app.Jobs[0].Subscribe(bus)
+	app.Jobs[0].Run()
+
+	app.ToggleMaintenance()
+	if !bus.InMaintenance() {
+		t.Fatal("expected toggle to enter maintenance mode")
+	}
+	app.ToggleMaintenance()
+	if bus.InMaintenance() {
+		t.Fatal("expected second toggle to exit maintenance mode")
+	}
+	app.Terminate()
+	bus.Wait()
+
+	// once we've started shutting down we don't toggle anymore
+	app.ToggleMaintenance()
+	got := map[events.Event]int{}
+	for _, result := range bus.DebugEvents() {
+		got[result]++
+	}
+	if !reflect.DeepEqual(got, map[events.Event]int{
+		events.GlobalEnterMaintenance:                   1,
+		events.GlobalExitMaintenance:                    1,
+		events.GlobalShutdown:                           1,
+		{Code: events.Stopping, Source: "test-service"}: 1,
+		{Code: events.Stopped, Source: "test-service"}:  1,
+	}) {
+		t.Fatalf("expected maintenance toggles and shutdown but got:\n%v", got)
+	}
+}
+
 // Test that only ensures that we cover a straight-line run through
 // the handleSignals setup code
 func TestSignalWiring(t *testing.T) {
@@ -71,6 +106,24 @@ func TestSignalWiring(t *testing.T) {
 	sendAndWaitForSignal(t, syscall.SIGTERM)
 }
 
+// A signal that can be configured but has no action is forwarded by the
+// supervisor, so it's caught and dropped rather than stopping the worker.
+// Without an action SIGQUIT would exit with a stack dump.
+func TestUnconfiguredSignal(t *testing.T) {
+	app := EmptyApp()
+	app.Bus = events.NewEventBus()
+	app.handleSignals()
+	defer signal.Stop(app.signalCh)
+
+	me, _ := os.FindProcess(os.Getpid())
+	if err := me.Signal(syscall.SIGQUIT); err != nil {
+		t.Fatalf("Got error on %s: %v\n", syscall.SIGQUIT, err)
+	}
+	if results := app.Bus.DebugEvents(); len(results) != 0 {
+		t.Fatalf("expected signal to be dropped but got:\n%v", results)
+	}
+}
+
 // Helper to ensure the signal that we send has been received so that
 // we don't muddy subsequent tests of the signal handler.
 func sendAndWaitForSignal(t *testing.T, s os.Signal) {
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/jobs"
+	"github.com/joyent/containerpilot/watches"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const startupTimeoutSource = "startup-timeout"
+
+// startupMonitor bounds the time between ContainerPilot starting and
+// every job with a service becoming healthy for the first time, including
+// the time spent waiting for the watches of the startupGate. If the
+// deadline passes first it shuts down the EventBus so that ContainerPilot
+// exits rather than hanging in a half-started state.
+type startupMonitor struct {
+	timeout   time.Duration
+	startedAt time.Time
+	pending   map[string]bool
+	phase     string
+	timedOut  bool
+	lock      *sync.RWMutex
+	events.EventHandler
+}
+
+func newStartupMonitor(
+	timeout time.Duration,
+	startedAt time.Time,
+	jobs []*jobs.Job,
+	watches []*watches.Watch,
+) *startupMonitor {
+	pending := map[string]bool{}
+	for _, job := range jobs {
+		if job.Service != nil {
+			pending[job.Name] = true
+		}
+	}
+	phase := "starting jobs"
+	for _, watch := range watches {
+		if watch.WaitOnStartup {
+			pending[watch.Name] = true
+			phase = "waiting for watches to become healthy"
+		}
+	}
+	m := &startupMonitor{
+		timeout:   timeout,
+		startedAt: startedAt,
+		pending:   pending,
+		phase:     phase,
+		lock:      &sync.RWMutex{},
+	}
+	m.InitRx()
+	return m
+}
+
+// TimedOut reports whether the startup deadline passed before startup
+// completed
+func (m *startupMonitor) TimedOut() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.timedOut
+}
+
+// pendingServices returns the sorted names of the services that have not
+// yet become healthy
+func (m *startupMonitor) pendingServices() []string {
+	names := []string{}
+	for name := range m.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run executes the event loop for the startupMonitor
+func (m *startupMonitor) Run(bus *events.EventBus) {
+	if len(m.pending) == 0 {
+		return
+	}
+	m.Subscribe(bus, true)
+	m.Bus = bus
+	ctx, cancel := context.WithCancel(context.Background())
+	remaining := m.timeout - time.Since(m.startedAt)
+	events.NewEventTimeout(ctx, events.RealClock, m.Rx, remaining, startupTimeoutSource)
+	go func() {
+		defer cancel()
+		for event := range m.Rx {
+			switch event.Code {
+			case events.Startup:
+				m.phase = "waiting for services to become healthy"
+			case events.StatusHealthy:
+				delete(m.pending, event.Source)
+				if len(m.pending) == 0 {
+					log.Infof("startup completed in %v",
+						time.Since(m.startedAt))
+					m.Unsubscribe(m.Bus, true)
+					return
+				}
+			case events.TimerExpired:
+				if event.Source != startupTimeoutSource {
+					continue
+				}
+				log.Errorf("startup timed out after %v while %s: %s",
+					m.timeout, m.phase,
+					strings.Join(m.pendingServices(), ", "))
+				m.lock.Lock()
+				m.timedOut = true
+				m.lock.Unlock()
+				// unsubscribe first so that we don't block receiving
+				// our own shutdown event
+				m.Unsubscribe(m.Bus, true)
+				m.Bus.Shutdown()
+				return
+			case events.Quit, events.Shutdown:
+				m.Unsubscribe(m.Bus, true)
+				return
+			}
+		}
+	}()
+}
+
+// startupGate holds back the startup event until every watch with
+// waitOnStartup has seen a healthy instance of its service, so that jobs
+// which need those services don't crash-loop while they come up. The
+// startupTimeout, if any, bounds the wait.
+type startupGate struct {
+	pending map[string]bool
+	events.EventHandler
+}
+
+func newStartupGate(watches []*watches.Watch) *startupGate {
+	pending := map[string]bool{}
+	for _, watch := range watches {
+		if watch.WaitOnStartup {
+			pending[watch.Name] = true
+		}
+	}
+	g := &startupGate{pending: pending}
+	g.InitRx()
+	return g
+}
+
+// Run publishes the startup event once the watches are healthy, or right
+// away if there are no watches to wait for
+func (g *startupGate) Run(bus *events.EventBus) {
+	if len(g.pending) == 0 {
+		bus.Publish(events.GlobalStartup)
+		return
+	}
+	log.Infof("waiting for %s to become healthy before starting jobs",
+		strings.Join(g.pendingWatches(), ", "))
+	g.Subscribe(bus, true)
+	g.Bus = bus
+	go func() {
+		for event := range g.Rx {
+			switch event.Code {
+			case events.StatusHealthy:
+				if !g.pending[event.Source] {
+					continue
+				}
+				delete(g.pending, event.Source)
+				if len(g.pending) == 0 {
+					log.Info("all watches are healthy, starting jobs")
+					// unsubscribe first so that we don't block
+					// receiving our own startup event
+					g.Unsubscribe(g.Bus, true)
+					g.Bus.Publish(events.GlobalStartup)
+					return
+				}
+			case events.Quit, events.Shutdown:
+				g.Unsubscribe(g.Bus, true)
+				return
+			}
+		}
+	}()
+}
+
+// pendingWatches returns the sorted names of the watches that have not
+// yet become healthy
+func (g *startupGate) pendingWatches() []string {
+	names := []string{}
+	for name := range g.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/jobs"
+	"github.com/joyent/containerpilot/tests"
+	"github.com/joyent/containerpilot/tests/mocks"
+	"github.com/joyent/containerpilot/watches"
+)
+
+func testStartupJobs(t *testing.T, names ...string) []*jobs.Job {
+	result := []*jobs.Job{}
+	for _, name := range names {
+		cfg := &jobs.Config{
+			Name:       name,
+			Port:       1,
+			Interfaces: []string{"inet"},
+			Health: &jobs.HealthConfig{
+				Heartbeat: 1,
+				TTL:       1,
+			},
+		}
+		if err := cfg.Validate(&mocks.NoopDiscoveryBackend{}); err != nil {
+			t.Fatalf("unexpected error in Validate: %v", err)
+		}
+		result = append(result, jobs.NewJob(cfg))
+	}
+	return result
+}
+
+func TestStartupMonitorTimeout(t *testing.T) {
+	bus := events.NewEventBus()
+	monitor := newStartupMonitor(100*time.Millisecond, time.Now(),
+		testStartupJobs(t, "app", "db"), nil)
+	monitor.Run(bus)
+	bus.Publish(events.GlobalStartup)
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "db"})
+	time.Sleep(300 * time.Millisecond)
+
+	assert.True(t, monitor.TimedOut(), "expected startup to time out")
+	assert.Contains(t, bus.DebugEvents(), events.GlobalShutdown,
+		"expected startup timeout to shut down the bus")
+}
+
+func TestStartupMonitorCompleted(t *testing.T) {
+	bus := events.NewEventBus()
+	monitor := newStartupMonitor(100*time.Millisecond, time.Now(),
+		testStartupJobs(t, "app", "db"), nil)
+	monitor.Run(bus)
+	bus.Publish(events.GlobalStartup)
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "db"})
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "app"})
+	time.Sleep(300 * time.Millisecond)
+
+	assert.False(t, monitor.TimedOut(), "expected startup to complete")
+	assert.NotContains(t, bus.DebugEvents(), events.GlobalShutdown,
+		"expected bus to keep running after startup")
+}
+
+func TestStartupMonitorWatches(t *testing.T) {
+	cfgs, err := watches.NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "db", interval: 1, waitOnStartup: true},
+	{name: "other", interval: 1}]`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	monitor := newStartupMonitor(time.Second, time.Now(),
+		testStartupJobs(t, "app"), watches.FromConfigs(cfgs))
+	assert.Equal(t, []string{"app", "watch.db"}, monitor.pendingServices())
+	assert.Equal(t, "waiting for watches to become healthy", monitor.phase)
+}
+
+// testSubscriber lets a test wait for events on the bus
+type testSubscriber struct {
+	events.EventHandler
+}
+
+func TestStartupGate(t *testing.T) {
+	cfgs, err := watches.NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "db", interval: 1, waitOnStartup: true},
+	{name: "cache", interval: 1, waitOnStartup: true},
+	{name: "other", interval: 1}]`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bus := events.NewEventBus()
+	sub := &testSubscriber{}
+	sub.InitRx()
+	sub.Subscribe(bus)
+	defer sub.Unsubscribe(bus)
+	expectStartup := func(expected bool) {
+		timeout := time.After(50 * time.Millisecond)
+		if expected {
+			timeout = time.After(time.Second)
+		}
+		for {
+			select {
+			case event := <-sub.Rx:
+				if event == events.GlobalStartup {
+					assert.True(t, expected, "unexpected startup event")
+					return
+				}
+			case <-timeout:
+				assert.False(t, expected, "expected a startup event")
+				return
+			}
+		}
+	}
+
+	newStartupGate(watches.FromConfigs(cfgs)).Run(bus)
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "watch.db"})
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "watch.other"})
+	bus.Publish(events.Event{Code: events.StatusUnhealthy, Source: "watch.cache"})
+	expectStartup(false)
+	bus.Publish(events.Event{Code: events.StatusHealthy, Source: "watch.cache"})
+	expectStartup(true)
+
+	// without any watches to wait on, startup isn't held back
+	newStartupGate(watches.FromConfigs(cfgs[2:])).Run(bus)
+	expectStartup(true)
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joyent/containerpilot/config/timing"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var errorCollector *prometheus.CounterVec
+
+func init() {
+	errorCollector = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerpilot_discovery_errors",
+		Help: "count of failed requests to ContainerPilot discovery backends, partitioned by backend",
+	}, []string{"backend"})
+	prometheus.MustRegister(errorCollector)
+}
+
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = time.Minute
+)
+
+// ErrBackingOff is returned instead of making a request to a discovery
+// backend that has been failing, until its backoff interval has elapsed
+var ErrBackingOff = errors.New("backing off after failed requests")
+
+// backoff tracks consecutive request failures for a single discovery
+// backend. After each failure we skip requests for an interval that
+// doubles up to max, and the first success resets it.
+type backoff struct {
+	name   string // the backend, for logs
+	min    time.Duration
+	max    time.Duration
+	jitter bool
+
+	lock     sync.Mutex
+	failures int
+	until    time.Time
+	now      func() time.Time
+}
+
+func newBackoff(parsed *parsedConfig) (*backoff, error) {
+	return newNamedBackoff("consul",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+}
+
+// newNamedBackoff creates a backoff from the backoffMin, backoffMax, and
+// backoffJitter config of the named backend
+func newNamedBackoff(name, rawMin, rawMax string, rawJitter *bool) (*backoff, error) {
+	min, err := timing.GetTimeout(rawMin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: unable to parse backoffMin '%s': %v",
+			name, rawMin, err)
+	}
+	max, err := timing.GetTimeout(rawMax)
+	if err != nil {
+		return nil, fmt.Errorf("%s: unable to parse backoffMax '%s': %v",
+			name, rawMax, err)
+	}
+	if min == 0 {
+		min = defaultBackoffMin
+	}
+	if max == 0 {
+		max = defaultBackoffMax
+	}
+	if min < 0 || max < min {
+		return nil, fmt.Errorf(
+			"%s: backoffMin '%v' must be > 0 and not more than backoffMax '%v'",
+			name, min, max)
+	}
+	jitter := true
+	if rawJitter != nil {
+		jitter = *rawJitter
+	}
+	return &backoff{name: name, min: min, max: max, jitter: jitter,
+		now: time.Now}, nil
+}
+
+// allow returns ErrBackingOff if we're still waiting out the interval
+// after the last failure
+func (b *backoff) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if remaining := b.until.Sub(b.now()); remaining > 0 {
+		return fmt.Errorf("%w: retrying in %v", ErrBackingOff,
+			remaining.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// record updates the backoff with the result of a request
+func (b *backoff) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		if b.failures > 0 {
+			log.Infof("%s: request succeeded after %d failures", b.name, b.failures)
+		}
+		b.failures = 0
+		b.until = time.Time{}
+		return
+	}
+	errorCollector.WithLabelValues(b.name).Inc()
+	b.failures++
+	interval := b.interval()
+	b.until = b.now().Add(interval)
+	log.Warnf("%s: request failed %d time(s), backing off for %v: %v",
+		b.name, b.failures, interval, err)
+}
+
+// interval returns the time to wait after the current number of failures.
+// With jitter we pick a random interval between half and all of it so
+// that many containers don't all retry at the same moment.
+func (b *backoff) interval() time.Duration {
+	interval := b.max
+	// guard against overflow for long outages
+	if b.failures < 32 {
+		if doubled := b.min << uint(b.failures-1); doubled > 0 && doubled < b.max {
+			interval = doubled
+		}
+	}
+	if b.jitter {
+		half := interval / 2
+		interval = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+	return interval
+}
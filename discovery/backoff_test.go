@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffConfig(t *testing.T) {
+	b, err := newBackoff(&parsedConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultBackoffMin, b.min)
+	assert.Equal(t, defaultBackoffMax, b.max)
+	assert.True(t, b.jitter)
+
+	noJitter := false
+	b, err = newBackoff(&parsedConfig{BackoffMin: "500ms", BackoffMax: "10",
+		BackoffJitter: &noJitter})
+	assert.Nil(t, err)
+	assert.Equal(t, 500*time.Millisecond, b.min)
+	assert.Equal(t, 10*time.Second, b.max)
+	assert.False(t, b.jitter)
+
+	_, err = newBackoff(&parsedConfig{BackoffMin: "x"})
+	assert.EqualError(t, err,
+		"consul: unable to parse backoffMin 'x': time: invalid duration \"x\"")
+	_, err = newBackoff(&parsedConfig{BackoffMin: "10s", BackoffMax: "1s"})
+	assert.EqualError(t, err,
+		"consul: backoffMin '10s' must be > 0 and not more than backoffMax '1s'")
+
+	_, err = NewConsul(map[string]interface{}{
+		"address": "consul:8500", "backoffMax": "-1s"})
+	assert.Error(t, err)
+}
+
+func TestBackoffInterval(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := &backoff{min: time.Second, max: 5 * time.Second,
+		now: func() time.Time { return now }}
+	assert.Nil(t, b.allow(), "expected no backoff before any failure")
+
+	failed := fmt.Errorf("connection refused")
+	expected := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, interval := range expected {
+		b.record(failed)
+		assert.Equal(t, now.Add(interval), b.until, "interval after failure %d", i+1)
+		err := b.allow()
+		assert.True(t, errors.Is(err, ErrBackingOff), "expected ErrBackingOff")
+		now = b.until
+		assert.Nil(t, b.allow(), "expected retry once interval elapsed")
+	}
+
+	// the first success resets to the minimum
+	b.record(nil)
+	assert.Nil(t, b.allow())
+	b.record(failed)
+	assert.Equal(t, now.Add(time.Second), b.until)
+
+	// lots of failures must not overflow
+	b.failures = 100
+	b.record(failed)
+	assert.Equal(t, now.Add(5*time.Second), b.until)
+}
+
+func TestBackoffJitter(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := &backoff{min: 4 * time.Second, max: time.Minute, jitter: true,
+		now: func() time.Time { return now }}
+	for i := 0; i < 20; i++ {
+		b.failures = 0
+		b.record(fmt.Errorf("connection refused"))
+		interval := b.until.Sub(now)
+		assert.True(t, interval >= 2*time.Second && interval <= 4*time.Second,
+			"jittered interval %v out of range", interval)
+	}
+}
+
+func TestBackoffPerBackend(t *testing.T) {
+	flaky, _ := NewConsul("127.0.0.1:1")
+	healthy, _ := NewConsul("127.0.0.1:2")
+	flaky.backoff.record(fmt.Errorf("connection refused"))
+
+	err := flaky.PassTTL("service:app", "ok")
+	assert.True(t, errors.Is(err, ErrBackingOff), "expected ErrBackingOff")
+	assert.Nil(t, healthy.backoff.allow(),
+		"expected the other backend not to be backing off")
+}
+
+func TestBackoffErrorMetric(t *testing.T) {
+	b := &backoff{name: "metrics", min: time.Second, max: time.Minute,
+		now: time.Now}
+	b.record(fmt.Errorf("connection refused"))
+	b.record(nil)
+	b.record(fmt.Errorf("connection refused"))
+
+	metric := &dto.Metric{}
+	errorCollector.WithLabelValues("metrics").Write(metric)
+	assert.Equal(t, 2.0, metric.GetCounter().GetValue())
+}
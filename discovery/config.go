@@ -1,6 +1,8 @@
 package discovery
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -9,10 +11,23 @@ import (
 )
 
 type parsedConfig struct {
-	Address string          `mapstructure:"address"`
-	Scheme  string          `mapstructure:"scheme"`
-	Token   string          `mapstructure:"token"`
-	TLS     parsedTLSConfig `mapstructure:"tls"` // optional TLS settings
+	Address   string          `mapstructure:"address"`
+	Scheme    string          `mapstructure:"scheme"`
+	Token     string          `mapstructure:"token"`
+	TokenFile string          `mapstructure:"tokenFile"`
+	TLS       parsedTLSConfig `mapstructure:"tls"` // optional TLS settings
+
+	// flat aliases of the tls block's cafile, clientcert, clientkey, and
+	// verify fields
+	CAFile   string `mapstructure:"caFile"`
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	Verify   *bool  `mapstructure:"verify"`
+
+	// optional backoff settings for failed requests
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
 }
 
 type parsedTLSConfig struct {
@@ -21,7 +36,43 @@ type parsedTLSConfig struct {
 	HTTPClientCert    string `mapstructure:"clientcert"`
 	HTTPClientKey     string `mapstructure:"clientkey"`
 	HTTPTLSServerName string `mapstructure:"servername"`
-	HTTPSSLVerify     bool   `mapstructure:"verify"`
+	HTTPSSLVerify     *bool  `mapstructure:"verify"` // defaults to true
+}
+
+// move the flat TLS fields of an already-parsed parsedConfig into its tls
+// block, so that each can be set either way but not both
+func mergeTLSAliases(parsed *parsedConfig) error {
+	tls := &parsed.TLS
+	if err := mergeTLSAlias("caFile", &parsed.CAFile,
+		"tls.cafile", &tls.HTTPCAFile); err != nil {
+		return err
+	}
+	if err := mergeTLSAlias("certFile", &parsed.CertFile,
+		"tls.clientcert", &tls.HTTPClientCert); err != nil {
+		return err
+	}
+	if err := mergeTLSAlias("keyFile", &parsed.KeyFile,
+		"tls.clientkey", &tls.HTTPClientKey); err != nil {
+		return err
+	}
+	if parsed.Verify != nil {
+		if tls.HTTPSSLVerify != nil {
+			return fmt.Errorf("consul: only one of 'verify' or 'tls.verify' can be set")
+		}
+		tls.HTTPSSLVerify, parsed.Verify = parsed.Verify, nil
+	}
+	return nil
+}
+
+func mergeTLSAlias(alias string, value *string, field string, target *string) error {
+	if *value == "" {
+		return nil
+	}
+	if *target != "" {
+		return fmt.Errorf("consul: only one of '%s' or '%s' can be set", alias, field)
+	}
+	*target, *value = *value, ""
+	return nil
 }
 
 // override an already-parsed parsedConfig with any options that might
@@ -40,49 +91,115 @@ func getTLSConfig(parsed *parsedConfig) api.TLSConfig {
 		parsed.TLS.HTTPClientKey = clientKey
 	}
 	if serverName := os.Getenv("CONSUL_TLS_SERVER_NAME"); serverName != "" {
-		parsed.TLS.HTTPClientKey = serverName
+		parsed.TLS.HTTPTLSServerName = serverName
 	}
-	verify := os.Getenv("CONSUL_HTTP_SSL_VERIFY")
-	switch strings.ToLower(verify) {
+	switch strings.ToLower(os.Getenv("CONSUL_HTTP_SSL_VERIFY")) {
 	case "1", "true":
-		parsed.TLS.HTTPSSLVerify = true
+		verify := true
+		parsed.TLS.HTTPSSLVerify = &verify
 	case "0", "false":
-		parsed.TLS.HTTPSSLVerify = false
+		verify := false
+		parsed.TLS.HTTPSSLVerify = &verify
 	}
+	// like the Consul CLI, verify the server's certificate unless told
+	// not to, so that the CA we're given is actually used
+	skipVerify := parsed.TLS.HTTPSSLVerify != nil && !*parsed.TLS.HTTPSSLVerify
 	tlsConfig := api.TLSConfig{
 		Address:            parsed.TLS.HTTPTLSServerName,
-		CAFile:             parsed.TLS.HTTPCAPath,
-		CertFile:           parsed.TLS.HTTPCAPath,
+		CAFile:             parsed.TLS.HTTPCAFile,
+		CAPath:             parsed.TLS.HTTPCAPath,
+		CertFile:           parsed.TLS.HTTPClientCert,
 		KeyFile:            parsed.TLS.HTTPClientKey,
-		InsecureSkipVerify: !parsed.TLS.HTTPSSLVerify,
+		InsecureSkipVerify: skipVerify,
 	}
 	return tlsConfig
 }
 
-func configFromMap(raw map[string]interface{}) (*api.Config, error) {
-	parsed := &parsedConfig{}
-	if err := decode.ToStruct(raw, parsed); err != nil {
+// override an already-parsed parsedConfig with the ACL token from the
+// environment, if any, and then return the token. The token can be read
+// from a file so that it doesn't need to be in the config file.
+func getToken(parsed *parsedConfig) (string, error) {
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		return token, nil
+	}
+	if tokenFile := os.Getenv("CONSUL_HTTP_TOKEN_FILE"); tokenFile != "" {
+		parsed.Token = ""
+		parsed.TokenFile = tokenFile
+	}
+	if parsed.TokenFile == "" {
+		return parsed.Token, nil
+	}
+	if parsed.Token != "" {
+		return "", fmt.Errorf("consul: only one of 'token' or 'tokenFile' can be set")
+	}
+	data, err := ioutil.ReadFile(parsed.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("consul: could not read token file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// validateTLSConfig makes sure that any TLS files we've been given are
+// readable now rather than failing on the first request to Consul
+func validateTLSConfig(tlsConfig api.TLSConfig) error {
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return fmt.Errorf("consul: tls.clientcert and tls.clientkey must be set together")
+	}
+	files := []struct{ field, path string }{
+		{"tls.cafile", tlsConfig.CAFile},
+		{"tls.clientcert", tlsConfig.CertFile},
+		{"tls.clientkey", tlsConfig.KeyFile},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		f, err := os.Open(file.path)
+		if err != nil {
+			return fmt.Errorf("consul: could not read %s: %v", file.field, err)
+		}
+		f.Close()
+	}
+	if tlsConfig.CAPath != "" {
+		if _, err := ioutil.ReadDir(tlsConfig.CAPath); err != nil {
+			return fmt.Errorf("consul: could not read tls.capath: %v", err)
+		}
+	}
+	return nil
+}
+
+func newAPIConfig(parsed *parsedConfig) (*api.Config, error) {
+	token, err := getToken(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if err := mergeTLSAliases(parsed); err != nil {
+		return nil, err
+	}
+	tlsConfig := getTLSConfig(parsed)
+	if err := validateTLSConfig(tlsConfig); err != nil {
 		return nil, err
 	}
 	config := &api.Config{
 		Address:   parsed.Address,
 		Scheme:    parsed.Scheme,
-		Token:     parsed.Token,
-		TLSConfig: getTLSConfig(parsed),
+		Token:     token,
+		TLSConfig: tlsConfig,
 	}
 	return config, nil
 }
 
-func configFromURI(uri string) (*api.Config, error) {
-	address, scheme := parseRawURI(uri)
-	parsed := &parsedConfig{Address: address, Scheme: scheme}
-	config := &api.Config{
-		Address:   parsed.Address,
-		Scheme:    parsed.Scheme,
-		Token:     parsed.Token,
-		TLSConfig: getTLSConfig(parsed),
+func configFromMap(raw map[string]interface{}) (*parsedConfig, error) {
+	parsed := &parsedConfig{}
+	if err := decode.ToStruct(raw, parsed); err != nil {
+		return nil, err
 	}
-	return config, nil
+	return parsed, nil
+}
+
+func configFromURI(uri string) (*parsedConfig, error) {
+	address, scheme := parseRawURI(uri)
+	return &parsedConfig{Address: address, Scheme: scheme}, nil
 }
 
 // Returns the uri broken into an address and scheme portion
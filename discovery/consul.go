@@ -1,9 +1,10 @@
 package discovery
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/consul/api"
@@ -27,66 +28,111 @@ type Consul struct {
 	api.Client
 	lock            sync.RWMutex
 	watchedServices map[string][]*api.ServiceEntry
+	backoff         *backoff
+
+	// the last value of each watched key, if it existed
+	watchedKeys map[string]string
 }
 
 // NewConsul creates a new service discovery backend for Consul
 func NewConsul(config interface{}) (*Consul, error) {
-	var consulConfig *api.Config
+	var parsed *parsedConfig
 	var err error
 	switch t := config.(type) {
 	case string:
-		consulConfig, err = configFromURI(t)
+		parsed, err = configFromURI(t)
 	case map[string]interface{}:
-		consulConfig, err = configFromMap(t)
+		parsed, err = configFromMap(t)
 	default:
 		return nil, fmt.Errorf("no discovery backend defined")
 	}
 	if err != nil {
 		return nil, err
 	}
-
-	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
-		consulConfig.Token = token
+	consulConfig, err := newAPIConfig(parsed)
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newBackoff(parsed)
+	if err != nil {
+		return nil, err
 	}
+
 	client, err := api.NewClient(consulConfig)
 	if err != nil {
 		return nil, err
 	}
 	watchedServices := make(map[string][]*api.ServiceEntry)
-	consul := &Consul{*client, sync.RWMutex{}, watchedServices}
+	consul := &Consul{*client, sync.RWMutex{}, watchedServices, backoff,
+		map[string]string{}}
 	return consul, nil
 }
 
 // PassTTL wraps the Consul.Agent's PassTTL method, and is used to set a
 // TTL check to the passing state
 func (c *Consul) PassTTL(name, note string) error {
-	return c.Agent().PassTTL(name, note)
+	if err := c.backoff.allow(); err != nil {
+		return err
+	}
+	err := c.Agent().PassTTL(name, note)
+	c.backoff.record(err)
+	return err
+}
+
+// FailTTL implements TTLFailer for Consul by wrapping the Consul.Agent's
+// FailTTL method, which sets a TTL check to the critical state
+func (c *Consul) FailTTL(name, note string) error {
+	if err := c.backoff.allow(); err != nil {
+		return err
+	}
+	err := c.Agent().FailTTL(name, note)
+	c.backoff.record(err)
+	return err
 }
 
 // CheckRegister wraps the Consul.Agent's CheckRegister method,
 // is used to register a new service with the local agent
 func (c *Consul) CheckRegister(check *api.AgentCheckRegistration) error {
-	return c.Agent().CheckRegister(check)
+	if err := c.backoff.allow(); err != nil {
+		return err
+	}
+	err := c.Agent().CheckRegister(check)
+	c.backoff.record(err)
+	return err
 }
 
 // ServiceRegister wraps the Consul.Agent's ServiceRegister method,
 // is used to register a new service with the local agent
 func (c *Consul) ServiceRegister(service *api.AgentServiceRegistration) error {
-	return c.Agent().ServiceRegister(service)
+	if err := c.backoff.allow(); err != nil {
+		return err
+	}
+	err := c.Agent().ServiceRegister(service)
+	c.backoff.record(err)
+	return err
 }
 
 // ServiceDeregister wraps the Consul.Agent's ServiceDeregister method,
-// and is used to deregister a service from the local agent
+// and is used to deregister a service from the local agent. We always
+// try to deregister, even while backing off, because it usually happens
+// during shutdown when there won't be another chance.
 func (c *Consul) ServiceDeregister(serviceID string) error {
-	return c.Agent().ServiceDeregister(serviceID)
+	err := c.Agent().ServiceDeregister(serviceID)
+	c.backoff.record(err)
+	return err
 }
 
 // CheckForUpstreamChanges requests the set of healthy instances of a
 // service from Consul and checks whether there has been a change since
 // the last check.
 func (c *Consul) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	if err := c.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
 	opts := &api.QueryOptions{Datacenter: dc}
 	instances, meta, err := c.Health().Service(backendName, backendTag, true, opts)
+	c.backoff.record(err)
 	if err != nil {
 		log.Warnf("failed to query %v: %s [%v]", backendName, err, meta)
 		return false, false
@@ -97,6 +143,107 @@ func (c *Consul) CheckForUpstreamChanges(backendName, backendTag, dc string) (di
 	return didChange, isHealthy
 }
 
+// CheckForUpstreamChangesInDCs implements DatacenterWatcher for Consul by
+// merging the healthy instances of the service in each datacenter. If any
+// datacenter can't be queried we don't report a change, so that the
+// instances in it don't appear to have gone away.
+func (c *Consul) CheckForUpstreamChangesInDCs(backendName, backendTag string, dcs []string) (didChange, isHealthy bool) {
+	if err := c.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
+	var instances []*api.ServiceEntry
+	for _, dc := range dcs {
+		found, meta, err := c.Health().Service(backendName, backendTag, true,
+			&api.QueryOptions{Datacenter: dc})
+		c.backoff.record(err)
+		if err != nil {
+			log.Warnf("failed to query %v in %v: %s [%v]", backendName, dc, err, meta)
+			return false, false
+		}
+		instances = append(instances, found...)
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+	isHealthy = len(instances) > 0
+	didChange = c.compareAndSwap(backendName, instances)
+	return didChange, isHealthy
+}
+
+// CheckForKVChanges implements KVWatcher for Consul. The value of a prefix
+// is a JSON object of the value of each key under it, by the rest of
+// its key after the prefix.
+func (c *Consul) CheckForKVChanges(key, dc string) (didChange, exists bool, value string) {
+	if err := c.backoff.allow(); err != nil {
+		log.Debugf("skipped query for key %v: %v", key, err)
+		return false, false, ""
+	}
+	opts := &api.QueryOptions{Datacenter: dc}
+	if strings.HasSuffix(key, "/") {
+		pairs, _, err := c.KV().List(key, opts)
+		c.backoff.record(err)
+		if err != nil {
+			log.Warnf("failed to query key %v: %s", key, err)
+			return false, false, ""
+		}
+		if len(pairs) > 0 {
+			values := make(map[string]string, len(pairs))
+			for _, pair := range pairs {
+				values[strings.TrimPrefix(pair.Key, key)] = string(pair.Value)
+			}
+			// map keys are sorted, so the same values marshal the same way
+			data, _ := json.Marshal(values)
+			exists, value = true, string(data)
+		}
+	} else {
+		pair, _, err := c.KV().Get(key, opts)
+		c.backoff.record(err)
+		if err != nil {
+			log.Warnf("failed to query key %v: %s", key, err)
+			return false, false, ""
+		}
+		if pair != nil {
+			exists, value = true, string(pair.Value)
+		}
+	}
+	watched := dc + "/" + key
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	last, existed := c.watchedKeys[watched]
+	if exists {
+		c.watchedKeys[watched] = value
+	} else {
+		delete(c.watchedKeys, watched)
+	}
+	didChange = exists != existed || value != last
+	return didChange, exists, value
+}
+
+// Ping implements Pinger for Consul by asking the agent for the leader
+// of its cluster
+func (c *Consul) Ping() error {
+	leader, err := c.Status().Leader()
+	if err != nil {
+		return fmt.Errorf("consul: %v", err)
+	}
+	if leader == "" {
+		return fmt.Errorf("consul: cluster has no leader")
+	}
+	return nil
+}
+
+// SupportsConnect implements ConnectRegistrar for Consul
+func (c *Consul) SupportsConnect() bool { return true }
+
+// SupportsDatacenter implements DatacenterSelector for Consul
+func (c *Consul) SupportsDatacenter() bool { return true }
+
+// InstanceCount implements InstanceCounter for Consul
+func (c *Consul) InstanceCount(service string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.watchedServices[service])
+}
+
 // returns true if any addresses for the service changed and updates
 // the internal state
 func (c *Consul) compareAndSwap(service string, new []*api.ServiceEntry) bool {
@@ -127,6 +274,15 @@ func compareForChange(existing, newEntries []*api.ServiceEntry) (changed bool) {
 // ByServiceID implements the Sort interface because Go can't sort without it.
 type ByServiceID []*api.ServiceEntry
 
-func (se ByServiceID) Len() int           { return len(se) }
-func (se ByServiceID) Swap(i, j int)      { se[i], se[j] = se[j], se[i] }
-func (se ByServiceID) Less(i, j int) bool { return se[i].Service.ID < se[j].Service.ID }
+func (se ByServiceID) Len() int      { return len(se) }
+func (se ByServiceID) Swap(i, j int) { se[i], se[j] = se[j], se[i] }
+func (se ByServiceID) Less(i, j int) bool {
+	// instances in different datacenters can have the same ID
+	if se[i].Service.ID != se[j].Service.ID {
+		return se[i].Service.ID < se[j].Service.ID
+	}
+	if se[i].Service.Address != se[j].Service.Address {
+		return se[i].Service.Address < se[j].Service.Address
+	}
+	return se[i].Service.Port < se[j].Service.Port
+}
@@ -1,11 +1,20 @@
 package discovery
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	consul "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/testutil"
+	"github.com/joyent/containerpilot/config/decode"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,6 +30,247 @@ func TestConsulObjectParse(t *testing.T) {
 	}
 }
 
+func TestConsulTLSConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-tls")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"ca.crt", "client.crt", "client.key"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0600)
+	}
+	parsed := &parsedConfig{}
+	decode.ToStruct(map[string]interface{}{
+		"address": "consul:8501",
+		"scheme":  "https",
+		"tls": map[string]interface{}{
+			"cafile":     filepath.Join(dir, "ca.crt"),
+			"capath":     dir,
+			"clientcert": filepath.Join(dir, "client.crt"),
+			"clientkey":  filepath.Join(dir, "client.key"),
+			"servername": "consul.example.com",
+			"verify":     true,
+		},
+	}, parsed)
+	cfg, err := newAPIConfig(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, consul.TLSConfig{
+		Address:  "consul.example.com",
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CAPath:   dir,
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}, cfg.TLSConfig)
+
+	os.Setenv("CONSUL_TLS_SERVER_NAME", "consul.internal")
+	defer os.Unsetenv("CONSUL_TLS_SERVER_NAME")
+	cfg, err = newAPIConfig(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, "consul.internal", cfg.TLSConfig.Address)
+	assert.Equal(t, filepath.Join(dir, "client.key"), cfg.TLSConfig.KeyFile)
+}
+
+func TestConsulTLSConfigVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-tls")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, []byte("x"), 0600)
+
+	skipVerify := func(tls map[string]interface{}) bool {
+		parsed := &parsedConfig{}
+		decode.ToStruct(map[string]interface{}{
+			"address": "consul:8501", "scheme": "https", "tls": tls}, parsed)
+		cfg, err := newAPIConfig(parsed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cfg.TLSConfig.InsecureSkipVerify
+	}
+	assert.False(t, skipVerify(map[string]interface{}{"cafile": caFile}),
+		"expected the server certificate to be verified by default")
+	assert.True(t, skipVerify(map[string]interface{}{
+		"cafile": caFile, "verify": false}))
+
+	os.Setenv("CONSUL_HTTP_SSL_VERIFY", "false")
+	defer os.Unsetenv("CONSUL_HTTP_SSL_VERIFY")
+	assert.True(t, skipVerify(map[string]interface{}{"cafile": caFile}))
+}
+
+func TestConsulTLSConfigAliases(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-tls")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"ca.crt", "client.crt", "client.key"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0600)
+	}
+	parsed := &parsedConfig{}
+	decode.ToStruct(map[string]interface{}{
+		"address":  "consul:8501",
+		"scheme":   "https",
+		"token":    "ec492475-7753-4ff0-bd65-2f056d68f78b",
+		"caFile":   filepath.Join(dir, "ca.crt"),
+		"certFile": filepath.Join(dir, "client.crt"),
+		"keyFile":  filepath.Join(dir, "client.key"),
+		"verify":   false,
+	}, parsed)
+	cfg, err := newAPIConfig(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, consul.TLSConfig{
+		CAFile:             filepath.Join(dir, "ca.crt"),
+		CertFile:           filepath.Join(dir, "client.crt"),
+		KeyFile:            filepath.Join(dir, "client.key"),
+		InsecureSkipVerify: true,
+	}, cfg.TLSConfig)
+
+	_, err = NewConsul(map[string]interface{}{
+		"address": "consul:8501",
+		"caFile":  filepath.Join(dir, "ca.crt"),
+		"tls":     map[string]interface{}{"cafile": filepath.Join(dir, "ca.crt")},
+	})
+	assert.EqualError(t, err, "consul: only one of 'caFile' or 'tls.cafile' can be set")
+}
+
+func TestConsulTLSConfigUnreadable(t *testing.T) {
+	_, err := NewConsul(map[string]interface{}{
+		"address": "consul:8501",
+		"tls":     map[string]interface{}{"cafile": "/xxxx/ca.crt"},
+	})
+	assert.EqualError(t, err,
+		"consul: could not read tls.cafile: open /xxxx/ca.crt: no such file or directory")
+
+	_, err = NewConsul(map[string]interface{}{
+		"address": "consul:8501",
+		"tls":     map[string]interface{}{"clientcert": "/xxxx/client.crt"},
+	})
+	assert.EqualError(t, err,
+		"consul: tls.clientcert and tls.clientkey must be set together")
+}
+
+func TestConsulToken(t *testing.T) {
+	f, _ := ioutil.TempFile("", "consul-token")
+	defer os.Remove(f.Name())
+	f.WriteString("ec492475-7753-4ff0-bd65-2f056d68f78b\n")
+	f.Close()
+
+	token, err := getToken(&parsedConfig{Token: "abc"})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", token)
+
+	token, err = getToken(&parsedConfig{TokenFile: f.Name()})
+	assert.Nil(t, err)
+	assert.Equal(t, "ec492475-7753-4ff0-bd65-2f056d68f78b", token)
+
+	_, err = getToken(&parsedConfig{Token: "abc", TokenFile: f.Name()})
+	assert.EqualError(t, err, "consul: only one of 'token' or 'tokenFile' can be set")
+
+	_, err = getToken(&parsedConfig{TokenFile: "/xxxx"})
+	assert.EqualError(t, err,
+		"consul: could not read token file: open /xxxx: no such file or directory")
+
+	os.Setenv("CONSUL_HTTP_TOKEN_FILE", f.Name())
+	token, err = getToken(&parsedConfig{Token: "abc"})
+	os.Unsetenv("CONSUL_HTTP_TOKEN_FILE")
+	assert.Nil(t, err)
+	assert.Equal(t, "ec492475-7753-4ff0-bd65-2f056d68f78b", token)
+
+	os.Setenv("CONSUL_HTTP_TOKEN", "from-env")
+	token, err = getToken(&parsedConfig{Token: "abc"})
+	os.Unsetenv("CONSUL_HTTP_TOKEN")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", token)
+}
+
+func TestConsulPing(t *testing.T) {
+	leader := `"10.0.0.2:8300"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/status/leader" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, leader)
+	}))
+	defer server.Close()
+	c, _ := NewConsul(server.URL)
+	assert.Nil(t, c.Ping())
+
+	leader = `""`
+	assert.EqualError(t, c.Ping(), "consul: cluster has no leader")
+
+	// a backend that can't be pinged is skipped
+	multi := NewMultiBackend(&fakeBackend{}, c)
+	assert.EqualError(t, multi.Ping(), "backend 1: consul: cluster has no leader")
+}
+
+func TestConsulCheckForKVChanges(t *testing.T) {
+	values := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		_, recurse := r.URL.Query()["recurse"]
+		pairs := []string{}
+		for k, v := range values {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, fmt.Sprintf(`{"Key": %q, "Value": %q}`,
+					k, base64.StdEncoding.EncodeToString([]byte(v))))
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(pairs)
+		fmt.Fprint(w, "["+strings.Join(pairs, ",")+"]")
+	}))
+	defer server.Close()
+	c, _ := NewConsul(server.URL)
+
+	checkKey := func(key string, expectChange, expectExists bool, expectValue string) {
+		t.Helper()
+		changed, exists, value := c.CheckForKVChanges(key, "")
+		assert.Equal(t, expectChange, changed, "change to key %s", key)
+		assert.Equal(t, expectExists, exists, "existence of key %s", key)
+		assert.Equal(t, expectValue, value, "value of key %s", key)
+	}
+	checkKey("flags/beta", false, false, "")
+	values["flags/beta"] = "on"
+	checkKey("flags/beta", true, true, "on")
+	checkKey("flags/beta", false, true, "on")
+
+	values["flags/alpha"] = "off"
+	checkKey("flags/", true, true, `{"alpha":"off","beta":"on"}`)
+	checkKey("flags/", false, true, `{"alpha":"off","beta":"on"}`)
+	delete(values, "flags/beta")
+	checkKey("flags/beta", true, false, "")
+	checkKey("flags/", true, true, `{"alpha":"off"}`)
+}
+
+func TestConsulCheckForUpstreamChangesInDCs(t *testing.T) {
+	instances := map[string]string{
+		"dc1": `[{"Service": {"ID": "db-1", "Address": "10.0.0.1", "Port": 5432}}]`,
+		"dc2": `[{"Service": {"ID": "db-1", "Address": "10.1.0.1", "Port": 5432}}]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries, ok := instances[r.URL.Query().Get("dc")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, entries)
+	}))
+	defer server.Close()
+	c, _ := NewConsul(server.URL)
+
+	changed, healthy := c.CheckForUpstreamChangesInDCs("db", "", []string{"dc1", "dc2"})
+	assert.True(t, changed && healthy, "expected the instances of both datacenters")
+	assert.Equal(t, 2, c.InstanceCount("db"))
+	changed, _ = c.CheckForUpstreamChangesInDCs("db", "", []string{"dc2", "dc1"})
+	assert.False(t, changed, "expected the same instances in any order to be unchanged")
+
+	// an instance in one datacenter going away is a change, but a
+	// datacenter we can't reach isn't
+	instances["dc2"] = "[]"
+	changed, healthy = c.CheckForUpstreamChangesInDCs("db", "", []string{"dc1", "dc2"})
+	assert.True(t, changed && healthy, "expected the instance in dc2 to be gone")
+	changed, _ = c.CheckForUpstreamChangesInDCs("db", "", []string{"dc1", "dc3"})
+	assert.False(t, changed, "expected no change for an unreachable datacenter")
+	assert.Equal(t, 1, c.InstanceCount("db"))
+}
+
 func TestConsulAddressParse(t *testing.T) {
 	// typical valid entries
 	runParseTest(t, "https://consul:8500", "consul:8500", "https")
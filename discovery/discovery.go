@@ -12,3 +12,48 @@ type Backend interface {
 	ServiceDeregister(serviceID string) error
 	ServiceRegister(service *api.AgentServiceRegistration) error
 }
+
+// InstanceCounter is implemented by Backends that can report how many
+// healthy instances of a watched service they saw on their last check
+type InstanceCounter interface {
+	InstanceCount(service string) int
+}
+
+// Pinger is implemented by Backends that can check that they can reach
+// their service discovery service, without changing anything in it
+type Pinger interface {
+	Ping() error
+}
+
+// DatacenterWatcher is implemented by Backends that can watch a service
+// across several datacenters, as if its instances were all in one
+type DatacenterWatcher interface {
+	CheckForUpstreamChangesInDCs(service, tag string, dcs []string) (didChange, isHealthy bool)
+}
+
+// DatacenterSelector is implemented by Backends that can honor the
+// datacenter passed to CheckForUpstreamChanges or CheckForKVChanges,
+// rather than ignoring it
+type DatacenterSelector interface {
+	SupportsDatacenter() bool
+}
+
+// KVWatcher is implemented by Backends that can watch a key in a
+// key/value store. A key that ends in "/" is a prefix. It returns whether
+// the value has changed since the last check, whether the key exists, and
+// its value.
+type KVWatcher interface {
+	CheckForKVChanges(key, dc string) (didChange, exists bool, value string)
+}
+
+// TTLFailer is implemented by Backends that can set a TTL check to the
+// critical state right away, instead of waiting for its TTL to expire
+type TTLFailer interface {
+	FailTTL(checkID, note string) error
+}
+
+// ConnectRegistrar is implemented by Backends that can register a Consul
+// Connect sidecar proxy along with a service
+type ConnectRegistrar interface {
+	SupportsConnect() bool
+}
@@ -0,0 +1,234 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	defaultDNSPort    = "53"
+)
+
+// DNS is a service discovery backend that looks up the instances of
+// watched services in DNS each time a watch polls. The records are kept
+// by something else (ex. a Kubernetes headless Service, or Route53), so
+// registering services and sending heartbeats do nothing.
+type DNS struct {
+	domain   string
+	timeout  time.Duration
+	resolver dnsResolver
+	backoff  *backoff
+
+	lock            sync.RWMutex
+	watchedServices map[string][]string
+}
+
+// dnsResolver is the part of net.Resolver that we use
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type parsedDNSConfig struct {
+	Resolver string `mapstructure:"resolver"`
+	Domain   string `mapstructure:"domain"`
+	Timeout  string `mapstructure:"timeout"`
+
+	// optional backoff settings for failed lookups
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
+}
+
+// NewDNS creates a new service discovery backend for DNS. The config is
+// either true, to use the system's resolver, or a map of options.
+func NewDNS(config interface{}) (*DNS, error) {
+	parsed := &parsedDNSConfig{}
+	switch t := config.(type) {
+	case bool:
+		if !t {
+			return nil, fmt.Errorf("dns: must be true or a map of options")
+		}
+	case map[string]interface{}:
+		if err := decode.ToStruct(t, parsed); err != nil {
+			return nil, fmt.Errorf("dns: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("dns: must be true or a map of options")
+	}
+	timeout, err := timing.GetTimeout(parsed.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dns: unable to parse timeout '%s': %v",
+			parsed.Timeout, err)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("dns: timeout must be > 0: %v", timeout)
+	}
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	var resolver dnsResolver = net.DefaultResolver
+	if parsed.Resolver != "" {
+		address := parsed.Resolver
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), defaultDNSPort)
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+	backoff, err := newNamedBackoff("dns",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+	if err != nil {
+		return nil, err
+	}
+	return &DNS{
+		domain:          strings.Trim(parsed.Domain, "."),
+		timeout:         timeout,
+		resolver:        resolver,
+		backoff:         backoff,
+		watchedServices: make(map[string][]string),
+	}, nil
+}
+
+// ServiceRegister does nothing, because the DNS records are kept by
+// something else
+func (d *DNS) ServiceRegister(service *api.AgentServiceRegistration) error {
+	return nil
+}
+
+// ServiceDeregister does nothing, like ServiceRegister
+func (d *DNS) ServiceDeregister(serviceID string) error {
+	return nil
+}
+
+// PassTTL does nothing, like ServiceRegister
+func (d *DNS) PassTTL(checkID, note string) error {
+	return nil
+}
+
+// CheckRegister does nothing, like ServiceRegister
+func (d *DNS) CheckRegister(check *api.AgentCheckRegistration) error {
+	return nil
+}
+
+// CheckForUpstreamChanges looks up the instances of the service and
+// checks whether they have changed since the last check. With a tag, we
+// look up the '_<tag>._tcp' SRV records of the service; without one, the
+// SRV records of the service's name, or else its A/AAAA records. DNS
+// doesn't have datacenters, so the dc is ignored.
+func (d *DNS) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	if err := d.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
+	instances, err := d.instances(backendName, backendTag)
+	d.backoff.record(err)
+	if err != nil {
+		log.Warnf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	existing := d.watchedServices[backendName]
+	d.watchedServices[backendName] = instances
+	return !equalStrings(existing, instances), len(instances) > 0
+}
+
+// instances returns the sorted 'ip:port' of the service's SRV records, or
+// the sorted IPs of its A/AAAA records if it only has those
+func (d *DNS) instances(service, tag string) ([]string, error) {
+	name := service
+	if d.domain != "" {
+		name += "." + d.domain
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	proto := ""
+	if tag != "" {
+		proto = "tcp"
+	}
+	instances := []string{}
+	_, records, err := d.resolver.LookupSRV(ctx, tag, proto, name)
+	if isDNSNotFound(err) || (err == nil && len(records) == 0) {
+		if tag != "" {
+			return instances, nil
+		}
+		addrs, err := d.resolver.LookupIPAddr(ctx, name)
+		if isDNSNotFound(err) {
+			return instances, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dns: unable to look up %s: %v", name, err)
+		}
+		for _, addr := range addrs {
+			instances = append(instances, addr.IP.String())
+		}
+		return uniqueSorted(instances), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dns: unable to look up %s: %v", name, err)
+	}
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addrs, err := d.resolver.LookupIPAddr(ctx, target)
+		if isDNSNotFound(err) {
+			continue // an SRV record whose target has gone
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dns: unable to look up %s: %v", target, err)
+		}
+		port := strconv.Itoa(int(record.Port))
+		for _, addr := range addrs {
+			instances = append(instances, net.JoinHostPort(addr.IP.String(), port))
+		}
+	}
+	return uniqueSorted(instances), nil
+}
+
+// InstanceCount implements InstanceCounter for DNS
+func (d *DNS) InstanceCount(service string) int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return len(d.watchedServices[service])
+}
+
+// isDNSNotFound returns true if the name doesn't exist or doesn't have
+// records of the type we asked for, which means there are no instances
+// rather than that the lookup failed
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// uniqueSorted sorts the strings and removes duplicates, as two records
+// can point at the same address
+func uniqueSorted(s []string) []string {
+	sort.Strings(s)
+	unique := s[:0]
+	for _, v := range s {
+		if len(unique) == 0 || v != unique[len(unique)-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDNS answers lookups from its records, and says a name that isn't
+// in its records doesn't exist
+type fakeDNS struct {
+	lock sync.Mutex
+	srv  map[string][]*net.SRV
+	ips  map[string][]string
+	err  error
+}
+
+func (fake *fakeDNS) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if service != "" {
+		name = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	}
+	if fake.err != nil {
+		return "", nil, fake.err
+	}
+	records, ok := fake.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (fake *fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	ips, ok := fake.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (fake *fakeDNS) set(srv map[string][]*net.SRV, ips map[string][]string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.srv, fake.ips = srv, ips
+}
+
+func TestDNSConfig(t *testing.T) {
+	d, err := NewDNS(true)
+	assert.Nil(t, err)
+	assert.Equal(t, net.DefaultResolver, d.resolver)
+	assert.Equal(t, defaultDNSTimeout, d.timeout)
+
+	d, err = NewDNS(map[string]interface{}{
+		"resolver": "10.0.0.2", "domain": ".apps.svc.cluster.local.", "timeout": "1s"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, net.DefaultResolver, d.resolver)
+	assert.Equal(t, "apps.svc.cluster.local", d.domain)
+
+	_, err = NewDNS(false)
+	assert.EqualError(t, err, "dns: must be true or a map of options")
+	_, err = NewDNS(map[string]interface{}{"timeout": "-1s"})
+	assert.EqualError(t, err, "dns: timeout must be > 0: -1s")
+}
+
+func TestDNSUpstreams(t *testing.T) {
+	fake := &fakeDNS{}
+	d, _ := NewDNS(map[string]interface{}{"domain": "apps.svc.cluster.local"})
+	d.resolver = fake
+
+	didChange, isHealthy := d.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change for a name that doesn't exist")
+	assert.False(t, isHealthy)
+
+	fake.set(map[string][]*net.SRV{
+		"db.apps.svc.cluster.local": {
+			{Target: "db-0.db.apps.svc.cluster.local.", Port: 5432},
+			{Target: "db-1.db.apps.svc.cluster.local.", Port: 5432},
+			{Target: "db-2.db.apps.svc.cluster.local.", Port: 5432}, // gone
+		},
+		"_metrics._tcp.db.apps.svc.cluster.local": {
+			{Target: "db-0.db.apps.svc.cluster.local.", Port: 9187},
+		},
+	}, map[string][]string{
+		"db-0.db.apps.svc.cluster.local": {"10.0.0.5"},
+		"db-1.db.apps.svc.cluster.local": {"10.0.0.6", "fd00::6"},
+	})
+	didChange, isHealthy = d.CheckForUpstreamChanges("db", "", "")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5:5432", "10.0.0.6:5432", "[fd00::6]:5432"},
+		d.watchedServices["db"])
+	assert.Equal(t, 3, d.InstanceCount("db"))
+	didChange, _ = d.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change for the same records")
+
+	didChange, isHealthy = d.CheckForUpstreamChanges("db", "metrics", "")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5:9187"}, d.watchedServices["db"],
+		"expected the tag to select the SRV service")
+	didChange, isHealthy = d.CheckForUpstreamChanges("db", "http", "")
+	assert.True(t, didChange)
+	assert.False(t, isHealthy, "expected a tag without SRV records to have no instances")
+
+	// a name without SRV records falls back to its A/AAAA records
+	fake.set(nil, map[string][]string{
+		"db.apps.svc.cluster.local": {"10.0.0.6", "10.0.0.5", "10.0.0.6"}})
+	didChange, isHealthy = d.CheckForUpstreamChanges("db", "", "")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, d.watchedServices["db"])
+
+	// a failed lookup doesn't change the watch
+	fake.err = &net.DNSError{Err: "i/o timeout", Name: "db", IsTimeout: true}
+	didChange, isHealthy = d.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange)
+	assert.False(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, d.watchedServices["db"])
+}
+
+func TestDNSRegistrationIsNoop(t *testing.T) {
+	d, _ := NewDNS(true)
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80, TTL: 10,
+		IPAddress: "10.0.0.5", Consul: d}
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Nil(t, service.SendHeartbeat())
+	service.Deregister()
+}
@@ -0,0 +1,697 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEtcdPrefix  = "/containerpilot/services"
+	defaultEtcdTimeout = 5 * time.Second
+
+	// defaultEtcdTTL is the lease TTL for a service without a TTL check,
+	// in seconds
+	defaultEtcdTTL = 10
+
+	// etcdWatchTimeout is how long a watch on a service's instances
+	// stays open before it's created again by the next check, so that a
+	// watch for a service that's no longer checked (ex. after a reload)
+	// doesn't stay open forever
+	etcdWatchTimeout = time.Minute
+
+	// etcdUnauthenticated is the gRPC code for an expired auth token
+	etcdUnauthenticated = 16
+)
+
+// errEtcdLeaseExpired means a service's lease has expired, so it needs to
+// be registered again
+var errEtcdLeaseExpired = errors.New("lease has expired")
+
+// Etcd is a service discovery backend for etcd v3. Each service is a key
+// under the prefix, attached to a lease with the TTL of the service's
+// health check, so that a service that stops sending heartbeats expires
+// on its own. Requests use the JSON API of the etcd gRPC gateway, which
+// requires etcd 3.4 or later.
+type Etcd struct {
+	endpoints []string
+	prefix    string
+	username  string
+	password  string
+	client    *http.Client
+	timeout   time.Duration
+	backoff   *backoff
+
+	lock            sync.RWMutex
+	token           string
+	leases          map[string]*etcdLease // by check ID
+	watchedServices map[string][]string
+	watchers        map[string]*etcdWatcher
+}
+
+type parsedEtcdConfig struct {
+	Endpoints interface{}         `mapstructure:"endpoints"`
+	Prefix    string              `mapstructure:"prefix"`
+	Username  string              `mapstructure:"username"`
+	Password  string              `mapstructure:"password"`
+	Timeout   string              `mapstructure:"timeout"`
+	TLS       parsedEtcdTLSConfig `mapstructure:"tls"`
+
+	// optional backoff settings for failed requests
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
+}
+
+type parsedEtcdTLSConfig struct {
+	CAFile     string `mapstructure:"cafile"`
+	ClientCert string `mapstructure:"clientcert"`
+	ClientKey  string `mapstructure:"clientkey"`
+	ServerName string `mapstructure:"servername"`
+}
+
+// registryInstance is the value of a service's key in etcd, or of its
+// znode in ZooKeeper
+type registryInstance struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Status  string            `json:"status"`
+}
+
+// etcdLease is the lease that a registered service's key is attached to
+type etcdLease struct {
+	id       etcdInt
+	key      string
+	instance registryInstance
+}
+
+// etcdWatcher tracks the watch on the instances of a service. The
+// instances are only read again once the watch has seen a change, or
+// once the watch has ended and we may have missed one.
+type etcdWatcher struct {
+	running bool
+	dirty   bool
+}
+
+// NewEtcd creates a new service discovery backend for etcd. The config is
+// either the URL of an etcd endpoint, or a map of options.
+func NewEtcd(config interface{}) (*Etcd, error) {
+	parsed := &parsedEtcdConfig{}
+	switch t := config.(type) {
+	case string:
+		parsed.Endpoints = t
+	case map[string]interface{}:
+		if err := decode.ToStruct(t, parsed); err != nil {
+			return nil, fmt.Errorf("etcd: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("etcd: no endpoints defined")
+	}
+	endpoints, err := decode.ToStrings(parsed.Endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: unable to parse endpoints: %v", err)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcd: no endpoints defined")
+	}
+	for i, endpoint := range endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		endpoints[i] = strings.TrimSuffix(endpoint, "/")
+	}
+	timeout, err := timing.GetTimeout(parsed.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: unable to parse timeout '%s': %v",
+			parsed.Timeout, err)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("etcd: timeout must be > 0: %v", timeout)
+	}
+	if timeout == 0 {
+		timeout = defaultEtcdTimeout
+	}
+	prefix := parsed.Prefix
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+	if (parsed.Username == "") != (parsed.Password == "") {
+		return nil, fmt.Errorf("etcd: username and password must be set together")
+	}
+	tlsConfig, err := newEtcdTLSConfig(parsed.TLS)
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newNamedBackoff("etcd",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+	if err != nil {
+		return nil, err
+	}
+	return &Etcd{
+		endpoints: endpoints,
+		prefix:    strings.TrimSuffix(prefix, "/") + "/",
+		username:  parsed.Username,
+		password:  parsed.Password,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}},
+		timeout:         timeout,
+		backoff:         backoff,
+		leases:          make(map[string]*etcdLease),
+		watchedServices: make(map[string][]string),
+		watchers:        make(map[string]*etcdWatcher),
+	}, nil
+}
+
+// newEtcdTLSConfig returns the TLS config for https endpoints, reading
+// any files now rather than failing on the first request
+func newEtcdTLSConfig(parsed parsedEtcdTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: parsed.ServerName}
+	if parsed.CAFile != "" {
+		pem, err := ioutil.ReadFile(parsed.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: could not read tls.cafile: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("etcd: no certificates in tls.cafile")
+		}
+	}
+	if (parsed.ClientCert == "") != (parsed.ClientKey == "") {
+		return nil, fmt.Errorf("etcd: tls.clientcert and tls.clientkey must be set together")
+	}
+	if parsed.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(parsed.ClientCert, parsed.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: could not read tls.clientcert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// ServiceRegister puts the service's key with a lease for the TTL of its
+// check. A service that's registered again (ex. with a new status) keeps
+// its lease as long as the lease hasn't expired.
+func (e *Etcd) ServiceRegister(service *api.AgentServiceRegistration) error {
+	if err := e.backoff.allow(); err != nil {
+		return err
+	}
+	err := e.register(service)
+	e.backoff.record(err)
+	return err
+}
+
+func (e *Etcd) register(service *api.AgentServiceRegistration) error {
+	instance := registryInstance{
+		ID:      service.ID,
+		Name:    service.Name,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+		Status:  api.HealthPassing,
+	}
+	ttl := defaultEtcdTTL
+	if service.Check != nil {
+		instance.Status = service.Check.Status
+		if seconds, err := strconv.Atoi(strings.TrimSuffix(service.Check.TTL, "s")); err == nil {
+			ttl = seconds
+		}
+	}
+	checkID := "service:" + service.ID
+	lease := &etcdLease{key: e.prefix + service.Name + "/" + service.ID,
+		instance: instance}
+
+	e.lock.RLock()
+	existing, ok := e.leases[checkID]
+	e.lock.RUnlock()
+	if ok && existing.key == lease.key {
+		lease.id = existing.id
+		if err := e.put(lease); err == nil {
+			e.storeLease(checkID, lease)
+			return nil
+		}
+		// the lease has most likely expired, so we need a new one
+	}
+	var granted struct {
+		ID etcdInt `json:"ID"`
+	}
+	if err := e.call("/v3/lease/grant", map[string]interface{}{
+		"TTL": ttl}, &granted); err != nil {
+		return fmt.Errorf("etcd: unable to grant lease: %v", err)
+	}
+	lease.id = granted.ID
+	if err := e.put(lease); err != nil {
+		return err
+	}
+	if ok && existing.key != lease.key {
+		// the service's name changed, so the old key needs to go now
+		// rather than when its lease expires
+		e.revoke(existing)
+	}
+	e.storeLease(checkID, lease)
+	return nil
+}
+
+func (e *Etcd) storeLease(checkID string, lease *etcdLease) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.leases[checkID] = lease
+}
+
+// put writes the key of the lease's service
+func (e *Etcd) put(lease *etcdLease) error {
+	value, err := json.Marshal(lease.instance)
+	if err != nil {
+		return err
+	}
+	if err := e.call("/v3/kv/put", map[string]interface{}{
+		"key":   []byte(lease.key),
+		"value": value,
+		"lease": lease.id,
+	}, nil); err != nil {
+		return fmt.Errorf("etcd: unable to put %s: %v", lease.key, err)
+	}
+	return nil
+}
+
+// revoke revokes the lease, which deletes the service's key
+func (e *Etcd) revoke(lease *etcdLease) error {
+	err := e.call("/v3/lease/revoke", map[string]interface{}{"ID": lease.id}, nil)
+	if err != nil {
+		return fmt.Errorf("etcd: unable to revoke lease for %s: %v", lease.key, err)
+	}
+	return nil
+}
+
+// ServiceDeregister revokes the lease of the service. Like Consul, we
+// always try to deregister, even while backing off.
+func (e *Etcd) ServiceDeregister(serviceID string) error {
+	e.lock.Lock()
+	lease, ok := e.leases["service:"+serviceID]
+	delete(e.leases, "service:"+serviceID)
+	e.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	err := e.revoke(lease)
+	e.backoff.record(err)
+	return err
+}
+
+// PassTTL keeps the lease of the check's service alive, and marks the
+// service as passing if it was registered with another status. An error
+// means the lease has expired, so the service is registered again.
+func (e *Etcd) PassTTL(checkID, note string) error {
+	e.lock.RLock()
+	lease, ok := e.leases[checkID]
+	e.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("etcd: unknown check %s", checkID)
+	}
+	if err := e.backoff.allow(); err != nil {
+		return err
+	}
+	err := e.keepalive(checkID, lease)
+	if errors.Is(err, errEtcdLeaseExpired) {
+		// etcd answered, so this isn't a reason to back off of the
+		// registration that follows
+		e.backoff.record(nil)
+		return err
+	}
+	e.backoff.record(err)
+	return err
+}
+
+func (e *Etcd) keepalive(checkID string, lease *etcdLease) error {
+	var keepalive struct {
+		Result struct {
+			TTL etcdInt `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.call("/v3/lease/keepalive", map[string]interface{}{
+		"ID": lease.id}, &keepalive); err != nil {
+		return fmt.Errorf("etcd: unable to keep lease for %s alive: %v", lease.key, err)
+	}
+	if keepalive.Result.TTL <= 0 {
+		e.lock.Lock()
+		delete(e.leases, checkID)
+		e.lock.Unlock()
+		return fmt.Errorf("etcd: %w: %s", errEtcdLeaseExpired, lease.key)
+	}
+	if lease.instance.Status == api.HealthPassing {
+		return nil
+	}
+	passing := *lease
+	passing.instance.Status = api.HealthPassing
+	if err := e.put(&passing); err != nil {
+		return err
+	}
+	e.storeLease(checkID, &passing)
+	return nil
+}
+
+// CheckRegister isn't supported by etcd, so the only checks are the TTL
+// checks of the services themselves
+func (e *Etcd) CheckRegister(check *api.AgentCheckRegistration) error {
+	return fmt.Errorf("etcd: checks can only be registered with a service")
+}
+
+// CheckForUpstreamChanges reads the passing instances of the service and
+// checks whether they have changed since the last check. Between checks
+// we watch the service's keys, so the instances are only read again if
+// the watch has seen a change. Datacenters aren't supported by etcd, so
+// watches can't set a dc and it's always empty.
+func (e *Etcd) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	e.lock.RLock()
+	watcher, watching := e.watchers[backendName]
+	if watching && watcher.running && !watcher.dirty {
+		isHealthy = len(e.watchedServices[backendName]) > 0
+		e.lock.RUnlock()
+		return false, isHealthy
+	}
+	e.lock.RUnlock()
+
+	if err := e.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
+	instances, revision, err := e.instances(backendName, backendTag)
+	e.backoff.record(err)
+	if err != nil {
+		log.Warnf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	existing := e.watchedServices[backendName]
+	e.watchedServices[backendName] = instances
+	if !watching {
+		watcher = &etcdWatcher{}
+		e.watchers[backendName] = watcher
+	}
+	watcher.dirty = false
+	if !watcher.running {
+		watcher.running = true
+		go e.watch(backendName, watcher, revision+1)
+	}
+	return !equalStrings(existing, instances), len(instances) > 0
+}
+
+// instances returns the sorted 'ip:port' of the passing instances of the
+// service with the tag, and the revision they were read at
+func (e *Etcd) instances(service, tag string) ([]string, int64, error) {
+	key := e.prefix + service + "/"
+	var response struct {
+		Header struct {
+			Revision etcdInt `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := e.call("/v3/kv/range", map[string]interface{}{
+		"key":       []byte(key),
+		"range_end": prefixEnd(key),
+	}, &response); err != nil {
+		return nil, 0, err
+	}
+	instances := []string{}
+	for _, kv := range response.KVs {
+		var instance registryInstance
+		if err := json.Unmarshal(kv.Value, &instance); err != nil {
+			log.Debugf("etcd: ignoring invalid service %s: %v", kv.Key, err)
+			continue
+		}
+		if instance.Status != api.HealthPassing {
+			continue
+		}
+		if tag != "" && !containsTag(instance.Tags, tag) {
+			continue
+		}
+		instances = append(instances,
+			net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port)))
+	}
+	sort.Strings(instances)
+	return instances, int64(response.Header.Revision), nil
+}
+
+// watch marks the watcher dirty when any of the service's keys change
+// after the revision. When the watch ends we can't know what we missed,
+// so the watcher is marked dirty as well, and the next check reads the
+// instances and watches them again.
+func (e *Etcd) watch(service string, watcher *etcdWatcher, revision int64) {
+	defer func() {
+		e.lock.Lock()
+		watcher.running = false
+		watcher.dirty = true
+		e.lock.Unlock()
+	}()
+	key := e.prefix + service + "/"
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(key),
+			"range_end":      prefixEnd(key),
+			"start_revision": etcdInt(revision),
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdWatchTimeout)
+	defer cancel()
+	err := e.stream(ctx, "/v3/watch", request, func(decoder *json.Decoder) error {
+		for {
+			var response struct {
+				Result struct {
+					Events   []json.RawMessage `json:"events"`
+					Canceled bool              `json:"canceled"`
+				} `json:"result"`
+			}
+			if err := decoder.Decode(&response); err != nil {
+				return err
+			}
+			if response.Result.Canceled {
+				return fmt.Errorf("watch canceled")
+			}
+			if len(response.Result.Events) > 0 {
+				e.lock.Lock()
+				watcher.dirty = true
+				e.lock.Unlock()
+			}
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Debugf("etcd: watch for %s ended: %v", service, err)
+	}
+}
+
+// InstanceCount implements InstanceCounter for Etcd
+func (e *Etcd) InstanceCount(service string) int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return len(e.watchedServices[service])
+}
+
+// Ping implements Pinger for Etcd by asking for the status of the first
+// endpoint that answers
+func (e *Etcd) Ping() error {
+	if err := e.call("/v3/maintenance/status", struct{}{}, nil); err != nil {
+		return fmt.Errorf("etcd: %v", err)
+	}
+	return nil
+}
+
+// call posts the request to the path of the first endpoint that answers,
+// and decodes the first JSON object of the response
+func (e *Etcd) call(path string, request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	return e.stream(ctx, path, request, func(decoder *json.Decoder) error {
+		if response == nil {
+			return nil
+		}
+		return decoder.Decode(response)
+	})
+}
+
+// stream posts the request to the path of each endpoint in turn until
+// one answers, and reads the response with fn. An error from etcd itself
+// is returned without trying the other endpoints.
+func (e *Etcd) stream(ctx context.Context, path string, request interface{},
+	fn func(*json.Decoder) error) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		resp, err := e.post(ctx, endpoint, path, body)
+		if err != nil {
+			var apiErr *etcdError
+			if errors.As(err, &apiErr) {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		err = fn(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		return err
+	}
+	return lastErr
+}
+
+// post makes the request to one endpoint, authenticating first if we
+// have a username and no token
+func (e *Etcd) post(ctx context.Context, endpoint, path string, body []byte) (*http.Response, error) {
+	token, err := e.authenticate(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := &etcdError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = resp.Status
+	}
+	if apiErr.Code == etcdUnauthenticated {
+		// the token has expired, so the next request gets a new one
+		e.lock.Lock()
+		e.token = ""
+		e.lock.Unlock()
+	}
+	return nil, apiErr
+}
+
+// authenticate returns the auth token, requesting one from the endpoint
+// if we don't have one yet
+func (e *Etcd) authenticate(ctx context.Context, endpoint string) (string, error) {
+	if e.username == "" {
+		return "", nil
+	}
+	e.lock.RLock()
+	token := e.token
+	e.lock.RUnlock()
+	if token != "" {
+		return token, nil
+	}
+	body, _ := json.Marshal(map[string]string{
+		"name": e.username, "password": e.password})
+	req, err := http.NewRequest("POST", endpoint+"/v3/auth/authenticate",
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &etcdError{}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		return "", fmt.Errorf("unable to authenticate: %w", apiErr)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", fmt.Errorf("unable to authenticate: %v", err)
+	}
+	e.lock.Lock()
+	e.token = auth.Token
+	e.lock.Unlock()
+	return auth.Token, nil
+}
+
+// etcdError is an error response from the etcd gRPC gateway
+type etcdError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *etcdError) Error() string { return err.Message }
+
+// etcdInt is an int64 in the etcd JSON API, which the gateway encodes as
+// a string
+type etcdInt int64
+
+func (i etcdInt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *etcdInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = etcdInt(n)
+	return nil
+}
+
+// prefixEnd returns the end of the range of keys with the prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // every key
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
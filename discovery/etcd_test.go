@@ -0,0 +1,373 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcd is enough of the etcd v3 JSON gateway for the Etcd backend
+type fakeEtcd struct {
+	*httptest.Server
+	lock     sync.Mutex
+	kvs      map[string]fakeKV
+	leases   map[int64]bool
+	nextID   int64
+	revision int64
+	ranges   int
+	changed  chan struct{}
+	password string // require auth if set
+	tokens   int
+}
+
+type fakeKV struct {
+	value []byte
+	lease int64
+}
+
+func newFakeEtcd(t *testing.T) *fakeEtcd {
+	fake := &fakeEtcd{
+		kvs:     make(map[string]fakeKV),
+		leases:  make(map[int64]bool),
+		changed: make(chan struct{}),
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(func() {
+		// the backend's watches stay open until they time out
+		fake.CloseClientConnections()
+		fake.Close()
+	})
+	return fake
+}
+
+func (fake *fakeEtcd) serve(w http.ResponseWriter, r *http.Request) {
+	var req map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&req)
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var password string
+		json.Unmarshal(req["password"], &password)
+		if password != fake.password {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code": 9, "message": "authentication failed"}`)
+			return
+		}
+		fake.lock.Lock()
+		fake.tokens++
+		token := fmt.Sprintf("token-%d", fake.tokens)
+		fake.lock.Unlock()
+		fmt.Fprintf(w, `{"token": %q}`, token)
+		return
+	}
+	if fake.password != "" && r.Header.Get("Authorization") != fake.token() {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"code": 16, "message": "etcdserver: invalid auth token"}`)
+		return
+	}
+	if r.URL.Path == "/v3/watch" {
+		var create struct {
+			StartRevision json.RawMessage `json:"start_revision"`
+		}
+		json.Unmarshal(req["create_request"], &create)
+		fake.watch(w, r, parseFakeInt(create.StartRevision))
+		return
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		fake.nextID++
+		fake.leases[fake.nextID] = true
+		fmt.Fprintf(w, `{"ID": "%d", "TTL": %s}`, fake.nextID, req["TTL"])
+	case "/v3/lease/keepalive":
+		id := parseFakeInt(req["ID"])
+		if !fake.leases[id] {
+			fmt.Fprintf(w, `{"result": {"ID": "%d"}}`, id)
+			return
+		}
+		fmt.Fprintf(w, `{"result": {"ID": "%d", "TTL": "10"}}`, id)
+	case "/v3/maintenance/status":
+		fmt.Fprint(w, `{"version": "3.5.0"}`)
+	case "/v3/lease/revoke":
+		fake.expireLocked(parseFakeInt(req["ID"]))
+		fmt.Fprint(w, `{}`)
+	case "/v3/kv/put":
+		var key, value []byte
+		json.Unmarshal(req["key"], &key)
+		json.Unmarshal(req["value"], &value)
+		lease := parseFakeInt(req["lease"])
+		if !fake.leases[lease] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"code": 5, "message": "etcdserver: requested lease not found"}`)
+			return
+		}
+		fake.kvs[string(key)] = fakeKV{value: value, lease: lease}
+		fake.changeLocked()
+		fmt.Fprint(w, `{}`)
+	case "/v3/kv/range":
+		var key, end []byte
+		json.Unmarshal(req["key"], &key)
+		json.Unmarshal(req["range_end"], &end)
+		fake.ranges++
+		var kvs []map[string][]byte
+		for k, kv := range fake.kvs {
+			if k >= string(key) && k < string(end) {
+				kvs = append(kvs, map[string][]byte{"key": []byte(k), "value": kv.value})
+			}
+		}
+		out, _ := json.Marshal(kvs)
+		fmt.Fprintf(w, `{"header": {"revision": "%d"}, "kvs": %s}`, fake.revision, out)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// watch sends an event for every change since the revision until the
+// request is done
+func (fake *fakeEtcd) watch(w http.ResponseWriter, r *http.Request, revision int64) {
+	fmt.Fprint(w, `{"result": {"created": true}}`)
+	w.(http.Flusher).Flush()
+	for {
+		fake.lock.Lock()
+		changed := fake.changed
+		missed := fake.revision >= revision
+		revision = fake.revision + 1
+		fake.lock.Unlock()
+		if missed {
+			fmt.Fprint(w, `{"result": {"events": [{}]}}`)
+			w.(http.Flusher).Flush()
+			continue
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (fake *fakeEtcd) token() string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fmt.Sprintf("token-%d", fake.tokens)
+}
+
+func (fake *fakeEtcd) changeLocked() {
+	fake.revision++
+	close(fake.changed)
+	fake.changed = make(chan struct{})
+}
+
+// expire expires every lease, as if the heartbeats had stopped
+func (fake *fakeEtcd) expire() {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for id := range fake.leases {
+		fake.expireLocked(id)
+	}
+}
+
+func (fake *fakeEtcd) expireLocked(id int64) {
+	delete(fake.leases, id)
+	for k, kv := range fake.kvs {
+		if kv.lease == id {
+			delete(fake.kvs, k)
+		}
+	}
+	fake.changeLocked()
+}
+
+func (fake *fakeEtcd) keys() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	var keys []string
+	for k := range fake.kvs {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (fake *fakeEtcd) value(key string) registryInstance {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	var instance registryInstance
+	json.Unmarshal(fake.kvs[key].value, &instance)
+	return instance
+}
+
+func (fake *fakeEtcd) rangeCount() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.ranges
+}
+
+func parseFakeInt(raw json.RawMessage) int64 {
+	var i etcdInt
+	i.UnmarshalJSON(raw)
+	return int64(i)
+}
+
+func TestEtcdConfig(t *testing.T) {
+	e, err := NewEtcd("etcd:2379")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://etcd:2379"}, e.endpoints)
+	assert.Equal(t, "/containerpilot/services/", e.prefix)
+	assert.Equal(t, defaultEtcdTimeout, e.timeout)
+
+	e, err = NewEtcd(map[string]interface{}{
+		"endpoints": []interface{}{"https://etcd-0:2379/", "etcd-1:2379"},
+		"prefix":    "/services/", "timeout": "1s"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://etcd-0:2379", "http://etcd-1:2379"}, e.endpoints)
+	assert.Equal(t, "/services/", e.prefix)
+	assert.Equal(t, time.Second, e.timeout)
+
+	_, err = NewEtcd(map[string]interface{}{"prefix": "/services"})
+	assert.EqualError(t, err, "etcd: no endpoints defined")
+	_, err = NewEtcd(map[string]interface{}{"endpoints": "etcd:2379", "username": "cp"})
+	assert.EqualError(t, err, "etcd: username and password must be set together")
+	_, err = NewEtcd(map[string]interface{}{"endpoints": "etcd:2379",
+		"tls": map[string]interface{}{"cafile": "/nope"}})
+	assert.EqualError(t, err,
+		"etcd: could not read tls.cafile: open /nope: no such file or directory")
+}
+
+func TestEtcdRegistration(t *testing.T) {
+	fake := newFakeEtcd(t)
+	e, _ := NewEtcd(fake.URL)
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80,
+		TTL: 10, IPAddress: "10.0.0.5", Tags: []string{"a"}, Consul: e}
+	key := "/containerpilot/services/app/app-1"
+
+	assert.Nil(t, service.SendWarning())
+	assert.Equal(t, api.HealthWarning, fake.value(key).Status)
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Equal(t, registryInstance{ID: "app-1", Name: "app", Address: "10.0.0.5",
+		Port: 80, Tags: []string{"a"}, Status: api.HealthPassing}, fake.value(key),
+		"expected the heartbeat to mark the service as passing")
+	assert.Equal(t, etcdInt(1), e.leases["service:app-1"].id,
+		"expected the registration to keep its lease")
+
+	// a heartbeat after the lease has expired registers the service again
+	fake.expire()
+	assert.Empty(t, fake.keys())
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Equal(t, []string{key}, fake.keys())
+	assert.Equal(t, etcdInt(2), e.leases["service:app-1"].id)
+
+	service.Deregister()
+	assert.Empty(t, fake.keys())
+	err := e.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err, "etcd: unknown check service:app-1",
+		"expected a deregistered service to be unknown")
+}
+
+func TestEtcdUpstreams(t *testing.T) {
+	fake := newFakeEtcd(t)
+	e, _ := NewEtcd(fake.URL)
+	register := func(id, ip string, status string, tags ...string) {
+		err := e.ServiceRegister(&api.AgentServiceRegistration{ID: id, Name: "db",
+			Address: ip, Port: 5432, Tags: tags,
+			Check: &api.AgentServiceCheck{TTL: "10s", Status: status}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// waitForChange waits for the watch to see a change, and then checks
+	waitForChange := func(tag string) (bool, bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			e.lock.RLock()
+			dirty := e.watchers["db"].dirty
+			e.lock.RUnlock()
+			if dirty {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return e.CheckForUpstreamChanges("db", tag, "")
+	}
+
+	didChange, isHealthy := e.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change with no instances")
+	assert.False(t, isHealthy)
+
+	register("db-1", "10.0.0.5", api.HealthPassing, "primary")
+	register("db-2", "10.0.0.6", api.HealthWarning)
+	didChange, isHealthy = waitForChange("")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5:5432"}, e.watchedServices["db"],
+		"expected only passing instances")
+	assert.Equal(t, 1, e.InstanceCount("db"))
+
+	// without a change the instances aren't read again
+	ranges := fake.rangeCount()
+	didChange, isHealthy = e.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, ranges, fake.rangeCount(), "expected the watch to be used")
+
+	register("db-2", "10.0.0.6", api.HealthPassing)
+	didChange, _ = waitForChange("")
+	assert.True(t, didChange)
+	assert.Equal(t, []string{"10.0.0.5:5432", "10.0.0.6:5432"}, e.watchedServices["db"])
+
+	register("db-2", "10.0.0.6", api.HealthPassing, "replica")
+	didChange, _ = waitForChange("primary")
+	assert.True(t, didChange)
+	assert.Equal(t, []string{"10.0.0.5:5432"}, e.watchedServices["db"],
+		"expected only instances with the tag")
+}
+
+func TestEtcdAuthAndFailover(t *testing.T) {
+	fake := newFakeEtcd(t)
+	fake.password = "secret"
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	e, _ := NewEtcd(map[string]interface{}{
+		"endpoints": []interface{}{down.URL, fake.URL},
+		"username":  "cp", "password": "secret"})
+	registration := &api.AgentServiceRegistration{ID: "app-1", Name: "app",
+		Address: "10.0.0.5", Port: 80}
+	assert.Nil(t, e.ServiceRegister(registration),
+		"expected the request to fail over to the next endpoint")
+	assert.Equal(t, "token-1", e.token)
+
+	// an expired token fails the request and is replaced on the next one
+	fake.lock.Lock()
+	fake.tokens++
+	fake.lock.Unlock()
+	err := e.PassTTL("service:app-1", "ok")
+	assert.True(t, strings.HasSuffix(err.Error(), "etcdserver: invalid auth token"),
+		"unexpected error: %v", err)
+	e.backoff.record(nil)
+	assert.Nil(t, e.PassTTL("service:app-1", "ok"))
+	assert.Equal(t, "token-3", e.token)
+}
+
+func TestEtcdPing(t *testing.T) {
+	fake := newFakeEtcd(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	e, _ := NewEtcd(map[string]interface{}{
+		"endpoints": []interface{}{down.URL, fake.URL}})
+	assert.Nil(t, e.Ping(), "expected the ping to fail over to the next endpoint")
+
+	e, _ = NewEtcd(down.URL)
+	err := e.Ping()
+	assert.True(t, strings.HasPrefix(err.Error(), "etcd: "), "unexpected error: %v", err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("/services/db0"), prefixEnd("/services/db/"))
+	assert.Equal(t, []byte{'a', 0x01}, prefixEnd("a\x00\xff"))
+	assert.Equal(t, []byte{0}, prefixEnd("\xff"))
+}
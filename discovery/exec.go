@@ -0,0 +1,313 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/commands"
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultExecTimeout = 10 * time.Second
+
+	// execOutputLimit is how much of the end of a failed command's stderr
+	// is included in its error
+	execOutputLimit = 1024
+)
+
+// Exec is a service discovery backend that runs external commands to
+// register services with, and query, a service registry that doesn't have
+// a native backend. Each command gets its arguments in the environment,
+// and any exit code other than 0 is a failed request.
+type Exec struct {
+	register     *execCommand
+	deregister   *execCommand
+	heartbeat    *execCommand
+	getUpstreams *execCommand
+	backoff      *backoff
+
+	lock            sync.RWMutex
+	registrations   map[string]*api.AgentServiceRegistration // by check ID
+	watchedServices map[string][]string
+}
+
+type parsedExecConfig struct {
+	Register     interface{} `mapstructure:"register"`
+	Deregister   interface{} `mapstructure:"deregister"`
+	Heartbeat    interface{} `mapstructure:"heartbeat"`
+	GetUpstreams interface{} `mapstructure:"getUpstreams"`
+	Timeout      string      `mapstructure:"timeout"`
+
+	// optional backoff settings for failed commands
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
+}
+
+// execCommand is one of the commands of an Exec backend
+type execCommand struct {
+	name    string
+	exec    string
+	args    []string
+	timeout time.Duration
+}
+
+// NewExec creates a new service discovery backend that runs the commands
+// in the config
+func NewExec(config interface{}) (*Exec, error) {
+	parsed := &parsedExecConfig{}
+	if err := decode.ToStruct(config, parsed); err != nil {
+		return nil, fmt.Errorf("exec: %v", err)
+	}
+	timeout, err := timing.GetTimeout(parsed.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("exec: unable to parse timeout '%s': %v",
+			parsed.Timeout, err)
+	}
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("exec: timeout must be > 0: %v", timeout)
+	}
+	newCommand := func(name string, raw interface{}, required bool) (*execCommand, error) {
+		if raw == nil {
+			if required {
+				return nil, fmt.Errorf("exec: %s must be set", name)
+			}
+			return nil, nil
+		}
+		executable, args, err := commands.ParseArgs(raw)
+		if err != nil {
+			return nil, fmt.Errorf("exec: unable to parse %s: %v", name, err)
+		}
+		return &execCommand{name: name, exec: executable, args: args,
+			timeout: timeout}, nil
+	}
+	e := &Exec{
+		registrations:   make(map[string]*api.AgentServiceRegistration),
+		watchedServices: make(map[string][]string),
+	}
+	if e.register, err = newCommand("register", parsed.Register, true); err != nil {
+		return nil, err
+	}
+	if e.deregister, err = newCommand("deregister", parsed.Deregister, true); err != nil {
+		return nil, err
+	}
+	if e.heartbeat, err = newCommand("heartbeat", parsed.Heartbeat, false); err != nil {
+		return nil, err
+	}
+	if e.getUpstreams, err = newCommand("getUpstreams", parsed.GetUpstreams, false); err != nil {
+		return nil, err
+	}
+	e.backoff, err = newNamedBackoff("exec",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// run runs the command with the env on top of the environment of
+// ContainerPilot, and returns its stdout if it exits with 0
+func (c *execCommand) run(env []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.exec, c.args...)
+	cmd.Env = append(os.Environ(), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s timeout after %v", c.name, c.timeout)
+	}
+	if err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if len(output) > execOutputLimit {
+			output = output[len(output)-execOutputLimit:]
+		}
+		if output != "" {
+			return "", fmt.Errorf("%s failed: %v: %s", c.name, err, output)
+		}
+		return "", fmt.Errorf("%s failed: %v", c.name, err)
+	}
+	log.Debugf("exec: %s succeeded", c.name)
+	return stdout.String(), nil
+}
+
+// runWithBackoff runs the command unless we're backing off, and records
+// the result in the backoff
+func (e *Exec) runWithBackoff(c *execCommand, env []string) (string, error) {
+	if err := e.backoff.allow(); err != nil {
+		return "", err
+	}
+	out, err := c.run(env)
+	e.backoff.record(err)
+	return out, err
+}
+
+// registrationEnv returns the environment for the register command
+func registrationEnv(service *api.AgentServiceRegistration) []string {
+	status := api.HealthPassing
+	ttl := ""
+	if service.Check != nil {
+		status = service.Check.Status
+		ttl = strings.TrimSuffix(service.Check.TTL, "s")
+	}
+	return []string{
+		"CONTAINERPILOT_SERVICE_ID=" + service.ID,
+		"CONTAINERPILOT_SERVICE_NAME=" + service.Name,
+		"CONTAINERPILOT_SERVICE_IP=" + service.Address,
+		"CONTAINERPILOT_SERVICE_PORT=" + strconv.Itoa(service.Port),
+		"CONTAINERPILOT_SERVICE_TAGS=" + strings.Join(service.Tags, ","),
+		"CONTAINERPILOT_SERVICE_STATUS=" + status,
+		"CONTAINERPILOT_SERVICE_TTL=" + ttl,
+	}
+}
+
+// ServiceRegister runs the register command for the service
+func (e *Exec) ServiceRegister(service *api.AgentServiceRegistration) error {
+	if _, err := e.runWithBackoff(e.register, registrationEnv(service)); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.registrations["service:"+service.ID] = service
+	return nil
+}
+
+// ServiceDeregister runs the deregister command for the service. Like
+// Consul, we always try to deregister, even while backing off.
+func (e *Exec) ServiceDeregister(serviceID string) error {
+	e.lock.Lock()
+	delete(e.registrations, "service:"+serviceID)
+	e.lock.Unlock()
+	_, err := e.deregister.run([]string{"CONTAINERPILOT_SERVICE_ID=" + serviceID})
+	e.backoff.record(err)
+	return err
+}
+
+// PassTTL runs the heartbeat command for the service of the TTL check. A
+// failed heartbeat means the registry doesn't know the service, so it's
+// registered again. Without a heartbeat command, we run the register
+// command again instead.
+func (e *Exec) PassTTL(checkID, note string) error {
+	e.lock.RLock()
+	registration, ok := e.registrations[checkID]
+	e.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("exec: unknown check %s", checkID)
+	}
+	if e.heartbeat == nil {
+		passing := *registration
+		if registration.Check != nil {
+			check := *registration.Check
+			check.Status = api.HealthPassing
+			passing.Check = &check
+		}
+		return e.ServiceRegister(&passing)
+	}
+	_, err := e.runWithBackoff(e.heartbeat, []string{
+		"CONTAINERPILOT_SERVICE_ID=" + registration.ID,
+		"CONTAINERPILOT_SERVICE_NAME=" + registration.Name,
+		"CONTAINERPILOT_SERVICE_NOTE=" + note,
+	})
+	return err
+}
+
+// CheckRegister isn't supported by the register command, so the only
+// checks are the TTL checks of the services themselves
+func (e *Exec) CheckRegister(check *api.AgentCheckRegistration) error {
+	return fmt.Errorf("exec: checks can only be registered with a service")
+}
+
+// CheckForUpstreamChanges runs the getUpstreams command for the service
+// and checks whether its healthy instances have changed since the last
+// check. The command prints each healthy instance as 'ip:port' on a line.
+func (e *Exec) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	if e.getUpstreams == nil {
+		log.Warnf("exec: no getUpstreams command to query %v", backendName)
+		return false, false
+	}
+	out, err := e.runWithBackoff(e.getUpstreams, []string{
+		"CONTAINERPILOT_UPSTREAM_NAME=" + backendName,
+		"CONTAINERPILOT_UPSTREAM_TAG=" + backendTag,
+		"CONTAINERPILOT_UPSTREAM_DC=" + dc,
+	})
+	if err != nil {
+		log.Debugf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	instances, err := parseUpstreams(out)
+	if err != nil {
+		log.Warnf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	existing := e.watchedServices[backendName]
+	e.watchedServices[backendName] = instances
+	didChange = !equalStrings(existing, instances)
+	return didChange, len(instances) > 0
+}
+
+// SupportsDatacenter implements DatacenterSelector for Exec, which
+// passes the datacenter to the getUpstreams command
+func (e *Exec) SupportsDatacenter() bool { return true }
+
+// InstanceCount implements InstanceCounter for Exec
+func (e *Exec) InstanceCount(service string) int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return len(e.watchedServices[service])
+}
+
+// parseUpstreams parses the output of the getUpstreams command into the
+// sorted list of instances, ignoring blank lines
+func parseUpstreams(out string) ([]string, error) {
+	instances := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(line)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("getUpstreams printed '%s', expected 'ip:port'", line)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("getUpstreams printed an invalid port: '%s'", line)
+		}
+		instances = append(instances, line)
+	}
+	sort.Strings(instances)
+	return instances, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
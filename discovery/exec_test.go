@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// logCommand is a command that appends the quoted shell to the log file
+func logCommand(shell string) []interface{} {
+	return []interface{}{"sh", "-c", `echo "` + shell + `" >> "$EXEC_TEST_LOG"`}
+}
+
+func execTestLog(t *testing.T) (string, func() []string) {
+	dir, _ := ioutil.TempDir("", "exec-discovery")
+	path := filepath.Join(dir, "log")
+	os.Setenv("EXEC_TEST_LOG", path)
+	t.Cleanup(func() {
+		os.Unsetenv("EXEC_TEST_LOG")
+		os.RemoveAll(dir)
+	})
+	return path, func() []string {
+		out, _ := ioutil.ReadFile(path)
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+}
+
+func TestExecConfig(t *testing.T) {
+	e, err := NewExec(map[string]interface{}{
+		"register": "register.sh", "deregister": []interface{}{"deregister.sh", "-f"}})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultExecTimeout, e.register.timeout)
+	assert.Equal(t, []string{"-f"}, e.deregister.args)
+	assert.Nil(t, e.heartbeat)
+	assert.Nil(t, e.getUpstreams)
+
+	_, err = NewExec(map[string]interface{}{"deregister": "deregister.sh"})
+	assert.EqualError(t, err, "exec: register must be set")
+	_, err = NewExec(map[string]interface{}{
+		"register": "r", "deregister": "d", "timeout": "x"})
+	assert.EqualError(t, err,
+		"exec: unable to parse timeout 'x': time: invalid duration \"x\"")
+	_, err = NewExec(map[string]interface{}{
+		"register": "r", "deregister": "d", "backoffMin": "x"})
+	assert.EqualError(t, err,
+		"exec: unable to parse backoffMin 'x': time: invalid duration \"x\"")
+}
+
+func TestExecRegistration(t *testing.T) {
+	_, read := execTestLog(t)
+	e, err := NewExec(map[string]interface{}{
+		"register": logCommand("register $CONTAINERPILOT_SERVICE_ID " +
+			"$CONTAINERPILOT_SERVICE_NAME $CONTAINERPILOT_SERVICE_IP " +
+			"$CONTAINERPILOT_SERVICE_PORT $CONTAINERPILOT_SERVICE_TAGS " +
+			"$CONTAINERPILOT_SERVICE_STATUS $CONTAINERPILOT_SERVICE_TTL"),
+		"deregister": logCommand("deregister $CONTAINERPILOT_SERVICE_ID"),
+		"heartbeat":  logCommand("heartbeat $CONTAINERPILOT_SERVICE_ID $CONTAINERPILOT_SERVICE_NOTE"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80,
+		TTL: 10, IPAddress: "10.0.0.5", Tags: []string{"a", "b"}, Consul: e}
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Nil(t, service.SendHeartbeat())
+	service.Deregister()
+	assert.Equal(t, []string{
+		"register app-1 app 10.0.0.5 80 a,b passing 10",
+		"heartbeat app-1 ok",
+		"deregister app-1",
+	}, read())
+
+	err = e.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err, "exec: unknown check service:app-1",
+		"expected a deregistered service to be unknown")
+}
+
+// Without a heartbeat command, each heartbeat registers the service again
+func TestExecHeartbeatRegisters(t *testing.T) {
+	_, read := execTestLog(t)
+	e, _ := NewExec(map[string]interface{}{
+		"register": logCommand(
+			"register $CONTAINERPILOT_SERVICE_ID $CONTAINERPILOT_SERVICE_STATUS"),
+		"deregister": "true",
+	})
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80,
+		TTL: 10, IPAddress: "10.0.0.5", Consul: e}
+	assert.Nil(t, service.SendWarning())
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Equal(t, []string{"register app-1 warning", "register app-1 passing"}, read())
+}
+
+func TestExecCommandFailures(t *testing.T) {
+	e, _ := NewExec(map[string]interface{}{
+		"register":   []interface{}{"sh", "-c", "echo 'registry is down' >&2; exit 2"},
+		"deregister": []interface{}{"sleep", "1"},
+		"timeout":    "50ms",
+	})
+	registration := &api.AgentServiceRegistration{ID: "app-1", Name: "app"}
+	err := e.ServiceRegister(registration)
+	assert.EqualError(t, err, "register failed: exit status 2: registry is down")
+	err = e.ServiceRegister(registration)
+	assert.True(t, errors.Is(err, ErrBackingOff), "expected ErrBackingOff, got %v", err)
+
+	// deregistering doesn't wait out the backoff
+	err = e.ServiceDeregister("app-1")
+	assert.EqualError(t, err, "deregister timeout after 50ms")
+}
+
+func TestExecUpstreams(t *testing.T) {
+	path, _ := execTestLog(t)
+	e, _ := NewExec(map[string]interface{}{
+		"register":     "true",
+		"deregister":   "true",
+		"getUpstreams": []interface{}{"sh", "-c", `test "$CONTAINERPILOT_UPSTREAM_NAME" = db && cat "$EXEC_TEST_LOG"`},
+	})
+	upstreams := func(lines string) (bool, bool) {
+		ioutil.WriteFile(path, []byte(lines), 0644)
+		e.backoff.record(nil)
+		return e.CheckForUpstreamChanges("db", "", "")
+	}
+
+	didChange, isHealthy := upstreams("")
+	assert.False(t, didChange, "expected no change with no instances")
+	assert.False(t, isHealthy)
+
+	didChange, isHealthy = upstreams("10.0.0.6:5432\n10.0.0.5:5432\n\n")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, 2, e.InstanceCount("db"))
+
+	didChange, isHealthy = upstreams("10.0.0.5:5432\n10.0.0.6:5432\n")
+	assert.False(t, didChange, "expected the order not to matter")
+	assert.True(t, isHealthy)
+
+	didChange, isHealthy = upstreams("10.0.0.5:5432\n")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+
+	didChange, isHealthy = upstreams("db.internal:5432\n")
+	assert.False(t, didChange, "expected invalid output to be a failure")
+	assert.False(t, isHealthy)
+	assert.Equal(t, 1, e.InstanceCount("db"))
+
+	e.backoff.record(nil)
+	didChange, isHealthy = e.CheckForUpstreamChanges("web", "", "")
+	assert.False(t, didChange, "expected a failed command to be no change")
+	assert.False(t, isHealthy)
+	assert.True(t, errors.Is(e.backoff.allow(), ErrBackingOff),
+		"expected a failed command to back off")
+}
+
+func TestParseUpstreams(t *testing.T) {
+	instances, err := parseUpstreams("10.0.0.6:80\n[fd00::5]:80\n 10.0.0.5:80 \n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.5:80", "10.0.0.6:80", "[fd00::5]:80"}, instances)
+
+	_, err = parseUpstreams("10.0.0.5")
+	assert.EqualError(t, err, "getUpstreams printed '10.0.0.5', expected 'ip:port'")
+	_, err = parseUpstreams("10.0.0.5:0")
+	assert.EqualError(t, err, "getUpstreams printed an invalid port: '10.0.0.5:0'")
+}
@@ -0,0 +1,437 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultKubernetesServiceAccount is where Kubernetes mounts the
+	// service account of a pod
+	defaultKubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultKubernetesTimeout        = 5 * time.Second
+
+	// kubernetesWatchTimeout is how long the API server keeps a watch on
+	// a service's EndpointSlices open, in seconds, before it's created
+	// again by the next check
+	kubernetesWatchTimeout = 60
+
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+)
+
+// Kubernetes is a service discovery backend that reads the EndpointSlices
+// of a Kubernetes Service. Kubernetes adds a pod to the endpoints of the
+// Services that select it once the pod is ready, so registering services
+// and sending heartbeats do nothing.
+type Kubernetes struct {
+	host      string
+	namespace string
+	tokenFile string
+	client    *http.Client
+	timeout   time.Duration
+	backoff   *backoff
+
+	lock            sync.RWMutex
+	watchedServices map[string][]string
+	watchers        map[string]*kubernetesWatcher
+}
+
+type parsedKubernetesConfig struct {
+	Host      string `mapstructure:"host"`
+	Namespace string `mapstructure:"namespace"`
+	TokenFile string `mapstructure:"tokenFile"`
+	CAFile    string `mapstructure:"caFile"`
+	Timeout   string `mapstructure:"timeout"`
+
+	// optional backoff settings for failed requests
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
+}
+
+// kubernetesWatcher tracks the watch on the EndpointSlices of a service,
+// like the etcdWatcher of the Etcd backend
+type kubernetesWatcher struct {
+	running bool
+	dirty   bool
+}
+
+// kubernetesEndpointSlices is the part of an EndpointSliceList that we use
+type kubernetesEndpointSlices struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesEndpointSlice `json:"items"`
+}
+
+type kubernetesEndpointSlice struct {
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port *int   `json:"port"`
+	} `json:"ports"`
+}
+
+// NewKubernetes creates a new service discovery backend for the
+// Kubernetes API of the cluster that ContainerPilot runs in. The config
+// is either true, for the defaults of a pod, or a map of options.
+func NewKubernetes(config interface{}) (*Kubernetes, error) {
+	parsed := &parsedKubernetesConfig{}
+	switch t := config.(type) {
+	case bool:
+		if !t {
+			return nil, fmt.Errorf("kubernetes: must be true or a map of options")
+		}
+	case map[string]interface{}:
+		if err := decode.ToStruct(t, parsed); err != nil {
+			return nil, fmt.Errorf("kubernetes: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("kubernetes: must be true or a map of options")
+	}
+	host, err := kubernetesHost(parsed.Host)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := timing.GetTimeout(parsed.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: unable to parse timeout '%s': %v",
+			parsed.Timeout, err)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("kubernetes: timeout must be > 0: %v", timeout)
+	}
+	if timeout == 0 {
+		timeout = defaultKubernetesTimeout
+	}
+	namespace := parsed.Namespace
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(filepath.Join(defaultKubernetesServiceAccount, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: namespace must be set outside of a pod: %v", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	tokenFile := parsed.TokenFile
+	if tokenFile == "" {
+		tokenFile = filepath.Join(defaultKubernetesServiceAccount, "token")
+	}
+	// the token is read again for each request, because Kubernetes
+	// rotates it, but we make sure we can read it now
+	if _, err := ioutil.ReadFile(tokenFile); err != nil {
+		return nil, fmt.Errorf("kubernetes: could not read tokenFile: %v", err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if strings.HasPrefix(host, "https://") {
+		caFile := parsed.CAFile
+		if caFile == "" {
+			caFile = filepath.Join(defaultKubernetesServiceAccount, "ca.crt")
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: could not read caFile: %v", err)
+		}
+		transport.TLSClientConfig, err = newKubernetesTLSConfig(pem)
+		if err != nil {
+			return nil, err
+		}
+	}
+	backoff, err := newNamedBackoff("kubernetes",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+	if err != nil {
+		return nil, err
+	}
+	return &Kubernetes{
+		host:            host,
+		namespace:       namespace,
+		tokenFile:       tokenFile,
+		client:          &http.Client{Transport: transport},
+		timeout:         timeout,
+		backoff:         backoff,
+		watchedServices: make(map[string][]string),
+		watchers:        make(map[string]*kubernetesWatcher),
+	}, nil
+}
+
+// kubernetesHost returns the URL of the API server, which Kubernetes sets
+// in the environment of every pod
+func kubernetesHost(host string) (string, error) {
+	if host == "" {
+		serviceHost := os.Getenv("KUBERNETES_SERVICE_HOST")
+		servicePort := os.Getenv("KUBERNETES_SERVICE_PORT")
+		if serviceHost == "" || servicePort == "" {
+			return "", fmt.Errorf("kubernetes: host must be set outside of a pod")
+		}
+		host = net.JoinHostPort(serviceHost, servicePort)
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return strings.TrimSuffix(host, "/"), nil
+}
+
+func newKubernetesTLSConfig(pem []byte) (*tls.Config, error) {
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("kubernetes: no certificates in caFile")
+	}
+	return config, nil
+}
+
+// ServiceRegister does nothing, because Kubernetes adds the pod to the
+// endpoints of its Services once the pod is ready
+func (k *Kubernetes) ServiceRegister(service *api.AgentServiceRegistration) error {
+	return nil
+}
+
+// ServiceDeregister does nothing, because Kubernetes removes the pod from
+// the endpoints of its Services once the pod stops being ready
+func (k *Kubernetes) ServiceDeregister(serviceID string) error {
+	return nil
+}
+
+// PassTTL does nothing, because the pod's readiness probe is what
+// Kubernetes checks
+func (k *Kubernetes) PassTTL(checkID, note string) error {
+	return nil
+}
+
+// CheckRegister does nothing, like ServiceRegister
+func (k *Kubernetes) CheckRegister(check *api.AgentCheckRegistration) error {
+	return nil
+}
+
+// CheckForUpstreamChanges reads the ready endpoints of the Service and
+// checks whether they have changed since the last check. Between checks
+// we watch the Service's EndpointSlices, so the endpoints are only read
+// again if the watch has seen a change. The tag is the name of the port
+// to use, and the dc is the namespace of the Service.
+func (k *Kubernetes) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	namespace := dc
+	if namespace == "" {
+		namespace = k.namespace
+	}
+
+	k.lock.RLock()
+	watcher, watching := k.watchers[backendName]
+	if watching && watcher.running && !watcher.dirty {
+		isHealthy = len(k.watchedServices[backendName]) > 0
+		k.lock.RUnlock()
+		return false, isHealthy
+	}
+	k.lock.RUnlock()
+
+	if err := k.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
+	instances, resourceVersion, err := k.endpoints(namespace, backendName, backendTag)
+	k.backoff.record(err)
+	if err != nil {
+		log.Warnf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	existing := k.watchedServices[backendName]
+	k.watchedServices[backendName] = instances
+	if !watching {
+		watcher = &kubernetesWatcher{}
+		k.watchers[backendName] = watcher
+	}
+	watcher.dirty = false
+	if !watcher.running {
+		watcher.running = true
+		go k.watch(namespace, backendName, watcher, resourceVersion)
+	}
+	return !equalStrings(existing, instances), len(instances) > 0
+}
+
+// endpoints returns the sorted 'ip:port' of the ready endpoints of the
+// Service, with the port named by the tag or else the first port, and
+// the resource version they were read at
+func (k *Kubernetes) endpoints(namespace, service, tag string) ([]string, string, error) {
+	var slices kubernetesEndpointSlices
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout)
+	defer cancel()
+	resp, err := k.get(ctx, k.endpointSlicesPath(namespace, service, url.Values{}))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&slices); err != nil {
+		return nil, "", fmt.Errorf("kubernetes: unable to decode EndpointSlices: %v", err)
+	}
+	seen := make(map[string]bool)
+	instances := []string{}
+	for _, slice := range slices.Items {
+		port, ok := slice.port(tag)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// a nil ready condition means ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				// an endpoint can be in two slices while they're updated
+				instance := net.JoinHostPort(address, strconv.Itoa(port))
+				if !seen[instance] {
+					seen[instance] = true
+					instances = append(instances, instance)
+				}
+			}
+		}
+	}
+	sort.Strings(instances)
+	return instances, slices.Metadata.ResourceVersion, nil
+}
+
+// port returns the port of the slice with the name, or its first port if
+// the name is empty
+func (slice kubernetesEndpointSlice) port(name string) (int, bool) {
+	for _, port := range slice.Ports {
+		if port.Port != nil && (name == "" || port.Name == name) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// watch marks the watcher dirty when any of the Service's EndpointSlices
+// change after the resource version. When the watch ends we can't know
+// what we missed, so the watcher is marked dirty as well.
+func (k *Kubernetes) watch(namespace, service string, watcher *kubernetesWatcher, resourceVersion string) {
+	defer func() {
+		k.lock.Lock()
+		watcher.running = false
+		watcher.dirty = true
+		k.lock.Unlock()
+	}()
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(kubernetesWatchTimeout))
+	// the API server ends the watch itself, so this is only a safeguard
+	// against a connection that hangs
+	ctx, cancel := context.WithTimeout(context.Background(),
+		kubernetesWatchTimeout*time.Second+k.timeout)
+	defer cancel()
+	resp, err := k.get(ctx, k.endpointSlicesPath(namespace, service, query))
+	if err != nil {
+		log.Debugf("kubernetes: watch for %s failed: %v", service, err)
+		return
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("kubernetes: watch for %s ended: %v", service, err)
+			}
+			return
+		}
+		switch event.Type {
+		case "BOOKMARK":
+		case "ERROR":
+			// most likely the resource version is too old
+			log.Debugf("kubernetes: watch for %s ended with an error", service)
+			return
+		default:
+			k.lock.Lock()
+			watcher.dirty = true
+			k.lock.Unlock()
+		}
+	}
+}
+
+// SupportsDatacenter implements DatacenterSelector for Kubernetes, which
+// uses the datacenter as the namespace of the Service
+func (k *Kubernetes) SupportsDatacenter() bool { return true }
+
+// InstanceCount implements InstanceCounter for Kubernetes
+func (k *Kubernetes) InstanceCount(service string) int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return len(k.watchedServices[service])
+}
+
+// Ping implements Pinger for Kubernetes by listing an EndpointSlice of
+// the namespace, which also checks that the service account can list them
+func (k *Kubernetes) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout)
+	defer cancel()
+	resp, err := k.get(ctx, k.endpointSlicesPath(k.namespace, "",
+		url.Values{"limit": {"1"}}))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (k *Kubernetes) endpointSlicesPath(namespace, service string, query url.Values) string {
+	query.Set("labelSelector", kubernetesServiceNameLabel+"="+service)
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		url.PathEscape(namespace), query.Encode())
+}
+
+// get makes the request with the service account's token
+func (k *Kubernetes) get(ctx context.Context, path string) (*http.Response, error) {
+	token, err := ioutil.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: could not read tokenFile: %v", err)
+	}
+	req, err := http.NewRequest("GET", k.host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Message == "" {
+		status.Message = resp.Status
+	}
+	return nil, fmt.Errorf("kubernetes: %s", status.Message)
+}
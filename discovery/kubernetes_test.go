@@ -0,0 +1,259 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKubernetes is enough of the Kubernetes API to list and watch the
+// EndpointSlices of a namespace
+type fakeKubernetes struct {
+	*httptest.Server
+	lock     sync.Mutex
+	slices   map[string]map[string]interface{} // by namespace/service
+	version  int
+	lists    int
+	changed  chan struct{}
+	token    string
+	requests []string
+}
+
+func newFakeKubernetes(t *testing.T) *fakeKubernetes {
+	fake := &fakeKubernetes{
+		slices:  make(map[string]map[string]interface{}),
+		changed: make(chan struct{}),
+		token:   "secret",
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(func() {
+		// the backend's watches stay open until they time out
+		fake.CloseClientConnections()
+		fake.Close()
+	})
+	return fake
+}
+
+func (fake *fakeKubernetes) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fake.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"kind": "Status", "message": "Unauthorized"}`)
+		return
+	}
+	var namespace string
+	if _, err := fmt.Sscanf(r.URL.Path,
+		"/apis/discovery.k8s.io/v1/namespaces/%s", &namespace); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	namespace = filepath.Dir(namespace)
+	service := r.URL.Query().Get("labelSelector")[len(kubernetesServiceNameLabel)+1:]
+	key := namespace + "/" + service
+	fake.lock.Lock()
+	fake.requests = append(fake.requests, r.URL.Path+"?"+r.URL.RawQuery)
+	fake.lock.Unlock()
+	if r.URL.Query().Get("watch") == "1" {
+		version, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+		fake.watch(w, r, key, version)
+		return
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.lists++
+	items := []interface{}{}
+	if slice, ok := fake.slices[key]; ok {
+		items = append(items, slice)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metadata": map[string]string{"resourceVersion": strconv.Itoa(fake.version)},
+		"items":    items,
+	})
+}
+
+// watch sends an event for every change after the version until the
+// request is done
+func (fake *fakeKubernetes) watch(w http.ResponseWriter, r *http.Request, key string, version int) {
+	w.(http.Flusher).Flush()
+	for {
+		fake.lock.Lock()
+		changed := fake.changed
+		missed := fake.version > version
+		version = fake.version
+		fake.lock.Unlock()
+		if missed {
+			fmt.Fprint(w, `{"type": "MODIFIED", "object": {}}`)
+			w.(http.Flusher).Flush()
+			continue
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// set replaces the EndpointSlice of the service
+func (fake *fakeKubernetes) set(key string, slice map[string]interface{}) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.slices[key] = slice
+	fake.version++
+	close(fake.changed)
+	fake.changed = make(chan struct{})
+}
+
+func (fake *fakeKubernetes) listCount() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.lists
+}
+
+func newTestKubernetes(t *testing.T, fake *fakeKubernetes) *Kubernetes {
+	token := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(token, []byte(fake.token+"\n"), 0600)
+	k, err := NewKubernetes(map[string]interface{}{
+		"host": fake.URL, "namespace": "apps", "tokenFile": token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return k
+}
+
+func endpointSlice(ports map[string]int, endpoints ...interface{}) map[string]interface{} {
+	slicePorts := []interface{}{}
+	for name, port := range ports {
+		slicePorts = append(slicePorts, map[string]interface{}{"name": name, "port": port})
+	}
+	return map[string]interface{}{"endpoints": endpoints, "ports": slicePorts}
+}
+
+func endpoint(ready *bool, addresses ...string) map[string]interface{} {
+	return map[string]interface{}{"addresses": addresses,
+		"conditions": map[string]interface{}{"ready": ready}}
+}
+
+func TestKubernetesConfig(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(token, []byte("secret"), 0600)
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "fd00::1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	host, err := kubernetesHost("")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://[fd00::1]:443", host)
+	host, _ = kubernetesHost("kubernetes:6443/")
+	assert.Equal(t, "https://kubernetes:6443", host)
+
+	k, err := NewKubernetes(map[string]interface{}{
+		"host": "http://kubernetes:8080", "namespace": "apps", "tokenFile": token})
+	assert.Nil(t, err)
+	assert.Equal(t, "apps", k.namespace)
+	assert.Equal(t, defaultKubernetesTimeout, k.timeout)
+
+	_, err = NewKubernetes(map[string]interface{}{
+		"host": "http://kubernetes:8080", "namespace": "apps", "tokenFile": "/nope"})
+	assert.EqualError(t, err,
+		"kubernetes: could not read tokenFile: open /nope: no such file or directory")
+	_, err = NewKubernetes(map[string]interface{}{
+		"host": "https://kubernetes:6443", "namespace": "apps", "tokenFile": token,
+		"caFile": token})
+	assert.EqualError(t, err, "kubernetes: no certificates in caFile")
+	_, err = NewKubernetes(map[string]interface{}{
+		"host": "http://kubernetes:8080", "namespace": "apps", "tokenFile": token,
+		"timeout": "-1s"})
+	assert.EqualError(t, err, "kubernetes: timeout must be > 0: -1s")
+	_, err = NewKubernetes("kubernetes:6443")
+	assert.EqualError(t, err, "kubernetes: must be true or a map of options")
+}
+
+func TestKubernetesRegistrationIsNoop(t *testing.T) {
+	fake := newFakeKubernetes(t)
+	k := newTestKubernetes(t, fake)
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80, TTL: 10,
+		IPAddress: "10.0.0.5", Consul: k}
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Nil(t, service.SendHeartbeat())
+	service.Deregister()
+	assert.Empty(t, fake.requests, "expected no requests to Kubernetes")
+}
+
+func TestKubernetesUpstreams(t *testing.T) {
+	fake := newFakeKubernetes(t)
+	k := newTestKubernetes(t, fake)
+	ready, notReady := true, false
+	// waitForChange waits for the watch to see a change, and then checks
+	waitForChange := func(tag, dc string) (bool, bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			k.lock.RLock()
+			dirty := k.watchers["db"].dirty
+			k.lock.RUnlock()
+			if dirty {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return k.CheckForUpstreamChanges("db", tag, dc)
+	}
+
+	didChange, isHealthy := k.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change with no endpoints")
+	assert.False(t, isHealthy)
+
+	fake.set("apps/db", endpointSlice(map[string]int{"postgres": 5432},
+		endpoint(&ready, "10.0.0.6"), endpoint(nil, "10.0.0.5"),
+		endpoint(&notReady, "10.0.0.7")))
+	didChange, isHealthy = waitForChange("", "")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"10.0.0.5:5432", "10.0.0.6:5432"}, k.watchedServices["db"],
+		"expected only ready endpoints")
+	assert.Equal(t, 2, k.InstanceCount("db"))
+
+	// without a change the endpoints aren't read again
+	lists := fake.listCount()
+	didChange, isHealthy = k.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, lists, fake.listCount(), "expected the watch to be used")
+
+	fake.set("apps/db", endpointSlice(map[string]int{"postgres": 5432},
+		endpoint(&ready, "10.0.0.6")))
+	didChange, _ = waitForChange("", "")
+	assert.True(t, didChange)
+	assert.Equal(t, []string{"10.0.0.6:5432"}, k.watchedServices["db"])
+
+	fake.set("apps/db", endpointSlice(map[string]int{"metrics": 9187},
+		endpoint(&ready, "10.0.0.6")))
+	didChange, isHealthy = waitForChange("postgres", "")
+	assert.True(t, didChange)
+	assert.False(t, isHealthy, "expected no endpoints without the named port")
+
+	// the dc is the namespace
+	fake.set("other/db", endpointSlice(map[string]int{"postgres": 5432},
+		endpoint(&ready, "fd00::6")))
+	didChange, isHealthy = waitForChange("postgres", "other")
+	assert.True(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, []string{"[fd00::6]:5432"}, k.watchedServices["db"])
+}
+
+func TestKubernetesUnauthorized(t *testing.T) {
+	fake := newFakeKubernetes(t)
+	k := newTestKubernetes(t, fake)
+	assert.Nil(t, k.Ping())
+	fake.token = "rotated"
+	_, _, err := k.endpoints("apps", "db", "")
+	assert.EqualError(t, err, "kubernetes: Unauthorized")
+	assert.EqualError(t, k.Ping(), "kubernetes: Unauthorized")
+}
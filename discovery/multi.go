@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// MultiBackend fans out every call to a list of service discovery
+// backends, so that a service is registered and health-checked in each
+// of them (ex. while migrating between Consul clusters). A failure in one
+// backend is logged and doesn't prevent calls to the others.
+type MultiBackend struct {
+	backends []Backend
+}
+
+// NewMultiBackend creates a MultiBackend for the list of backends
+func NewMultiBackend(backends ...Backend) *MultiBackend {
+	return &MultiBackend{backends: backends}
+}
+
+// NewBackend creates the service discovery backend for the `consul`
+// config, which may be a single Consul config or a list of them
+func NewBackend(config interface{}) (Backend, error) {
+	list, ok := config.([]interface{})
+	if !ok {
+		consul, err := NewConsul(config)
+		if err != nil {
+			return nil, err
+		}
+		return consul, nil
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no discovery backend defined")
+	}
+	backends := make([]Backend, len(list))
+	for i, raw := range list {
+		consul, err := NewConsul(raw)
+		if err != nil {
+			return nil, fmt.Errorf("consul[%d]: %v", i, err)
+		}
+		backends[i] = consul
+	}
+	return NewMultiBackend(backends...), nil
+}
+
+// each calls fn for every backend and returns an error if any of them
+// failed, after logging each failure
+func (m *MultiBackend) each(action string, fn func(Backend) error) error {
+	var errs []error
+	for i, backend := range m.backends {
+		if err := fn(backend); err != nil {
+			log.Warnf("discovery backend %d: %s failed: %v", i, action, err)
+			errs = append(errs, fmt.Errorf("backend %d: %v", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckForUpstreamChanges queries every backend. A change in any backend
+// is reported as a change, and the service is healthy if it has healthy
+// instances in any backend.
+func (m *MultiBackend) CheckForUpstreamChanges(service, tag, dc string) (didChange, isHealthy bool) {
+	// we have to query every backend so that each one updates the
+	// state it's tracking for the service
+	for _, backend := range m.backends {
+		changed, healthy := backend.CheckForUpstreamChanges(service, tag, dc)
+		didChange = didChange || changed
+		isHealthy = isHealthy || healthy
+	}
+	return didChange, isHealthy
+}
+
+// InstanceCount implements InstanceCounter for MultiBackend by adding up
+// the instances seen by each backend that can count them
+func (m *MultiBackend) InstanceCount(service string) int {
+	count := 0
+	for _, backend := range m.backends {
+		if counter, ok := backend.(InstanceCounter); ok {
+			count += counter.InstanceCount(service)
+		}
+	}
+	return count
+}
+
+// Ping implements Pinger for MultiBackend by pinging each backend that
+// can be pinged
+func (m *MultiBackend) Ping() error {
+	var errs []error
+	for i, backend := range m.backends {
+		if pinger, ok := backend.(Pinger); ok {
+			if err := pinger.Ping(); err != nil {
+				errs = append(errs, fmt.Errorf("backend %d: %v", i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SupportsConnect implements ConnectRegistrar for MultiBackend, which
+// can only register a sidecar proxy if every backend can
+func (m *MultiBackend) SupportsConnect() bool {
+	for _, backend := range m.backends {
+		if registrar, ok := backend.(ConnectRegistrar); !ok || !registrar.SupportsConnect() {
+			return false
+		}
+	}
+	return true
+}
+
+// SupportsDatacenter implements DatacenterSelector for MultiBackend,
+// which can only honor a datacenter if every backend can, because the
+// others would watch the wrong instances
+func (m *MultiBackend) SupportsDatacenter() bool {
+	for _, backend := range m.backends {
+		if selector, ok := backend.(DatacenterSelector); !ok || !selector.SupportsDatacenter() {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckForUpstreamChangesInDCs implements DatacenterWatcher for
+// MultiBackend by querying every backend that can watch several
+// datacenters, in the same way as CheckForUpstreamChanges
+func (m *MultiBackend) CheckForUpstreamChangesInDCs(service, tag string, dcs []string) (didChange, isHealthy bool) {
+	for _, backend := range m.backends {
+		watcher, ok := backend.(DatacenterWatcher)
+		if !ok {
+			continue
+		}
+		changed, healthy := watcher.CheckForUpstreamChangesInDCs(service, tag, dcs)
+		didChange = didChange || changed
+		isHealthy = isHealthy || healthy
+	}
+	return didChange, isHealthy
+}
+
+// CheckForKVChanges implements KVWatcher for MultiBackend by watching the
+// key in the first backend that can, because merging the values of
+// stores that may disagree wouldn't give a meaningful value
+func (m *MultiBackend) CheckForKVChanges(key, dc string) (didChange, exists bool, value string) {
+	for _, backend := range m.backends {
+		if watcher, ok := backend.(KVWatcher); ok {
+			return watcher.CheckForKVChanges(key, dc)
+		}
+	}
+	return false, false, ""
+}
+
+// CheckRegister registers the check with every backend
+func (m *MultiBackend) CheckRegister(check *api.AgentCheckRegistration) error {
+	return m.each("check registration", func(b Backend) error {
+		return b.CheckRegister(check)
+	})
+}
+
+// PassTTL sets the TTL check to the passing state in every backend
+func (m *MultiBackend) PassTTL(checkID, note string) error {
+	return m.each("TTL update", func(b Backend) error {
+		return b.PassTTL(checkID, note)
+	})
+}
+
+// FailTTL implements TTLFailer for MultiBackend by setting the TTL check
+// to the critical state in each backend that can; the others find out
+// when the TTL expires
+func (m *MultiBackend) FailTTL(checkID, note string) error {
+	return m.each("TTL update", func(b Backend) error {
+		if failer, ok := b.(TTLFailer); ok {
+			return failer.FailTTL(checkID, note)
+		}
+		return nil
+	})
+}
+
+// ServiceDeregister deregisters the service from every backend
+func (m *MultiBackend) ServiceDeregister(serviceID string) error {
+	return m.each("deregistration", func(b Backend) error {
+		return b.ServiceDeregister(serviceID)
+	})
+}
+
+// ServiceRegister registers the service with every backend
+func (m *MultiBackend) ServiceRegister(service *api.AgentServiceRegistration) error {
+	return m.each("registration", func(b Backend) error {
+		return b.ServiceRegister(service)
+	})
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend records the calls made to it and fails them if err is set
+type fakeBackend struct {
+	calls   []string
+	err     error
+	changed bool
+	healthy bool
+}
+
+func (f *fakeBackend) CheckForUpstreamChanges(service, _, _ string) (bool, bool) {
+	f.calls = append(f.calls, "changes:"+service)
+	return f.changed, f.healthy
+}
+
+func (f *fakeBackend) CheckRegister(check *api.AgentCheckRegistration) error {
+	f.calls = append(f.calls, "check:"+check.ID)
+	return f.err
+}
+
+func (f *fakeBackend) PassTTL(checkID, _ string) error {
+	f.calls = append(f.calls, "ttl:"+checkID)
+	return f.err
+}
+
+func (f *fakeBackend) FailTTL(checkID, note string) error {
+	f.calls = append(f.calls, "fail:"+checkID+":"+note)
+	return f.err
+}
+
+func (f *fakeBackend) ServiceDeregister(serviceID string) error {
+	f.calls = append(f.calls, "deregister:"+serviceID)
+	return f.err
+}
+
+func (f *fakeBackend) ServiceRegister(service *api.AgentServiceRegistration) error {
+	f.calls = append(f.calls, "register:"+service.ID)
+	return f.err
+}
+
+func TestMultiBackendFanOut(t *testing.T) {
+	failing := &fakeBackend{err: fmt.Errorf("connection refused")}
+	working := &fakeBackend{}
+	multi := NewMultiBackend(failing, working)
+
+	err := multi.ServiceRegister(&api.AgentServiceRegistration{ID: "app-1"})
+	assert.EqualError(t, err, "backend 0: connection refused")
+	err = multi.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err, "backend 0: connection refused")
+	working.err = fmt.Errorf("timeout")
+	failing.err = nil
+	err = multi.ServiceDeregister("app-1")
+	assert.EqualError(t, err, "backend 1: timeout")
+
+	// every backend gets every call even if another one fails
+	expected := []string{"register:app-1", "ttl:service:app-1", "deregister:app-1"}
+	assert.Equal(t, expected, failing.calls)
+	assert.Equal(t, expected, working.calls)
+}
+
+func TestMultiBackendUpstreamChanges(t *testing.T) {
+	first := &fakeBackend{changed: true}
+	second := &fakeBackend{healthy: true}
+	multi := NewMultiBackend(first, second)
+
+	didChange, isHealthy := multi.CheckForUpstreamChanges("db", "", "")
+	assert.True(t, didChange, "expected change from first backend")
+	assert.True(t, isHealthy, "expected healthy from second backend")
+	assert.Equal(t, []string{"changes:db"}, first.calls)
+	assert.Equal(t, []string{"changes:db"}, second.calls)
+
+	first.changed = false
+	second.healthy = false
+	didChange, isHealthy = multi.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change")
+	assert.False(t, isHealthy, "expected unhealthy")
+}
+
+func TestMultiBackendSupportsDatacenter(t *testing.T) {
+	consul, _ := NewConsul("consul:8500")
+	multi := NewMultiBackend(consul, &fakeBackend{})
+	assert.False(t, multi.SupportsDatacenter(),
+		"expected a backend that ignores the dc to be unsupported")
+	multi = NewMultiBackend(consul, &Exec{})
+	assert.True(t, multi.SupportsDatacenter())
+}
+
+func TestNewBackend(t *testing.T) {
+	backend, err := NewBackend("consul:8500")
+	assert.Nil(t, err)
+	_, ok := backend.(*Consul)
+	assert.True(t, ok, "expected a single Consul backend")
+
+	backend, err = NewBackend([]interface{}{
+		"consul-old:8500",
+		map[string]interface{}{"address": "consul-new:8500", "scheme": "https"},
+	})
+	assert.Nil(t, err)
+	multi, ok := backend.(*MultiBackend)
+	assert.True(t, ok, "expected a MultiBackend")
+	assert.Equal(t, 2, len(multi.backends))
+
+	_, err = NewBackend([]interface{}{"consul:8500", 1})
+	assert.EqualError(t, err, "consul[1]: no discovery backend defined")
+
+	_, err = NewBackend([]interface{}{})
+	assert.EqualError(t, err, "no discovery backend defined")
+}
@@ -1,12 +1,46 @@
 package discovery
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/joyent/containerpilot/events"
 )
 
+var registeredCollector *prometheus.GaugeVec
+
+func init() {
+	registeredCollector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "containerpilot_service_registered",
+		Help: "1 if the service is registered with the discovery backend, otherwise 0, partitioned by service",
+	}, []string{"service"})
+	prometheus.MustRegister(registeredCollector)
+}
+
+// IPv6MetaKey is the service metadata key that a dual-stack service
+// advertises its IPv6 address under, because the service's Address can
+// only have one IP
+const IPv6MetaKey = "ipv6"
+
+// IPRefresher resolves the IP of a service again, returning the IP to
+// advertise and an error if the service shouldn't be registered
+type IPRefresher interface {
+	Refresh() (string, error)
+}
+
+// DualStackRefresher is an IPRefresher that also resolves the IPv6
+// address of a dual-stack service
+type DualStackRefresher interface {
+	IPRefresher
+	IPv6() string
+}
+
 // ServiceDefinition is how a job communicates with the Consul service
 // discovery backend.
 type ServiceDefinition struct {
@@ -15,11 +49,23 @@ type ServiceDefinition struct {
 	Port                           int
 	TTL                            int
 	Tags                           []string
+	Meta                           map[string]string
+	Weights                        *api.AgentWeights
 	IPAddress                      string
+	IPv6Address                    string
 	EnableTagOverride              bool
 	DeregisterCriticalServiceAfter string
+	Sidecar                        *SidecarService
 	Consul                         Backend
 
+	// Resolver is optional, and re-resolves the IPAddress each time the
+	// service has to be registered again after its first registration
+	Resolver IPRefresher
+
+	// Bus is optional, and each registration and deregistration of the
+	// service is published on it
+	Bus *events.EventBus
+
 	wasRegistered bool
 }
 
@@ -33,7 +79,10 @@ func (service *ServiceDefinition) MarkForMaintenance() {
 	log.Debugf("deregistering: %s", service.ID)
 	if err := service.Consul.ServiceDeregister(service.ID); err != nil {
 		log.Infof("deregistering failed: %s", err)
+	} else if service.wasRegistered {
+		service.publish(events.Deregistered, map[string]string{"id": service.ID})
 	}
+	registeredCollector.WithLabelValues(service.Name).Set(0)
 }
 
 // SendHeartbeat writes a TTL check status=ok to the consul store.
@@ -42,7 +91,7 @@ func (service *ServiceDefinition) MarkForMaintenance() {
 func (service *ServiceDefinition) SendHeartbeat() error {
 	if !service.wasRegistered {
 		if err := service.registerService(); err != nil {
-			log.Warnf("service registration failed: %s", err)
+			logRegistrationError(err)
 			return err
 		}
 		service.wasRegistered = true
@@ -50,9 +99,18 @@ func (service *ServiceDefinition) SendHeartbeat() error {
 	}
 	checkID := fmt.Sprintf("service:%s", service.ID)
 	if err := service.Consul.PassTTL(checkID, "ok"); err != nil {
+		if errors.Is(err, ErrBackingOff) {
+			// the backend has already logged the failure that caused this
+			log.Debugf("heartbeat skipped: %v", err)
+			return err
+		}
 		log.Infof("service not registered: %v", err)
+		if err = service.refreshIP(); err != nil {
+			log.Errorf("service registration failed: %v", err)
+			return err
+		}
 		if err = service.registerService(); err != nil {
-			log.Warnf("service registration failed: %s", err)
+			logRegistrationError(err)
 			return err
 		}
 		log.Infof("Service registered: %v", service.Name)
@@ -60,22 +118,174 @@ func (service *ServiceDefinition) SendHeartbeat() error {
 	return nil
 }
 
+// SendFailure sets the TTL check to the critical state, so that the
+// service stops being reported as passing as soon as the job is
+// unhealthy, rather than once its TTL expires. Backends that can't fail
+// a check, and services that were never registered, are left alone.
+func (service *ServiceDefinition) SendFailure(note string) error {
+	failer, ok := service.Consul.(TTLFailer)
+	if !ok || !service.wasRegistered {
+		return nil
+	}
+	checkID := fmt.Sprintf("service:%s", service.ID)
+	if err := failer.FailTTL(checkID, note); err != nil {
+		if errors.Is(err, ErrBackingOff) {
+			log.Debugf("failing TTL check skipped: %v", err)
+			return err
+		}
+		// the TTL expiring will mark the check critical anyways
+		log.Infof("unable to fail TTL check for %s: %v", service.Name, err)
+		return err
+	}
+	return nil
+}
+
+// refreshIP updates the IPAddress from the Resolver, if there is one. The
+// Resolver keeps the last IP if it fails, so we use whatever IP it
+// returns even if it also returns an error.
+func (service *ServiceDefinition) refreshIP() error {
+	if service.Resolver == nil {
+		return nil
+	}
+	ip, err := service.Resolver.Refresh()
+	if ip != "" {
+		service.IPAddress = ip
+		if dual, ok := service.Resolver.(DualStackRefresher); ok {
+			service.IPv6Address = dual.IPv6()
+		}
+	}
+	return err
+}
+
+// SendWarning registers the service with its TTL check in the warning
+// state, so that a service that's still warming up is visible in Consul
+// without being reported as either passing or critical. Each call resets
+// the TTL until the next heartbeat.
+func (service *ServiceDefinition) SendWarning() error {
+	if err := service.register(api.HealthWarning); err != nil {
+		logRegistrationError(err)
+		return err
+	}
+	service.wasRegistered = true
+	return nil
+}
+
+func logRegistrationError(err error) {
+	if errors.Is(err, ErrBackingOff) {
+		log.Debugf("service registration skipped: %v", err)
+		return
+	}
+	log.Warnf("service registration failed: %s", err)
+}
+
 // registers the service along with a check set to the passing state
 func (service *ServiceDefinition) registerService() error {
-	return service.Consul.ServiceRegister(
-		&api.AgentServiceRegistration{
-			ID:                service.ID,
-			Name:              service.Name,
-			Tags:              service.Tags,
-			Port:              service.Port,
-			Address:           service.IPAddress,
-			EnableTagOverride: service.EnableTagOverride,
-			Check: &api.AgentServiceCheck{
-				TTL:    fmt.Sprintf("%ds", service.TTL),
-				Status: api.HealthPassing,
-				Notes:  fmt.Sprintf("TTL for %s set by containerpilot", service.Name),
+	return service.register(api.HealthPassing)
+}
+
+// Registration returns the registration that's sent to Consul the first
+// time the service's health check passes
+func (service *ServiceDefinition) Registration() *api.AgentServiceRegistration {
+	registration := &api.AgentServiceRegistration{
+		ID:                service.ID,
+		Name:              service.Name,
+		Tags:              service.Tags,
+		Meta:              service.meta(),
+		Port:              service.Port,
+		Address:           service.IPAddress,
+		Weights:           service.Weights,
+		EnableTagOverride: service.EnableTagOverride,
+		Check: &api.AgentServiceCheck{
+			TTL:                            fmt.Sprintf("%ds", service.TTL),
+			Status:                         api.HealthPassing,
+			Notes:                          fmt.Sprintf("TTL for %s set by containerpilot", service.Name),
+			DeregisterCriticalServiceAfter: service.DeregisterCriticalServiceAfter,
+		},
+	}
+	if service.Sidecar != nil {
+		registration.Connect = &api.AgentServiceConnect{
+			SidecarService: service.Sidecar.registration(service),
+		}
+	}
+	return registration
+}
+
+// meta returns the service metadata, with the IPv6 address of a
+// dual-stack service added to it
+func (service *ServiceDefinition) meta() map[string]string {
+	if service.IPv6Address == "" {
+		return service.Meta
+	}
+	meta := make(map[string]string, len(service.Meta)+1)
+	for key, value := range service.Meta {
+		meta[key] = value
+	}
+	meta[IPv6MetaKey] = service.IPv6Address
+	return meta
+}
+
+// SidecarService is a Consul Connect sidecar proxy that's registered
+// along with the service. Consul fills in the rest of the proxy's
+// registration from the service it's the sidecar for.
+type SidecarService struct {
+	Port          int
+	Tags          []string
+	Upstreams     []api.Upstream
+	Config        map[string]interface{}
+	CheckInterval int // time in seconds
+}
+
+// registration returns the sidecar registration for the service. The
+// proxy is healthy if its listener accepts connections and the service
+// it's proxying for is passing its own health check.
+func (sidecar *SidecarService) registration(service *ServiceDefinition) *api.AgentServiceRegistration {
+	return &api.AgentServiceRegistration{
+		Port: sidecar.Port,
+		Tags: sidecar.Tags,
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			Config:    sidecar.Config,
+			Upstreams: sidecar.Upstreams,
+		},
+		Checks: api.AgentServiceChecks{
+			{
+				Name: "Connect Sidecar Listening",
+				TCP: net.JoinHostPort(service.IPAddress,
+					strconv.Itoa(sidecar.Port)),
+				Interval:                       fmt.Sprintf("%ds", sidecar.CheckInterval),
 				DeregisterCriticalServiceAfter: service.DeregisterCriticalServiceAfter,
 			},
+			{
+				Name:         "Connect Sidecar Aliasing " + service.ID,
+				AliasService: service.ID,
+			},
 		},
-	)
+	}
+}
+
+// registers the service along with a check set to the status
+func (service *ServiceDefinition) register(status string) error {
+	registration := service.Registration()
+	registration.Check.Status = status
+	err := service.Consul.ServiceRegister(registration)
+	if err != nil {
+		registeredCollector.WithLabelValues(service.Name).Set(0)
+		return err
+	}
+	registeredCollector.WithLabelValues(service.Name).Set(1)
+	service.publish(events.Registered, map[string]string{
+		"id":      service.ID,
+		"address": registration.Address,
+		"port":    strconv.Itoa(registration.Port),
+		"status":  status,
+	})
+	return nil
+}
+
+// publish sends an event for the service with the fields, if the service
+// has a Bus
+func (service *ServiceDefinition) publish(code events.EventCode, fields map[string]string) {
+	if service.Bus != nil {
+		service.Bus.PublishWithFields(
+			events.Event{Code: code, Source: service.Name}, fields)
+	}
 }
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/events"
+)
+
+// unregisteredBackend fails every heartbeat, as Consul does for a service
+// it doesn't know about, and records each registration and its address
+type unregisteredBackend struct {
+	Backend
+	addresses     []string
+	registrations []*api.AgentServiceRegistration
+}
+
+func (b *unregisteredBackend) PassTTL(checkID, note string) error {
+	return errors.New("unknown check")
+}
+
+func (b *unregisteredBackend) ServiceRegister(service *api.AgentServiceRegistration) error {
+	b.addresses = append(b.addresses, service.Address)
+	b.registrations = append(b.registrations, service)
+	return nil
+}
+
+type testResolver struct {
+	ip  string
+	err error
+}
+
+func (r *testResolver) Refresh() (string, error) { return r.ip, r.err }
+
+func TestServiceReregisterRefreshesIP(t *testing.T) {
+	backend := &unregisteredBackend{}
+	resolver := &testResolver{ip: "10.0.0.2"}
+	service := &ServiceDefinition{ID: "app-1", Name: "app", TTL: 5,
+		IPAddress: "10.0.0.1", Consul: backend, Resolver: resolver}
+
+	// the first registration uses the IP resolved at startup
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, backend.addresses)
+
+	resolver.err = errors.New("no interfaces")
+	assert.Error(t, service.SendHeartbeat(),
+		"expected the registration to fail once the resolver gives up")
+	assert.Len(t, backend.addresses, 2)
+	assert.Equal(t, "10.0.0.2", service.IPAddress, "expected the last IP to be kept")
+}
+
+// A failing service's TTL check is only failed once it's been registered,
+// and only in the backends that can fail it
+func TestServiceSendFailure(t *testing.T) {
+	backend := &fakeBackend{}
+	service := &ServiceDefinition{ID: "app-1", Name: "app", TTL: 5,
+		IPAddress: "10.0.0.1", Consul: NewMultiBackend(backend, &unregisteredBackend{})}
+	assert.Nil(t, service.SendFailure("exit status 1"))
+	assert.Empty(t, backend.calls, "expected no update before registration")
+
+	assert.Nil(t, service.SendHeartbeat())
+	assert.Nil(t, service.SendFailure("exit status 1"))
+	assert.Equal(t, []string{"register:app-1", "fail:service:app-1:exit status 1"},
+		backend.calls)
+}
+
+type recordingSink struct {
+	records chan events.Record
+}
+
+func (s *recordingSink) Emit(record events.Record) error {
+	s.records <- record
+	return nil
+}
+
+// Registrations and deregistrations are published with the service's ID
+// and address, but a service that was never registered isn't deregistered
+func TestServicePublishesRegistrations(t *testing.T) {
+	bus := events.NewEventBus()
+	sink := &recordingSink{records: make(chan events.Record, 10)}
+	events.NewSinkHandler(sink).Run(bus)
+	service := &ServiceDefinition{ID: "app-1", Name: "app", TTL: 5, Port: 80,
+		IPAddress: "10.0.0.1", Consul: &fakeBackend{}, Bus: bus}
+
+	service.MarkForMaintenance()
+	assert.Nil(t, service.SendHeartbeat())
+	service.MarkForMaintenance()
+	bus.Shutdown()
+
+	expected := []events.Record{
+		{Type: "Registered", Source: "app", Fields: map[string]string{
+			"id": "app-1", "address": "10.0.0.1", "port": "80", "status": "passing"}},
+		{Type: "Deregistered", Source: "app", Fields: map[string]string{"id": "app-1"}},
+		{Type: "Shutdown", Source: "global"},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-sink.records:
+			got.Timestamp = time.Time{}
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s record", want.Type)
+		}
+	}
+}
+
+// The sidecar proxy is registered in the same request as its service
+// and without the Connect stanza when there's no sidecar
+func TestServiceRegistrationSidecar(t *testing.T) {
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80,
+		TTL: 10, IPAddress: "10.0.0.5"}
+	assert.Nil(t, service.Registration().Connect)
+
+	service.Sidecar = &SidecarService{Port: 21000, CheckInterval: 5}
+	backend := &unregisteredBackend{}
+	service.Consul = backend
+	assert.Nil(t, service.SendHeartbeat())
+	sidecar := backend.registrations[0].Connect.SidecarService
+	assert.Equal(t, 21000, sidecar.Port)
+	assert.Equal(t, api.AgentServiceChecks{
+		{Name: "Connect Sidecar Listening", TCP: "10.0.0.5:21000", Interval: "5s"},
+		{Name: "Connect Sidecar Aliasing app-1", AliasService: "app-1"},
+	}, sidecar.Checks)
+}
@@ -0,0 +1,577 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gozk "github.com/go-zookeeper/zk"
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/config/decode"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultZookeeperPrefix         = "/containerpilot/services"
+	defaultZookeeperSessionTimeout = 10 * time.Second
+	defaultZookeeperPort           = "2181"
+
+	// defaultZookeeperTTL is the TTL of a service without a TTL check
+	defaultZookeeperTTL = 10 * time.Second
+)
+
+// Zookeeper is a service discovery backend for ZooKeeper. Each service is
+// an ephemeral znode under the prefix, so ZooKeeper removes it if our
+// session expires. A znode outlives a service whose health check fails
+// for as long as the session is alive, so we also remove a service's
+// znode ourselves once its TTL passes without a heartbeat.
+type Zookeeper struct {
+	hosts          []string
+	prefix         string
+	sessionTimeout time.Duration
+	backoff        *backoff
+
+	lock          sync.Mutex
+	conn          *gozk.Conn
+	sessionID     int64
+	registrations map[string]*zkRegistration // by check ID
+
+	// ready is closed while the client has a session
+	ready      chan struct{}
+	hasSession bool
+
+	// session counts our sessions, so we know when the znodes of a
+	// registration have gone with its session
+	session         int
+	watchedServices map[string][]string
+	watchers        map[string]*zkWatcher
+}
+
+// zkACL is the ACL of the znodes we create
+var zkACL = gozk.WorldACL(gozk.PermAll)
+
+type parsedZookeeperConfig struct {
+	Hosts          interface{} `mapstructure:"hosts"`
+	Prefix         string      `mapstructure:"prefix"`
+	SessionTimeout string      `mapstructure:"sessionTimeout"`
+
+	// optional backoff settings for failed requests
+	BackoffMin    string `mapstructure:"backoffMin"`
+	BackoffMax    string `mapstructure:"backoffMax"`
+	BackoffJitter *bool  `mapstructure:"backoffJitter"`
+}
+
+// zkRegistration is the znode of a registered service
+type zkRegistration struct {
+	path     string
+	instance registryInstance
+	session  int // the session that created the znode
+	ttl      time.Duration
+	timer    *time.Timer
+}
+
+// zkWatcher tracks the ZooKeeper watches on the znodes of a service.
+// Watches only fire once, and may have missed a change while the client
+// was disconnected, so the znodes are read again, with new watches, once
+// a watch has fired or the connection has dropped.
+type zkWatcher struct {
+	dirty bool
+}
+
+// zkLogger sends the logs of the ZooKeeper client to our debug logs
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	log.Debugf("zookeeper: "+format, args...)
+}
+
+// NewZookeeper creates a new service discovery backend for ZooKeeper. The
+// config is either a comma-separated list of hosts, or a map of options.
+func NewZookeeper(config interface{}) (*Zookeeper, error) {
+	parsed := &parsedZookeeperConfig{}
+	switch t := config.(type) {
+	case string:
+		parsed.Hosts = t
+	case map[string]interface{}:
+		if err := decode.ToStruct(t, parsed); err != nil {
+			return nil, fmt.Errorf("zookeeper: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("zookeeper: no hosts defined")
+	}
+	rawHosts, err := decode.ToStrings(parsed.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("zookeeper: unable to parse hosts: %v", err)
+	}
+	var hosts []string
+	for _, raw := range rawHosts {
+		for _, host := range strings.Split(raw, ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), defaultZookeeperPort)
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("zookeeper: no hosts defined")
+	}
+	sessionTimeout, err := timing.GetTimeout(parsed.SessionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("zookeeper: unable to parse sessionTimeout '%s': %v",
+			parsed.SessionTimeout, err)
+	}
+	if sessionTimeout < 0 {
+		return nil, fmt.Errorf("zookeeper: sessionTimeout must be > 0: %v", sessionTimeout)
+	}
+	if sessionTimeout == 0 {
+		sessionTimeout = defaultZookeeperSessionTimeout
+	}
+	prefix := parsed.Prefix
+	if prefix == "" {
+		prefix = defaultZookeeperPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("zookeeper: prefix must start with '/': %s", prefix)
+	}
+	backoff, err := newNamedBackoff("zookeeper",
+		parsed.BackoffMin, parsed.BackoffMax, parsed.BackoffJitter)
+	if err != nil {
+		return nil, err
+	}
+	return &Zookeeper{
+		hosts:           hosts,
+		prefix:          strings.TrimSuffix(prefix, "/"),
+		sessionTimeout:  sessionTimeout,
+		backoff:         backoff,
+		registrations:   make(map[string]*zkRegistration),
+		ready:           make(chan struct{}),
+		watchedServices: make(map[string][]string),
+		watchers:        make(map[string]*zkWatcher),
+	}, nil
+}
+
+// connect returns the client, starting it first if it hasn't been, and
+// waits for it to have a session. The client connects to each host in
+// turn, and after a dropped connection resumes our session if it hasn't
+// expired, so that its znodes and watches are kept, or starts a new one
+// if it has. It also returns the session, to compare with the session of
+// a registration.
+func (zk *Zookeeper) connect() (*gozk.Conn, int, error) {
+	zk.lock.Lock()
+	if zk.conn == nil {
+		conn, _, err := gozk.Connect(zk.hosts, zk.sessionTimeout,
+			gozk.WithLogger(zkLogger{}), gozk.WithEventCallback(zk.onEvent))
+		if err != nil {
+			zk.lock.Unlock()
+			return nil, 0, fmt.Errorf("zookeeper: unable to connect to %s: %v",
+				strings.Join(zk.hosts, ","), err)
+		}
+		zk.conn = conn
+	}
+	conn, ready := zk.conn, zk.ready
+	zk.lock.Unlock()
+	select {
+	case <-ready:
+	case <-time.After(zk.sessionTimeout):
+		return nil, 0, fmt.Errorf("zookeeper: unable to connect to %s within %v",
+			strings.Join(zk.hosts, ","), zk.sessionTimeout)
+	}
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	return conn, zk.session, nil
+}
+
+// onEvent tracks the session of the client, and marks the watchers of
+// the services whose znodes have changed dirty. It's called by the
+// client, so it mustn't block.
+func (zk *Zookeeper) onEvent(event gozk.Event) {
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	if event.Type != gozk.EventSession {
+		zk.markDirty(event.Path)
+		return
+	}
+	if event.State == gozk.StateHasSession {
+		if id := zk.conn.SessionID(); id != zk.sessionID {
+			zk.session++
+			zk.sessionID = id
+		}
+		if !zk.hasSession {
+			zk.hasSession = true
+			close(zk.ready)
+		}
+		return
+	}
+	if event.State == gozk.StateExpired {
+		log.Infof("zookeeper: session has expired, starting a new one")
+	}
+	if zk.hasSession {
+		zk.hasSession = false
+		zk.ready = make(chan struct{})
+		for _, watcher := range zk.watchers {
+			watcher.dirty = true
+		}
+	}
+}
+
+// ServiceRegister creates the service's ephemeral znode, or updates it if
+// the service is registered again (ex. with a new status)
+func (zk *Zookeeper) ServiceRegister(service *api.AgentServiceRegistration) error {
+	if err := zk.backoff.allow(); err != nil {
+		return err
+	}
+	err := zk.register(service)
+	zk.backoff.record(err)
+	return err
+}
+
+func (zk *Zookeeper) register(service *api.AgentServiceRegistration) error {
+	instance := registryInstance{
+		ID:      service.ID,
+		Name:    service.Name,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+		Status:  api.HealthPassing,
+	}
+	ttl := defaultZookeeperTTL
+	if service.Check != nil {
+		instance.Status = service.Check.Status
+		if parsed, err := time.ParseDuration(service.Check.TTL); err == nil && parsed > 0 {
+			ttl = parsed
+		}
+	}
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	conn, session, err := zk.connect()
+	if err != nil {
+		return err
+	}
+	path := zk.prefix + "/" + service.Name + "/" + service.ID
+	_, err = conn.Create(path, data, gozk.FlagEphemeral, zkACL)
+	if errors.Is(err, gozk.ErrNoNode) {
+		if err = zk.createParents(conn, path); err == nil {
+			_, err = conn.Create(path, data, gozk.FlagEphemeral, zkACL)
+		}
+	}
+	if errors.Is(err, gozk.ErrNodeExists) {
+		err = zk.replace(conn, path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("zookeeper: unable to create %s: %v", path, err)
+	}
+
+	checkID := "service:" + service.ID
+	registration := &zkRegistration{path: path, instance: instance,
+		session: session, ttl: ttl}
+	zk.lock.Lock()
+	old := zk.registrations[checkID]
+	if old != nil {
+		old.timer.Stop()
+	}
+	registration.timer = time.AfterFunc(ttl, func() {
+		zk.expire(checkID, registration)
+	})
+	zk.registrations[checkID] = registration
+	zk.lock.Unlock()
+	if old != nil && old.path != path && old.session == session {
+		// the service's name changed, so the old znode needs to go now
+		// rather than when our session ends
+		if err := conn.Delete(old.path, -1); err != nil && !errors.Is(err, gozk.ErrNoNode) {
+			log.Debugf("zookeeper: unable to delete %s: %v", old.path, err)
+		}
+	}
+	return nil
+}
+
+// createParents creates the persistent parent znodes of the path
+func (zk *Zookeeper) createParents(conn *gozk.Conn, path string) error {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	parent := ""
+	for _, part := range parts[:len(parts)-1] {
+		parent += "/" + part
+		_, err := conn.Create(parent, nil, 0, zkACL)
+		if err != nil && !errors.Is(err, gozk.ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace updates the znode if it belongs to our session, or else replaces
+// the znode of an expired session, which ZooKeeper only deletes once it
+// notices the session has expired
+func (zk *Zookeeper) replace(conn *gozk.Conn, path string, data []byte) error {
+	exists, stat, err := conn.Exists(path)
+	if err != nil {
+		return err
+	}
+	if exists && stat.EphemeralOwner == conn.SessionID() {
+		_, err := conn.Set(path, data, -1)
+		return err
+	}
+	if exists {
+		if err := conn.Delete(path, -1); err != nil && !errors.Is(err, gozk.ErrNoNode) {
+			return err
+		}
+	}
+	_, err = conn.Create(path, data, gozk.FlagEphemeral, zkACL)
+	return err
+}
+
+// expire deletes the service's znode once its TTL has passed without a
+// heartbeat, like Consul does with a TTL check that isn't passed in time
+func (zk *Zookeeper) expire(checkID string, registration *zkRegistration) {
+	zk.lock.Lock()
+	if zk.registrations[checkID] != registration {
+		zk.lock.Unlock()
+		return
+	}
+	delete(zk.registrations, checkID)
+	conn, session, hasSession := zk.conn, zk.session, zk.hasSession
+	zk.lock.Unlock()
+	log.Debugf("zookeeper: TTL of %s has passed", registration.path)
+	if !hasSession || session != registration.session {
+		return // the znode has gone, or will go, with its session
+	}
+	if err := conn.Delete(registration.path, -1); err != nil && !errors.Is(err, gozk.ErrNoNode) {
+		log.Debugf("zookeeper: unable to delete %s: %v", registration.path, err)
+	}
+}
+
+// ServiceDeregister deletes the service's znode. Like Consul, we always
+// try to deregister, even while backing off.
+func (zk *Zookeeper) ServiceDeregister(serviceID string) error {
+	checkID := "service:" + serviceID
+	zk.lock.Lock()
+	registration, ok := zk.registrations[checkID]
+	delete(zk.registrations, checkID)
+	zk.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	registration.timer.Stop()
+	conn, session, err := zk.connect()
+	if err == nil && session == registration.session {
+		err = conn.Delete(registration.path, -1)
+		if errors.Is(err, gozk.ErrNoNode) {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("zookeeper: unable to delete %s: %v", registration.path, err)
+		}
+	}
+	zk.backoff.record(err)
+	return err
+}
+
+// PassTTL checks that the service's znode still belongs to our session,
+// marks the service as passing if it was registered with another status,
+// and starts its TTL again. An error means the znode has gone, so the
+// service is registered again.
+func (zk *Zookeeper) PassTTL(checkID, note string) error {
+	zk.lock.Lock()
+	registration, ok := zk.registrations[checkID]
+	zk.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("zookeeper: unknown check %s", checkID)
+	}
+	if err := zk.backoff.allow(); err != nil {
+		return err
+	}
+	err := zk.heartbeat(checkID, registration)
+	if errors.Is(err, gozk.ErrSessionExpired) || errors.Is(err, gozk.ErrNoNode) {
+		// ZooKeeper answered, so this isn't a reason to back off of the
+		// registration that follows
+		zk.forget(checkID, registration)
+		zk.backoff.record(nil)
+		return err
+	}
+	zk.backoff.record(err)
+	return err
+}
+
+func (zk *Zookeeper) heartbeat(checkID string, registration *zkRegistration) error {
+	conn, session, err := zk.connect()
+	if err != nil {
+		return err
+	}
+	if session != registration.session {
+		return fmt.Errorf("zookeeper: %w: %s", gozk.ErrSessionExpired, registration.path)
+	}
+	exists, stat, err := conn.Exists(registration.path)
+	if err == nil && (!exists || stat.EphemeralOwner != conn.SessionID()) {
+		err = gozk.ErrNoNode // deleted, or replaced by another session
+	}
+	if err != nil {
+		return fmt.Errorf("zookeeper: unable to check %s: %w", registration.path, err)
+	}
+	zk.lock.Lock()
+	instance := registration.instance
+	zk.lock.Unlock()
+	if instance.Status != api.HealthPassing {
+		instance.Status = api.HealthPassing
+		data, err := json.Marshal(instance)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Set(registration.path, data, -1); err != nil {
+			return fmt.Errorf("zookeeper: unable to update %s: %w", registration.path, err)
+		}
+	}
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	registration.instance = instance
+	if zk.registrations[checkID] == registration {
+		registration.timer.Reset(registration.ttl)
+	}
+	return nil
+}
+
+func (zk *Zookeeper) forget(checkID string, registration *zkRegistration) {
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	if zk.registrations[checkID] == registration {
+		registration.timer.Stop()
+		delete(zk.registrations, checkID)
+	}
+}
+
+// CheckRegister isn't supported by ZooKeeper, so the only checks are the
+// TTL checks of the services themselves
+func (zk *Zookeeper) CheckRegister(check *api.AgentCheckRegistration) error {
+	return fmt.Errorf("zookeeper: checks can only be registered with a service")
+}
+
+// CheckForUpstreamChanges reads the passing instances of the service and
+// checks whether they have changed since the last check. The znodes are
+// watched, so they're only read again once they've changed. Datacenters
+// aren't supported by ZooKeeper, so the dc is ignored.
+func (zk *Zookeeper) CheckForUpstreamChanges(backendName, backendTag, dc string) (didChange, isHealthy bool) {
+	zk.lock.Lock()
+	watcher, watching := zk.watchers[backendName]
+	if watching && !watcher.dirty && zk.hasSession {
+		isHealthy = len(zk.watchedServices[backendName]) > 0
+		zk.lock.Unlock()
+		return false, isHealthy
+	}
+	zk.lock.Unlock()
+
+	if err := zk.backoff.allow(); err != nil {
+		log.Debugf("skipped query for %v: %v", backendName, err)
+		return false, false
+	}
+	conn, _, err := zk.connect()
+	var instances []string
+	if err == nil {
+		// a watch that fires while we read marks the watcher dirty again
+		zk.lock.Lock()
+		if !watching {
+			watcher = &zkWatcher{}
+			zk.watchers[backendName] = watcher
+		}
+		watcher.dirty = false
+		zk.lock.Unlock()
+		instances, err = zk.instances(conn, backendName, backendTag)
+	}
+	zk.backoff.record(err)
+	if err != nil {
+		if watcher != nil {
+			zk.lock.Lock()
+			watcher.dirty = true
+			zk.lock.Unlock()
+		}
+		log.Warnf("failed to query %v: %v", backendName, err)
+		return false, false
+	}
+	collector.WithLabelValues(backendName).Set(float64(len(instances)))
+
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	existing := zk.watchedServices[backendName]
+	zk.watchedServices[backendName] = instances
+	return !equalStrings(existing, instances), len(instances) > 0
+}
+
+// instances returns the sorted 'ip:port' of the passing instances of the
+// service with the tag, and watches the service's znodes
+func (zk *Zookeeper) instances(conn *gozk.Conn, service, tag string) ([]string, error) {
+	path := zk.prefix + "/" + service
+	instances := []string{}
+	children, _, _, err := conn.ChildrenW(path)
+	if errors.Is(err, gozk.ErrNoNode) {
+		// watch for the first instance of the service instead
+		if _, _, _, err := conn.ExistsW(path); err != nil {
+			return nil, fmt.Errorf("zookeeper: unable to read %s: %v", path, err)
+		}
+		return instances, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("zookeeper: unable to read %s: %v", path, err)
+	}
+	for _, child := range children {
+		data, _, _, err := conn.GetW(path + "/" + child)
+		if errors.Is(err, gozk.ErrNoNode) {
+			continue // deleted since we read the children
+		}
+		if err != nil {
+			return nil, fmt.Errorf("zookeeper: unable to read %s/%s: %v", path, child, err)
+		}
+		var instance registryInstance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			log.Debugf("zookeeper: ignoring invalid service %s/%s: %v", path, child, err)
+			continue
+		}
+		if instance.Status != api.HealthPassing {
+			continue
+		}
+		if tag != "" && !containsTag(instance.Tags, tag) {
+			continue
+		}
+		instances = append(instances,
+			net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port)))
+	}
+	sort.Strings(instances)
+	return instances, nil
+}
+
+// markDirty marks the watcher of the service that the znode belongs to
+// dirty. The caller holds the lock.
+func (zk *Zookeeper) markDirty(path string) {
+	name := strings.TrimPrefix(path, zk.prefix+"/")
+	if name == path {
+		return
+	}
+	name = strings.SplitN(name, "/", 2)[0]
+	if watcher, ok := zk.watchers[name]; ok {
+		watcher.dirty = true
+	}
+}
+
+// Ping implements Pinger for Zookeeper by connecting to it, if we aren't
+// connected already
+func (zk *Zookeeper) Ping() error {
+	_, _, err := zk.connect()
+	return err
+}
+
+// InstanceCount implements InstanceCounter for Zookeeper
+func (zk *Zookeeper) InstanceCount(service string) int {
+	zk.lock.Lock()
+	defer zk.lock.Unlock()
+	return len(zk.watchedServices[service])
+}
@@ -0,0 +1,642 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// opcodes of the ZooKeeper requests that fakeZookeeper handles
+const (
+	zkOpCreate       int32 = 1
+	zkOpDelete       int32 = 2
+	zkOpExists       int32 = 3
+	zkOpGetData      int32 = 4
+	zkOpSetData      int32 = 5
+	zkOpPing         int32 = 11
+	zkOpGetChildren2 int32 = 12
+)
+
+// error codes of ZooKeeper responses
+const (
+	zkErrUnimplemented int32 = -6
+	zkErrNoNode        int32 = -101
+	zkErrNodeExists    int32 = -110
+	zkErrNotEmpty      int32 = -111
+)
+
+const (
+	zkXidWatch      int32 = -1
+	zkFlagEphemeral int32 = 1
+)
+
+// fakeZookeeper is enough of a ZooKeeper server for the Zookeeper backend
+type fakeZookeeper struct {
+	listener    net.Listener
+	lock        sync.Mutex
+	nodes       map[string]*fakeZnode
+	sessions    map[int64]bool
+	nextSession int64
+	zxid        int64
+	conns       map[*fakeZkConn]bool
+	ops         map[int32]int
+}
+
+type fakeZnode struct {
+	data  []byte
+	owner int64
+}
+
+type fakeZkConn struct {
+	net.Conn
+	session      int64
+	writeLock    sync.Mutex
+	dataWatches  map[string]bool
+	childWatches map[string]bool
+}
+
+func newFakeZookeeper(t *testing.T) *fakeZookeeper {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fake := &fakeZookeeper{
+		listener: listener,
+		nodes:    map[string]*fakeZnode{"/": {}},
+		sessions: make(map[int64]bool),
+		conns:    make(map[*fakeZkConn]bool),
+		ops:      make(map[int32]int),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		fake.disconnect()
+	})
+	return fake
+}
+
+func (fake *fakeZookeeper) addr() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeZookeeper) serve(netConn net.Conn) {
+	defer netConn.Close()
+	frame, err := readZkFrame(netConn)
+	if err != nil {
+		return
+	}
+	r := &zkReader{data: frame}
+	r.int32()              // protocol version
+	r.int64()              // last zxid
+	timeout := r.int32()   // session timeout
+	sessionID := r.int64() // session to resume
+	conn := &fakeZkConn{Conn: netConn, dataWatches: make(map[string]bool),
+		childWatches: make(map[string]bool)}
+	fake.lock.Lock()
+	if sessionID != 0 && !fake.sessions[sessionID] {
+		fake.lock.Unlock()
+		response := &zkWriter{}
+		response.int32(0)
+		response.int32(0) // the session has expired
+		response.int64(0)
+		response.buffer(make([]byte, 16))
+		writeZkFrame(netConn, response.Bytes())
+		return
+	}
+	if sessionID == 0 {
+		fake.nextSession++
+		sessionID = fake.nextSession
+		fake.sessions[sessionID] = true
+	}
+	conn.session = sessionID
+	fake.conns[conn] = true
+	fake.lock.Unlock()
+	response := &zkWriter{}
+	response.int32(0)
+	response.int32(timeout)
+	response.int64(sessionID)
+	response.buffer([]byte("0123456789abcdef"))
+	conn.send(response)
+
+	defer func() {
+		fake.lock.Lock()
+		delete(fake.conns, conn)
+		fake.lock.Unlock()
+	}()
+	for {
+		frame, err := readZkFrame(netConn)
+		if err != nil {
+			return
+		}
+		r := &zkReader{data: frame}
+		xid, op := r.int32(), r.int32()
+		fake.lock.Lock()
+		fake.ops[op]++
+		body, code := fake.handle(conn, op, r)
+		fake.zxid++
+		response := &zkWriter{}
+		response.int32(xid)
+		response.int64(fake.zxid)
+		response.int32(code)
+		if code == 0 && body != nil {
+			response.Write(body.Bytes())
+		}
+		conn.send(response)
+		fake.lock.Unlock()
+	}
+}
+
+func (conn *fakeZkConn) send(frame *zkWriter) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	writeZkFrame(conn, frame.Bytes())
+}
+
+// handle handles the request; the caller holds the lock
+func (fake *fakeZookeeper) handle(conn *fakeZkConn, op int32, r *zkReader) (*zkWriter, int32) {
+	body := &zkWriter{}
+	switch op {
+	case zkOpPing:
+		return nil, 0
+	case zkOpCreate:
+		p, data := r.string(), r.buffer()
+		for n := r.int32(); n > 0; n-- {
+			r.int32()
+			r.string()
+			r.string()
+		}
+		flags := r.int32()
+		if _, ok := fake.nodes[path.Dir(p)]; !ok {
+			return nil, zkErrNoNode
+		}
+		if _, ok := fake.nodes[p]; ok {
+			return nil, zkErrNodeExists
+		}
+		node := &fakeZnode{data: data}
+		if flags&zkFlagEphemeral != 0 {
+			node.owner = conn.session
+		}
+		fake.nodes[p] = node
+		fake.fire(p, 1, false)
+		fake.fire(path.Dir(p), 4, true)
+		body.string(p)
+	case zkOpDelete:
+		p := r.string()
+		if _, ok := fake.nodes[p]; !ok {
+			return nil, zkErrNoNode
+		}
+		if len(fake.children(p)) > 0 {
+			return nil, zkErrNotEmpty
+		}
+		fake.deleteLocked(p)
+	case zkOpExists, zkOpGetData:
+		p, watch := r.string(), r.bool()
+		node, ok := fake.nodes[p]
+		if watch && (ok || op == zkOpExists) {
+			conn.dataWatches[p] = true
+		}
+		if !ok {
+			return nil, zkErrNoNode
+		}
+		if op == zkOpGetData {
+			body.buffer(node.data)
+		}
+		fake.stat(body, p, node)
+	case zkOpSetData:
+		p, data := r.string(), r.buffer()
+		node, ok := fake.nodes[p]
+		if !ok {
+			return nil, zkErrNoNode
+		}
+		node.data = data
+		fake.fire(p, 3, false)
+		fake.stat(body, p, node)
+	case zkOpGetChildren2:
+		p, watch := r.string(), r.bool()
+		node, ok := fake.nodes[p]
+		if !ok {
+			return nil, zkErrNoNode
+		}
+		if watch {
+			conn.childWatches[p] = true
+		}
+		children := fake.children(p)
+		body.int32(int32(len(children)))
+		for _, child := range children {
+			body.string(child)
+		}
+		fake.stat(body, p, node)
+	default:
+		return nil, zkErrUnimplemented
+	}
+	return body, 0
+}
+
+// stat writes the stat of the znode, without the fields we don't use
+func (fake *fakeZookeeper) stat(body *zkWriter, p string, node *fakeZnode) {
+	for i := 0; i < 4; i++ {
+		body.int64(0)
+	}
+	for i := 0; i < 3; i++ {
+		body.int32(0)
+	}
+	body.int64(node.owner)
+	body.int32(int32(len(node.data)))
+	body.int32(int32(len(fake.children(p))))
+	body.int64(0)
+}
+
+func (fake *fakeZookeeper) children(p string) []string {
+	var children []string
+	for node := range fake.nodes {
+		if node != "/" && path.Dir(node) == p {
+			children = append(children, path.Base(node))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (fake *fakeZookeeper) deleteLocked(p string) {
+	delete(fake.nodes, p)
+	fake.fire(p, 2, false)
+	fake.fire(p, 2, true)
+	fake.fire(path.Dir(p), 4, true)
+}
+
+// fire sends the watch event to each connection watching the path, and
+// removes the watches
+func (fake *fakeZookeeper) fire(p string, eventType int32, child bool) {
+	for conn := range fake.conns {
+		watches := conn.dataWatches
+		if child {
+			watches = conn.childWatches
+		}
+		if !watches[p] {
+			continue
+		}
+		delete(watches, p)
+		event := &zkWriter{}
+		event.int32(zkXidWatch)
+		event.int64(-1)
+		event.int32(0)
+		event.int32(eventType)
+		event.int32(3) // connected
+		event.string(p)
+		conn.send(event)
+	}
+}
+
+// disconnect drops every connection, but keeps their sessions
+func (fake *fakeZookeeper) disconnect() {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for conn := range fake.conns {
+		conn.Close()
+	}
+}
+
+// expire expires every session, which deletes their ephemeral znodes
+func (fake *fakeZookeeper) expire() {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for conn := range fake.conns {
+		conn.Close()
+	}
+	for p, node := range fake.nodes {
+		if node.owner != 0 {
+			fake.deleteLocked(p)
+		}
+	}
+	fake.sessions = make(map[int64]bool)
+}
+
+func (fake *fakeZookeeper) node(p string) (registryInstance, int64, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	var instance registryInstance
+	node, ok := fake.nodes[p]
+	if !ok {
+		return instance, 0, false
+	}
+	json.Unmarshal(node.data, &instance)
+	return instance, node.owner, true
+}
+
+func (fake *fakeZookeeper) opCount(op int32) int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.ops[op]
+}
+
+// waitForClosed waits for the backend to notice its connection has dropped
+func waitForClosed(t *testing.T, zk *Zookeeper) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		zk.lock.Lock()
+		closed := !zk.hasSession
+		zk.lock.Unlock()
+		if closed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the connection to close")
+}
+
+func TestZookeeperConfig(t *testing.T) {
+	zk, err := NewZookeeper("zk-0, zk-1:2182")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"zk-0:2181", "zk-1:2182"}, zk.hosts)
+	assert.Equal(t, "/containerpilot/services", zk.prefix)
+	assert.Equal(t, defaultZookeeperSessionTimeout, zk.sessionTimeout)
+
+	zk, err = NewZookeeper(map[string]interface{}{
+		"hosts":  []interface{}{"zk-0:2181", "[fd00::1]"},
+		"prefix": "/services/", "sessionTimeout": "30s"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"zk-0:2181", "[fd00::1]:2181"}, zk.hosts)
+	assert.Equal(t, "/services", zk.prefix)
+	assert.Equal(t, 30*time.Second, zk.sessionTimeout)
+
+	_, err = NewZookeeper(map[string]interface{}{"hosts": ""})
+	assert.EqualError(t, err, "zookeeper: no hosts defined")
+	_, err = NewZookeeper(map[string]interface{}{"hosts": "zk:2181", "prefix": "services"})
+	assert.EqualError(t, err, "zookeeper: prefix must start with '/': services")
+	_, err = NewZookeeper(map[string]interface{}{"hosts": "zk:2181", "sessionTimeout": "-1s"})
+	assert.EqualError(t, err, "zookeeper: sessionTimeout must be > 0: -1s")
+}
+
+func TestZookeeperRegistration(t *testing.T) {
+	fake := newFakeZookeeper(t)
+	zk, _ := NewZookeeper(fake.addr())
+	service := &ServiceDefinition{ID: "app-1", Name: "app", Port: 80,
+		TTL: 10, IPAddress: "10.0.0.5", Tags: []string{"a"}, Consul: zk}
+	p := "/containerpilot/services/app/app-1"
+
+	assert.Nil(t, service.SendWarning())
+	instance, owner, _ := fake.node(p)
+	assert.Equal(t, api.HealthWarning, instance.Status)
+	assert.NotZero(t, owner, "expected an ephemeral znode")
+	assert.Nil(t, service.SendHeartbeat())
+	instance, _, _ = fake.node(p)
+	assert.Equal(t, registryInstance{ID: "app-1", Name: "app", Address: "10.0.0.5",
+		Port: 80, Tags: []string{"a"}, Status: api.HealthPassing}, instance,
+		"expected the heartbeat to mark the service as passing")
+
+	// a dropped connection resumes its session and keeps its znode
+	creates := fake.opCount(zkOpCreate)
+	fake.disconnect()
+	waitForClosed(t, zk)
+	assert.Nil(t, service.SendHeartbeat())
+	_, resumed, _ := fake.node(p)
+	assert.Equal(t, owner, resumed)
+	assert.Equal(t, creates, fake.opCount(zkOpCreate), "expected no new registration")
+
+	// a heartbeat after the session has expired registers the service again
+	fake.expire()
+	waitForClosed(t, zk)
+	err := zk.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err,
+		"zookeeper: zk: session has been expired by the server: "+
+			"/containerpilot/services/app/app-1")
+	assert.Nil(t, service.SendHeartbeat())
+	_, newOwner, ok := fake.node(p)
+	assert.True(t, ok)
+	assert.NotEqual(t, owner, newOwner)
+
+	service.Deregister()
+	_, _, ok = fake.node(p)
+	assert.False(t, ok)
+	err = zk.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err, "zookeeper: unknown check service:app-1",
+		"expected a deregistered service to be unknown")
+}
+
+func TestZookeeperTTL(t *testing.T) {
+	fake := newFakeZookeeper(t)
+	zk, _ := NewZookeeper(fake.addr())
+	p := "/containerpilot/services/app/app-1"
+	err := zk.ServiceRegister(&api.AgentServiceRegistration{ID: "app-1", Name: "app",
+		Address: "10.0.0.5", Port: 80, Check: &api.AgentServiceCheck{
+			TTL: "200ms", Status: api.HealthPassing}})
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, zk.PassTTL("service:app-1", "ok"))
+	}
+	_, _, ok := fake.node(p)
+	assert.True(t, ok, "expected heartbeats to keep the znode")
+
+	time.Sleep(400 * time.Millisecond)
+	_, _, ok = fake.node(p)
+	assert.False(t, ok, "expected the znode to be deleted once its TTL passed")
+	err = zk.PassTTL("service:app-1", "ok")
+	assert.EqualError(t, err, "zookeeper: unknown check service:app-1")
+}
+
+func TestZookeeperUpstreams(t *testing.T) {
+	fake := newFakeZookeeper(t)
+	zk, _ := NewZookeeper(fake.addr())
+	register := func(id, ip string, status string, tags ...string) {
+		err := zk.ServiceRegister(&api.AgentServiceRegistration{ID: id, Name: "db",
+			Address: ip, Port: 5432, Tags: tags,
+			Check: &api.AgentServiceCheck{TTL: "10s", Status: status}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// waitForChange waits for a watch to fire, and then checks
+	waitForChange := func(tag string) (bool, bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			zk.lock.Lock()
+			dirty := zk.watchers["db"].dirty
+			zk.lock.Unlock()
+			if dirty {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return zk.CheckForUpstreamChanges("db", tag, "")
+	}
+
+	didChange, isHealthy := zk.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange, "expected no change with no instances")
+	assert.False(t, isHealthy)
+
+	register("db-1", "10.0.0.5", api.HealthPassing, "primary")
+	didChange, isHealthy = waitForChange("")
+	assert.True(t, didChange, "expected a watch on the service's znode")
+	assert.True(t, isHealthy)
+	register("db-2", "10.0.0.6", api.HealthWarning)
+	didChange, _ = waitForChange("")
+	assert.False(t, didChange, "expected only passing instances")
+	assert.Equal(t, []string{"10.0.0.5:5432"}, zk.watchedServices["db"])
+	assert.Equal(t, 1, zk.InstanceCount("db"))
+
+	// without a change the znodes aren't read again
+	reads := fake.opCount(zkOpGetChildren2)
+	didChange, isHealthy = zk.CheckForUpstreamChanges("db", "", "")
+	assert.False(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, reads, fake.opCount(zkOpGetChildren2), "expected the watch to be used")
+
+	register("db-2", "10.0.0.6", api.HealthPassing, "replica")
+	didChange, _ = waitForChange("")
+	assert.True(t, didChange, "expected a watch on the instance's data")
+	assert.Equal(t, []string{"10.0.0.5:5432", "10.0.0.6:5432"}, zk.watchedServices["db"])
+
+	zk.ServiceDeregister("db-2")
+	didChange, _ = waitForChange("primary")
+	assert.True(t, didChange)
+	assert.Equal(t, []string{"10.0.0.5:5432"}, zk.watchedServices["db"])
+
+	// a watch may have missed a change while disconnected, so the znodes
+	// are read again
+	fake.disconnect()
+	waitForClosed(t, zk)
+	didChange, isHealthy = zk.CheckForUpstreamChanges("db", "primary", "")
+	assert.False(t, didChange)
+	assert.True(t, isHealthy)
+	assert.Equal(t, reads+3, fake.opCount(zkOpGetChildren2))
+}
+
+func TestZookeeperFailover(t *testing.T) {
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	fake := newFakeZookeeper(t)
+	zk, _ := NewZookeeper(map[string]interface{}{
+		"hosts": down.Addr().String(), "sessionTimeout": "500ms"})
+	err := zk.Ping()
+	assert.True(t, strings.HasPrefix(err.Error(), "zookeeper: unable to connect to "),
+		"unexpected error: %v", err)
+
+	zk, _ = NewZookeeper(strings.Join([]string{down.Addr().String(), fake.addr()}, ","))
+	assert.Nil(t, zk.Ping(), "expected the ping to fail over to the next host")
+	err = zk.ServiceRegister(&api.AgentServiceRegistration{ID: "app-1", Name: "app",
+		Address: "10.0.0.5", Port: 80})
+	assert.Nil(t, err, "expected the request to fail over to the next host")
+	_, _, ok := fake.node("/containerpilot/services/app/app-1")
+	assert.True(t, ok)
+}
+
+func writeZkFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readZkFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// zkWriter encodes the fields of a response
+type zkWriter struct {
+	bytes.Buffer
+}
+
+func (w *zkWriter) int32(i int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(i))
+	w.Write(b[:])
+}
+
+func (w *zkWriter) int64(i int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	w.Write(b[:])
+}
+
+func (w *zkWriter) buffer(b []byte) {
+	if b == nil {
+		w.int32(-1)
+		return
+	}
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *zkWriter) string(s string) {
+	w.int32(int32(len(s)))
+	w.WriteString(s)
+}
+
+// zkReader decodes the fields of a request. Fields past the end of the
+// request are zero.
+type zkReader struct {
+	data []byte
+}
+
+func (r *zkReader) next(n int) []byte {
+	if n < 0 || n > len(r.data) {
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *zkReader) int32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *zkReader) int64() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *zkReader) bool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *zkReader) buffer() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *zkReader) string() string {
+	return string(r.buffer())
+}
@@ -13,6 +13,7 @@ type EventBus struct {
 	registry map[Subscriber]bool
 	lock     *sync.RWMutex
 	reload   bool
+	maint    bool
 	done     sync.WaitGroup
 
 	// circular buffer of events
@@ -33,6 +34,8 @@ func (bus *EventBus) enqueue(event Event) {
 // DebugEvents ...
 func (bus *EventBus) DebugEvents() []Event {
 	time.Sleep(100 * time.Millisecond)
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
 	events := []Event{}
 	for {
 		if bus.head == -1 {
@@ -57,14 +60,22 @@ func (bus *EventBus) mod(p int) int {
 	return p % len(bus.buf)
 }
 
-var collector *prometheus.CounterVec
+var (
+	collector        *prometheus.CounterVec
+	publishCollector prometheus.Histogram
+)
 
 func init() {
 	collector = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "containerpilot_events",
 		Help: "count of ContainerPilot events, partitioned by type and source",
 	}, []string{"code", "source"})
-	prometheus.MustRegister(collector)
+	publishCollector = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "containerpilot_event_publish_duration_seconds",
+		Help:    "time taken to deliver each ContainerPilot event to every subscriber",
+		Buckets: []float64{.0001, .001, .01, .1, 1, 10},
+	})
+	prometheus.MustRegister(collector, publishCollector)
 }
 
 // NewEventBus initializes an EventBus. We need this rather than a struct
@@ -106,18 +117,40 @@ func (bus *EventBus) Unregister(subscriber Subscriber, isInternal ...bool) {
 	}
 }
 
-// Publish an Event to all Subscribers
+// Publish an Event to all Subscribers. A Subscriber whose event loop has
+// fallen behind blocks the Publish once its buffer is full, so the time
+// taken here is a measure of how far behind the event loops are.
 func (bus *EventBus) Publish(event Event) {
+	bus.PublishWithFields(event, nil)
+}
+
+// PublishWithFields publishes an Event like Publish, along with fields
+// that describe it (ex. the ID of a service that was registered). Only a
+// FieldsReceiver like the SinkHandler gets the fields; the other
+// Subscribers receive the Event alone.
+func (bus *EventBus) PublishWithFields(event Event, fields map[string]string) {
+	started := time.Now()
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
 	log.Debugf("event: %v", event)
 	collector.WithLabelValues(event.Code.String(), event.Source).Inc()
+	switch event {
+	case GlobalEnterMaintenance:
+		bus.maint = true
+	case GlobalExitMaintenance:
+		bus.maint = false
+	}
 	for subscriber := range bus.registry {
 		// sending to an unsubscribed Subscriber shouldn't be a runtime
 		// error, so this is in intentionally allowed to panic here
+		if receiver, ok := subscriber.(FieldsReceiver); ok {
+			receiver.ReceiveWithFields(event, fields)
+			continue
+		}
 		subscriber.Receive(event)
 	}
 	bus.enqueue(event)
+	publishCollector.Observe(time.Since(started).Seconds())
 }
 
 // SetReloadFlag sets the flag that Wait will use to signal to the main
@@ -128,6 +161,14 @@ func (bus *EventBus) SetReloadFlag() {
 	bus.reload = true
 }
 
+// InMaintenance returns true if maintenance mode has been entered
+// since the EventBus was created and not exited since
+func (bus *EventBus) InMaintenance() bool {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	return bus.maint
+}
+
 // Shutdown asks all Subscribers to halt by sending the GlobalShutdown
 // message. Subscribers are responsible for handling this message.
 func (bus *EventBus) Shutdown() {
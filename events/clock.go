@@ -0,0 +1,27 @@
+package events
+
+import "time"
+
+// Clock is the source of time for the event timers. Jobs and watches use
+// RealClock, and tests can use a fake Clock to advance time by hand.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock of the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// orRealClock returns the clock, or RealClock if it's nil, so that a Job
+// or watch that was created without a clock still has timers
+func orRealClock(clock Clock) Clock {
+	if clock == nil {
+		return RealClock
+	}
+	return clock
+}
@@ -4,9 +4,9 @@ package events
 
 import "fmt"
 
-const eventCodename = "NoneExitSuccessExitFailedStoppingStoppedStatusHealthyStatusUnhealthyStatusChangedTimerExpiredEnterMaintenanceExitMaintenanceErrorQuitMetricStartupShutdown"
+const eventCodename = "NoneExitSuccessExitFailedStoppingStoppedStatusHealthyStatusUnhealthyStatusChangedTimerExpiredEnterMaintenanceExitMaintenanceErrorQuitMetricStartupShutdownRegisteredDeregisteredReloadedRestarting"
 
-var eventCodeindex = [...]uint8{0, 4, 15, 25, 33, 40, 53, 68, 81, 93, 109, 124, 129, 133, 139, 146, 154}
+var eventCodeindex = [...]uint8{0, 4, 15, 25, 33, 40, 53, 68, 81, 93, 109, 124, 129, 133, 139, 146, 154, 164, 176, 184, 194}
 
 func (i EventCode) String() string {
 	if i < 0 || i >= EventCode(len(eventCodeindex)-1) {
@@ -33,8 +33,12 @@ const (
 	Error
 	Quit
 	Metric
-	Startup  // fired once after events are set up and event loop is started
-	Shutdown // fired once after all jobs exit or on receiving SIGTERM
+	Startup      // fired once after events are set up and event loop is started
+	Shutdown     // fired once after all jobs exit or on receiving SIGTERM
+	Registered   // emitted when a Job's service is registered with discovery
+	Deregistered // emitted when a Job's service is deregistered from discovery
+	Reloaded     // fired once after the configuration has been reloaded
+	Restarting   // emitted when a Job restarts its process after it exited
 )
 
 // global events
@@ -45,6 +49,7 @@ var (
 	NonEvent               = Event{Code: None, Source: ""}
 	GlobalEnterMaintenance = Event{Code: EnterMaintenance, Source: "global"}
 	GlobalExitMaintenance  = Event{Code: ExitMaintenance, Source: "global"}
+	GlobalReloaded         = Event{Code: Reloaded, Source: "global"}
 )
 
 // FromString parses a string as an EventCode enum
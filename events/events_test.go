@@ -37,6 +37,22 @@ func TestSafeUnsubscribe(t *testing.T) {
 	}
 }
 
+func TestInMaintenance(t *testing.T) {
+	bus := NewEventBus()
+	if bus.InMaintenance() {
+		t.Fatal("expected new bus not to be in maintenance")
+	}
+	bus.Publish(GlobalEnterMaintenance)
+	bus.Publish(GlobalEnterMaintenance)
+	if !bus.InMaintenance() {
+		t.Fatal("expected bus to be in maintenance after entering it")
+	}
+	bus.Publish(GlobalExitMaintenance)
+	if bus.InMaintenance() {
+		t.Fatal("expected bus not to be in maintenance after exiting it")
+	}
+}
+
 /*
 Dummy TestSubscriber as test helpers; need this because we
 don't want a circular reference with the mocks package
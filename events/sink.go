@@ -0,0 +1,136 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is the serialized form of an Event that is handed to a Sink. The
+// Fields describe the Event when it was published with them, ex. the ID and
+// address of a service that was registered.
+type Record struct {
+	Type      string            `json:"type"`
+	Source    string            `json:"source"`
+	Timestamp time.Time         `json:"timestamp"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// NewRecord stamps an Event and its fields, if any, with the current time
+func NewRecord(event Event, fields map[string]string) Record {
+	return Record{
+		Type:      event.Code.String(),
+		Source:    event.Source,
+		Timestamp: time.Now().UTC(),
+		Fields:    fields,
+	}
+}
+
+// FieldsReceiver is a Subscriber that takes the fields that each Event
+// was published with, as well as the Event
+type FieldsReceiver interface {
+	Subscriber
+	ReceiveWithFields(Event, map[string]string)
+}
+
+// Sink is an interface for audit trails of every Event published on the
+// EventBus. Implementations other than the JSONSink (ex. a webhook) only
+// need to accept a Record.
+type Sink interface {
+	Emit(Record) error
+}
+
+// JSONSink writes each Record as a single line of JSON to its writer
+type JSONSink struct {
+	lock *sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONSink creates a JSONSink writing to w
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{lock: &sync.Mutex{}, enc: json.NewEncoder(w)}
+}
+
+// Emit implements Sink for JSONSink. json.Encoder terminates each
+// Record with a newline, so the output is in JSON-lines format.
+func (s *JSONSink) Emit(record Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.enc.Encode(record)
+}
+
+// SinkHandler subscribes to the EventBus and forwards the Record of every
+// Event it receives to its Sink. It runs as an internal subscriber like the
+// control and telemetry servers so it never holds up shutdown. Unlike the
+// other subscribers it doesn't embed an EventHandler, because it has to be
+// registered itself for the EventBus to hand it the fields of each Event.
+type SinkHandler struct {
+	Bus  *EventBus
+	sink Sink
+	rx   chan sinkEntry
+	wg   sync.WaitGroup
+}
+
+// sinkEntry keeps the Event of each Record so that the event loop can
+// tell when to stop
+type sinkEntry struct {
+	event  Event
+	record Record
+}
+
+// NewSinkHandler creates a SinkHandler for the Sink
+func NewSinkHandler(sink Sink) *SinkHandler {
+	return &SinkHandler{sink: sink, rx: make(chan sinkEntry, eventBufferSize)}
+}
+
+// Subscribe implements Subscriber for SinkHandler
+func (h *SinkHandler) Subscribe(bus *EventBus, isInternal ...bool) {
+	h.wg.Add(1)
+	bus.Register(h, isInternal...)
+	h.Bus = bus
+}
+
+// Unsubscribe implements Subscriber for SinkHandler
+func (h *SinkHandler) Unsubscribe(bus *EventBus, isInternal ...bool) {
+	h.wg.Done()
+	bus.Unregister(h, isInternal...)
+}
+
+// Receive implements Subscriber for SinkHandler
+func (h *SinkHandler) Receive(event Event) {
+	h.rx <- sinkEntry{event, NewRecord(event, nil)}
+}
+
+// ReceiveWithFields implements FieldsReceiver for SinkHandler
+func (h *SinkHandler) ReceiveWithFields(event Event, fields map[string]string) {
+	h.rx <- sinkEntry{event, NewRecord(event, fields)}
+}
+
+// Quit implements Subscriber for SinkHandler. It waits for the Records
+// already received to be written.
+func (h *SinkHandler) Quit() {
+	h.rx <- sinkEntry{event: QuitByClose}
+	h.wg.Wait()
+}
+
+// Run executes the event loop for the SinkHandler
+func (h *SinkHandler) Run(bus *EventBus) {
+	h.Subscribe(bus, true)
+	go func() {
+		defer h.Unsubscribe(h.Bus, true)
+		for entry := range h.rx {
+			if entry.event == QuitByClose {
+				return
+			}
+			if err := h.sink.Emit(entry.record); err != nil {
+				log.Warnf("events: failed to write event to sink: %v", err)
+			}
+			if entry.event == GlobalShutdown {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJSONSinkEmit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewJSONSink(buf)
+	sink.Emit(NewRecord(Event{Code: StatusHealthy, Source: "serviceA"}, nil))
+	sink.Emit(NewRecord(Event{Code: Registered, Source: "serviceA"},
+		map[string]string{"id": "serviceA-1"}))
+	sink.Emit(NewRecord(GlobalShutdown, nil))
+
+	scanner := bufio.NewScanner(buf)
+	got := []Record{}
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected one JSON record per line: %v", err)
+		}
+		got = append(got, record)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 records but got %d: %v", len(got), got)
+	}
+	if got[0].Type != "StatusHealthy" || got[0].Source != "serviceA" ||
+		got[0].Fields != nil {
+		t.Fatalf("unexpected record: %+v", got[0])
+	}
+	if got[1].Type != "Registered" || got[1].Fields["id"] != "serviceA-1" {
+		t.Fatalf("unexpected record: %+v", got[1])
+	}
+	if got[2].Type != "Shutdown" || got[2].Source != "global" {
+		t.Fatalf("unexpected record: %+v", got[2])
+	}
+	if got[0].Timestamp.IsZero() {
+		t.Fatalf("expected record to be timestamped")
+	}
+}
+
+type testSink struct {
+	records chan Record
+}
+
+func (s *testSink) Emit(record Record) error {
+	s.records <- record
+	return nil
+}
+
+func TestSinkHandler(t *testing.T) {
+	bus := NewEventBus()
+	sink := &testSink{records: make(chan Record, 10)}
+	NewSinkHandler(sink).Run(bus)
+	bus.Publish(GlobalStartup)
+	bus.PublishWithFields(GlobalReloaded, map[string]string{"jobs": "2"})
+	bus.Shutdown()
+
+	expected := []string{"Startup", "Reloaded", "Shutdown"}
+	for _, code := range expected {
+		select {
+		case record := <-sink.records:
+			if record.Type != code {
+				t.Fatalf("expected %s record but got %+v", code, record)
+			}
+			if code == "Reloaded" && record.Fields["jobs"] != "2" {
+				t.Fatalf("expected fields on %s record but got %+v", code, record)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s record", code)
+		}
+	}
+	bus.Wait() // internal subscribers never block Wait
+}
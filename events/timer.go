@@ -2,6 +2,9 @@ package events
 
 import (
 	"context"
+	"math/rand"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -9,12 +12,14 @@ import (
 // TimerExpired event when the timer expires
 func NewEventTimeout(
 	ctx context.Context,
+	clock Clock,
 	rx chan Event,
 	tick time.Duration,
 	name string,
 ) {
+	clock = orRealClock(clock)
 	go func() {
-		timeout := time.After(tick)
+		timeout := clock.After(tick)
 		select {
 		case <-ctx.Done():
 			return
@@ -35,26 +40,119 @@ func NewEventTimeout(
 // TimerExpired event every time the timer expires
 func NewEventTimer(
 	ctx context.Context,
+	clock Clock,
 	rx chan Event,
 	tick time.Duration,
 	name string,
 ) {
+	NewEventTimerWithSplay(ctx, clock, rx, tick, 0, name)
+}
+
+// each process gets its own seed so that containers started from the same
+// image at the same moment don't all pick the same splay
+var (
+	splayLock sync.Mutex
+	splayRand = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))
+)
+
+// randomSplay returns a random duration in [0, splay)
+func randomSplay(splay time.Duration) time.Duration {
+	splayLock.Lock()
+	defer splayLock.Unlock()
+	return time.Duration(splayRand.Int63n(int64(splay)))
+}
+
+// NewEventTimerWithSplay is like NewEventTimer but adds a new random
+// delay of up to splay to each tick, including the first one, so that
+// many instances polling on the same interval spread out over time. If
+// splay is zero this is the same as NewEventTimer.
+//
+// The ticks are scheduled every tick from when the timer started rather
+// than from the last event, so the time it takes the receiver to handle
+// an event doesn't add up into drift. A receiver that's still busy when
+// the next tick is due just misses that tick, as with a time.Ticker.
+func NewEventTimerWithSplay(
+	ctx context.Context,
+	clock Clock,
+	rx chan Event,
+	tick time.Duration,
+	splay time.Duration,
+	name string,
+) {
+	clock = orRealClock(clock)
+	go func() {
+		// sending the timeout event potentially races with a closing
+		// rx channel, so just recover from the panic and exit
+		defer func() {
+			if r := recover(); r != nil {
+				return
+			}
+		}()
+		next := clock.Now()
+		for {
+			next = nextTick(next, tick, clock.Now())
+			wait := next.Sub(clock.Now())
+			if splay > 0 {
+				wait += randomSplay(splay)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(wait):
+				rx <- Event{Code: TimerExpired, Source: name}
+			}
+		}
+	}()
+}
+
+// nextTick returns the first tick after the last one that isn't in the
+// past, skipping the ticks that were missed
+func nextTick(last time.Time, tick time.Duration, now time.Time) time.Time {
+	next := last.Add(tick)
+	if next.Before(now) {
+		missed := now.Sub(next) / tick
+		next = next.Add((missed + 1) * tick)
+	}
+	return next
+}
+
+// NewEventSchedule starts a goroutine that sends a TimerExpired event at
+// each time returned by next, which gets the time of the last event (or
+// when the schedule started) and returns the time of the next one, or the
+// zero time if there are no more. As with NewEventTimer, the times that
+// are already in the past when the receiver is done are skipped.
+func NewEventSchedule(
+	ctx context.Context,
+	clock Clock,
+	rx chan Event,
+	next func(time.Time) time.Time,
+	name string,
+) {
+	clock = orRealClock(clock)
 	go func() {
-		ticker := time.NewTicker(tick)
+		// sending the timeout event potentially races with a closing
+		// rx channel, so just recover from the panic and exit
+		defer func() {
+			if r := recover(); r != nil {
+				return
+			}
+		}()
+		last := clock.Now()
 		for {
+			at := next(last)
+			if at.IsZero() {
+				return
+			}
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
-				// sending the timeout event potentially races with a closing
-				// rx channel, so just recover from the panic and exit
-				defer func() {
-					if r := recover(); r != nil {
-						return
-					}
-				}()
+			case <-clock.After(at.Sub(clock.Now())):
 				rx <- Event{Code: TimerExpired, Source: name}
 			}
+			last = at
+			if now := clock.Now(); now.After(last) {
+				last = now
+			}
 		}
 	}()
 }
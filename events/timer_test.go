@@ -0,0 +1,158 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/joyent/containerpilot/tests/mocks"
+)
+
+func TestEventTimerWithSplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rx := make(chan Event, 10)
+	tick := 20 * time.Millisecond
+	start := time.Now()
+	NewEventTimerWithSplay(ctx, nil, rx, tick, 10*time.Millisecond, "splayed")
+
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-rx:
+			if event != (Event{TimerExpired, "splayed"}) {
+				t.Fatalf("unexpected event: %v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for tick %d", i)
+		}
+		// every tick, including the first, waits at least the interval;
+		// the ticks are on the interval from the start, so it's the time
+		// since the start that can't be less than the intervals so far
+		if elapsed, min := time.Since(start), time.Duration(i+1)*tick; elapsed < min {
+			t.Fatalf("tick %d came after %v, expected at least %v", i, elapsed, min)
+		}
+	}
+}
+
+// The ticks stay on the interval from when the timer started no matter
+// how late each one was handled, and the ticks that were missed entirely
+// are skipped rather than sent all at once
+func TestEventTimerFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := mocks.NewFakeClock()
+	rx := make(chan Event, 10)
+	NewEventTimer(ctx, clock, rx, 10*time.Second, "ticker")
+
+	advance := func(d time.Duration) {
+		if !clock.BlockUntil(1, time.Second) {
+			t.Fatalf("timed out waiting for the timer")
+		}
+		clock.Advance(d)
+	}
+	expectTicks := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-rx:
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for tick %d of %d", i+1, n)
+			}
+		}
+		select {
+		case event := <-rx:
+			t.Fatalf("expected %d ticks but got another: %v", n, event)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		advance(10 * time.Second)
+		expectTicks(1)
+	}
+	advance(9 * time.Second)
+	expectTicks(0)
+	advance(time.Second)
+	expectTicks(1)
+
+	// we're at 40s, so the 50s and 60s ticks are missed and the next one
+	// is still at 70s
+	advance(25 * time.Second)
+	expectTicks(1)
+	advance(4 * time.Second)
+	expectTicks(0)
+	advance(time.Second)
+	expectTicks(1)
+}
+
+// A schedule fires at each of the times from its next func, and skips
+// the times that were missed while the receiver was busy
+func TestEventScheduleFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := mocks.NewFakeClock()
+	rx := make(chan Event, 10)
+	next := func(last time.Time) time.Time {
+		return last.Truncate(10 * time.Second).Add(10 * time.Second)
+	}
+	NewEventSchedule(ctx, clock, rx, next, "scheduled")
+
+	advance := func(d time.Duration) {
+		if !clock.BlockUntil(1, time.Second) {
+			t.Fatalf("timed out waiting for the schedule")
+		}
+		clock.Advance(d)
+	}
+	expectTicks := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case event := <-rx:
+				if event != (Event{TimerExpired, "scheduled"}) {
+					t.Fatalf("unexpected event: %v", event)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for tick %d of %d", i+1, n)
+			}
+		}
+		select {
+		case event := <-rx:
+			t.Fatalf("expected %d ticks but got another: %v", n, event)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	advance(10 * time.Second)
+	expectTicks(1)
+	// we're at 35s, so the 30s time is missed and the next one is at 40s
+	advance(25 * time.Second)
+	expectTicks(1)
+	advance(4 * time.Second)
+	expectTicks(0)
+	advance(time.Second)
+	expectTicks(1)
+}
+
+func TestNextTick(t *testing.T) {
+	start := time.Unix(100, 0)
+	tick := 10 * time.Second
+	if got := nextTick(start, tick, start.Add(3*time.Second)); !got.Equal(start.Add(tick)) {
+		t.Fatalf("expected the next tick on the interval but got %v", got)
+	}
+	if got := nextTick(start, tick, start.Add(35*time.Second)); !got.Equal(start.Add(40 * time.Second)) {
+		t.Fatalf("expected the missed ticks to be skipped but got %v", got)
+	}
+}
+
+func TestRandomSplay(t *testing.T) {
+	splay := 5 * time.Millisecond
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		got := randomSplay(splay)
+		if got < 0 || got >= splay {
+			t.Fatalf("splay %v out of range [0, %v)", got, splay)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected random splays but always got %v", seen)
+	}
+}
@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/joyent/containerpilot/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// reportAggregateCheck publishes the result of each service listed in the
+// output of an aggregate health check, as though each of those services
+// had run its own check. The output is only trusted if the check passed;
+// if it failed, every service it reports for is failed.
+func (job *Job) reportAggregateCheck(passed bool) {
+	if len(job.aggregateServices) == 0 {
+		return
+	}
+	var results map[string]bool
+	if passed {
+		results = parseAggregateOutput(job.Name,
+			job.healthCheck.LastResult().Stdout, job.aggregateServices)
+	} else {
+		results = make(map[string]bool, len(job.aggregateServices))
+		for name := range job.aggregateServices {
+			results[name] = false
+		}
+	}
+	for name := range job.aggregateServices {
+		if _, ok := results[name]; !ok {
+			log.Debugf("%s: no aggregate health check status for service '%s'",
+				job.Name, name)
+		}
+	}
+	for name, healthy := range results {
+		code := events.ExitFailed
+		if healthy {
+			code = events.ExitSuccess
+		}
+		job.Bus.Publish(events.Event{Code: code, Source: "check." + name})
+	}
+}
+
+// parseAggregateOutput parses lines like "svcA ok" or "svcB fail" from the
+// output of an aggregate health check. Blank lines are skipped, and lines
+// for services that aren't reported by this check or that we can't parse
+// are logged and ignored.
+func parseAggregateOutput(name, output string, services map[string]bool) map[string]bool {
+	results := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			log.Warnf("%s: ignoring aggregate health check output '%s'",
+				name, scanner.Text())
+			continue
+		}
+		service, status := fields[0], strings.ToLower(fields[1])
+		if !services[service] {
+			log.Warnf("%s: ignoring aggregate health check output for "+
+				"unknown service '%s'", name, service)
+			continue
+		}
+		switch status {
+		case "ok":
+			results[service] = true
+		case "fail":
+			results[service] = false
+		default:
+			log.Warnf("%s: ignoring aggregate health check status '%s' "+
+				"for service '%s'", name, fields[1], service)
+		}
+	}
+	return results
+}
@@ -0,0 +1,241 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joyent/containerpilot/commands"
+	"github.com/joyent/containerpilot/config/timing"
+	"github.com/joyent/containerpilot/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthChecker runs a Job's health check asynchronously and publishes
+// an ExitSuccess or ExitFailed event with the check's name as the Source
+// when it is done. The result of the check is available from LastResult
+// by the time the event is published. commands.Command satisfies this for
+// exec checks.
+type healthChecker interface {
+	Run(ctx context.Context, bus *events.EventBus)
+	LastResult() commands.Result
+}
+
+// HTTPCheckConfig configures a health check that makes an HTTP GET
+// request in-process rather than forking an exec. The URL can also be a
+// 'host:port' address or a 'unix://' socket path, in which case the
+// request is sent to Path.
+type HTTPCheckConfig struct {
+	URL     string `mapstructure:"url"`
+	Path    string `mapstructure:"path"`
+	Status  []int  `mapstructure:"status"`
+	Timeout string `mapstructure:"timeout"`
+}
+
+// TCPCheckConfig configures a health check that opens a TCP connection
+// in-process rather than forking an exec
+type TCPCheckConfig struct {
+	Address string `mapstructure:"address"`
+	Timeout string `mapstructure:"timeout"`
+}
+
+// probeCheck is a healthChecker that runs its probe function in-process
+type probeCheck struct {
+	name    string
+	timeout time.Duration
+	probe   func(ctx context.Context) error
+	lock    *sync.Mutex
+
+	resultLock sync.Mutex
+	result     commands.Result
+}
+
+// Run implements healthChecker for probeCheck
+func (check *probeCheck) Run(pctx context.Context, bus *events.EventBus) {
+	go func() {
+		// like a Command, we never run more than one probe at a time
+		check.lock.Lock()
+		defer check.lock.Unlock()
+		ctx, cancel := context.WithTimeout(pctx, check.timeout)
+		defer cancel()
+		started := time.Now()
+		err := check.probe(ctx)
+		check.setResult(started, err)
+		if err != nil {
+			log.Errorf("%s failed: %v", check.name, err)
+			bus.Publish(events.Event{events.ExitFailed, check.name})
+			bus.Publish(events.Event{events.Error,
+				fmt.Errorf("%s: %s", check.name, err).Error()})
+			return
+		}
+		log.Debugf("%s passed", check.name)
+		bus.Publish(events.Event{events.ExitSuccess, check.name})
+	}()
+}
+
+// LastResult implements healthChecker for probeCheck. Probes don't have
+// an exit code, so a failed probe has an ExitCode of 1 and its error as
+// the Output.
+func (check *probeCheck) LastResult() commands.Result {
+	check.resultLock.Lock()
+	defer check.resultLock.Unlock()
+	return check.result
+}
+
+func (check *probeCheck) setResult(started time.Time, err error) {
+	result := commands.Result{Duration: time.Since(started), Time: time.Now()}
+	if err != nil {
+		result.ExitCode = 1
+		result.Error = err.Error()
+		result.Output = err.Error()
+	}
+	check.resultLock.Lock()
+	check.result = result
+	check.resultLock.Unlock()
+}
+
+// parseCheckTimeout returns the timeout for an in-process check, falling
+// back to the health check's timeout. A probe always needs a timeout so
+// that it can't block the next check forever.
+func parseCheckTimeout(raw string, fallback time.Duration) (time.Duration, error) {
+	timeout, err := timing.GetTimeout(raw)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	return timeout, nil
+}
+
+// parseHTTPCheckURL returns the URL to request for an HTTP check and the
+// client to request it with. A unix socket URL gets a client that dials
+// the socket for every request, whatever the host in the request URL.
+func parseHTTPCheckURL(field string, cfg *HTTPCheckConfig) (*url.URL, *http.Client, error) {
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		return nil, nil, fmt.Errorf("%s.path must start with '/': '%s'",
+			field, cfg.Path)
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/"
+	}
+	if !strings.Contains(cfg.URL, "://") {
+		if _, _, err := net.SplitHostPort(cfg.URL); err == nil {
+			target, err := url.Parse("http://" + cfg.URL + path)
+			if err == nil {
+				return target, &http.Client{}, nil
+			}
+		}
+	}
+	target, err := url.Parse(cfg.URL)
+	switch {
+	case err != nil:
+	case target.Scheme == "unix" && target.Host == "" && target.Path != "":
+		socket := target.Path
+		dialer := &net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		target, err = url.Parse("http://localhost" + path)
+		if err == nil {
+			return target, &http.Client{Transport: transport}, nil
+		}
+	case (target.Scheme == "http" || target.Scheme == "https") && target.Host != "":
+		if cfg.Path != "" {
+			return nil, nil, fmt.Errorf("%s.path can only be used with a "+
+				"'host:port' or 'unix://' url", field)
+		}
+		return target, &http.Client{}, nil
+	}
+	return nil, nil, fmt.Errorf("%s.url must be an http or https URL, "+
+		"a 'host:port' address, or a 'unix://' socket path: '%s'", field, cfg.URL)
+}
+
+func newHTTPCheck(name, field string, cfg *HTTPCheckConfig, fallback time.Duration) (*probeCheck, error) {
+	target, client, err := parseHTTPCheckURL(field, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range cfg.Status {
+		if status < 100 || status > 599 {
+			return nil, fmt.Errorf("%s.status must be valid HTTP status codes: %v",
+				field, cfg.Status)
+		}
+	}
+	timeout, err := parseCheckTimeout(cfg.Timeout, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s.timeout '%s': %v",
+			field, cfg.Timeout, err)
+	}
+	expected := cfg.Status
+	display := cfg.URL
+	if cfg.Path != "" {
+		display = cfg.URL + " " + cfg.Path
+	}
+	probe := func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", target.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if !expectedStatus(expected, resp.StatusCode) {
+			return fmt.Errorf("unexpected HTTP status %d from %s",
+				resp.StatusCode, display)
+		}
+		return nil
+	}
+	return &probeCheck{name: name, timeout: timeout, probe: probe,
+		lock: &sync.Mutex{}}, nil
+}
+
+// expectedStatus returns true if the code is one of the expected codes,
+// or is a 2xx code if there are no expected codes
+func expectedStatus(expected []int, code int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, status := range expected {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
+
+func newTCPCheck(name, field string, cfg *TCPCheckConfig, fallback time.Duration) (*probeCheck, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("%s.address must be in the form 'host:port': '%s'",
+			field, cfg.Address)
+	}
+	timeout, err := parseCheckTimeout(cfg.Timeout, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s.timeout '%s': %v",
+			field, cfg.Timeout, err)
+	}
+	address := cfg.Address
+	probe := func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		conn, err := net.DialTimeout("tcp", address, time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return &probeCheck{name: name, timeout: timeout, probe: probe,
+		lock: &sync.Mutex{}}, nil
+}
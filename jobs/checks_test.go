@@ -0,0 +1,199 @@
+package jobs
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/tests"
+)
+
+func TestHTTPHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/ok":
+				w.WriteHeader(http.StatusNoContent)
+			case "/slow":
+				time.Sleep(200 * time.Millisecond)
+			default:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	defer server.Close()
+
+	probe := func(cfg *HTTPCheckConfig) error {
+		check, err := newHTTPCheck("check.test", "health.http", cfg, time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error creating check: %v", err)
+		}
+		return check.probe(context.Background())
+	}
+	assert.Nil(t, probe(&HTTPCheckConfig{URL: server.URL + "/ok"}))
+	assert.Error(t, probe(&HTTPCheckConfig{URL: server.URL + "/fail"}))
+	assert.Nil(t, probe(&HTTPCheckConfig{URL: server.URL + "/fail", Status: []int{503}}))
+	assert.Error(t, probe(&HTTPCheckConfig{URL: server.URL + "/ok", Status: []int{200}}))
+
+	check, _ := newHTTPCheck("check.test", "health.http",
+		&HTTPCheckConfig{URL: server.URL + "/slow", Timeout: "50ms"}, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+	defer cancel()
+	assert.Error(t, check.probe(ctx), "expected timeout")
+}
+
+func TestHTTPHealthCheckAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+	check, err := newHTTPCheck("check.test", "health.http",
+		&HTTPCheckConfig{URL: address, Path: "/health"}, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error creating check: %v", err)
+	}
+	assert.Nil(t, check.probe(context.Background()))
+
+	check, _ = newHTTPCheck("check.test", "health.http",
+		&HTTPCheckConfig{URL: address}, time.Second)
+	assert.EqualError(t, check.probe(context.Background()),
+		"unexpected HTTP status 404 from "+address)
+}
+
+func TestHTTPHealthCheckUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerpilot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/ok":
+				w.WriteHeader(http.StatusNoContent)
+			case "/slow":
+				time.Sleep(200 * time.Millisecond)
+			default:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	url := "unix://" + socket
+	probe := func(cfg *HTTPCheckConfig) error {
+		check, err := newHTTPCheck("check.test", "health.http", cfg, time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error creating check: %v", err)
+		}
+		return check.probe(context.Background())
+	}
+	assert.Nil(t, probe(&HTTPCheckConfig{URL: url, Path: "/ok"}))
+	assert.EqualError(t, probe(&HTTPCheckConfig{URL: url, Path: "/fail"}),
+		"unexpected HTTP status 503 from "+url+" /fail")
+	assert.Nil(t, probe(&HTTPCheckConfig{URL: url, Path: "/fail", Status: []int{503}}))
+	assert.Error(t, probe(&HTTPCheckConfig{URL: url, Path: "/ok", Status: []int{200}}))
+	assert.Error(t, probe(&HTTPCheckConfig{URL: "unix://" + socket + ".missing"}),
+		"expected error for missing socket")
+
+	check, _ := newHTTPCheck("check.test", "health.http",
+		&HTTPCheckConfig{URL: url, Path: "/slow", Timeout: "50ms"}, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+	defer cancel()
+	assert.Error(t, check.probe(ctx), "expected timeout")
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+
+	check, err := newTCPCheck("check.test", "health.tcp",
+		&TCPCheckConfig{Address: address}, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error creating check: %v", err)
+	}
+	bus := events.NewEventBus()
+	check.Run(context.Background(), bus)
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, bus.DebugEvents(),
+		events.Event{Code: events.ExitSuccess, Source: "check.test"})
+
+	ln.Close()
+	bus = events.NewEventBus()
+	check.Run(context.Background(), bus)
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, bus.DebugEvents(),
+		events.Event{Code: events.ExitFailed, Source: "check.test"})
+}
+
+func TestJobConfigHealthCheckTypes(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+              health: {http: {url: "http://localhost/health", status: [200, 204]},
+                       interval: 1, ttl: 5, timeout: "2s"}}]`
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	check, ok := jobs[0].healthCheck.(*probeCheck)
+	assert.True(t, ok, "expected in-process health check")
+	assert.Equal(t, 2*time.Second, check.timeout, "expected health.timeout fallback")
+	assert.Nil(t, jobs[0].healthCheckExec)
+
+	cfg = `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+             health: {tcp: {address: "localhost:5432"}, interval: 3, ttl: 5}}]`
+	jobs, err = NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	check, _ = jobs[0].healthCheck.(*probeCheck)
+	assert.Equal(t, 3*time.Second, check.timeout, "expected interval fallback")
+
+	testErr := func(health, expected string) {
+		cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+                  health: ` + health + `}]`
+		_, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		assert.EqualError(t, err, expected)
+	}
+	testErr(`{exec: "true", tcp: {address: "localhost:80"}, interval: 1, ttl: 5}`,
+		"job[myName].health must have only one of 'exec', 'http', 'tcp', or 'grpc'")
+	testErr(`{http: {url: "localhost/health"}, interval: 1, ttl: 5}`,
+		"job[myName].health.http.url must be an http or https URL, "+
+			"a 'host:port' address, or a 'unix://' socket path: 'localhost/health'")
+	testErr(`{http: {url: "http://localhost", path: "/health"}, interval: 1, ttl: 5}`,
+		"job[myName].health.http.path can only be used with a 'host:port' or 'unix://' url")
+	testErr(`{http: {url: "unix:///tmp/app.sock", path: "health"}, interval: 1, ttl: 5}`,
+		"job[myName].health.http.path must start with '/': 'health'")
+	testErr(`{http: {url: "http://localhost", status: [1000]}, interval: 1, ttl: 5}`,
+		"job[myName].health.http.status must be valid HTTP status codes: [1000]")
+	testErr(`{tcp: {address: "localhost"}, interval: 1, ttl: 5}`,
+		"job[myName].health.tcp.address must be in the form 'host:port': 'localhost'")
+	testErr(`{tcp: {address: "localhost:80", timeout: "x"}, interval: 1, ttl: 5}`,
+		"could not parse job[myName].health.tcp.timeout 'x': time: invalid duration \"x\"")
+	testErr(`{grpc: {address: "localhost"}, interval: 1, ttl: 5}`,
+		"job[myName].health.grpc.address must be in the form 'host:port': 'localhost'")
+	testErr(`{grpc: {address: "localhost:80", tls: {clientcert: "cert.pem"}}, interval: 1, ttl: 5}`,
+		"job[myName].health.grpc.tls.clientcert and job[myName].health.grpc.tls.clientkey "+
+			"must be set together")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/joyent/containerpilot/commands"
@@ -17,33 +19,88 @@ import (
 
 const taskMinDuration = time.Millisecond
 
+// healthCheckKillGracePeriod is how long a health check that has timed
+// out has to exit after SIGTERM before it gets SIGKILL
+const healthCheckKillGracePeriod = time.Second
+
+// healthCheckOutputLimit is how much of the end of a health check's stderr
+// is kept for telemetry after it fails
+const healthCheckOutputLimit = 1024
+
+// aggregateCheckOutputLimit is how much of the end of an aggregate health
+// check's stdout is parsed for the status of each service
+const aggregateCheckOutputLimit = 64 * 1024
+
+// restartPolicy determines which exits of a Job's process are restarted
+type restartPolicy string
+
+const (
+	restartDefault   restartPolicy = ""           // restart on any exit, up to 'restarts'
+	restartAlways    restartPolicy = "always"     // like the default, but unlimited by default
+	restartOnFailure restartPolicy = "on-failure" // restart only after a failed exit
+	restartNever     restartPolicy = "never"
+)
+
+// maxRestartBackoff caps the doubling of the restartBackoff, and a process
+// that runs for longer than this resets the backoff
+const maxRestartBackoff = time.Minute
+
 // Config holds the configuration for service discovery data
 type Config struct {
 	Name string      `mapstructure:"name"`
 	Exec interface{} `mapstructure:"exec"`
 
 	// service discovery
-	Port              int           `mapstructure:"port"`
-	Interfaces        interface{}   `mapstructure:"interfaces"`
-	Tags              []string      `mapstructure:"tags"`
-	ConsulExtras      *ConsulExtras `mapstructure:"consul"`
-	serviceDefinition *discovery.ServiceDefinition
+	Port                   int               `mapstructure:"port"`
+	Interfaces             interface{}       `mapstructure:"interfaces"`
+	PreferredNetworks      []string          `mapstructure:"preferredNetworks"`
+	InterfaceOverlap       string            `mapstructure:"interfaceOverlap"`
+	InterfaceOrder         string            `mapstructure:"interfaceOrder"`
+	InterfaceSelection     string            `mapstructure:"interfaceSelection"`
+	InterfaceTimeout       string            `mapstructure:"interfaceTimeout"`
+	InterfaceRetryInterval string            `mapstructure:"interfaceRetryInterval"`
+	InterfaceFailureLimit  int               `mapstructure:"interfaceFailureLimit"`
+	DualStack              bool              `mapstructure:"dualStack"`
+	Tags                   []string          `mapstructure:"tags"`
+	Meta                   map[string]string `mapstructure:"meta"`
+	Weights                *WeightsConfig    `mapstructure:"weights"`
+	Routing                *RoutingConfig    `mapstructure:"routing"`
+	ConsulExtras           *ConsulExtras     `mapstructure:"consul"`
+	Connect                *ConnectConfig    `mapstructure:"connect"`
+	OnHealthy              *OnHealthyConfig  `mapstructure:"onHealthy"`
+	serviceDefinition      *discovery.ServiceDefinition
 
 	// health checking
 	Health            *HealthConfig `mapstructure:"health"`
 	healthCheckExec   *commands.Command
+	healthCheckExecs  map[string]*commands.Command // of health.checks, by field
+	onHealthy         *onHealthyHook
+	healthCheck       healthChecker
+	healthCheckName   string
 	heartbeatInterval time.Duration
+	heartbeatSplay    time.Duration
+	healthGrace       time.Duration
+	failureThreshold  int
+	successThreshold  int
+	aggregateServices []string
 	ttl               int
 
 	// timeouts and restarts
 	ExecTimeout     string      `mapstructure:"timeout"`
 	Restarts        interface{} `mapstructure:"restarts"`
+	RestartPolicy   string      `mapstructure:"restartPolicy"`
+	RestartBackoff  string      `mapstructure:"restartBackoff"`
+	Critical        bool        `mapstructure:"critical"`
 	StopTimeout     string      `mapstructure:"stopTimeout"`
 	execTimeout     time.Duration
 	exec            *commands.Command
 	stoppingTimeout time.Duration
 	restartLimit    int
+	restartPolicy   restartPolicy
+	restartBackoff  time.Duration
 	freqInterval    time.Duration
+	freqSplay       time.Duration
+	freqSchedule    *timing.CronSchedule
 
 	// related jobs and frequency
 	When              *WhenConfig `mapstructure:"when"`
@@ -51,30 +108,62 @@ type Config struct {
 	whenTimeout       time.Duration
 	whenStartsLimit   int
 	stoppingWaitEvent events.Event
+
+	// how the output of the process is logged
+	Logging *LoggingConfig `mapstructure:"logging"`
 }
 
 // WhenConfig determines when a Job runs (dependencies on other Jobs,
 // Watches, or frequency timers)
 type WhenConfig struct {
 	Frequency string `mapstructure:"interval"`
+	Cron      string `mapstructure:"cron"`
 	Source    string `mapstructure:"source"`
 	Once      string `mapstructure:"once"`
 	Each      string `mapstructure:"each"`
 	Timeout   string `mapstructure:"timeout"`
+	Splay     string `mapstructure:"splay"`
+}
+
+// LoggingConfig configures how the output of the Job's process is logged,
+// or where it's forwarded to instead
+type LoggingConfig struct {
+	Raw      bool        `mapstructure:"raw"`
+	Output   string      `mapstructure:"output"`
+	MaxSize  interface{} `mapstructure:"maxSize"`
+	MaxFiles int         `mapstructure:"maxFiles"`
 }
 
 // HealthConfig configures the Job's health checks
 type HealthConfig struct {
-	CheckExec    interface{} `mapstructure:"exec"`
-	CheckTimeout string      `mapstructure:"timeout"`
-	Heartbeat    int         `mapstructure:"interval"` // time in seconds
-	TTL          int         `mapstructure:"ttl"`      // time in seconds
+	CheckExec    interface{}      `mapstructure:"exec"`
+	CheckHTTP    *HTTPCheckConfig `mapstructure:"http"`
+	CheckTCP     *TCPCheckConfig  `mapstructure:"tcp"`
+	CheckGRPC    *GRPCCheckConfig `mapstructure:"grpc"`
+	CheckTimeout string           `mapstructure:"timeout"`
+	Heartbeat    int              `mapstructure:"interval"` // time in seconds
+	TTL          int              `mapstructure:"ttl"`      // time in seconds
+	Splay        string           `mapstructure:"splay"`
+	Grace        string           `mapstructure:"grace"`
+	Aggregate    bool             `mapstructure:"aggregate"`
+	From         string           `mapstructure:"from"`
+
+	// consecutive failed checks before a healthy Job becomes unhealthy,
+	// and passed checks before an unhealthy Job becomes healthy again
+	FailureThreshold int `mapstructure:"failureThreshold"`
+	SuccessThreshold int `mapstructure:"successThreshold"`
+
+	// Checks replaces the single check with several checks, which are
+	// combined as set by Require: "all" (the default) or "any"
+	Checks  []*HealthCheckConfig `mapstructure:"checks"`
+	Require string               `mapstructure:"require"`
 }
 
 // ConsulExtras handles additional Consul configuration.
 type ConsulExtras struct {
 	EnableTagOverride              bool   `mapstructure:"enableTagOverride"`
 	DeregisterCriticalServiceAfter string `mapstructure:"deregisterCriticalServiceAfter"`
+	DeregisterAfter                string `mapstructure:"deregisterAfter"` // alias of the above
 }
 
 // NewConfigs parses json config into a validated slice of Configs
@@ -83,14 +172,52 @@ func NewConfigs(raw []interface{}, disc discovery.Backend) ([]*Config, error) {
 	if raw == nil {
 		return jobs, nil
 	}
-	if err := decode.ToStruct(raw, &jobs); err != nil {
+	normalized := make([]interface{}, len(raw))
+	for i, job := range raw {
+		var err error
+		if normalized[i], err = normalizePort(job); err != nil {
+			return nil, err
+		}
+	}
+	if err := decode.ToStruct(normalized, &jobs); err != nil {
 		return nil, fmt.Errorf("job configuration error: %v", err)
 	}
-	stopDependencies := make(map[string]string)
 	for _, job := range jobs {
 		if err := job.Validate(disc); err != nil {
 			return nil, err
 		}
+	}
+	if err := LinkConfigs(jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// NewConfig parses json config into a single validated Config, without
+// linking it to the other Jobs it refers to
+func NewConfig(raw interface{}, disc discovery.Backend) (*Config, error) {
+	var job *Config
+	raw, err := normalizePort(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := decode.ToStruct(raw, &job); err != nil {
+		return nil, fmt.Errorf("job configuration error: %v", err)
+	}
+	if job == nil {
+		return nil, fmt.Errorf("job configuration error: empty job")
+	}
+	if err := job.Validate(disc); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// LinkConfigs sets up the dependencies between validated Configs, and
+// returns an error if any Config refers to a Job that can't satisfy them
+func LinkConfigs(jobs []*Config) error {
+	stopDependencies := make(map[string]string)
+	for _, job := range jobs {
 		if job.whenEvent.Code == events.Stopping {
 			stopDependencies[job.whenEvent.Source] = job.Name
 		}
@@ -101,7 +228,34 @@ func NewConfigs(raw []interface{}, disc discovery.Backend) ([]*Config, error) {
 			job.setStopping(dependent)
 		}
 	}
-	return jobs, nil
+	return setAggregateChecks(jobs)
+}
+
+// setAggregateChecks tells each Job with an aggregate health check which
+// Jobs get their health from its output
+func setAggregateChecks(jobs []*Config) error {
+	byName := make(map[string]*Config, len(jobs))
+	for _, job := range jobs {
+		byName[job.Name] = job
+		job.aggregateServices = nil
+	}
+	for _, job := range jobs {
+		if job.Health == nil || job.Health.From == "" {
+			continue
+		}
+		from, ok := byName[job.Health.From]
+		if !ok || from.Health == nil || !from.Health.Aggregate {
+			return fmt.Errorf("job[%s].health.from '%s' must be the name of "+
+				"a job with an aggregate health check", job.Name, job.Health.From)
+		}
+		if from.heartbeatInterval >= time.Duration(job.ttl)*time.Second {
+			log.Warnf("job[%s].health.ttl is not more than the "+
+				"health.interval of job[%s], so the service may be marked "+
+				"critical between checks", job.Name, from.Name)
+		}
+		from.aggregateServices = append(from.aggregateServices, job.Name)
+	}
+	return nil
 }
 
 // Validate ensures that a Config meets all constraints
@@ -109,12 +263,18 @@ func (cfg *Config) Validate(disc discovery.Backend) error {
 	if err := cfg.validateDiscovery(disc); err != nil {
 		return err
 	}
+	if err := cfg.validateOnHealthy(); err != nil {
+		return err
+	}
 	if err := cfg.validateWhen(); err != nil {
 		return err
 	}
 	if err := cfg.validateStoppingTimeout(); err != nil {
 		return err
 	}
+	if err := cfg.validateRestartPolicy(); err != nil {
+		return err
+	}
 	if err := cfg.validateRestarts(); err != nil {
 		return err
 	}
@@ -155,15 +315,27 @@ func (cfg *Config) validateWhen() error {
 		return nil
 	}
 
-	if (cfg.When.Frequency != "" && cfg.When.Once != "") ||
-		(cfg.When.Frequency != "" && cfg.When.Each != "") ||
-		(cfg.When.Once != "" && cfg.When.Each != "") {
-		return fmt.Errorf("job[%s].when can have only one of 'interval', 'once', or 'each'",
+	triggers := 0
+	for _, trigger := range []string{cfg.When.Frequency, cfg.When.Cron,
+		cfg.When.Once, cfg.When.Each} {
+		if trigger != "" {
+			triggers++
+		}
+	}
+	if triggers > 1 {
+		return fmt.Errorf("job[%s].when can have only one of 'interval', 'cron', 'once', or 'each'",
+			cfg.Name)
+	}
+	if cfg.When.Splay != "" && cfg.When.Frequency == "" {
+		return fmt.Errorf("job[%s].when.splay can only be used with 'interval'",
 			cfg.Name)
 	}
 	if cfg.When.Frequency != "" {
 		return cfg.validateFrequency()
 	}
+	if cfg.When.Cron != "" {
+		return cfg.validateCron()
+	}
 	return cfg.validateWhenEvent()
 }
 
@@ -177,13 +349,61 @@ func (cfg *Config) validateFrequency() error {
 		return fmt.Errorf("job[%s].when.interval '%s' cannot be less than %v",
 			cfg.Name, cfg.When.Frequency, taskMinDuration)
 	}
+	splay, err := timing.ParseSplay(cfg.When.Splay, freq)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].when.splay '%s': %v",
+			cfg.Name, cfg.When.Splay, err)
+	}
+	if splay < 0 {
+		return fmt.Errorf("job[%s].when.splay '%s' cannot be negative",
+			cfg.Name, cfg.When.Splay)
+	}
 	cfg.freqInterval = freq
+	cfg.freqSplay = splay
 	cfg.whenTimeout = time.Duration(0)
 	cfg.whenEvent = events.GlobalStartup
 	cfg.whenStartsLimit = 1
 	return nil
 }
 
+// validateCron parses the cron schedule of a periodic task. Unlike an
+// interval, the task doesn't run at startup but waits for the first time
+// that matches the schedule.
+func (cfg *Config) validateCron() error {
+	schedule, err := timing.ParseCron(cfg.When.Cron)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].when.cron '%s': %v",
+			cfg.Name, cfg.When.Cron, err)
+	}
+	first := schedule.Next(time.Now())
+	if first.IsZero() {
+		return fmt.Errorf("job[%s].when.cron '%s' never runs",
+			cfg.Name, cfg.When.Cron)
+	}
+	// the default timeout of a task is the time until its next run
+	// can start, so use the shortest time between upcoming runs
+	shortest := time.Duration(0)
+	for i, last := 0, first; i < 64; i++ {
+		next := schedule.Next(last)
+		if next.IsZero() {
+			break
+		}
+		if gap := next.Sub(last); shortest == 0 || gap < shortest {
+			shortest = gap
+		}
+		last = next
+	}
+	if shortest == 0 {
+		shortest = time.Minute
+	}
+	cfg.freqInterval = shortest
+	cfg.freqSchedule = schedule
+	cfg.whenTimeout = time.Duration(0)
+	cfg.whenEvent = events.NonEvent
+	cfg.whenStartsLimit = 0
+	return nil
+}
+
 func (cfg *Config) validateWhenEvent() error {
 
 	whenTimeout, err := timing.GetTimeout(cfg.When.Timeout)
@@ -250,11 +470,93 @@ func (cfg *Config) validateExec() error {
 			cfg.Name = cmd.Exec
 		}
 		cmd.Name = cfg.Name
+		cmd.StopGracePeriod = cfg.stoppingTimeout
+		if cfg.Logging != nil {
+			cmd.RawOutput = cfg.Logging.Raw
+			forward, err := cfg.validateLogging()
+			if err != nil {
+				return err
+			}
+			cmd.Forward = forward
+		}
 		cfg.exec = cmd
 	}
 	return nil
 }
 
+// validateLogging returns the Forwarder for the 'logging.output', if any
+func (cfg *Config) validateLogging() (*commands.Forwarder, error) {
+	logging := cfg.Logging
+	var forward *commands.Forwarder
+	if logging.Output != "" {
+		if logging.Raw {
+			return nil, fmt.Errorf("job[%s].logging.output can't be used with 'raw'",
+				cfg.Name)
+		}
+		var err error
+		forward, err = commands.NewForwarder(logging.Output, cfg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job[%s].logging.output: %v", cfg.Name, err)
+		}
+	}
+	if forward == nil || !forward.IsFile() {
+		if logging.MaxSize != nil || logging.MaxFiles != 0 {
+			return nil, fmt.Errorf(
+				"job[%s].logging.maxSize and maxFiles require a file output", cfg.Name)
+		}
+		return forward, nil
+	}
+	if logging.MaxSize != nil {
+		maxSize, err := parseSize(logging.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse job[%s].logging.maxSize '%v': %v",
+				cfg.Name, logging.MaxSize, err)
+		}
+		forward.MaxSize = maxSize
+	}
+	if logging.MaxFiles < 0 {
+		return nil, fmt.Errorf("job[%s].logging.maxFiles must be > 0", cfg.Name)
+	}
+	if logging.MaxFiles > 0 {
+		forward.MaxFiles = logging.MaxFiles
+	}
+	return forward, nil
+}
+
+var sizeUnits = map[string]int64{
+	"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30,
+}
+
+// parseSize parses a number of bytes, or a string with a unit of "KB",
+// "MB", or "GB" (ex. "10MB")
+func parseSize(raw interface{}) (int64, error) {
+	var size int64
+	switch v := raw.(type) {
+	case int:
+		size = int64(v)
+	case float64:
+		size = int64(v)
+	case string:
+		value := strings.TrimSpace(v)
+		i := strings.IndexFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+		if i < 0 {
+			i = len(value)
+		}
+		unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+		n, err := strconv.ParseInt(value[:i], 10, 64)
+		if !ok || err != nil {
+			return 0, fmt.Errorf("expected a number of bytes or a size like '10MB'")
+		}
+		size = n * unit
+	default:
+		return 0, fmt.Errorf("expected a number of bytes or a size like '10MB'")
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("must be > 0")
+	}
+	return size, nil
+}
+
 func (cfg *Config) validateHealthCheck() error {
 	if cfg.Port != 0 && cfg.Health == nil && cfg.Name != "containerpilot" {
 		return fmt.Errorf("job[%s].health must be set if 'port' is set", cfg.Name)
@@ -262,7 +564,34 @@ func (cfg *Config) validateHealthCheck() error {
 	if cfg.Health == nil {
 		return nil // non-advertised jobs don't need health checks
 	}
-	if cfg.Health.Heartbeat < 1 {
+	if err := cfg.validateHealthThresholds(); err != nil {
+		return err
+	}
+	if cfg.Health.From != "" {
+		return cfg.validateHealthFrom()
+	}
+	heartbeat := cfg.Health.Heartbeat
+	if len(cfg.Health.Checks) > 0 {
+		// the Job heartbeats as often as its most frequent check
+		heartbeat = 0
+		for i, check := range cfg.Health.Checks {
+			if check == nil {
+				return fmt.Errorf("job[%s].health.checks[%d] must be a check",
+					cfg.Name, i)
+			}
+			if check.Interval == 0 {
+				check.Interval = cfg.Health.Heartbeat
+			}
+			if check.Interval < 1 {
+				return fmt.Errorf("job[%s].health.checks[%d].interval must be > 0",
+					cfg.Name, i)
+			}
+			if heartbeat == 0 || check.Interval < heartbeat {
+				heartbeat = check.Interval
+			}
+		}
+	}
+	if heartbeat < 1 {
 		return fmt.Errorf("job[%s].health.interval must be > 0", cfg.Name)
 	}
 	if cfg.Health.TTL < 1 {
@@ -270,7 +599,34 @@ func (cfg *Config) validateHealthCheck() error {
 	}
 
 	cfg.ttl = cfg.Health.TTL
-	cfg.heartbeatInterval = time.Duration(cfg.Health.Heartbeat) * time.Second
+	cfg.heartbeatInterval = time.Duration(heartbeat) * time.Second
+
+	splay, err := timing.ParseSplay(cfg.Health.Splay, cfg.heartbeatInterval)
+	if err != nil {
+		return fmt.Errorf("could not parse job[%s].health.splay '%s': %v",
+			cfg.Name, cfg.Health.Splay, err)
+	}
+	if splay < 0 {
+		return fmt.Errorf("job[%s].health.splay '%s' cannot be negative",
+			cfg.Name, cfg.Health.Splay)
+	}
+	if splay > 0 && cfg.heartbeatInterval+splay >= time.Duration(cfg.ttl)*time.Second {
+		log.Warnf("job[%s].health.interval plus splay '%s' is not less than "+
+			"the ttl, so the service may be marked critical between checks",
+			cfg.Name, cfg.Health.Splay)
+	}
+	cfg.heartbeatSplay = splay
+
+	grace, err := timing.GetTimeout(cfg.Health.Grace)
+	if err != nil {
+		return fmt.Errorf("could not parse job[%s].health.grace '%s': %v",
+			cfg.Name, cfg.Health.Grace, err)
+	}
+	if grace < 0 {
+		return fmt.Errorf("job[%s].health.grace '%s' cannot be negative",
+			cfg.Name, cfg.Health.Grace)
+	}
+	cfg.healthGrace = grace
 
 	var checkTimeout time.Duration
 	if cfg.Health.CheckTimeout != "" {
@@ -284,18 +640,249 @@ func (cfg *Config) validateHealthCheck() error {
 		checkTimeout = cfg.execTimeout
 	}
 
-	if cfg.Health.CheckExec != nil {
-		// the telemetry service won't have a health check
-		checkName := "check." + cfg.Name
-		cmd, err := commands.NewCommand(cfg.Health.CheckExec, checkTimeout,
-			log.Fields{"check": checkName})
+	if cfg.Health.Aggregate && cfg.Health.CheckExec == nil {
+		return fmt.Errorf("job[%s].health.aggregate requires 'exec'", cfg.Name)
+	}
+
+	// the telemetry service won't have a health check
+	checkName := "check." + cfg.Name
+	cfg.healthCheckName = checkName
+
+	field := fmt.Sprintf("job[%s].health", cfg.Name)
+	types := checkTypeConfig{cfg.Health.CheckExec, cfg.Health.CheckHTTP,
+		cfg.Health.CheckTCP, cfg.Health.CheckGRPC}
+	if len(cfg.Health.Checks) > 0 {
+		if types.count() > 0 {
+			return fmt.Errorf("%s.checks cannot be used with 'exec', 'http', "+
+				"'tcp', or 'grpc'", field)
+		}
+		return cfg.validateHealthChecks(field, checkName, checkTimeout)
+	}
+	if cfg.Health.Require != "" {
+		return fmt.Errorf("%s.require can only be used with 'checks'", field)
+	}
+	check, cmd, err := newHealthChecker(checkName, field, types, checkTimeout,
+		cfg.heartbeatInterval)
+	if err != nil {
+		return err
+	}
+	if cmd != nil && cfg.Health.Aggregate {
+		cmd.StdoutLimit = aggregateCheckOutputLimit
+	}
+	cfg.healthCheckExec = cmd
+	cfg.healthCheck = check
+	return nil
+}
+
+// validateHealthThresholds checks the failure and success thresholds,
+// which default to 1 so that every check counts
+func (cfg *Config) validateHealthThresholds() error {
+	for _, threshold := range []struct {
+		name  string
+		value int
+		dest  *int
+	}{
+		{"failureThreshold", cfg.Health.FailureThreshold, &cfg.failureThreshold},
+		{"successThreshold", cfg.Health.SuccessThreshold, &cfg.successThreshold},
+	} {
+		if threshold.value < 0 {
+			return fmt.Errorf("job[%s].health.%s must be > 0", cfg.Name,
+				threshold.name)
+		}
+		*threshold.dest = threshold.value
+		if threshold.value == 0 {
+			*threshold.dest = 1
+		}
+	}
+	return nil
+}
+
+// validateHealthChecks creates the multiCheck of a Job with several
+// health.checks. Each check can have its own timeout, which defaults
+// to the health.timeout.
+func (cfg *Config) validateHealthChecks(field, checkName string, checkTimeout time.Duration) error {
+	require := strings.ToLower(cfg.Health.Require)
+	switch require {
+	case "":
+		require = requireAll
+	case requireAll, requireAny:
+	default:
+		return fmt.Errorf("%s.require must be 'all' or 'any': '%s'",
+			field, cfg.Health.Require)
+	}
+	multi := &multiCheck{name: checkName, require: require,
+		lock: &sync.Mutex{}, now: time.Now}
+	cfg.healthCheckExecs = make(map[string]*commands.Command)
+	names := make(map[string]bool)
+	for i, check := range cfg.Health.Checks {
+		subField := fmt.Sprintf("%s.checks[%d]", field, i)
+		name := check.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if names[name] {
+			return fmt.Errorf("%s.name must be unique: '%s'", subField, name)
+		}
+		names[name] = true
+		timeout := checkTimeout
+		if check.CheckTimeout != "" {
+			parsedTimeout, err := timing.GetTimeout(check.CheckTimeout)
+			if err != nil {
+				return fmt.Errorf("could not parse %s.timeout '%s': %v",
+					subField, check.CheckTimeout, err)
+			}
+			timeout = parsedTimeout
+		}
+		interval := time.Duration(check.Interval) * time.Second
+		types := checkTypeConfig{check.CheckExec, check.CheckHTTP,
+			check.CheckTCP, check.CheckGRPC}
+		if types.count() == 0 {
+			return fmt.Errorf("%s must have one of 'exec', 'http', 'tcp', "+
+				"or 'grpc'", subField)
+		}
+		subName := checkName + "." + name
+		healthCheck, cmd, err := newHealthChecker(subName, subField, types,
+			timeout, interval)
+		if err != nil {
+			return err
+		}
+		if cmd != nil {
+			cfg.healthCheckExecs[subField+".exec"] = cmd
+		}
+		multi.checks = append(multi.checks, &subCheck{name: subName,
+			check: healthCheck, interval: interval})
+	}
+	cfg.healthCheck = multi
+	return nil
+}
+
+// checkTypeConfig is the part of a health check's config that chooses
+// the kind of check to run
+type checkTypeConfig struct {
+	exec interface{}
+	http *HTTPCheckConfig
+	tcp  *TCPCheckConfig
+	grpc *GRPCCheckConfig
+}
+
+// count returns how many kinds of check are set
+func (types checkTypeConfig) count() int {
+	count := 0
+	for _, isSet := range []bool{types.exec != nil, types.http != nil,
+		types.tcp != nil, types.grpc != nil} {
+		if isSet {
+			count++
+		}
+	}
+	return count
+}
+
+// newHealthChecker creates the check of the kind that's set, returning
+// the Command too if it's an exec check. It returns a nil healthChecker
+// if no kind of check is set. In-process checks can't be killed, so they
+// always need a timeout and fall back to the interval.
+func newHealthChecker(name, field string, types checkTypeConfig,
+	checkTimeout, interval time.Duration) (healthChecker, *commands.Command, error) {
+	if types.count() > 1 {
+		return nil, nil, fmt.Errorf("%s must have only one of 'exec', 'http', "+
+			"'tcp', or 'grpc'", field)
+	}
+	probeTimeout := checkTimeout
+	if probeTimeout <= 0 {
+		probeTimeout = interval
+	}
+	switch {
+	case types.http != nil:
+		check, err := newHTTPCheck(name, field+".http", types.http, probeTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return check, nil, nil
+	case types.tcp != nil:
+		check, err := newTCPCheck(name, field+".tcp", types.tcp, probeTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return check, nil, nil
+	case types.grpc != nil:
+		check, err := newGRPCCheck(name, field+".grpc", types.grpc, probeTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return check, nil, nil
+	case types.exec != nil:
+		// like the probes, a check without a timeout is killed once its
+		// interval has elapsed, so that a hung check can't keep the
+		// Job from ever checking again
+		cmd, err := commands.NewCommand(types.exec, probeTimeout,
+			log.Fields{"check": name})
 		if err != nil {
-			return fmt.Errorf("unable to create job[%s].health.exec: %v",
-				cfg.Name, err)
+			return nil, nil, fmt.Errorf("unable to create %s.exec: %v", field, err)
 		}
-		cmd.Name = checkName
-		cfg.healthCheckExec = cmd
+		cmd.Name = name
+		cmd.KillGracePeriod = healthCheckKillGracePeriod
+		cmd.OutputLimit = healthCheckOutputLimit
+		return cmd, cmd, nil
+	}
+	return nil, nil, nil
+}
+
+// validateHealthFrom validates the health config of a Job whose health
+// is reported by another Job's aggregate health check, so it doesn't run
+// any check or heartbeat of its own
+func (cfg *Config) validateHealthFrom() error {
+	switch {
+	case cfg.Health.CheckExec != nil || cfg.Health.CheckHTTP != nil ||
+		cfg.Health.CheckTCP != nil || cfg.Health.CheckGRPC != nil ||
+		len(cfg.Health.Checks) > 0:
+		return fmt.Errorf("job[%s].health.from cannot be used with "+
+			"'exec', 'http', 'tcp', 'grpc', or 'checks'", cfg.Name)
+	case cfg.Health.Heartbeat != 0:
+		return fmt.Errorf("job[%s].health.from cannot be used with 'interval'",
+			cfg.Name)
+	case cfg.Health.Aggregate:
+		return fmt.Errorf("job[%s].health.from cannot be used with 'aggregate'",
+			cfg.Name)
+	case cfg.Health.TTL < 1:
+		return fmt.Errorf("job[%s].health.ttl must be > 0", cfg.Name)
+	}
+	cfg.ttl = cfg.Health.TTL
+	cfg.healthCheckName = "check." + cfg.Name
+	return nil
+}
+
+func (cfg *Config) validateRestartPolicy() error {
+	switch restartPolicy(cfg.RestartPolicy) {
+	case restartDefault:
+	case restartAlways, restartOnFailure:
+		if cfg.Restarts == nil {
+			// the point of setting a policy is to restart, so the
+			// default retry limit is unlimited rather than "never"
+			cfg.Restarts = "unlimited"
+		}
+	case restartNever:
+		// validateRestarts checks that this doesn't conflict with restarts
+	default:
+		return fmt.Errorf(
+			`job[%s].restartPolicy '%s' invalid: accepts "always", "on-failure", or "never"`,
+			cfg.Name, cfg.RestartPolicy)
+	}
+	if cfg.RestartPolicy != "" && cfg.freqInterval > 0 {
+		return fmt.Errorf("job[%s].restartPolicy cannot be used with 'when.interval' or 'when.cron'",
+			cfg.Name)
+	}
+	cfg.restartPolicy = restartPolicy(cfg.RestartPolicy)
+
+	backoff, err := timing.GetTimeout(cfg.RestartBackoff)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].restartBackoff '%s': %v",
+			cfg.Name, cfg.RestartBackoff, err)
 	}
+	if backoff < 0 {
+		return fmt.Errorf("job[%s].restartBackoff '%s' cannot be negative",
+			cfg.Name, cfg.RestartBackoff)
+	}
+	cfg.restartBackoff = backoff
 	return nil
 }
 
@@ -347,6 +934,10 @@ func (cfg *Config) validateRestarts() error {
 		return fmt.Errorf(msg, cfg.Name, cfg.Restarts,
 			`accepts positive integers, "unlimited", or "never"`)
 	}
+	if cfg.restartPolicy == restartNever && cfg.restartLimit != 0 {
+		return fmt.Errorf(msg, cfg.Name, cfg.Restarts,
+			`must be "never" when restartPolicy is "never"`)
+	}
 
 	return nil
 }
@@ -358,7 +949,75 @@ func (cfg *Config) addDiscoveryConfig(disc discovery.Backend) error {
 	if ifaceErr != nil {
 		return ifaceErr
 	}
-	ipAddress, err := services.GetIP(interfaces)
+	overlap, err := services.ParseOverlapPolicy(cfg.InterfaceOverlap)
+	if err != nil {
+		return fmt.Errorf("job[%s].interfaceOverlap: %v", cfg.Name, err)
+	}
+	order, err := services.ParseSpecOrder(cfg.InterfaceOrder)
+	if err != nil {
+		return fmt.Errorf("job[%s].interfaceOrder: %v", cfg.Name, err)
+	}
+	selection, err := services.ParseIPSelection(cfg.InterfaceSelection)
+	if err != nil {
+		return fmt.Errorf("job[%s].interfaceSelection: %v", cfg.Name, err)
+	}
+	retryTimeout, err := timing.GetTimeout(cfg.InterfaceTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].interfaceTimeout '%s': %v",
+			cfg.Name, cfg.InterfaceTimeout, err)
+	}
+	retryInterval, err := timing.GetTimeout(cfg.InterfaceRetryInterval)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].interfaceRetryInterval '%s': %v",
+			cfg.Name, cfg.InterfaceRetryInterval, err)
+	}
+	if cfg.InterfaceFailureLimit < 0 {
+		return fmt.Errorf("job[%s].interfaceFailureLimit cannot be negative: %d",
+			cfg.Name, cfg.InterfaceFailureLimit)
+	}
+	newResolver := services.NewIPResolver
+	if cfg.DualStack {
+		if _, ok := cfg.Meta[discovery.IPv6MetaKey]; ok {
+			return fmt.Errorf("job[%s].meta key '%s' is reserved for the IPv6 "+
+				"address when dualStack is set", cfg.Name, discovery.IPv6MetaKey)
+		}
+		newResolver = services.NewDualStackIPResolver
+	}
+	ipOpts := services.IPOptions{
+		PreferredNetworks: cfg.PreferredNetworks,
+		Overlap:           overlap,
+		Order:             order,
+		Selection:         selection,
+		RetryTimeout:      retryTimeout,
+		RetryInterval:     retryInterval,
+	}
+	resolver := newResolver(interfaces, ipOpts, cfg.InterfaceFailureLimit)
+	ipAddress, err := resolver.Resolve()
+	if err != nil {
+		return err
+	}
+	// the interfaces are up once we've resolved an IP, so this is when we
+	// can tell which of the specs overlap
+	if err := services.CheckOverlappingSpecs(interfaces, ipOpts); err != nil {
+		return fmt.Errorf("job[%s].interfaces: %v", cfg.Name, err)
+	}
+	tags := cfg.validateTags()
+	if cfg.Routing != nil {
+		routingTags, err := cfg.Routing.validate(cfg.Name)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, routingTags...)
+	}
+	meta, err := cfg.validateMeta()
+	if err != nil {
+		return err
+	}
+	weights, err := cfg.validateWeights()
+	if err != nil {
+		return err
+	}
+	sidecar, err := cfg.validateConnect(disc)
 	if err != nil {
 		return err
 	}
@@ -371,13 +1030,10 @@ func (cfg *Config) addDiscoveryConfig(disc discovery.Backend) error {
 	)
 
 	if cfg.ConsulExtras != nil {
-		deregAfter = cfg.ConsulExtras.DeregisterCriticalServiceAfter
-		_, err := time.ParseDuration(deregAfter)
-		if err != nil {
-			return fmt.Errorf(
-				"unable to parse job[%s].consul.deregisterCriticalServiceAfter: %s",
-				cfg.Name, err)
+		if err := cfg.validateDeregisterCriticalServiceAfter(); err != nil {
+			return err
 		}
+		deregAfter = cfg.ConsulExtras.DeregisterCriticalServiceAfter
 		enableTagOverride = cfg.ConsulExtras.EnableTagOverride
 	}
 	cfg.serviceDefinition = &discovery.ServiceDefinition{
@@ -385,15 +1041,86 @@ func (cfg *Config) addDiscoveryConfig(disc discovery.Backend) error {
 		Name:                           cfg.Name,
 		Port:                           cfg.Port,
 		TTL:                            cfg.ttl,
-		Tags:                           cfg.Tags,
+		Tags:                           tags,
+		Meta:                           meta,
+		Weights:                        weights,
 		IPAddress:                      ipAddress,
+		IPv6Address:                    resolver.IPv6(),
 		DeregisterCriticalServiceAfter: deregAfter,
 		EnableTagOverride:              enableTagOverride,
+		Sidecar:                        sidecar,
 		Consul:                         disc,
+		Resolver:                       resolver,
+	}
+	if cfg.healthCheckExec != nil {
+		// the health check is checking this service, so it sees the IP
+		// that this service advertises
+		cfg.healthCheckExec.Env = serviceIPEnvironment(cfg.serviceDefinition)
+	}
+	for _, cmd := range cfg.healthCheckExecs {
+		cmd.Env = serviceIPEnvironment(cfg.serviceDefinition)
+	}
+	return nil
+}
+
+// validateDeregisterCriticalServiceAfter checks the duration that Consul
+// waits after the TTL check goes critical before it deregisters the
+// service. If unset, Consul never deregisters the service on its own.
+// It can be set as either deregisterCriticalServiceAfter or its shorter
+// alias deregisterAfter.
+func (cfg *Config) validateDeregisterCriticalServiceAfter() error {
+	extras := cfg.ConsulExtras
+	field, raw := "deregisterCriticalServiceAfter", extras.DeregisterCriticalServiceAfter
+	if extras.DeregisterAfter != "" {
+		if raw != "" {
+			return fmt.Errorf("job[%s].consul: only one of "+
+				"'deregisterAfter' or 'deregisterCriticalServiceAfter' can be set",
+				cfg.Name)
+		}
+		field, raw = "deregisterAfter", extras.DeregisterAfter
+		extras.DeregisterCriticalServiceAfter, extras.DeregisterAfter = raw, ""
+	}
+	if raw == "" {
+		return nil
+	}
+	deregAfter, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].consul.%s: %s",
+			cfg.Name, field, err)
+	}
+	if deregAfter <= 0 {
+		return fmt.Errorf("job[%s].consul.%s '%s' must be > 0",
+			cfg.Name, field, raw)
+	}
+	// a service that misses a heartbeat could be deregistered before its
+	// TTL has let the next heartbeat mark it healthy again
+	ttl := time.Duration(cfg.ttl) * time.Second
+	if deregAfter < ttl {
+		log.Warnf("job[%s].consul.%s '%s' is shorter than health.ttl '%v'",
+			cfg.Name, field, raw, ttl)
 	}
 	return nil
 }
 
+// Executables returns the executable of each of the job's commands, by
+// the name of the field that configures the command
+func (cfg *Config) Executables() map[string]string {
+	executables := make(map[string]string)
+	if cfg.exec != nil {
+		executables[fmt.Sprintf("job[%s].exec", cfg.Name)] = cfg.exec.Exec
+	}
+	if cfg.healthCheckExec != nil {
+		executables[fmt.Sprintf("job[%s].health.exec", cfg.Name)] = cfg.healthCheckExec.Exec
+	}
+	for field, cmd := range cfg.healthCheckExecs {
+		executables[field] = cmd.Exec
+	}
+	if cfg.onHealthy != nil {
+		executables[fmt.Sprintf("job[%s].onHealthy.exec", cfg.Name)] = cfg.onHealthy.exec.Exec
+	}
+	return executables
+}
+
 // String implements the stdlib fmt.Stringer interface for pretty-printing
 func (cfg *Config) String() string {
 	return "jobs.Config[" + cfg.Name + "]"
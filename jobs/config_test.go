@@ -3,11 +3,15 @@ package jobs
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/events"
 	"github.com/joyent/containerpilot/tests"
 	"github.com/joyent/containerpilot/tests/mocks"
@@ -37,6 +41,8 @@ func TestJobConfigServiceWithPreStart(t *testing.T) {
 		"config for job0.healthCheckExec.Exec")
 	assert.Equal(job0.healthCheckExec.Args, []string{"A1", "A2"},
 		"config for job0.healthCheckExec.Args")
+	assert.Equal(job0.healthCheckExec.Timeout, 10*time.Second,
+		"expected job0.healthCheckExec.Timeout to default to the interval")
 	assert.Nil(job0.Restarts, "config for job0.Restarts")
 
 	// job1 is the preStart
@@ -78,6 +84,10 @@ func TestJobConfigServiceWithStopping(t *testing.T) {
 	assert.Equal(job0.Name, "serviceA", "config for job0.Name")
 	assert.Equal(job0.stoppingWaitEvent, events.Event{events.Stopped, "preStop"},
 		"expected no stopping event for serviceA")
+	assert.Equal(job0.stoppingTimeout, 5*time.Second,
+		"config for serviceA.stoppingTimeout")
+	assert.Equal(job0.exec.StopGracePeriod, 5*time.Second,
+		"config for serviceA.exec.StopGracePeriod")
 
 	// job1 is its preStart
 	job1 := jobs[1]
@@ -199,6 +209,50 @@ func TestJobConfigSmokeTest(t *testing.T) {
 // ---------------------------------------------------------------------
 // Error condition tests
 
+func TestJobConfigLogging(t *testing.T) {
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "raw", exec: "/bin/raw", logging: {raw: true}},
+	{name: "logged", exec: "/bin/logged"}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.True(t, jobs[0].exec.RawOutput, "expected raw output for job[raw]")
+	assert.False(t, jobs[1].exec.RawOutput, "expected logged output for job[logged]")
+	assert.Nil(t, jobs[1].exec.Forward, "expected no forwarding for job[logged]")
+
+	jobs, err = NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "file", exec: "/bin/file",
+	 logging: {output: "/var/log/file.log", maxSize: "10MB", maxFiles: 3}},
+	{name: "syslog", exec: "/bin/syslog",
+	 logging: {output: "syslog+tcp://logs.example.com:514"}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	forward := jobs[0].exec.Forward
+	assert.Equal(t, "/var/log/file.log", forward.Path)
+	assert.Equal(t, int64(10<<20), forward.MaxSize)
+	assert.Equal(t, 3, forward.MaxFiles)
+	assert.False(t, jobs[1].exec.Forward.IsFile(), "expected job[syslog] to use syslog")
+
+	testErr := func(logging, expected string) {
+		_, err := NewConfigs(tests.DecodeRawToSlice(
+			`[{name: "myjob", exec: "/bin/myjob", logging: `+logging+`}]`), noop)
+		assert.EqualError(t, err, expected)
+	}
+	testErr(`{raw: true, output: "/var/log/myjob.log"}`,
+		"job[myjob].logging.output can't be used with 'raw'")
+	testErr(`{output: "syslog://logs"}`,
+		"invalid job[myjob].logging.output: syslog address must be in the form 'host:port': 'logs'")
+	testErr(`{output: "syslog", maxSize: 1024}`,
+		"job[myjob].logging.maxSize and maxFiles require a file output")
+	testErr(`{output: "/var/log/myjob.log", maxSize: "10XB"}`,
+		"unable to parse job[myjob].logging.maxSize '10XB': expected a number of bytes or a size like '10MB'")
+	testErr(`{output: "/var/log/myjob.log", maxSize: 0}`,
+		"unable to parse job[myjob].logging.maxSize '0': must be > 0")
+	testErr(`{output: "/var/log/myjob.log", maxFiles: -1}`,
+		"job[myjob].logging.maxFiles must be > 0")
+}
+
 func TestJobConfigValidateName(t *testing.T) {
 	assert := assert.New(t)
 
@@ -240,6 +294,373 @@ func TestJobConfigValidateDiscovery(t *testing.T) {
 	}
 }
 
+func TestJobConfigPreferredNetworks(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+              preferredNetworks: ["127.0.0.0/8"],
+              health: {interval: 1, ttl: 1}}]`
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	assert.Equal(t, jobs[0].serviceDefinition.IPAddress, "127.0.0.1",
+		"config for serviceDefinition.IPAddress")
+
+	cfg = `[{name: "myName", port: 80, preferredNetworks: ["nope"],
+             health: {interval: 1, ttl: 1}}]`
+	_, err = NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	assert.Error(t, err, "Unable to parse preferred network: nope")
+}
+
+func TestJobConfigInterfaceTimeout(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+              interfaceTimeout: "1s", interfaceRetryInterval: "100ms",
+              health: {interval: 1, ttl: 1}}]`
+	if _, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+
+	cfg = `[{name: "myName", port: 80, interfaceTimeout: "nope",
+             health: {interval: 1, ttl: 1}}]`
+	_, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	assert.EqualError(t, err, "unable to parse job[myName].interfaceTimeout 'nope': "+
+		"time: invalid duration \"nope\"")
+}
+
+// Overlapping interfaces are checked once, when the job is validated
+func TestJobConfigInterfaceOverlap(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, interfaceOverlap: "error",
+              interfaces: ["static:127.0.0.1", "127.0.0.0/8"],
+              health: {interval: 1, ttl: 1}}]`
+	_, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	assert.EqualError(t, err, "job[myName].interfaces: overlapping interface "+
+		"specifications:\ninterface specifications static:127.0.0.1 and "+
+		"127.0.0.0/8 both match 127.0.0.1")
+
+	cfg = `[{name: "myName", port: 80, interfaceOverlap: "warn",
+             interfaces: ["static:127.0.0.1", "127.0.0.0/8"],
+             health: {interval: 1, ttl: 1}}]`
+	if _, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+}
+
+func TestJobConfigTagsAndMeta(t *testing.T) {
+	os.Setenv("TEST_APP_VERSION", "1.2.3")
+	defer os.Unsetenv("TEST_APP_VERSION")
+	serviceFor := func(extra string) (*discovery.ServiceDefinition, error) {
+		cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+                  health: {interval: 1, ttl: 1}, ` + extra + `}]`
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		if err != nil {
+			return nil, err
+		}
+		return jobs[0].serviceDefinition, nil
+	}
+
+	service, err := serviceFor(`tags: ["version-$TEST_APP_VERSION", "primary"],
+		meta: {version: "${TEST_APP_VERSION}", team: "web", build: 42}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"version-1.2.3", "primary"}, service.Tags)
+	assert.Equal(t, map[string]string{
+		"version": "1.2.3", "team": "web", "build": "42"}, service.Meta)
+
+	service, err = serviceFor(`tags: ["version-$TEST_UNSET_VERSION"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"version-"}, service.Tags)
+	assert.Nil(t, service.Meta)
+
+	_, err = serviceFor(`meta: {"bad key": "x"}`)
+	assert.EqualError(t, err, "job[myName].meta key 'bad key' may only "+
+		"contain letters, numbers, '-', and '_'")
+	_, err = serviceFor(`meta: {"consul-version": "x"}`)
+	assert.EqualError(t, err,
+		"job[myName].meta key 'consul-version' cannot start with 'consul-'")
+	_, err = serviceFor(`meta: {version: "` + strings.Repeat("x", 513) + `"}`)
+	assert.EqualError(t, err,
+		"job[myName].meta.version cannot be longer than 512 characters")
+}
+
+func TestJobConfigWeights(t *testing.T) {
+	serviceFor := func(weights string) (*discovery.ServiceDefinition, error) {
+		cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+                  health: {interval: 1, ttl: 1}, weights: ` + weights + `}]`
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		if err != nil {
+			return nil, err
+		}
+		return jobs[0].serviceDefinition, nil
+	}
+
+	service, err := serviceFor(`{passing: 10, warning: 0}`)
+	assert.Nil(t, err)
+	assert.Equal(t, &api.AgentWeights{Passing: 10, Warning: 0}, service.Weights)
+	assert.Equal(t, service.Weights, service.Registration().Weights)
+
+	service, err = serviceFor(`{passing: 3}`)
+	assert.Nil(t, err)
+	assert.Equal(t, &api.AgentWeights{Passing: 3, Warning: 1}, service.Weights,
+		"expected Consul's default warning weight")
+
+	_, err = serviceFor(`{warning: 1}`)
+	assert.EqualError(t, err, "job[myName].weights.passing must be set")
+	_, err = serviceFor(`{passing: 0}`)
+	assert.EqualError(t, err, "job[myName].weights.passing must be > 0: 0")
+	_, err = serviceFor(`{passing: 1, warning: -1}`)
+	assert.EqualError(t, err, "job[myName].weights.warning cannot be negative: -1")
+}
+
+func TestJobConfigDualStack(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, dualStack: true, meta: {version: "1"},
+              interfaces: ["static:10.0.0.5", "static:fd00::5"],
+              health: {exec: "true", interval: 1, ttl: 1}}]`
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	assert.Nil(t, err)
+	service := jobs[0].serviceDefinition
+	assert.Equal(t, "10.0.0.5", service.IPAddress)
+	assert.Equal(t, "fd00::5", service.IPv6Address)
+	assert.Equal(t, map[string]string{"version": "1", "ipv6": "fd00::5"},
+		service.Registration().Meta)
+	assert.Equal(t, map[string]string{"version": "1"}, service.Meta,
+		"expected the configured meta to be unchanged")
+	assert.Equal(t, []string{"CONTAINERPILOT_IP=10.0.0.5",
+		"CONTAINERPILOT_IP6=fd00::5"}, jobs[0].healthCheckExec.Env)
+
+	cfg = `[{name: "myName", port: 80, dualStack: true, meta: {ipv6: "x"},
+              interfaces: "static:10.0.0.5", health: {interval: 1, ttl: 1}}]`
+	_, err = NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	assert.EqualError(t, err, "job[myName].meta key 'ipv6' is reserved "+
+		"for the IPv6 address when dualStack is set")
+}
+
+func TestJobConfigPort(t *testing.T) {
+	os.Setenv("TEST_JOB_PORT", "8080")
+	defer os.Unsetenv("TEST_JOB_PORT")
+	portFor := func(port string) (int, error) {
+		cfg := `[{name: "myName", port: ` + port + `, interfaces: "static:10.0.0.5",
+                  health: {exec: "true", interval: 1, ttl: 1}}]`
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		if err != nil {
+			return 0, err
+		}
+		return jobs[0].Port, nil
+	}
+	for config, expected := range map[string]int{
+		`80`: 80, `"80"`: 80, `65535`: 65535,
+		`"$TEST_JOB_PORT"`: 8080, `"${TEST_JOB_PORT}"`: 8080,
+	} {
+		port, err := portFor(config)
+		assert.Nil(t, err, "port: %s", config)
+		assert.Equal(t, expected, port, "port: %s", config)
+	}
+	for config, expected := range map[string]string{
+		`0`:                   "job[myName].port must be between 1 and 65535: 0",
+		`65536`:               "job[myName].port must be between 1 and 65535: 65536",
+		`-1`:                  "job[myName].port must be between 1 and 65535: -1",
+		`8080.5`:              "job[myName].port must be an integer: 8080.5",
+		`"8O80"`:              "job[myName].port '8O80' is not a number",
+		`"$TEST_UNSET_PORT"`:  "job[myName].port '$TEST_UNSET_PORT' uses unset environment variables: TEST_UNSET_PORT",
+		`"7$TEST_JOB_PORT"`:   "job[myName].port must be between 1 and 65535: 78080",
+		`"${TEST_JOB_PORT}x"`: "job[myName].port '${TEST_JOB_PORT}x' expanded to '8080x', which is not a number",
+		`[80]`:                "job[myName].port must be a number: [80]",
+	} {
+		_, err := portFor(config)
+		assert.EqualError(t, err, expected, "port: %s", config)
+	}
+
+	// a job without a port isn't advertised
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(`[{name: "myName", exec: "true"}]`), noop)
+	assert.Nil(t, err)
+	assert.Nil(t, jobs[0].serviceDefinition)
+}
+
+func TestJobConfigOnHealthy(t *testing.T) {
+	onHealthyFor := func(job string) (*onHealthyHook, error) {
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(`[{name: "myName", `+job+`}]`), noop)
+		if err != nil {
+			return nil, err
+		}
+		return jobs[0].onHealthy, nil
+	}
+	hook, err := onHealthyFor(`health: {exec: "true", interval: 1, ttl: 1},
+		onHealthy: {exec: "/bin/warm-cache", timeout: "5s"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "onHealthy.myName", hook.exec.Name)
+	assert.Equal(t, 5*time.Second, hook.exec.Timeout)
+	assert.False(t, hook.each)
+
+	hook, err = onHealthyFor(`health: {exec: "true", interval: 1, ttl: 1},
+		onHealthy: {exec: "/bin/warm-cache", each: true}`)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultOnHealthyMinInterval, hook.minInterval)
+
+	_, err = onHealthyFor(`onHealthy: {exec: "/bin/warm-cache"}`)
+	assert.EqualError(t, err, "job[myName].onHealthy requires a health check")
+	_, err = onHealthyFor(`health: {exec: "true", interval: 1, ttl: 1}, onHealthy: {}`)
+	assert.EqualError(t, err, "job[myName].onHealthy.exec must be set")
+	_, err = onHealthyFor(`health: {exec: "true", interval: 1, ttl: 1},
+		onHealthy: {exec: "/bin/warm-cache", minInterval: "1m"}`)
+	assert.EqualError(t, err,
+		"job[myName].onHealthy.minInterval can only be set with 'each'")
+	_, err = onHealthyFor(`health: {exec: "true", interval: 1, ttl: 1},
+		onHealthy: {exec: "/bin/warm-cache", each: true, minInterval: "x"}`)
+	assert.EqualError(t, err, "unable to parse job[myName].onHealthy.minInterval "+
+		"'x': time: invalid duration \"x\"")
+}
+
+func TestJobConfigConnect(t *testing.T) {
+	consul, _ := discovery.NewConsul("localhost:8500")
+	serviceFor := func(connect string, disc discovery.Backend) (*discovery.ServiceDefinition, error) {
+		cfg := `[{name: "myName", port: 80, interfaces: "static:10.0.0.5",
+                  health: {interval: 5, ttl: 10}, connect: ` + connect + `}]`
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), disc)
+		if err != nil {
+			return nil, err
+		}
+		return jobs[0].serviceDefinition, nil
+	}
+
+	service, err := serviceFor(`{sidecarService: {port: 21000, tags: ["proxy"],
+		upstreams: [{destinationName: "db", localBindPort: 9191}],
+		config: {protocol: "http"}}}`, consul)
+	assert.Nil(t, err)
+	sidecar := service.Registration().Connect.SidecarService
+	assert.Equal(t, 21000, sidecar.Port)
+	assert.Equal(t, []string{"proxy"}, sidecar.Tags)
+	assert.Equal(t, []api.Upstream{{DestinationName: "db", LocalBindPort: 9191}},
+		sidecar.Proxy.Upstreams)
+	assert.Equal(t, map[string]interface{}{"protocol": "http"}, sidecar.Proxy.Config)
+	assert.Equal(t, "10.0.0.5:21000", sidecar.Checks[0].TCP)
+	assert.Equal(t, "5s", sidecar.Checks[0].Interval)
+	assert.Equal(t, service.ID, sidecar.Checks[1].AliasService)
+
+	service, err = serviceFor(`{sidecarService: {port: 21000}}`,
+		discovery.NewMultiBackend(consul, consul))
+	assert.Nil(t, err)
+	assert.NotNil(t, service.Sidecar)
+
+	_, err = serviceFor(`{sidecarService: {port: 21000}}`, noop)
+	assert.EqualError(t, err,
+		"job[myName].connect requires the Consul discovery backend")
+	_, err = serviceFor(`{sidecarService: {port: 21000}}`,
+		discovery.NewMultiBackend(consul, noop))
+	assert.EqualError(t, err,
+		"job[myName].connect requires the Consul discovery backend")
+	_, err = serviceFor(`{}`, consul)
+	assert.EqualError(t, err, "job[myName].connect.sidecarService must be set")
+	_, err = serviceFor(`{sidecarService: {}}`, consul)
+	assert.EqualError(t, err,
+		"job[myName].connect.sidecarService.port must be between 1 and 65535: 0")
+	_, err = serviceFor(`{sidecarService: {port: 80}}`, consul)
+	assert.EqualError(t, err, "job[myName].connect.sidecarService.port "+
+		"cannot be the same as the service port: 80")
+	_, err = serviceFor(`{sidecarService: {port: 21000,
+		upstreams: [{localBindPort: 9191}]}}`, consul)
+	assert.EqualError(t, err, "job[myName].connect.sidecarService."+
+		"upstreams[0].destinationName must be set")
+	_, err = serviceFor(`{sidecarService: {port: 21000,
+		upstreams: [{destinationName: "db"}]}}`, consul)
+	assert.EqualError(t, err, "job[myName].connect.sidecarService."+
+		"upstreams[0].localBindPort must be between 1 and 65535: 0")
+}
+
+func TestJobConfigAggregateHealthCheck(t *testing.T) {
+	load := func(front, svc string) ([]*Config, error) {
+		return NewConfigs(tests.DecodeRawToSlice(`[
+		{name: "front", port: 80, interfaces: "inet",
+		 health: {interval: 1, ttl: 5, `+front+`}},
+		{name: "svcA", port: 81, interfaces: "inet", health: {`+svc+`}}]`), noop)
+	}
+	jobs, err := load(`exec: "check-all", aggregate: true`, `from: "front", ttl: 5`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, []string{"svcA"}, jobs[0].aggregateServices)
+	assert.Equal(t, aggregateCheckOutputLimit, jobs[0].healthCheckExec.StdoutLimit)
+	assert.Nil(t, jobs[1].healthCheck)
+	assert.Equal(t, time.Duration(0), jobs[1].heartbeatInterval)
+	assert.Equal(t, 5, jobs[1].ttl)
+
+	_, err = load(`tcp: {address: "localhost:80"}, aggregate: true`, `from: "front", ttl: 5`)
+	assert.EqualError(t, err, "job[front].health.aggregate requires 'exec'")
+	_, err = load(`exec: "check-all"`, `from: "front", ttl: 5`)
+	assert.EqualError(t, err, "job[svcA].health.from 'front' must be the name "+
+		"of a job with an aggregate health check")
+	_, err = load(`exec: "check-all", aggregate: true`, `from: "back", ttl: 5`)
+	assert.EqualError(t, err, "job[svcA].health.from 'back' must be the name "+
+		"of a job with an aggregate health check")
+	_, err = load(`exec: "check-all", aggregate: true`,
+		`from: "front", ttl: 5, exec: "true"`)
+	assert.EqualError(t, err, "job[svcA].health.from cannot be used with "+
+		"'exec', 'http', 'tcp', 'grpc', or 'checks'")
+	_, err = load(`exec: "check-all", aggregate: true`,
+		`from: "front", ttl: 5, interval: 1`)
+	assert.EqualError(t, err, "job[svcA].health.from cannot be used with 'interval'")
+	_, err = load(`exec: "check-all", aggregate: true`, `from: "front"`)
+	assert.EqualError(t, err, "job[svcA].health.ttl must be > 0")
+}
+
+func TestJobConfigRouting(t *testing.T) {
+	assert := assert.New(t)
+	tagsFor := func(routing string) ([]string, error) {
+		cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+                  tags: ["app"], routing: ` + routing + `,
+                  health: {interval: 1, ttl: 1}}]`
+		jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		if err != nil {
+			return nil, err
+		}
+		return jobs[0].serviceDefinition.Tags, nil
+	}
+
+	tags, err := tagsFor(`{router: "fabio", prefix: "/api"}`)
+	assert.Nil(err)
+	assert.Equal([]string{"app", "urlprefix-/api"}, tags)
+
+	tags, err = tagsFor(`{router: "fabio", host: "example.com", prefix: "/api", stripPrefix: true}`)
+	assert.Nil(err)
+	assert.Equal([]string{"app", "urlprefix-example.com/api strip=/api"}, tags)
+
+	tags, err = tagsFor(`{router: "fabio", host: "example.com"}`)
+	assert.Nil(err)
+	assert.Equal([]string{"app", "urlprefix-example.com/"}, tags)
+
+	tags, err = tagsFor(`{router: "traefik", host: "example.com", prefix: "/api"}`)
+	assert.Nil(err)
+	assert.Equal([]string{"app", "traefik.enable=true",
+		"traefik.frontend.rule=Host:example.com;PathPrefix:/api"}, tags)
+
+	tags, err = tagsFor(`{router: "traefik", prefix: "/api", stripPrefix: true}`)
+	assert.Nil(err)
+	assert.Equal([]string{"app", "traefik.enable=true",
+		"traefik.frontend.rule=PathPrefixStrip:/api"}, tags)
+
+	_, err = tagsFor(`{prefix: "/api"}`)
+	assert.EqualError(err, "job[myName].routing.router must be set")
+
+	_, err = tagsFor(`{router: "nginx", prefix: "/api"}`)
+	assert.EqualError(err,
+		"job[myName].routing.router must be one of 'fabio' or 'traefik': nginx")
+
+	_, err = tagsFor(`{router: "fabio"}`)
+	assert.EqualError(err,
+		"job[myName].routing must have at least one of 'prefix' or 'host'")
+
+	_, err = tagsFor(`{router: "fabio", prefix: "api"}`)
+	assert.EqualError(err, "job[myName].routing.prefix must start with '/': api")
+
+	_, err = tagsFor(`{router: "fabio", prefix: "/a b"}`)
+	assert.EqualError(err,
+		"job[myName].routing.prefix contains invalid characters: /a b")
+
+	_, err = tagsFor(`{router: "fabio", host: "-bad.example.com"}`)
+	assert.EqualError(err,
+		"job[myName].routing.host is not a valid hostname: -bad.example.com")
+
+	_, err = tagsFor(`{router: "fabio", host: "example.com", stripPrefix: true}`)
+	assert.EqualError(err,
+		"job[myName].routing.stripPrefix requires 'prefix' to be set")
+}
+
 func TestErrJobConfigConsulEnableTagOverride(t *testing.T) {
 	testCfg, _ := ioutil.ReadFile(fmt.Sprintf("./testdata/%s.json5", t.Name()))
 	_, err := NewConfigs(tests.DecodeRawToSlice(string(testCfg)), noop)
@@ -256,6 +677,45 @@ func TestErrJobConfigConsulDeregisterCriticalServiceAfter(t *testing.T) {
 	}
 }
 
+func TestJobConfigConsulExtrasDefaults(t *testing.T) {
+	testCfg := tests.DecodeRawToSlice(`[{name: "myjob", port: 80, interfaces: "inet",
+		health: {exec: "true", interval: 1, ttl: 5},
+		consul: {enableTagOverride: true}}]`)
+	jobs, err := NewConfigs(testCfg, noop)
+	assert.Nil(t, err)
+	assert.Equal(t, "", jobs[0].serviceDefinition.DeregisterCriticalServiceAfter,
+		"expected no deregisterCriticalServiceAfter by default")
+
+	testCfg = tests.DecodeRawToSlice(`[{name: "myjob", port: 80, interfaces: "inet",
+		health: {exec: "true", interval: 1, ttl: 5},
+		consul: {deregisterCriticalServiceAfter: "-1m"}}]`)
+	_, err = NewConfigs(testCfg, noop)
+	assert.EqualError(t, err,
+		"job[myjob].consul.deregisterCriticalServiceAfter '-1m' must be > 0")
+
+	testCfg = tests.DecodeRawToSlice(`[{name: "myjob", port: 80, interfaces: "inet",
+		health: {exec: "true", interval: 1, ttl: 5},
+		consul: {deregisterAfter: "10m"}}]`)
+	jobs, err = NewConfigs(testCfg, noop)
+	assert.Nil(t, err)
+	assert.Equal(t, "10m", jobs[0].serviceDefinition.DeregisterCriticalServiceAfter,
+		"expected deregisterAfter to set deregisterCriticalServiceAfter")
+
+	testCfg = tests.DecodeRawToSlice(`[{name: "myjob", port: 80, interfaces: "inet",
+		health: {exec: "true", interval: 1, ttl: 5},
+		consul: {deregisterAfter: "xx"}}]`)
+	_, err = NewConfigs(testCfg, noop)
+	assert.EqualError(t, err,
+		`unable to parse job[myjob].consul.deregisterAfter: time: invalid duration "xx"`)
+
+	testCfg = tests.DecodeRawToSlice(`[{name: "myjob", port: 80, interfaces: "inet",
+		health: {exec: "true", interval: 1, ttl: 5},
+		consul: {deregisterAfter: "10m", deregisterCriticalServiceAfter: "10m"}}]`)
+	_, err = NewConfigs(testCfg, noop)
+	assert.EqualError(t, err, "job[myjob].consul: only one of "+
+		"'deregisterAfter' or 'deregisterCriticalServiceAfter' can be set")
+}
+
 func TestJobConfigValidateFrequency(t *testing.T) {
 	expectErr := func(test, errMsg string) {
 		testCfg := tests.DecodeRawToSlice(test)
@@ -280,7 +740,7 @@ func TestJobConfigValidateFrequency(t *testing.T) {
 
 	expectErr(
 		`[{name: "E", exec: "/bin/taskE", timeout: "1ns", when: {interval: "xx"}}]`,
-		"unable to parse job[E].when.interval 'xx': time: invalid duration xx")
+		"unable to parse job[E].when.interval 'xx': time: invalid duration \"xx\"")
 
 	testCfg := tests.DecodeRawToSlice(
 		`[{name: "F", exec: "/bin/taskF", when: {interval: "1ms"}}]`)
@@ -335,7 +795,7 @@ func TestJobConfigValidateExec(t *testing.T) {
 		timeout: "xx"
 	}]`)
 	_, err = NewConfigs(testCfg, noop)
-	expected := "unable to parse job[serviceC].timeout 'xx': time: invalid duration xx"
+	expected := "unable to parse job[serviceC].timeout 'xx': time: invalid duration \"xx\""
 	if err == nil || err.Error() != expected {
 		t.Fatalf("expected '%s', got '%v'", expected, err)
 	}
@@ -398,6 +858,38 @@ func TestJobConfigValidateRestarts(t *testing.T) {
 	assert.Equal(cfg[6].restartLimit, 0, expectMsg)
 }
 
+func TestJobConfigRestartPolicy(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "default", exec: "true"},
+	{name: "always", exec: "true", restartPolicy: "always"},
+	{name: "onfailure", exec: "true", restartPolicy: "on-failure",
+	 restarts: 3, restartBackoff: "2s", critical: true},
+	{name: "never", exec: "true", restartPolicy: "never"}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, 0, cfgs[0].restartLimit)
+	assert.Equal(t, unlimited, cfgs[1].restartLimit)
+	assert.Equal(t, restartOnFailure, cfgs[2].restartPolicy)
+	assert.Equal(t, 3, cfgs[2].restartLimit)
+	assert.Equal(t, 2*time.Second, cfgs[2].restartBackoff)
+	assert.True(t, cfgs[2].Critical)
+	assert.Equal(t, 0, cfgs[3].restartLimit)
+
+	expectErr := func(test, errMsg string) {
+		_, err := NewConfigs(tests.DecodeRawToSlice(test), noop)
+		assert.EqualError(t, err, errMsg)
+	}
+	expectErr(`[{name: "myName", exec: "true", restartPolicy: "sometimes"}]`,
+		`job[myName].restartPolicy 'sometimes' invalid: accepts "always", "on-failure", or "never"`)
+	expectErr(`[{name: "myName", exec: "true", restartPolicy: "never", restarts: 2}]`,
+		`job[myName].restarts field '2' invalid: must be "never" when restartPolicy is "never"`)
+	expectErr(`[{name: "myName", exec: "true", restartPolicy: "always", when: {interval: "1s"}}]`,
+		"job[myName].restartPolicy cannot be used with 'when.interval' or 'when.cron'")
+	expectErr(`[{name: "myName", exec: "true", restartBackoff: "-1s"}]`,
+		"job[myName].restartBackoff '-1s' cannot be negative")
+}
+
 func TestHealthChecksConfigError(t *testing.T) {
 
 	expectErr := func(test, errMsg string) {
@@ -416,7 +908,85 @@ func TestHealthChecksConfigError(t *testing.T) {
 		"unable to create job[myName].health.exec: received zero-length argument")
 	expectErr(
 		`[{name: "myName", health: {exec: "/bin/true", interval: 1, ttl: 5, timeout: "xx"}}]`,
-		"could not parse job[myName].health.timeout 'xx': time: invalid duration xx")
+		"could not parse job[myName].health.timeout 'xx': time: invalid duration \"xx\"")
+	expectErr(
+		`[{name: "myName", health: {exec: "/bin/true", interval: 1, ttl: 5, splay: "-1s"}}]`,
+		"job[myName].health.splay '-1s' cannot be negative")
+	expectErr(
+		`[{name: "myName", health: {exec: "/bin/true", interval: 1, ttl: 5, grace: "x"}}]`,
+		"could not parse job[myName].health.grace 'x': time: invalid duration \"x\"")
+}
+
+func TestHealthChecksConfigSplay(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "none", health: {exec: "/bin/true", interval: 1, ttl: 5}},
+	{name: "splayed", health: {exec: "/bin/true", interval: 1, ttl: 5, splay: "500ms"}},
+	{name: "percent", health: {exec: "/bin/true", interval: 10, ttl: 20, splay: "10%"}}
+	]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, time.Duration(0), cfgs[0].heartbeatSplay)
+	assert.Equal(t, 500*time.Millisecond, cfgs[1].heartbeatSplay)
+	assert.Equal(t, 500*time.Millisecond, NewJob(cfgs[1]).heartbeatSplay)
+	assert.Equal(t, time.Second, cfgs[2].heartbeatSplay)
+}
+
+func TestJobConfigCron(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "rotate", exec: "/bin/true", when: {cron: "*/15 * * * *"}},
+	{name: "backup", exec: "/bin/true", timeout: "1h", when: {cron: "@daily"}}
+	]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.NotNil(t, NewJob(cfgs[0]).schedule)
+	assert.Equal(t, events.NonEvent, cfgs[0].whenEvent,
+		"expected cron task not to run at startup")
+	assert.Equal(t, 15*time.Minute, cfgs[0].execTimeout,
+		"expected timeout to default to the time between runs")
+	assert.Equal(t, unlimited, cfgs[0].restartLimit)
+	assert.Equal(t, time.Hour, cfgs[1].execTimeout)
+
+	testErr := func(when, expected string) {
+		_, err := NewConfigs(tests.DecodeRawToSlice(`[
+		{name: "task", exec: "/bin/true", when: `+when+`}]`), noop)
+		assert.EqualError(t, err, expected)
+	}
+	testErr(`{cron: "* * *"}`,
+		"unable to parse job[task].when.cron '* * *': expected 5 fields but got 3")
+	testErr(`{cron: "0 0 31 2 *"}`, "job[task].when.cron '0 0 31 2 *' never runs")
+	testErr(`{cron: "@hourly", interval: "1h"}`,
+		"job[task].when can have only one of 'interval', 'cron', 'once', or 'each'")
+	testErr(`{cron: "@hourly", splay: "1s"}`,
+		"job[task].when.splay can only be used with 'interval'")
+}
+
+func TestJobConfigFrequencySplay(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "task", exec: "/bin/true", when: {interval: "60s", splay: "5s"}},
+	{name: "percent", exec: "/bin/true", when: {interval: "60s", splay: "25%"}}
+	]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, 5*time.Second, NewJob(cfgs[0]).frequencySplay)
+	assert.Equal(t, 15*time.Second, cfgs[1].freqSplay)
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "task", exec: "/bin/true", when: {interval: "60s", splay: "-1s"}}
+	]`), noop)
+	assert.EqualError(t, err, "job[task].when.splay '-1s' cannot be negative")
+	_, err = NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "task", exec: "/bin/true", when: {interval: "60s", splay: "200%"}}
+	]`), noop)
+	assert.EqualError(t, err, "unable to parse job[task].when.splay '200%': "+
+		"percentage 200% must be between 0% and 100%")
+	_, err = NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "task", exec: "/bin/true", when: {source: "setup", once: "exitSuccess", splay: "1s"}}
+	]`), noop)
+	assert.EqualError(t, err, "job[task].when.splay can only be used with 'interval'")
+	assert.Equal(t, time.Duration(0), cfgs[1].healthGrace)
 }
 
 // ---------------------------------------------------------------------
@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/joyent/containerpilot/discovery"
+)
+
+// defaultSidecarCheckInterval is how often Consul checks the sidecar
+// proxy's listener if the job doesn't have a health check interval, in
+// seconds. This is the interval Consul uses for its own sidecar checks.
+const defaultSidecarCheckInterval = 10
+
+// ConnectConfig registers a Consul Connect sidecar proxy along with the
+// service. The sidecar proxy itself isn't run by ContainerPilot, so it
+// needs its own job (ex. running `consul connect proxy -sidecar-for`).
+type ConnectConfig struct {
+	SidecarService *SidecarServiceConfig `mapstructure:"sidecarService"`
+}
+
+// SidecarServiceConfig is the registration of the sidecar proxy. Consul
+// fills in the proxy's name, ID, address, and destination service from
+// the service it's the sidecar for.
+type SidecarServiceConfig struct {
+	Port      int                    `mapstructure:"port"`
+	Tags      []string               `mapstructure:"tags"`
+	Upstreams []UpstreamConfig       `mapstructure:"upstreams"`
+	Config    map[string]interface{} `mapstructure:"config"`
+}
+
+// UpstreamConfig is a service that the sidecar proxy makes available to
+// the job on a local port
+type UpstreamConfig struct {
+	DestinationName  string `mapstructure:"destinationName"`
+	Datacenter       string `mapstructure:"datacenter"`
+	LocalBindAddress string `mapstructure:"localBindAddress"`
+	LocalBindPort    int    `mapstructure:"localBindPort"`
+}
+
+// validateConnect returns the sidecar proxy to register with the service,
+// after checking that the discovery backend can register it
+func (cfg *Config) validateConnect(disc discovery.Backend) (*discovery.SidecarService, error) {
+	if cfg.Connect == nil {
+		return nil, nil
+	}
+	if registrar, ok := disc.(discovery.ConnectRegistrar); !ok || !registrar.SupportsConnect() {
+		return nil, fmt.Errorf("job[%s].connect requires the Consul discovery backend",
+			cfg.Name)
+	}
+	sidecar := cfg.Connect.SidecarService
+	if sidecar == nil {
+		return nil, fmt.Errorf("job[%s].connect.sidecarService must be set", cfg.Name)
+	}
+	if sidecar.Port < 1 || sidecar.Port > 65535 {
+		return nil, fmt.Errorf("job[%s].connect.sidecarService.port must be "+
+			"between 1 and 65535: %d", cfg.Name, sidecar.Port)
+	}
+	if sidecar.Port == cfg.Port {
+		return nil, fmt.Errorf("job[%s].connect.sidecarService.port cannot be "+
+			"the same as the service port: %d", cfg.Name, sidecar.Port)
+	}
+	upstreams := make([]api.Upstream, len(sidecar.Upstreams))
+	for i, upstream := range sidecar.Upstreams {
+		field := fmt.Sprintf("job[%s].connect.sidecarService.upstreams[%d]", cfg.Name, i)
+		if upstream.DestinationName == "" {
+			return nil, fmt.Errorf("%s.destinationName must be set", field)
+		}
+		if upstream.LocalBindPort < 1 || upstream.LocalBindPort > 65535 {
+			return nil, fmt.Errorf("%s.localBindPort must be between 1 and 65535: %d",
+				field, upstream.LocalBindPort)
+		}
+		upstreams[i] = api.Upstream{
+			DestinationName:  upstream.DestinationName,
+			Datacenter:       upstream.Datacenter,
+			LocalBindAddress: upstream.LocalBindAddress,
+			LocalBindPort:    upstream.LocalBindPort,
+		}
+	}
+	interval := int(cfg.heartbeatInterval / time.Second)
+	if interval < 1 {
+		interval = defaultSidecarCheckInterval
+	}
+	return &discovery.SidecarService{
+		Port:          sidecar.Port,
+		Tags:          sidecar.Tags,
+		Upstreams:     upstreams,
+		Config:        sidecar.Config,
+		CheckInterval: interval,
+	}, nil
+}
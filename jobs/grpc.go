@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCCheckConfig configures a health check that calls the standard
+// grpc.health.v1.Health/Check method in-process rather than forking an
+// exec of grpc_health_probe. The Service is the name of the service to
+// ask about; the server's overall health if it's empty.
+type GRPCCheckConfig struct {
+	Address string         `mapstructure:"address"`
+	Service string         `mapstructure:"service"`
+	Timeout string         `mapstructure:"timeout"`
+	TLS     *GRPCTLSConfig `mapstructure:"tls"`
+}
+
+// GRPCTLSConfig configures TLS for a gRPC health check. The check uses
+// plaintext HTTP/2 unless this is set.
+type GRPCTLSConfig struct {
+	CAFile     string `mapstructure:"cafile"`
+	ClientCert string `mapstructure:"clientcert"`
+	ClientKey  string `mapstructure:"clientkey"`
+	ServerName string `mapstructure:"servername"`
+	Verify     *bool  `mapstructure:"verify"`
+}
+
+func newGRPCCheck(name, field string, cfg *GRPCCheckConfig, fallback time.Duration) (*probeCheck, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("%s.address must be in the form 'host:port': '%s'",
+			field, cfg.Address)
+	}
+	timeout, err := parseCheckTimeout(cfg.Timeout, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s.timeout '%s': %v",
+			field, cfg.Timeout, err)
+	}
+	creds, err := newGRPCCredentials(field, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	address, service := cfg.Address, cfg.Service
+	probe := func(ctx context.Context) error {
+		// like grpc_health_probe, dial for each check and hang up after
+		conn, err := grpc.DialContext(ctx, address,
+			grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+			&healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			if s, ok := status.FromError(err); ok {
+				return fmt.Errorf("gRPC health check returned %s: %s",
+					s.Code(), s.Message())
+			}
+			return err
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			if service == "" {
+				return fmt.Errorf("gRPC server is %s", resp.GetStatus())
+			}
+			return fmt.Errorf("gRPC service '%s' is %s", service, resp.GetStatus())
+		}
+		return nil
+	}
+	return &probeCheck{name: name, timeout: timeout, probe: probe,
+		lock: &sync.Mutex{}}, nil
+}
+
+// newGRPCCredentials returns the transport credentials for the check
+func newGRPCCredentials(field string, cfg *GRPCTLSConfig) (credentials.TransportCredentials, error) {
+	if cfg == nil {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.Verify != nil && !*cfg.Verify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s.tls.cafile: %v", field, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s.tls.cafile", field)
+		}
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return nil, fmt.Errorf("%s.tls.clientcert and %s.tls.clientkey "+
+			"must be set together", field, field)
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s.tls.clientcert: %v",
+				field, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthServer serves grpc.health.v1.Health/Check with the status of
+// each service, or NOT_FOUND for services it doesn't know about
+func grpcHealthServer(statuses map[string]healthpb.HealthCheckResponse_ServingStatus) *grpc.Server {
+	server := grpc.NewServer()
+	checker := health.NewServer()
+	for service, status := range statuses {
+		checker.SetServingStatus(service, status)
+	}
+	healthpb.RegisterHealthServer(server, checker)
+	return server
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpcHealthServer(map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"":    healthpb.HealthCheckResponse_SERVING,
+		"app": healthpb.HealthCheckResponse_SERVING,
+		"db":  healthpb.HealthCheckResponse_NOT_SERVING,
+	})
+	go server.Serve(listener)
+	defer server.Stop()
+	address := listener.Addr().String()
+
+	probe := func(service string) error {
+		check, err := newGRPCCheck("check.test", "health.grpc",
+			&GRPCCheckConfig{Address: address, Service: service}, time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error creating check: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+		defer cancel()
+		return check.probe(ctx)
+	}
+	assert.Nil(t, probe(""))
+	assert.Nil(t, probe("app"))
+	assert.EqualError(t, probe("db"), "gRPC service 'db' is NOT_SERVING")
+	assert.EqualError(t, probe("nope"),
+		"gRPC health check returned NotFound: unknown service")
+
+	server.Stop()
+	assert.Error(t, probe("app"), "expected error after server is gone")
+}
+
+func TestGRPCHealthCheckTLS(t *testing.T) {
+	// *grpc.Server serves over an HTTP/2 server too, which lets us use
+	// the test certificate of httptest
+	server := httptest.NewUnstartedServer(grpcHealthServer(
+		map[string]healthpb.HealthCheckResponse_ServingStatus{
+			"": healthpb.HealthCheckResponse_SERVING}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	dir, err := ioutil.TempDir("", "containerpilot-grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	probe := func(tlsConfig *GRPCTLSConfig) error {
+		check, err := newGRPCCheck("check.test", "health.grpc",
+			&GRPCCheckConfig{Address: address, TLS: tlsConfig}, time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error creating check: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+		defer cancel()
+		return check.probe(ctx)
+	}
+	noVerify := false
+	assert.Nil(t, probe(&GRPCTLSConfig{CAFile: caFile}))
+	assert.Nil(t, probe(&GRPCTLSConfig{Verify: &noVerify}))
+	assert.Error(t, probe(&GRPCTLSConfig{}),
+		"expected unknown certificate authority")
+	assert.Error(t, probe(nil), "expected plaintext request to fail")
+}
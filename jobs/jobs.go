@@ -4,15 +4,61 @@ package jobs
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joyent/containerpilot/commands"
+	"github.com/joyent/containerpilot/config/timing"
 	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/watches"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	healthCheckCollector         *prometheus.CounterVec
+	healthCheckDurationCollector *prometheus.HistogramVec
+	healthCheckExitCodeCollector *prometheus.GaugeVec
+	restartCollector             *prometheus.CounterVec
+	runCollector                 *prometheus.CounterVec
+	runDurationCollector         *prometheus.HistogramVec
+)
+
+func init() {
+	healthCheckCollector = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerpilot_health_checks",
+		Help: "count of ContainerPilot health check results, partitioned by job and result",
+	}, []string{"job", "result"})
+	healthCheckDurationCollector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "containerpilot_health_check_duration_seconds",
+		Help: "duration of ContainerPilot health checks, partitioned by job and check",
+	}, []string{"job", "check"})
+	healthCheckExitCodeCollector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "containerpilot_health_check_last_exit_code",
+		Help: "exit code of the last failed ContainerPilot health check, partitioned by job and check",
+	}, []string{"job", "check"})
+	restartCollector = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerpilot_job_restarts",
+		Help: "count of times ContainerPilot has restarted a job's process after it exited, partitioned by job",
+	}, []string{"job"})
+	runCollector = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerpilot_job_runs",
+		Help: "count of ContainerPilot job process exits, partitioned by job and result",
+	}, []string{"job", "result"})
+	runDurationCollector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "containerpilot_job_run_duration_seconds",
+		Help: "duration of ContainerPilot job processes, partitioned by job",
+	}, []string{"job"})
+	prometheus.MustRegister(healthCheckCollector, healthCheckDurationCollector,
+		healthCheckExitCodeCollector, restartCollector, runCollector,
+		runDurationCollector)
+}
+
 type processEventStatus bool
 
 // Some magic numbers used internally by processEvent
@@ -31,8 +77,26 @@ type Job struct {
 	Status          JobStatus
 	statusLock      *sync.RWMutex
 	Service         *discovery.ServiceDefinition
-	healthCheckExec *commands.Command
+	healthCheck     healthChecker
 	healthCheckName string
+	healthGrace     time.Duration
+	warmUntil       time.Time
+	lastCheckFailed *commands.Result
+	onHealthy       *onHealthyHook
+
+	// consecutive health check results, for the thresholds of how many
+	// it takes to change between healthy and unhealthy
+	failureThreshold int
+	successThreshold int
+	checksFailed     int
+	checksPassed     int
+
+	// the Jobs whose health is reported by this Job's aggregate check
+	aggregateServices map[string]bool
+
+	// environment variables for the Job's processes, on top of the
+	// environment inherited from ContainerPilot
+	env []string
 
 	// starting events
 	startEvent        events.Event
@@ -45,10 +109,35 @@ type Job struct {
 	stoppingTimeout   time.Duration
 
 	// timing and restarts
+	clock          events.Clock
 	heartbeat      time.Duration
+	heartbeatSplay time.Duration
 	restartLimit   int
 	restartsRemain int
+	restartPolicy  restartPolicy
+	restartBackoff time.Duration
+	restartDelay   time.Duration
+	restarts       int
+	restartPending bool
+	execStartedAt  time.Time
 	frequency      time.Duration
+	frequencySplay time.Duration
+	schedule       *timing.CronSchedule
+
+	// critical Jobs shut down ContainerPilot when they fail for good
+	critical        bool
+	criticalFailure bool
+
+	// execCtx is the context for the processes the Job runs. It's
+	// separate from the event loop so that the processes can be handed
+	// off to the Job that replaces this one on a reload.
+	execCtx    context.Context
+	execCancel context.CancelFunc
+	handedOff  bool
+
+	// fingerprints of the config, for comparing Jobs on a reload
+	fingerprint     string
+	execFingerprint string
 
 	events.EventHandler // Event handling
 }
@@ -58,9 +147,16 @@ func NewJob(cfg *Config) *Job {
 	job := &Job{
 		Name:              cfg.Name,
 		exec:              cfg.exec,
+		clock:             events.RealClock,
 		heartbeat:         cfg.heartbeatInterval,
+		heartbeatSplay:    cfg.heartbeatSplay,
 		Service:           cfg.serviceDefinition,
-		healthCheckExec:   cfg.healthCheckExec,
+		healthCheck:       cfg.healthCheck,
+		healthCheckName:   cfg.healthCheckName,
+		healthGrace:       cfg.healthGrace,
+		failureThreshold:  cfg.failureThreshold,
+		successThreshold:  cfg.successThreshold,
+		onHealthy:         cfg.onHealthy,
 		startEvent:        cfg.whenEvent,
 		startTimeout:      cfg.whenTimeout,
 		startsRemain:      cfg.whenStartsLimit,
@@ -68,7 +164,24 @@ func NewJob(cfg *Config) *Job {
 		stoppingTimeout:   cfg.stoppingTimeout,
 		restartLimit:      cfg.restartLimit,
 		restartsRemain:    cfg.restartLimit,
+		restartPolicy:     cfg.restartPolicy,
+		restartBackoff:    cfg.restartBackoff,
+		restartDelay:      cfg.restartBackoff,
+		critical:          cfg.Critical,
 		frequency:         cfg.freqInterval,
+		frequencySplay:    cfg.freqSplay,
+		schedule:          cfg.freqSchedule,
+		fingerprint:       cfg.fingerprint(),
+		execFingerprint:   cfg.execFingerprint(),
+	}
+	if cfg.serviceDefinition != nil {
+		job.env = serviceIPEnvironment(cfg.serviceDefinition)
+	}
+	if len(cfg.aggregateServices) > 0 {
+		job.aggregateServices = make(map[string]bool, len(cfg.aggregateServices))
+		for _, name := range cfg.aggregateServices {
+			job.aggregateServices[name] = true
+		}
 	}
 	job.InitRx()
 	job.statusLock = &sync.RWMutex{}
@@ -98,6 +211,24 @@ func (job *Job) SendHeartbeat() {
 	}
 }
 
+// sendFailure marks this Job's service critical in the discovery backend,
+// with the reason its health check failed as the check's note
+func (job *Job) sendFailure() {
+	if job.Service == nil {
+		return
+	}
+	note := "health check failed"
+	if result, ok := job.LastHealthCheckFailure(); ok {
+		switch {
+		case result.Output != "":
+			note = result.Output
+		case result.Error != "":
+			note = result.Error
+		}
+	}
+	job.Service.SendFailure(note)
+}
+
 // GetStatus returns the current health status of the Job
 func (job *Job) GetStatus() JobStatus {
 	job.statusLock.RLock()
@@ -120,21 +251,39 @@ func (job *Job) Kill() {
 	}
 }
 
+// Signal sends the signal to the Job's process, if it's running, and
+// returns false if it isn't
+func (job *Job) Signal(sig syscall.Signal) bool {
+	if job.exec == nil {
+		return false
+	}
+	return job.exec.Signal(sig)
+}
+
 // Run executes the event loop for the Job
 func (job *Job) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
+	if job.Service != nil {
+		job.Service.Bus = job.Bus
+	}
+	if job.execCtx == nil {
+		job.execCtx, job.execCancel = context.WithCancel(context.Background())
+	}
 
-	if job.frequency > 0 {
-		events.NewEventTimer(ctx, job.Rx, job.frequency,
+	if job.schedule != nil {
+		events.NewEventSchedule(ctx, job.clock, job.Rx, job.schedule.Next,
 			fmt.Sprintf("%s.run-every", job.Name))
+	} else if job.frequency > 0 {
+		events.NewEventTimerWithSplay(ctx, job.clock, job.Rx, job.frequency,
+			job.frequencySplay, fmt.Sprintf("%s.run-every", job.Name))
 	}
 	if job.heartbeat > 0 {
-		events.NewEventTimer(ctx, job.Rx, job.heartbeat,
-			fmt.Sprintf("%s.heartbeat", job.Name))
+		events.NewEventTimerWithSplay(ctx, job.clock, job.Rx, job.heartbeat,
+			job.heartbeatSplay, fmt.Sprintf("%s.heartbeat", job.Name))
 	}
 	if job.startTimeout > 0 {
 		timeoutName := fmt.Sprintf("%s.wait-timeout", job.Name)
-		events.NewEventTimeout(ctx, job.Rx, job.startTimeout, timeoutName)
+		events.NewEventTimeout(ctx, job.clock, job.Rx, job.startTimeout, timeoutName)
 		job.startTimeoutEvent = events.Event{events.TimerExpired, timeoutName}
 	} else {
 		job.startTimeoutEvent = events.NonEvent
@@ -161,12 +310,17 @@ func (job *Job) Run() {
 func (job *Job) processEvent(ctx context.Context, event events.Event) processEventStatus {
 	runEverySource := fmt.Sprintf("%s.run-every", job.Name)
 	heartbeatSource := fmt.Sprintf("%s.heartbeat", job.Name)
-	healthCheckName := fmt.Sprintf("check.%s", job.Name)
-	if job.healthCheckExec != nil {
-		healthCheckName = job.healthCheckExec.Name
+	restartSource := fmt.Sprintf("%s.restart", job.Name)
+	onHealthySource := fmt.Sprintf("onHealthy.%s", job.Name)
+	healthCheckName := job.healthCheckName
+	if healthCheckName == "" {
+		healthCheckName = fmt.Sprintf("check.%s", job.Name)
 	}
 
 	switch event {
+	case handoffEvent:
+		job.handedOff = true
+		return jobHalt
 	case events.Event{Code: events.TimerExpired, Source: heartbeatSource}:
 		return job.onHeartbeatTimerExpired(ctx)
 	case job.startTimeoutEvent:
@@ -177,19 +331,31 @@ func (job *Job) processEvent(ctx context.Context, event events.Event) processEve
 		return job.onHealthCheckFailed(ctx)
 	case events.Event{Code: events.ExitSuccess, Source: healthCheckName}:
 		return job.onHealthCheckPassed(ctx)
+	case
+		events.Event{Code: events.ExitSuccess, Source: onHealthySource},
+		events.Event{Code: events.ExitFailed, Source: onHealthySource}:
+		job.onHealthyExited()
 	case
 		events.Event{Code: events.Quit, Source: job.Name},
-		events.QuitByClose,
 		events.GlobalShutdown:
 		return job.onQuit(ctx)
+	case events.QuitByClose:
+		// the Job is being stopped directly rather than as part of
+		// the global shutdown, so even "pre-stop" style jobs halt
+		job.startsRemain = 0
+		job.startEvent = events.NonEvent
+		return jobHalt
 	case events.GlobalEnterMaintenance:
 		return job.onEnterMaintenance(ctx)
 	case events.GlobalExitMaintenance:
 		job.setStatus(statusUnknown)
-	case
-		events.Event{Code: events.ExitSuccess, Source: job.Name},
-		events.Event{Code: events.ExitFailed, Source: job.Name}:
-		return job.onExecExit(ctx)
+	case events.Event{Code: events.ExitSuccess, Source: job.Name}:
+		return job.onExecExit(ctx, false)
+	case events.Event{Code: events.ExitFailed, Source: job.Name}:
+		return job.onExecExit(ctx, true)
+	case events.Event{Code: events.TimerExpired, Source: restartSource}:
+		job.restartPending = false
+		job.startJobExec(ctx)
 	case job.startEvent:
 		return job.onStartEvent(ctx)
 	}
@@ -199,17 +365,28 @@ func (job *Job) processEvent(ctx context.Context, event events.Event) processEve
 // startJobExec runs the Job's executable and returns without waiting
 func (job *Job) startJobExec(ctx context.Context) {
 	job.startTimeoutEvent = events.NonEvent
-	job.setStatus(statusUnknown)
+	job.execStartedAt = time.Now()
+	job.checksFailed, job.checksPassed = 0, 0
+	if job.healthGrace > 0 {
+		// failed health checks don't count until the process has had
+		// a chance to warm up
+		job.warmUntil = time.Now().Add(job.healthGrace)
+		job.setStatus(statusWarming)
+	} else {
+		job.setStatus(statusUnknown)
+	}
 	if job.exec != nil {
-		job.exec.Run(ctx, job.Bus)
+		job.exec.Run(job.execCtx, job.Bus)
 	}
 }
 
 func (job *Job) onHeartbeatTimerExpired(ctx context.Context) processEventStatus {
 	status := job.GetStatus()
 	if status != statusMaintenance && status != statusIdle {
-		if job.healthCheckExec != nil {
-			job.healthCheckExec.Run(ctx, job.Bus)
+		if job.healthCheck != nil {
+			// the check runs in the exec context so that a check in
+			// flight during a reload reports to the replacement Job
+			job.healthCheck.Run(job.execCtx, job.Bus)
 		} else if job.Service != nil {
 			// this is the case for non-checked but advertised
 			// services like the telemetry endpoint
@@ -239,22 +416,67 @@ func (job *Job) onRunEveryTimerExpired(ctx context.Context) processEventStatus {
 }
 
 func (job *Job) onHealthCheckFailed(ctx context.Context) processEventStatus {
-	if job.GetStatus() != statusMaintenance {
+	healthCheckCollector.WithLabelValues(job.Name, "failed").Inc()
+	job.recordHealthCheck(true)
+	if job.isWarming() {
+		log.Infof("%s: health check failed during its grace period, %v remaining",
+			job.Name, time.Until(job.warmUntil).Round(time.Second))
+		if job.Service != nil {
+			job.Service.SendWarning()
+		}
+		return jobContinue
+	}
+	job.reportAggregateCheck(false)
+	job.checksPassed = 0
+	job.checksFailed++
+	status := job.GetStatus()
+	if status != statusMaintenance && status != statusUnhealthy &&
+		job.checksFailed < job.failureThreshold {
+		log.Warnf("%s: health check failed %d of %d times before the job "+
+			"is unhealthy", job.Name, job.checksFailed, job.failureThreshold)
+		if status == statusHealthy {
+			// keep the service passing in the discovery backend
+			job.SendHeartbeat()
+		}
+		return jobContinue
+	}
+	if status != statusMaintenance {
 		job.setStatus(statusUnhealthy)
 		job.Bus.Publish(events.Event{events.StatusUnhealthy, job.Name})
+		job.sendFailure()
 	}
 	return jobContinue
 }
 
 func (job *Job) onHealthCheckPassed(ctx context.Context) processEventStatus {
-	if job.GetStatus() != statusMaintenance {
+	healthCheckCollector.WithLabelValues(job.Name, "passed").Inc()
+	job.recordHealthCheck(false)
+	job.reportAggregateCheck(true)
+	job.checksFailed = 0
+	job.checksPassed++
+	status := job.GetStatus()
+	if status == statusUnhealthy && job.checksPassed < job.successThreshold {
+		log.Infof("%s: health check passed %d of %d times before the job "+
+			"is healthy", job.Name, job.checksPassed, job.successThreshold)
+		return jobContinue
+	}
+	if status != statusMaintenance {
 		job.setStatus(statusHealthy)
 		job.Bus.Publish(events.Event{events.StatusHealthy, job.Name})
 		job.SendHeartbeat()
+		if status != statusHealthy {
+			job.runOnHealthy(job.execCtx)
+		}
 	}
 	return jobContinue
 }
 
+// isWarming returns true if the Job is still in the grace period after
+// its process started and no health check has passed yet
+func (job *Job) isWarming() bool {
+	return job.GetStatus() == statusWarming && time.Now().Before(job.warmUntil)
+}
+
 func (job *Job) onQuit(ctx context.Context) processEventStatus {
 	job.restartsRemain = 0 // no more restarts
 	if (job.startEvent.Code == events.Stopping ||
@@ -282,18 +504,22 @@ func (job *Job) onEnterMaintenance(ctx context.Context) processEventStatus {
 	return jobContinue
 }
 
-func (job *Job) onExecExit(ctx context.Context) processEventStatus {
+func (job *Job) onExecExit(ctx context.Context, failed bool) processEventStatus {
+	job.recordRun(failed)
 	if job.frequency > 0 {
 		return jobContinue // periodic jobs ignore previous events
 	}
-	if job.restartPermitted() {
+	if job.restartOnExit(failed) {
 		job.restartsRemain--
-		job.startJobExec(ctx)
+		job.restartJobExec(ctx)
 		return jobContinue
 	}
 	if job.startsRemain != 0 {
 		return jobContinue
 	}
+	if failed {
+		job.onFailedForGood()
+	}
 	log.Debugf("job exited but restart not permitted: %v", job.Name)
 	job.startEvent = events.NonEvent
 	job.setStatus(statusUnknown)
@@ -301,6 +527,8 @@ func (job *Job) onExecExit(ctx context.Context) processEventStatus {
 }
 
 func (job *Job) onStartEvent(ctx context.Context) processEventStatus {
+	// the event that started us, before we might stop listening for it
+	source := job.startEvent.Source
 	if job.startsRemain == 0 {
 		job.startEvent = events.NonEvent
 		return jobHalt
@@ -315,10 +543,174 @@ func (job *Job) onStartEvent(ctx context.Context) processEventStatus {
 			job.startEvent = events.NonEvent
 		}
 	}
+	if job.exec != nil {
+		job.exec.Env = append(append([]string{}, job.env...),
+			watchEnvironment(source)...)
+	}
 	job.startJobExec(ctx)
 	return jobContinue
 }
 
+// IPEnvironment returns the environment variables that tell a process
+// which IP is being advertised: CONTAINERPILOT_IP is always the IP, and
+// CONTAINERPILOT_IP6 is set as well if it's an IPv6 address
+func IPEnvironment(ip string) []string {
+	if ip == "" {
+		return nil
+	}
+	env := []string{"CONTAINERPILOT_IP=" + ip}
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		env = append(env, "CONTAINERPILOT_IP6="+ip)
+	}
+	return env
+}
+
+// serviceIPEnvironment returns the IPEnvironment for the IP a service
+// advertises, along with the IPv6 address of a dual-stack service
+func serviceIPEnvironment(service *discovery.ServiceDefinition) []string {
+	env := IPEnvironment(service.IPAddress)
+	if service.IPv6Address != "" {
+		env = append(env, "CONTAINERPILOT_IP6="+service.IPv6Address)
+	}
+	return env
+}
+
+// watchEnvironment returns the environment variables that tell a job
+// started by a watch's event which watch changed, and how many instances
+// it now has or the new value of its key
+func watchEnvironment(source string) []string {
+	if !strings.HasPrefix(source, "watch.") {
+		return nil
+	}
+	name := strings.TrimPrefix(source, "watch.")
+	env := []string{"CONTAINERPILOT_CHANGED_BACKENDS=" + name}
+	envKey := strings.Replace(strings.ToUpper(name), "-", "_", -1)
+	if count, ok := watches.Instances(source); ok {
+		env = append(env,
+			fmt.Sprintf("CONTAINERPILOT_%s_INSTANCES=%d", envKey, count))
+	}
+	if value, ok := watches.Value(source); ok {
+		env = append(env, fmt.Sprintf("CONTAINERPILOT_%s_VALUE=%s", envKey, value))
+	}
+	return env
+}
+
+// restartOnExit returns true if the Job's restart policy and remaining
+// restarts allow restarting its process after it exited
+func (job *Job) restartOnExit(failed bool) bool {
+	switch job.restartPolicy {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		if !failed {
+			return false
+		}
+	}
+	return job.restartPermitted()
+}
+
+// restartJobExec restarts the Job's process, after the restart backoff
+// if there is one. The backoff doubles on each restart up to a limit,
+// and resets if the process ran for longer than that limit.
+func (job *Job) restartJobExec(ctx context.Context) {
+	job.restarts++
+	restartCollector.WithLabelValues(job.Name).Inc()
+	if job.Bus != nil {
+		fields := map[string]string{"restarts": strconv.Itoa(job.restarts)}
+		if job.exec != nil {
+			fields["exitCode"] = strconv.Itoa(job.exec.LastResult().ExitCode)
+		}
+		job.Bus.PublishWithFields(
+			events.Event{Code: events.Restarting, Source: job.Name}, fields)
+	}
+	if job.restartBackoff == 0 {
+		job.startJobExec(ctx)
+		return
+	}
+	if time.Since(job.execStartedAt) > maxRestartBackoff {
+		job.restartDelay = job.restartBackoff
+	}
+	log.Infof("%s: restarting in %v (restart %d)",
+		job.Name, job.restartDelay, job.restarts)
+	job.restartPending = true
+	events.NewEventTimeout(ctx, job.clock, job.Rx, job.restartDelay,
+		fmt.Sprintf("%s.restart", job.Name))
+	job.restartDelay *= 2
+	if job.restartDelay > maxRestartBackoff {
+		job.restartDelay = maxRestartBackoff
+	}
+}
+
+// recordRun records the result and duration of the Job's process, which
+// for jobs that run on a watch's events is how long each handler took
+func (job *Job) recordRun(failed bool) {
+	result := "succeeded"
+	if failed {
+		result = "failed"
+	}
+	runCollector.WithLabelValues(job.Name, result).Inc()
+	if !job.execStartedAt.IsZero() {
+		runDurationCollector.WithLabelValues(job.Name).Observe(
+			time.Since(job.execStartedAt).Seconds())
+	}
+}
+
+// onFailedForGood is called when the Job's process has failed and won't
+// be restarted. A critical Job shuts down all of ContainerPilot.
+func (job *Job) onFailedForGood() {
+	if job.restarts > 0 {
+		log.Errorf("%s: exited with an error after %d restart(s) and won't be restarted again",
+			job.Name, job.restarts)
+	}
+	if job.critical {
+		log.Errorf("%s: critical job failed, shutting down", job.Name)
+		job.statusLock.Lock()
+		job.criticalFailure = true
+		job.statusLock.Unlock()
+		job.Bus.Shutdown()
+	}
+}
+
+// recordHealthCheck updates the health check metrics from the result of
+// the check that just finished, and keeps the result if it failed
+func (job *Job) recordHealthCheck(failed bool) {
+	if job.healthCheck == nil {
+		return
+	}
+	result := job.healthCheck.LastResult()
+	checkName := job.healthCheckName
+	healthCheckDurationCollector.WithLabelValues(job.Name, checkName).Observe(
+		result.Duration.Seconds())
+	if !failed {
+		return
+	}
+	healthCheckExitCodeCollector.WithLabelValues(job.Name, checkName).Set(
+		float64(result.ExitCode))
+	job.statusLock.Lock()
+	job.lastCheckFailed = &result
+	job.statusLock.Unlock()
+}
+
+// LastHealthCheckFailure returns the result of the Job's last failed
+// health check, including the end of its stderr, and false if its health
+// check has never failed
+func (job *Job) LastHealthCheckFailure() (commands.Result, bool) {
+	job.statusLock.RLock()
+	defer job.statusLock.RUnlock()
+	if job.lastCheckFailed == nil {
+		return commands.Result{}, false
+	}
+	return *job.lastCheckFailed, true
+}
+
+// CriticalFailure returns true if the Job is critical and it shut down
+// ContainerPilot because its process failed
+func (job *Job) CriticalFailure() bool {
+	job.statusLock.RLock()
+	defer job.statusLock.RUnlock()
+	return job.criticalFailure
+}
+
 func (job *Job) restartPermitted() bool {
 	if job.restartLimit == unlimited || job.restartsRemain > 0 {
 		return true
@@ -326,16 +718,27 @@ func (job *Job) restartPermitted() bool {
 	return false
 }
 
-// cleanup fires the Stopping event and will wait to receive a stoppingWaitEvent
-// if one is configured. cleans up registration to event bus and closes all
-// channels and contexts when done.
+// cleanup deregisters the service, fires the Stopping event and will wait
+// to receive a stoppingWaitEvent if one is configured. cleans up
+// registration to event bus and closes all channels and contexts when done.
 func (job *Job) cleanup(ctx context.Context, cancel context.CancelFunc) {
+	if job.handedOff {
+		// the replacement Job owns the service and processes now
+		cancel()
+		job.Unsubscribe(job.Bus)
+		return
+	}
 	stoppingTimeout := fmt.Sprintf("%s.stopping-timeout", job.Name)
+	if job.Service != nil {
+		// deregister from Consul before any "pre-stop" job runs and
+		// before we signal the process, so that it can drain connections
+		job.Service.Deregister()
+	}
 	job.Bus.Publish(events.Event{Code: events.Stopping, Source: job.Name})
 	if job.stoppingWaitEvent != events.NonEvent {
 		if job.stoppingTimeout > 0 {
 			// not having this set is a programmer error not a runtime error
-			events.NewEventTimeout(ctx, job.Rx,
+			events.NewEventTimeout(ctx, job.clock, job.Rx,
 				job.stoppingTimeout, stoppingTimeout)
 		}
 	loop:
@@ -344,15 +747,15 @@ func (job *Job) cleanup(ctx context.Context, cancel context.CancelFunc) {
 			switch event {
 			case job.stoppingWaitEvent:
 				break loop
-			case events.Event{events.Stopping, stoppingTimeout}:
+			case events.Event{Code: events.TimerExpired, Source: stoppingTimeout}:
+				log.Warnf("%s: timed out after %v waiting for %s",
+					job.Name, job.stoppingTimeout, job.stoppingWaitEvent.Source)
 				break loop
 			}
 		}
 	}
 	cancel()
-	if job.Service != nil {
-		job.Service.Deregister() // deregister from Consul
-	}
+	job.execCancel()
 	job.Unsubscribe(job.Bus) // deregister from events
 	job.Bus.Publish(events.Event{Code: events.Stopped, Source: job.Name})
 }
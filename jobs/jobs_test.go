@@ -1,14 +1,25 @@
 package jobs
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/api"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/joyent/containerpilot/commands"
 	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/tests"
+	"github.com/joyent/containerpilot/tests/mocks"
+	"github.com/joyent/containerpilot/watches"
 )
 
 func TestJobRunSafeClose(t *testing.T) {
@@ -30,10 +41,13 @@ func TestJobRunSafeClose(t *testing.T) {
 	}()
 	job.Bus.Publish(events.GlobalStartup)
 
+	// the process is stopped even though it's only just started
 	expected := []events.Event{
 		events.GlobalStartup,
 		{events.Stopping, "myjob"},
 		{events.Stopped, "myjob"},
+		{events.ExitFailed, "myjob"},
+		{events.Error, "myjob: signal: terminated"},
 	}
 	if !reflect.DeepEqual(expected, results) {
 		t.Fatalf("expected: %v\ngot: %v", expected, results)
@@ -151,6 +165,52 @@ func TestJobRunRestarts(t *testing.T) {
 	runRestartsTest(nil, 1)
 }
 
+// Each restart is published with the exit code of the process and the
+// number of restarts so far
+func TestJobRunRestartsPublished(t *testing.T) {
+	bus := events.NewEventBus()
+	records := make(chan events.Record, 10)
+	events.NewSinkHandler(recordSink(records)).Run(bus)
+	cfg := &Config{
+		Name:            "myjob",
+		whenEvent:       events.GlobalStartup,
+		whenStartsLimit: 1,
+		Exec:            []string{"./testdata/test.sh", "failStuff"},
+		Restarts:        1,
+	}
+	cfg.Validate(noop)
+	job := NewJob(cfg)
+	job.Subscribe(bus)
+	job.Run()
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(100 * time.Millisecond)
+	bus.Wait()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case record := <-records:
+			if record.Type != "Restarting" {
+				continue
+			}
+			assert.Equal(t, "myjob", record.Source)
+			assert.Equal(t, map[string]string{"exitCode": "255", "restarts": "1"},
+				record.Fields)
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for restart record")
+		}
+	}
+}
+
+// recordSink is an events.Sink that sends each Record to its channel
+type recordSink chan events.Record
+
+func (s recordSink) Emit(record events.Record) error {
+	s <- record
+	return nil
+}
+
 func TestJobRunPeriodic(t *testing.T) {
 	bus := events.NewEventBus()
 
@@ -189,6 +249,60 @@ func TestJobRunPeriodic(t *testing.T) {
 	}
 }
 
+// A task with a cron schedule doesn't run at startup, only at the times
+// that match the schedule
+func TestJobRunCron(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[{name: "cron",
+		exec: "true", when: {cron: "*/5 * * * *"}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	clock := mocks.NewFakeClock()
+	job.clock = clock
+
+	bus := events.NewEventBus()
+	waiter := &checkWaiter{}
+	waiter.InitRx()
+	waiter.Subscribe(bus)
+	job.Subscribe(bus)
+	job.Run()
+	bus.Publish(events.GlobalStartup)
+
+	exitOk := events.Event{Code: events.ExitSuccess, Source: "cron"}
+	expectRun := func(expected bool) {
+		timeout := time.After(100 * time.Millisecond)
+		if expected {
+			timeout = time.After(time.Second)
+		}
+		for {
+			select {
+			case event := <-waiter.Rx:
+				if event == exitOk {
+					assert.True(t, expected, "unexpected run of the task")
+					return
+				}
+			case <-timeout:
+				assert.False(t, expected, "expected a run of the task")
+				return
+			}
+		}
+	}
+	assert.True(t, clock.BlockUntil(1, time.Second), "expected a schedule timer")
+	expectRun(false)
+	clock.Advance(5 * time.Minute)
+	expectRun(true)
+	assert.True(t, clock.BlockUntil(1, time.Second), "expected a schedule timer")
+	clock.Advance(4 * time.Minute)
+	expectRun(false)
+	clock.Advance(time.Minute)
+	expectRun(true)
+
+	waiter.Unsubscribe(bus)
+	job.Quit()
+	bus.Wait()
+}
+
 func TestJobMaintenance(t *testing.T) {
 
 	testFunc := func(t *testing.T, startingState JobStatus, event events.Event) JobStatus {
@@ -443,3 +557,674 @@ func TestJobProcessEvent(t *testing.T) {
 	})
 
 }
+
+// stopOrderBackend records the state of the job's process and of the
+// "pre-stop" job's side-effect at the moment the service is deregistered
+type stopOrderBackend struct {
+	mocks.NoopDiscoveryBackend
+	job             *Job
+	marker          string
+	deregistered    bool
+	exitedFirst     bool
+	preStopRanFirst bool
+}
+
+func (b *stopOrderBackend) ServiceDeregister(serviceID string) error {
+	b.deregistered = true
+	b.exitedFirst = b.job.exec.Pid() == 0
+	_, err := os.Stat(b.marker)
+	b.preStopRanFirst = err == nil
+	return nil
+}
+
+// A Job should deregister its service before its "pre-stop" job runs and
+// before its own process is stopped
+func TestJobStopOrdering(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "prestop")
+	backend := &stopOrderBackend{marker: marker}
+
+	bus := events.NewEventBus()
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "app", exec: "sleep 10", port: 80, interfaces: "inet",
+	 stopTimeout: "2s", health: {exec: "true", interval: 5, ttl: 10}},
+	{name: "prestop", exec: "touch `+marker+`",
+	 when: {source: "app", once: "stopping"}}]`), backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	jobs := FromConfigs(cfgs)
+	backend.job = jobs[0]
+	for _, job := range jobs {
+		job.Subscribe(bus)
+		job.Run()
+	}
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(100 * time.Millisecond)
+	bus.Publish(events.GlobalShutdown)
+	bus.Wait()
+
+	assert.True(t, backend.deregistered, "expected service to be deregistered")
+	assert.False(t, backend.exitedFirst,
+		"expected deregistration before the process was stopped")
+	assert.False(t, backend.preStopRanFirst,
+		"expected deregistration before the pre-stop job ran")
+	_, err = os.Stat(marker)
+	assert.Nil(t, err, "expected pre-stop job to run")
+}
+
+// A Job should stop once its stopTimeout has passed even if its "pre-stop"
+// job never exits
+func TestJobStopTimeout(t *testing.T) {
+	bus := events.NewEventBus()
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "app", exec: "sleep 10", stopTimeout: "500ms"},
+	{name: "prestop", exec: "sleep 10",
+	 when: {source: "app", once: "stopping"}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	jobs := FromConfigs(cfgs)
+	for _, job := range jobs {
+		job.Subscribe(bus)
+		job.Run()
+	}
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(100 * time.Millisecond)
+	bus.Publish(events.GlobalShutdown)
+	time.Sleep(time.Second)
+	jobs[1].Quit() // the "pre-stop" job ignores the global shutdown
+	bus.Wait()
+
+	results := bus.DebugEvents()
+	appStopped := events.Event{Code: events.Stopped, Source: "app"}
+	preStopStopped := events.Event{Code: events.Stopped, Source: "prestop"}
+	for _, event := range results {
+		if event == preStopStopped {
+			t.Fatalf("expected app to stop before its pre-stop job, got: %v",
+				results)
+		}
+		if event == appStopped {
+			return
+		}
+	}
+	t.Fatalf("expected app to stop after its stopTimeout, got: %v", results)
+}
+
+// countingBackend reports a change with a fixed number of instances
+type countingBackend struct {
+	mocks.NoopDiscoveryBackend
+}
+
+func (b *countingBackend) CheckForUpstreamChanges(_, _, _ string) (bool, bool) {
+	return true, true
+}
+
+func (b *countingBackend) InstanceCount(service string) int {
+	return 3
+}
+
+// A Job started by a watch event should get the name of the watch and
+// its instance count in its environment
+func TestJobWatchEnvironment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+	os.Setenv("TEST_INHERITED_VAR", "inherited")
+	defer os.Unsetenv("TEST_INHERITED_VAR")
+
+	bus := events.NewEventBus()
+	watchCfgs, _ := watches.NewConfigs(tests.DecodeRawToSlice(
+		`[{name: "my-backend", interval: 60}]`), &countingBackend{})
+	watch := watches.NewWatch(watchCfgs[0])
+	watch.Run(bus)
+
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "on-change", exec: ["sh", "-c", "env > `+out+`"],
+	 when: {source: "watch.my-backend", each: "changed"}}]`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	job.Subscribe(bus)
+	job.Run()
+
+	bus.Publish(events.Event{events.TimerExpired, "watch.my-backend.poll"})
+	time.Sleep(200 * time.Millisecond)
+	watch.Quit()
+	job.Quit()
+	bus.Wait()
+
+	env, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected job to have run: %v", err)
+	}
+	assert.Contains(t, string(env), "CONTAINERPILOT_CHANGED_BACKENDS=my-backend\n")
+	assert.Contains(t, string(env), "CONTAINERPILOT_MY_BACKEND_INSTANCES=3\n")
+	assert.Contains(t, string(env), "TEST_INHERITED_VAR=inherited\n")
+}
+
+// kvBackend reports a new value for every watched key
+type kvBackend struct {
+	mocks.NoopDiscoveryBackend
+}
+
+func (b *kvBackend) CheckForKVChanges(key, _ string) (bool, bool, string) {
+	return true, true, `{"beta": "on"}`
+}
+
+// A Job started by a watch of a key should get the key's new value
+func TestJobWatchKVEnvironment(t *testing.T) {
+	bus := events.NewEventBus()
+	watchCfgs, err := watches.NewConfigs(tests.DecodeRawToSlice(
+		`[{name: "feature-flags", interval: 60, kv: "features/"}]`), &kvBackend{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	watch := watches.NewWatch(watchCfgs[0])
+	watch.Run(bus)
+	bus.Publish(events.Event{events.TimerExpired, "watch.feature-flags.poll"})
+	time.Sleep(100 * time.Millisecond)
+	watch.Quit()
+	bus.Wait()
+
+	assert.Equal(t, []string{"CONTAINERPILOT_CHANGED_BACKENDS=feature-flags",
+		`CONTAINERPILOT_FEATURE_FLAGS_VALUE={"beta": "on"}`},
+		watchEnvironment("watch.feature-flags"))
+}
+
+// A job with a service, and its health check, should see the IP that
+// the service advertises
+func TestJobIPEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerpilot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "app", exec: ["sh", "-c", "env > `+out+`"], port: 80,
+	 interfaces: ["static:192.0.2.10"],
+	 health: {exec: "true", interval: 1, ttl: 5}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, []string{"CONTAINERPILOT_IP=192.0.2.10"},
+		cfgs[0].healthCheckExec.Env)
+
+	bus := events.NewEventBus()
+	job := NewJob(cfgs[0])
+	job.Subscribe(bus)
+	job.Run()
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(200 * time.Millisecond)
+	job.Quit()
+	bus.Wait()
+
+	env, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected job to have run: %v", err)
+	}
+	assert.Contains(t, string(env), "CONTAINERPILOT_IP=192.0.2.10\n")
+	assert.NotContains(t, string(env), "CONTAINERPILOT_IP6=")
+
+	assert.Equal(t, []string{"CONTAINERPILOT_IP=fd00::1", "CONTAINERPILOT_IP6=fd00::1"},
+		IPEnvironment("fd00::1"))
+	assert.Nil(t, IPEnvironment(""))
+}
+
+func TestJobHealthCheckMetrics(t *testing.T) {
+	job := &Job{Name: "metricsJob", statusLock: &sync.RWMutex{}}
+	job.Bus = events.NewEventBus()
+	job.processEvent(nil, events.Event{events.ExitSuccess, "check.metricsJob"})
+	job.processEvent(nil, events.Event{events.ExitFailed, "check.metricsJob"})
+	job.processEvent(nil, events.Event{events.ExitFailed, "check.metricsJob"})
+
+	count := func(result string) float64 {
+		metric := &dto.Metric{}
+		healthCheckCollector.WithLabelValues("metricsJob", result).Write(metric)
+		return metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, 1.0, count("passed"))
+	assert.Equal(t, 2.0, count("failed"))
+}
+
+func TestJobRunMetrics(t *testing.T) {
+	job := &Job{Name: "runsJob", statusLock: &sync.RWMutex{},
+		frequency: time.Minute, execStartedAt: time.Now().Add(-2 * time.Second)}
+	job.Bus = events.NewEventBus()
+	job.processEvent(nil, events.Event{events.ExitSuccess, "runsJob"})
+	job.processEvent(nil, events.Event{events.ExitFailed, "runsJob"})
+
+	count := func(result string) float64 {
+		metric := &dto.Metric{}
+		runCollector.WithLabelValues("runsJob", result).Write(metric)
+		return metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, 1.0, count("succeeded"))
+	assert.Equal(t, 1.0, count("failed"))
+	metric := &dto.Metric{}
+	runDurationCollector.WithLabelValues("runsJob").Write(metric)
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 4.0, metric.GetHistogram().GetSampleSum(), 0.1)
+}
+
+// resultChecker is a healthChecker that always has the same result
+type resultChecker struct {
+	result commands.Result
+}
+
+func (c *resultChecker) Run(ctx context.Context, bus *events.EventBus) {}
+
+func (c *resultChecker) LastResult() commands.Result { return c.result }
+
+// countingChecker is a healthChecker that counts how many times it ran
+type countingChecker struct {
+	resultChecker
+	lock sync.Mutex
+	runs int
+}
+
+func (c *countingChecker) Run(ctx context.Context, bus *events.EventBus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.runs++
+}
+
+func (c *countingChecker) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.runs
+}
+
+// The health check runs exactly once per interval of the Job's clock
+func TestJobHeartbeatClock(t *testing.T) {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[{name: "clocked",
+		exec: "sleep 10", port: 80, interfaces: "static:10.0.0.5",
+		health: {exec: "true", interval: 5, ttl: 10}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	clock := mocks.NewFakeClock()
+	checker := &countingChecker{}
+	job.clock = clock
+	job.healthCheck = checker
+
+	bus := events.NewEventBus()
+	job.Subscribe(bus)
+	job.Run()
+	bus.Publish(events.GlobalStartup)
+
+	waitForRuns := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for checker.count() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		assert.True(t, clock.BlockUntil(1, time.Second), "expected a heartbeat timer")
+		clock.Advance(5 * time.Second)
+		waitForRuns(i)
+		assert.Equal(t, i, checker.count())
+	}
+	clock.Advance(4 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 3, checker.count(), "expected no check before the interval")
+
+	job.Quit()
+	bus.Wait()
+}
+
+func TestJobHealthCheckResults(t *testing.T) {
+	checker := &resultChecker{}
+	job := &Job{Name: "resultsJob", statusLock: &sync.RWMutex{},
+		healthCheck: checker, healthCheckName: "check.resultsJob"}
+	job.Bus = events.NewEventBus()
+	checker.result = commands.Result{Duration: 100 * time.Millisecond}
+	job.processEvent(nil, events.Event{events.ExitSuccess, "check.resultsJob"})
+	_, failed := job.LastHealthCheckFailure()
+	assert.False(t, failed, "expected no failure after a passing check")
+
+	checker.result = commands.Result{Duration: 2 * time.Second, ExitCode: 2,
+		Error: "exit status 2", Output: "connection refused"}
+	job.processEvent(nil, events.Event{events.ExitFailed, "check.resultsJob"})
+	checker.result = commands.Result{Duration: 50 * time.Millisecond}
+	job.processEvent(nil, events.Event{events.ExitSuccess, "check.resultsJob"})
+
+	failure, failed := job.LastHealthCheckFailure()
+	assert.True(t, failed)
+	assert.Equal(t, 2, failure.ExitCode)
+	assert.Equal(t, "connection refused", failure.Output,
+		"expected the failure to be kept after a passing check")
+
+	metric := &dto.Metric{}
+	healthCheckDurationCollector.WithLabelValues(
+		"resultsJob", "check.resultsJob").Write(metric)
+	assert.Equal(t, uint64(3), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 2.15, metric.GetHistogram().GetSampleSum(), 0.001)
+	metric = &dto.Metric{}
+	healthCheckExitCodeCollector.WithLabelValues(
+		"resultsJob", "check.resultsJob").Write(metric)
+	assert.Equal(t, 2.0, metric.GetGauge().GetValue())
+}
+
+// An aggregate health check should update the status of each service
+// listed in its output, and fail all of them if the check itself fails
+func TestJobAggregateHealthCheck(t *testing.T) {
+	runCheck := func(check string) map[string]JobStatus {
+		cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+		{name: "front", exec: "sleep 10", port: 80, interfaces: "inet",
+		 health: {exec: `+check+`, interval: 1, ttl: 5, aggregate: true}},
+		{name: "svcA", port: 81, interfaces: "inet", health: {from: "front", ttl: 5}},
+		{name: "svcB", port: 82, interfaces: "inet", health: {from: "front", ttl: 5}},
+		{name: "svcC", port: 83, interfaces: "inet", health: {from: "front", ttl: 5}}]`),
+			noop)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bus := events.NewEventBus()
+		jobs := FromConfigs(cfgs)
+		for _, job := range jobs {
+			job.Subscribe(bus)
+			job.Run()
+		}
+		bus.Publish(events.GlobalStartup)
+		time.Sleep(1500 * time.Millisecond)
+		statuses := map[string]JobStatus{}
+		for _, job := range jobs {
+			statuses[job.Name] = job.GetStatus()
+			job.Quit()
+		}
+		bus.Wait()
+		return statuses
+	}
+
+	statuses := runCheck(`["printf", "svcA ok\n\n  svcB   FAIL\nsvcD ok\nsvcC\n"]`)
+	assert.Equal(t, map[string]JobStatus{
+		"front": statusHealthy,
+		"svcA":  statusHealthy,
+		"svcB":  statusUnhealthy,
+		"svcC":  statusUnknown,
+	}, statuses)
+
+	statuses = runCheck(`["sh", "-c", "echo svcA ok; exit 1"]`)
+	assert.Equal(t, map[string]JobStatus{
+		"front": statusUnhealthy,
+		"svcA":  statusUnhealthy,
+		"svcB":  statusUnhealthy,
+		"svcC":  statusUnhealthy,
+	}, statuses, "expected output of a failed check not to be trusted")
+}
+
+// registrationBackend records each registration and its check status
+type registrationBackend struct {
+	mocks.NoopDiscoveryBackend
+	statuses      []string
+	registrations []*api.AgentServiceRegistration
+}
+
+func (b *registrationBackend) ServiceRegister(service *api.AgentServiceRegistration) error {
+	b.statuses = append(b.statuses, service.Check.Status)
+	b.registrations = append(b.registrations, service)
+	return nil
+}
+
+// ttlBackend records the TTL check updates
+type ttlBackend struct {
+	registrationBackend
+	updates []string
+}
+
+func (b *ttlBackend) PassTTL(checkID, note string) error {
+	b.updates = append(b.updates, "pass:"+checkID)
+	return nil
+}
+
+func (b *ttlBackend) FailTTL(checkID, note string) error {
+	b.updates = append(b.updates, "fail:"+checkID+":"+note)
+	return nil
+}
+
+// Failed health checks during the grace period shouldn't mark the Job
+// unhealthy, and a passing check should end the grace period early
+func TestJobHealthCheckGrace(t *testing.T) {
+	backend := &registrationBackend{}
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "warmup", port: 80, interfaces: "inet",
+	 health: {exec: "true", interval: 1, ttl: 5, grace: "1h"}}]`), backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	job.Bus = events.NewEventBus()
+	failed := events.Event{events.ExitFailed, "check.warmup"}
+	passed := events.Event{events.ExitSuccess, "check.warmup"}
+
+	job.startJobExec(nil)
+	assert.Equal(t, statusWarming, job.GetStatus())
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusWarming, job.GetStatus(),
+		"expected failure during grace period to be ignored")
+	assert.Equal(t, []string{api.HealthWarning}, backend.statuses,
+		"expected service to be registered as warning")
+
+	job.processEvent(nil, passed)
+	assert.Equal(t, statusHealthy, job.GetStatus())
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusUnhealthy, job.GetStatus(),
+		"expected passing check to end the grace period")
+
+	// once the grace period has expired failures count as usual
+	job.startJobExec(nil)
+	job.warmUntil = time.Now().Add(-time.Second)
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusUnhealthy, job.GetStatus(),
+		"expected failure after grace period to count")
+}
+
+// A Job only changes between healthy and unhealthy after its health
+// check has failed or passed the threshold number of times in a row
+func TestJobHealthCheckThresholds(t *testing.T) {
+	backend := &ttlBackend{}
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "flappy", port: 80, interfaces: "inet",
+	 health: {exec: "true", interval: 1, ttl: 5,
+	          failureThreshold: 3, successThreshold: 2}}]`), backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	job.Bus = events.NewEventBus()
+	failed := events.Event{events.ExitFailed, "check.flappy"}
+	passed := events.Event{events.ExitSuccess, "check.flappy"}
+
+	job.processEvent(nil, passed)
+	assert.Equal(t, statusHealthy, job.GetStatus(),
+		"expected first pass to count from an unknown status")
+	job.processEvent(nil, failed)
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusHealthy, job.GetStatus(),
+		"expected failures below the threshold to be ignored")
+	job.processEvent(nil, passed)
+	job.processEvent(nil, failed)
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusHealthy, job.GetStatus(),
+		"expected a pass to reset the failures")
+	job.processEvent(nil, failed)
+	assert.Equal(t, statusUnhealthy, job.GetStatus())
+
+	// the check is kept passing until the job is unhealthy, and is then
+	// failed right away rather than left to expire
+	checkID := "service:" + job.Service.ID
+	assert.Equal(t, []string{"pass:" + checkID, "pass:" + checkID,
+		"pass:" + checkID, "pass:" + checkID, "pass:" + checkID,
+		"fail:" + checkID + ":health check failed"}, backend.updates)
+
+	job.processEvent(nil, passed)
+	assert.Equal(t, statusUnhealthy, job.GetStatus(),
+		"expected a single pass to be ignored")
+	job.processEvent(nil, failed)
+	job.processEvent(nil, passed)
+	assert.Equal(t, statusUnhealthy, job.GetStatus(),
+		"expected a failure to reset the passes")
+	job.processEvent(nil, passed)
+	assert.Equal(t, statusHealthy, job.GetStatus())
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(`[
+	{name: "flappy", port: 80, interfaces: "inet",
+	 health: {exec: "true", interval: 1, ttl: 5, failureThreshold: -1}}]`), noop)
+	assert.EqualError(t, err, "job[flappy].health.failureThreshold must be > 0")
+}
+
+func TestJobRestartPolicy(t *testing.T) {
+	runPolicyTest := func(raw string) (*Job, map[events.Event]int) {
+		bus := events.NewEventBus()
+		cfgs, err := NewConfigs(tests.DecodeRawToSlice(raw), noop)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		job := NewJob(cfgs[0])
+		job.Subscribe(bus)
+		job.Run()
+		bus.Publish(events.GlobalStartup)
+		bus.Wait()
+		got := map[events.Event]int{}
+		for _, event := range bus.DebugEvents() {
+			got[event]++
+		}
+		return job, got
+	}
+	exitOk := events.Event{events.ExitSuccess, "myjob"}
+	exitFailed := events.Event{events.ExitFailed, "myjob"}
+
+	// a clean exit isn't restarted under on-failure
+	job, got := runPolicyTest(`[{name: "myjob", exec: "true",
+	restartPolicy: "on-failure"}]`)
+	assert.Equal(t, 1, got[exitOk], "expected no restart after clean exit")
+	assert.Equal(t, 0, job.restarts)
+
+	// a failed exit is restarted until the limit, and then a critical
+	// job shuts everything down
+	job, got = runPolicyTest(`[{name: "myjob", exec: ["sh", "-c", "exit 1"],
+	restartPolicy: "on-failure", restarts: 1, restartBackoff: "10ms",
+	critical: true}]`)
+	assert.Equal(t, 2, got[exitFailed], "expected one restart after failure")
+	assert.Equal(t, 1, job.restarts)
+	assert.Equal(t, 1, got[events.GlobalShutdown], "expected critical job to shut down")
+	assert.True(t, job.CriticalFailure())
+
+	// a non-critical job just stops
+	job, got = runPolicyTest(`[{name: "myjob", exec: ["sh", "-c", "exit 1"],
+	restartPolicy: "never"}]`)
+	assert.Equal(t, 1, got[exitFailed])
+	assert.Equal(t, 0, got[events.GlobalShutdown])
+	assert.False(t, job.CriticalFailure())
+}
+
+func TestJobRestartBackoff(t *testing.T) {
+	job := &Job{Name: "myjob", restartBackoff: 20 * time.Second,
+		restartDelay: 20 * time.Second, execStartedAt: time.Now()}
+	job.InitRx()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expected := []time.Duration{40 * time.Second, time.Minute, time.Minute}
+	for i, delay := range expected {
+		job.restartJobExec(ctx)
+		assert.Equal(t, delay, job.restartDelay, "delay after restart %d", i+1)
+		assert.True(t, job.restartPending)
+	}
+	// a process that ran for a while resets the backoff
+	job.execStartedAt = time.Now().Add(-2 * time.Minute)
+	job.restartJobExec(ctx)
+	assert.Equal(t, 40*time.Second, job.restartDelay)
+	assert.Equal(t, 4, job.restarts)
+}
+
+// newOnHealthyJob returns a Job with an onHealthy hook that appends its
+// environment to a log, for driving the Job's events by hand
+func newOnHealthyJob(t *testing.T, onHealthy string) (*Job, func() []string) {
+	dir, _ := ioutil.TempDir("", "onhealthy")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "log")
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(`[{name: "web",
+		port: 80, interfaces: "static:10.0.0.5",
+		health: {exec: "true", interval: 5, ttl: 10},
+		onHealthy: {exec: ["sh", "-c",
+		  "echo $CONTAINERPILOT_SERVICE_NAME $CONTAINERPILOT_IP >> `+path+`"], `+
+		onHealthy+`}}]`), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	job := NewJob(cfgs[0])
+	job.execCtx = context.Background()
+	job.Subscribe(events.NewEventBus())
+	return job, func() []string {
+		out, _ := ioutil.ReadFile(path)
+		if len(out) == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+}
+
+// waitForOnHealthy processes the Job's events until its onHealthy hook
+// has exited
+func waitForOnHealthy(t *testing.T, job *Job) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-job.Rx:
+			job.processEvent(context.Background(), event)
+			if event.Source == "onHealthy.web" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for onHealthy to exit")
+		}
+	}
+}
+
+func TestJobOnHealthyOnce(t *testing.T) {
+	job, read := newOnHealthyJob(t, `timeout: "1s"`)
+	pass := events.Event{events.ExitSuccess, "check.web"}
+	fail := events.Event{events.ExitFailed, "check.web"}
+
+	job.processEvent(nil, pass)
+	waitForOnHealthy(t, job)
+	assert.Equal(t, []string{"web 10.0.0.5"}, read())
+
+	job.processEvent(nil, pass)
+	job.processEvent(nil, fail)
+	job.processEvent(nil, pass)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"web 10.0.0.5"}, read(),
+		"expected onHealthy to run only the first time")
+}
+
+func TestJobOnHealthyEach(t *testing.T) {
+	job, read := newOnHealthyJob(t, `each: true, minInterval: "30s"`)
+	clock := mocks.NewFakeClock()
+	job.clock = clock
+	pass := events.Event{events.ExitSuccess, "check.web"}
+	fail := events.Event{events.ExitFailed, "check.web"}
+
+	job.processEvent(nil, pass)
+	waitForOnHealthy(t, job)
+	job.processEvent(nil, pass)
+	assert.Len(t, read(), 1, "expected no run while the job stays healthy")
+
+	// a flapping service doesn't run the hook more than once per interval
+	job.processEvent(nil, fail)
+	job.processEvent(nil, pass)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, read(), 1, "expected no run within the minInterval")
+
+	clock.Advance(30 * time.Second)
+	job.processEvent(nil, fail)
+	job.processEvent(nil, pass)
+	waitForOnHealthy(t, job)
+	assert.Equal(t, []string{"web 10.0.0.5", "web 10.0.0.5"}, read())
+}
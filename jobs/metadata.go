@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// limits on service metadata enforced by the Consul agent
+const (
+	metaMaxPairs       = 64
+	metaMaxKeyLength   = 128
+	metaMaxValueLength = 512
+	metaReservedPrefix = "consul-"
+)
+
+// defaultWarningWeight is the weight Consul gives an instance whose
+// health check is warning if the weight isn't set
+const defaultWarningWeight = 1
+
+var validMetaKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// WeightsConfig sets the weights that Consul reports for the service in
+// DNS SRV responses, depending on whether its health check is passing or
+// warning, so that clients can send less traffic to some instances
+type WeightsConfig struct {
+	Passing *int `mapstructure:"passing"`
+	Warning *int `mapstructure:"warning"`
+}
+
+// expandEnv expands $VAR and ${VAR} in a tag or metadata value from the
+// environment at the time the config is loaded (and reloaded). Unset
+// variables expand to an empty string, as they would in a shell.
+func expandEnv(field, value string) string {
+	var missing []string
+	expanded := os.Expand(value, func(key string) string {
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			missing = append(missing, key)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		log.Warnf("%s '%s': unset environment variables %v", field, value, missing)
+	}
+	return expanded
+}
+
+// validateTags returns the job's tags with environment variables expanded
+func (cfg *Config) validateTags() []string {
+	if cfg.Tags == nil {
+		return nil
+	}
+	tags := make([]string, len(cfg.Tags))
+	for i, tag := range cfg.Tags {
+		tags[i] = expandEnv(fmt.Sprintf("job[%s].tags[%d]", cfg.Name, i), tag)
+	}
+	return tags
+}
+
+// validateMeta returns the job's service metadata with environment
+// variables expanded in the values, after checking it against the limits
+// that the Consul agent would otherwise reject the registration for
+func (cfg *Config) validateMeta() (map[string]string, error) {
+	if len(cfg.Meta) == 0 {
+		return nil, nil
+	}
+	if len(cfg.Meta) > metaMaxPairs {
+		return nil, fmt.Errorf("job[%s].meta cannot have more than %d keys",
+			cfg.Name, metaMaxPairs)
+	}
+	keys := make([]string, 0, len(cfg.Meta))
+	for key := range cfg.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	meta := make(map[string]string, len(cfg.Meta))
+	for _, key := range keys {
+		switch {
+		case !validMetaKey.MatchString(key):
+			return nil, fmt.Errorf("job[%s].meta key '%s' may only contain "+
+				"letters, numbers, '-', and '_'", cfg.Name, key)
+		case len(key) > metaMaxKeyLength:
+			return nil, fmt.Errorf("job[%s].meta key '%s' cannot be longer "+
+				"than %d characters", cfg.Name, key, metaMaxKeyLength)
+		case strings.HasPrefix(key, metaReservedPrefix):
+			return nil, fmt.Errorf("job[%s].meta key '%s' cannot start with "+
+				"'%s'", cfg.Name, key, metaReservedPrefix)
+		}
+		value := expandEnv(fmt.Sprintf("job[%s].meta.%s", cfg.Name, key),
+			cfg.Meta[key])
+		if len(value) > metaMaxValueLength {
+			return nil, fmt.Errorf("job[%s].meta.%s cannot be longer than "+
+				"%d characters", cfg.Name, key, metaMaxValueLength)
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
+
+// validateWeights returns the job's service weights for the registration.
+// Consul rejects a passing weight of 0, and fills in the warning weight
+// if it's not set, so we do the same here to register what we validated.
+func (cfg *Config) validateWeights() (*api.AgentWeights, error) {
+	if cfg.Weights == nil {
+		return nil, nil
+	}
+	if cfg.Weights.Passing == nil {
+		return nil, fmt.Errorf("job[%s].weights.passing must be set", cfg.Name)
+	}
+	weights := &api.AgentWeights{
+		Passing: *cfg.Weights.Passing,
+		Warning: defaultWarningWeight,
+	}
+	if cfg.Weights.Warning != nil {
+		weights.Warning = *cfg.Weights.Warning
+	}
+	if weights.Passing < 1 {
+		return nil, fmt.Errorf("job[%s].weights.passing must be > 0: %d",
+			cfg.Name, weights.Passing)
+	}
+	if weights.Warning < 0 {
+		return nil, fmt.Errorf("job[%s].weights.warning cannot be negative: %d",
+			cfg.Name, weights.Warning)
+	}
+	return weights, nil
+}
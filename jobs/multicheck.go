@@ -0,0 +1,183 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joyent/containerpilot/commands"
+	"github.com/joyent/containerpilot/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthCheckConfig configures one of the checks in a Job's health.checks.
+// Each check has its own interval, which defaults to the health.interval.
+type HealthCheckConfig struct {
+	Name         string           `mapstructure:"name"`
+	CheckExec    interface{}      `mapstructure:"exec"`
+	CheckHTTP    *HTTPCheckConfig `mapstructure:"http"`
+	CheckTCP     *TCPCheckConfig  `mapstructure:"tcp"`
+	CheckGRPC    *GRPCCheckConfig `mapstructure:"grpc"`
+	CheckTimeout string           `mapstructure:"timeout"`
+	Interval     int              `mapstructure:"interval"` // time in seconds
+}
+
+const (
+	requireAll = "all"
+	requireAny = "any"
+)
+
+// multiCheck is a healthChecker that runs several checks and combines
+// their results: with requireAll every check must pass, and with
+// requireAny at least one of them. The Job runs it every heartbeat, which
+// is the shortest interval of its checks, and each run only runs the
+// checks that are due; the other checks count with their last result.
+type multiCheck struct {
+	name    string
+	require string
+	checks  []*subCheck
+	lock    *sync.Mutex
+	now     func() time.Time
+
+	resultLock sync.Mutex
+	result     commands.Result
+}
+
+// subCheck is one of the checks of a multiCheck
+type subCheck struct {
+	name     string
+	check    healthChecker
+	interval time.Duration
+	lastRun  time.Time
+	passed   bool
+}
+
+// checkWaiter receives the events that a subCheck publishes on its own
+// EventBus, so that the multiCheck can wait for it to finish
+type checkWaiter struct {
+	events.EventHandler
+}
+
+// Run implements healthChecker for multiCheck
+func (check *multiCheck) Run(pctx context.Context, bus *events.EventBus) {
+	go func() {
+		// like a Command, we never run more than one at a time
+		check.lock.Lock()
+		defer check.lock.Unlock()
+		started := check.now()
+		var wg sync.WaitGroup
+		for _, sub := range check.due(started) {
+			wg.Add(1)
+			go func(sub *subCheck) {
+				defer wg.Done()
+				sub.passed = sub.run(pctx)
+			}(sub)
+		}
+		wg.Wait()
+		err := check.setResult(started)
+		if err != nil {
+			log.Errorf("%s failed: %v", check.name, err)
+			bus.Publish(events.Event{events.ExitFailed, check.name})
+			bus.Publish(events.Event{events.Error,
+				fmt.Errorf("%s: %s", check.name, err).Error()})
+			return
+		}
+		log.Debugf("%s passed", check.name)
+		bus.Publish(events.Event{events.ExitSuccess, check.name})
+	}()
+}
+
+// due returns the checks whose interval has elapsed since they last
+// ran. The Job's heartbeats don't line up exactly with the intervals of
+// the checks, so a check that's due within half a heartbeat runs now
+// rather than on the next heartbeat.
+func (check *multiCheck) due(now time.Time) []*subCheck {
+	heartbeat := check.checks[0].interval
+	for _, sub := range check.checks {
+		if sub.interval < heartbeat {
+			heartbeat = sub.interval
+		}
+	}
+	due := []*subCheck{}
+	for _, sub := range check.checks {
+		if sub.lastRun.IsZero() || now.Sub(sub.lastRun)+heartbeat/2 >= sub.interval {
+			sub.lastRun = now
+			due = append(due, sub)
+		}
+	}
+	return due
+}
+
+// run runs the subCheck and waits for it to finish, returning true if
+// it passed
+func (sub *subCheck) run(ctx context.Context) bool {
+	bus := events.NewEventBus()
+	waiter := &checkWaiter{}
+	waiter.InitRx()
+	waiter.Subscribe(bus)
+	defer waiter.Unsubscribe(bus)
+	sub.check.Run(ctx, bus)
+	for {
+		select {
+		case event := <-waiter.Rx:
+			if event.Source != sub.name {
+				continue
+			}
+			switch event.Code {
+			case events.ExitSuccess:
+				return true
+			case events.ExitFailed:
+				return false
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// setResult combines the results of the checks, and returns an error
+// describing the failed checks if the multiCheck failed
+func (check *multiCheck) setResult(started time.Time) error {
+	var failed []*subCheck
+	for _, sub := range check.checks {
+		if !sub.passed {
+			failed = append(failed, sub)
+		}
+	}
+	result := commands.Result{Duration: check.now().Sub(started), Time: check.now()}
+	var err error
+	if len(failed) > 0 && (check.require == requireAll || len(failed) == len(check.checks)) {
+		// the first failed check is the most useful exit code and
+		// output, but the error names all of the failed checks
+		first := failed[0].check.LastResult()
+		result.ExitCode = first.ExitCode
+		result.Output = first.Output
+		result.Stdout = first.Stdout
+		msgs := make([]string, len(failed))
+		for i, sub := range failed {
+			msg := sub.check.LastResult().Error
+			if msg == "" {
+				msg = "failed"
+			}
+			msgs[i] = sub.name + ": " + msg
+		}
+		err = fmt.Errorf("%s", strings.Join(msgs, "; "))
+		result.Error = err.Error()
+		if result.Output == "" {
+			result.Output = result.Error
+		}
+	}
+	check.resultLock.Lock()
+	check.result = result
+	check.resultLock.Unlock()
+	return err
+}
+
+// LastResult implements healthChecker for multiCheck
+func (check *multiCheck) LastResult() commands.Result {
+	check.resultLock.Lock()
+	defer check.resultLock.Unlock()
+	return check.result
+}
@@ -0,0 +1,174 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/tests"
+)
+
+// fakeSubCheck returns a subCheck whose probe passes while *healthy is
+// true, counting its runs in *runs
+func fakeSubCheck(name string, interval time.Duration, healthy *bool, runs *int) *subCheck {
+	probe := func(ctx context.Context) error {
+		*runs++
+		if !*healthy {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	return &subCheck{name: name, interval: interval,
+		check: &probeCheck{name: name, timeout: time.Second, probe: probe,
+			lock: &sync.Mutex{}}}
+}
+
+// runMultiCheck runs the multiCheck and returns true if it passed
+func runMultiCheck(t *testing.T, check *multiCheck) bool {
+	bus := events.NewEventBus()
+	waiter := &checkWaiter{}
+	waiter.InitRx()
+	waiter.Subscribe(bus)
+	defer waiter.Unsubscribe(bus)
+	check.Run(context.Background(), bus)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-waiter.Rx:
+			switch event {
+			case events.Event{Code: events.ExitSuccess, Source: check.name}:
+				return true
+			case events.Event{Code: events.ExitFailed, Source: check.name}:
+				return false
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for check")
+			return false
+		}
+	}
+}
+
+func TestMultiCheckRequire(t *testing.T) {
+	webHealthy, diskHealthy := true, true
+	var webRuns, diskRuns int
+	newCheck := func(require string) *multiCheck {
+		return &multiCheck{name: "check.app", require: require,
+			lock: &sync.Mutex{}, now: time.Now,
+			checks: []*subCheck{
+				fakeSubCheck("check.app.web", time.Second, &webHealthy, &webRuns),
+				fakeSubCheck("check.app.disk", time.Second, &diskHealthy, &diskRuns),
+			}}
+	}
+	all, any := newCheck(requireAll), newCheck(requireAny)
+	assert.True(t, runMultiCheck(t, all))
+	assert.True(t, runMultiCheck(t, any))
+
+	diskHealthy = false
+	all.checks[1].lastRun, any.checks[1].lastRun = time.Time{}, time.Time{}
+	assert.False(t, runMultiCheck(t, all), "expected all to fail")
+	assert.Equal(t, "check.app.disk: unhealthy", all.LastResult().Error)
+	assert.Equal(t, 1, all.LastResult().ExitCode)
+	assert.True(t, runMultiCheck(t, any), "expected any to pass")
+	assert.Equal(t, "", any.LastResult().Error)
+
+	webHealthy = false
+	all.checks[0].lastRun, any.checks[0].lastRun = time.Time{}, time.Time{}
+	any.checks[1].lastRun = time.Time{}
+	assert.False(t, runMultiCheck(t, any), "expected any to fail")
+	assert.Equal(t, "check.app.web: unhealthy; check.app.disk: unhealthy",
+		any.LastResult().Error)
+}
+
+func TestMultiCheckIntervals(t *testing.T) {
+	healthy := true
+	var fastRuns, slowRuns int
+	now := time.Now()
+	check := &multiCheck{name: "check.app", require: requireAll,
+		lock: &sync.Mutex{}, now: func() time.Time { return now },
+		checks: []*subCheck{
+			fakeSubCheck("check.app.fast", 5*time.Second, &healthy, &fastRuns),
+			fakeSubCheck("check.app.slow", 60*time.Second, &healthy, &slowRuns),
+		}}
+	// heartbeats a bit early or late still run the checks that are due
+	for i := 0; i < 13; i++ {
+		assert.True(t, runMultiCheck(t, check))
+		now = now.Add(5*time.Second + time.Duration(i%3-1)*100*time.Millisecond)
+	}
+	assert.Equal(t, 13, fastRuns)
+	assert.Equal(t, 2, slowRuns)
+
+	// the slow check is failed until it runs again
+	healthy = false
+	assert.False(t, runMultiCheck(t, check))
+	assert.Equal(t, "check.app.fast: unhealthy", check.LastResult().Error)
+	healthy = true
+	assert.False(t, runMultiCheck(t, check), "expected slow check to still fail")
+}
+
+func TestJobConfigHealthChecks(t *testing.T) {
+	cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+              health: {checks: [
+                         {http: {url: "http://localhost/health"}},
+                         {name: "disk", exec: "/bin/check-disk", interval: 60,
+                          timeout: "10s"}],
+                       require: "any", interval: 5, ttl: 10}}]`
+	jobs, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	assert.Equal(t, 5*time.Second, jobs[0].heartbeatInterval)
+	assert.Nil(t, jobs[0].healthCheckExec)
+	check, ok := jobs[0].healthCheck.(*multiCheck)
+	if !ok {
+		t.Fatalf("expected multiCheck but got %T", jobs[0].healthCheck)
+	}
+	assert.Equal(t, requireAny, check.require)
+	assert.Equal(t, "check.myName.0", check.checks[0].name)
+	assert.Equal(t, 5*time.Second, check.checks[0].interval)
+	assert.Equal(t, 5*time.Second, check.checks[0].check.(*probeCheck).timeout)
+	assert.Equal(t, "check.myName.disk", check.checks[1].name)
+	assert.Equal(t, 60*time.Second, check.checks[1].interval)
+	assert.Equal(t, map[string]string{
+		"job[myName].health.checks[1].exec": "/bin/check-disk"},
+		jobs[0].Executables())
+
+	// without a health.interval, the job heartbeats as often as the
+	// most frequent check
+	cfg = `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+             health: {checks: [{tcp: {address: "localhost:80"}, interval: 7},
+                               {exec: "true", interval: 3}], ttl: 10}}]`
+	jobs, err = NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	assert.Equal(t, 3*time.Second, jobs[0].heartbeatInterval)
+	assert.Equal(t, requireAll, jobs[0].healthCheck.(*multiCheck).require)
+
+	testErr := func(health, expected string) {
+		cfg := `[{name: "myName", port: 80, interfaces: ["inet", "lo0"],
+                  health: ` + health + `}]`
+		_, err := NewConfigs(tests.DecodeRawToSlice(cfg), noop)
+		assert.EqualError(t, err, expected)
+	}
+	testErr(`{checks: [{exec: "true"}], ttl: 5}`,
+		"job[myName].health.checks[0].interval must be > 0")
+	testErr(`{checks: [{exec: "true"}], exec: "true", interval: 1, ttl: 5}`,
+		"job[myName].health.checks cannot be used with 'exec', 'http', 'tcp', or 'grpc'")
+	testErr(`{checks: [{interval: 1}], ttl: 5}`,
+		"job[myName].health.checks[0] must have one of 'exec', 'http', 'tcp', or 'grpc'")
+	testErr(`{checks: [{exec: "true", tcp: {address: "localhost:80"}}], interval: 1, ttl: 5}`,
+		"job[myName].health.checks[0] must have only one of 'exec', 'http', 'tcp', or 'grpc'")
+	testErr(`{checks: [{tcp: {address: "localhost"}}], interval: 1, ttl: 5}`,
+		"job[myName].health.checks[0].tcp.address must be in the form 'host:port': 'localhost'")
+	testErr(`{checks: [{name: "a", exec: "true"}, {name: "a", exec: "true"}], interval: 1, ttl: 5}`,
+		"job[myName].health.checks[1].name must be unique: 'a'")
+	testErr(`{checks: [{exec: "true"}], require: "most", interval: 1, ttl: 5}`,
+		"job[myName].health.require must be 'all' or 'any': 'most'")
+	testErr(`{exec: "true", require: "any", interval: 1, ttl: 5}`,
+		"job[myName].health.require can only be used with 'checks'")
+}
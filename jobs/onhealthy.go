@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/joyent/containerpilot/commands"
+	"github.com/joyent/containerpilot/config/timing"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultOnHealthyMinInterval is the least time between two runs of an
+// onHealthy hook with 'each' set, so that a service that flaps between
+// healthy and unhealthy doesn't run its hook on every health check
+const defaultOnHealthyMinInterval = 10 * time.Second
+
+// OnHealthyConfig is a command that runs when the Job becomes healthy.
+// By default it runs only the first time; with Each it runs each time
+// the Job goes from any other status to healthy.
+type OnHealthyConfig struct {
+	Exec        interface{} `mapstructure:"exec"`
+	Timeout     string      `mapstructure:"timeout"`
+	Each        bool        `mapstructure:"each"`
+	MinInterval string      `mapstructure:"minInterval"`
+}
+
+// onHealthyHook is the validated OnHealthyConfig of a Job
+type onHealthyHook struct {
+	exec        *commands.Command
+	each        bool
+	minInterval time.Duration
+
+	// set by the Job's event loop
+	ran     bool
+	running bool
+	lastRun time.Time
+}
+
+func (cfg *Config) validateOnHealthy() error {
+	if cfg.OnHealthy == nil {
+		return nil
+	}
+	if cfg.Health == nil {
+		return fmt.Errorf("job[%s].onHealthy requires a health check", cfg.Name)
+	}
+	if cfg.OnHealthy.Exec == nil {
+		return fmt.Errorf("job[%s].onHealthy.exec must be set", cfg.Name)
+	}
+	timeout, err := timing.GetTimeout(cfg.OnHealthy.Timeout)
+	if err != nil {
+		return fmt.Errorf("unable to parse job[%s].onHealthy.timeout '%s': %v",
+			cfg.Name, cfg.OnHealthy.Timeout, err)
+	}
+	minInterval := defaultOnHealthyMinInterval
+	if cfg.OnHealthy.MinInterval != "" {
+		if !cfg.OnHealthy.Each {
+			return fmt.Errorf("job[%s].onHealthy.minInterval can only be set "+
+				"with 'each'", cfg.Name)
+		}
+		minInterval, err = timing.GetTimeout(cfg.OnHealthy.MinInterval)
+		if err != nil {
+			return fmt.Errorf("unable to parse job[%s].onHealthy.minInterval '%s': %v",
+				cfg.Name, cfg.OnHealthy.MinInterval, err)
+		}
+		if minInterval < 0 {
+			return fmt.Errorf("job[%s].onHealthy.minInterval cannot be negative: %v",
+				cfg.Name, minInterval)
+		}
+	}
+	hookName := "onHealthy." + cfg.Name
+	cmd, err := commands.NewCommand(cfg.OnHealthy.Exec, timeout,
+		log.Fields{"process": "onHealthy", "job": cfg.Name})
+	if err != nil {
+		return fmt.Errorf("unable to create job[%s].onHealthy.exec: %v",
+			cfg.Name, err)
+	}
+	cmd.Name = hookName
+	cfg.onHealthy = &onHealthyHook{
+		exec:        cmd,
+		each:        cfg.OnHealthy.Each,
+		minInterval: minInterval,
+	}
+	return nil
+}
+
+// runOnHealthy runs the Job's onHealthy hook, if it has one and it's
+// due, after the Job has become healthy
+func (job *Job) runOnHealthy(ctx context.Context) {
+	hook := job.onHealthy
+	if hook == nil || (hook.ran && !hook.each) {
+		return
+	}
+	if hook.running {
+		// running the hook again would block the event loop until the
+		// last run exits
+		log.Debugf("%s: skipping onHealthy, last run hasn't exited", job.Name)
+		return
+	}
+	now := job.clock.Now()
+	if hook.ran && now.Sub(hook.lastRun) < hook.minInterval {
+		log.Debugf("%s: skipping onHealthy, last run %v ago",
+			job.Name, now.Sub(hook.lastRun))
+		return
+	}
+	hook.ran, hook.running, hook.lastRun = true, true, now
+	// the IP may have changed since the Job was configured, so the
+	// environment is read each time
+	env := []string{"CONTAINERPILOT_SERVICE_NAME=" + job.Name}
+	if job.Service != nil {
+		env = append(env, serviceIPEnvironment(job.Service)...)
+	}
+	hook.exec.Env = env
+	hook.exec.Run(ctx, job.Bus)
+}
+
+// onHealthyExited records that the onHealthy hook has exited, so that it
+// can run again
+func (job *Job) onHealthyExited() {
+	if job.onHealthy != nil {
+		job.onHealthy.running = false
+	}
+}
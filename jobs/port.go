@@ -0,0 +1,80 @@
+package jobs
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// normalizePort returns a copy of the raw job config with its 'port'
+// parsed into an int, so that the port can be given as a number, as a
+// numeric string, or as an environment variable like "$PORT" that is
+// set for ContainerPilot by the scheduler. A job without a port isn't
+// advertised, so the port is only checked if it's set.
+func normalizePort(raw interface{}) (interface{}, error) {
+	job, ok := raw.(map[string]interface{})
+	if !ok {
+		return raw, nil // decoding will report the bad job
+	}
+	rawPort, ok := job["port"]
+	if !ok || rawPort == nil {
+		return raw, nil
+	}
+	port, err := parsePort(fmt.Sprintf("%v", job["name"]), rawPort)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(map[string]interface{}, len(job))
+	for k, v := range job {
+		normalized[k] = v
+	}
+	normalized["port"] = port
+	return normalized, nil
+}
+
+// parsePort parses the port of the named job, expanding any environment
+// variables in a string first
+func parsePort(name string, raw interface{}) (int, error) {
+	var port int
+	switch t := raw.(type) {
+	case int:
+		port = t
+	case int64:
+		port = int(t)
+	case float64:
+		if t != math.Trunc(t) {
+			return 0, fmt.Errorf("job[%s].port must be an integer: %v", name, t)
+		}
+		port = int(t)
+	case string:
+		var missing []string
+		expanded := os.Expand(t, func(key string) string {
+			val := os.Getenv(key)
+			if val == "" {
+				missing = append(missing, key)
+			}
+			return val
+		})
+		if len(missing) > 0 {
+			return 0, fmt.Errorf("job[%s].port '%s' uses unset environment "+
+				"variables: %v", name, t, strings.Join(missing, ", "))
+		}
+		var err error
+		if port, err = strconv.Atoi(strings.TrimSpace(expanded)); err != nil {
+			if expanded != t {
+				return 0, fmt.Errorf("job[%s].port '%s' expanded to '%s', which "+
+					"is not a number", name, t, expanded)
+			}
+			return 0, fmt.Errorf("job[%s].port '%s' is not a number", name, t)
+		}
+	default:
+		return 0, fmt.Errorf("job[%s].port must be a number: %v", name, raw)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("job[%s].port must be between 1 and 65535: %d",
+			name, port)
+	}
+	return port, nil
+}
@@ -0,0 +1,189 @@
+package jobs
+
+import (
+	"encoding/json"
+
+	"github.com/joyent/containerpilot/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// handoffEvent tells a Job to stop its event loop without stopping its
+// processes, deregistering its service, or firing its Stopping and
+// Stopped events, so that the Job replacing it on a reload can take over
+var handoffEvent = events.Event{Code: events.Quit, Source: "reload.handoff"}
+
+// fingerprint identifies the user-facing config of a Job. The exported
+// fields are what was decoded from the config file, so two Configs with
+// the same fingerprint will create the same Job. The services reported by
+// an aggregate health check come from the other Jobs' configs, so we add
+// them as well.
+func (cfg *Config) fingerprint() string {
+	return marshalFingerprint(struct {
+		*Config
+		AggregateServices []string
+	}{cfg, cfg.aggregateServices})
+}
+
+// execFingerprint identifies the parts of the config that control the
+// Job's process. If these don't change, a reload doesn't need to restart
+// the process even if other parts (ex. the health check) have changed.
+func (cfg *Config) execFingerprint() string {
+	return marshalFingerprint(struct {
+		Exec        interface{}
+		ExecTimeout string
+		Restarts    interface{}
+		StopTimeout string
+		When        *WhenConfig
+		Logging     *LoggingConfig
+	}{cfg.Exec, cfg.ExecTimeout, cfg.Restarts, cfg.StopTimeout, cfg.When,
+		cfg.Logging})
+}
+
+func marshalFingerprint(v interface{}) string {
+	// the JSON encoder skips unexported fields and sorts map keys, which
+	// is exactly what we need to get a stable fingerprint
+	fingerprint, err := json.Marshal(v)
+	if err != nil {
+		// we can't compare this config so it'll always be replaced
+		log.Debugf("unable to fingerprint config: %v", err)
+		return ""
+	}
+	return string(fingerprint)
+}
+
+// Reload applies the Jobs from a reloaded config to the running Jobs on
+// the bus and returns the Jobs that replace them:
+//
+//   - unchanged Jobs keep running as they are
+//   - Jobs that aren't in the new config are stopped
+//   - new Jobs are started and receive the startup event
+//   - changed Jobs whose process config is the same take over the running
+//     process from the old Job, so only the service definition, health
+//     check, and timers are updated
+//   - changed Jobs whose process config has changed are restarted
+//
+// If the discovery backend has changed, every Job with a service is
+// replaced so that it registers with the new backend.
+func Reload(running, updated []*Job, bus *events.EventBus, discoveryChanged bool) []*Job {
+	previous := make(map[string]*Job, len(running))
+	for _, job := range running {
+		previous[job.Name] = job
+	}
+	current := make(map[string]bool, len(updated))
+	for _, job := range updated {
+		current[job.Name] = true
+	}
+
+	var (
+		result   []*Job
+		adopting []*Job
+		started  []*Job
+	)
+	for _, job := range updated {
+		old, ok := previous[job.Name]
+		switch {
+		case !ok:
+			log.Infof("reload: starting new job %s", job.Name)
+			started = append(started, job)
+		case job.fingerprint == old.fingerprint &&
+			job.fingerprint != "" &&
+			!(discoveryChanged && old.Service != nil):
+			result = append(result, old)
+			continue
+		case job.execFingerprint == old.execFingerprint && job.execFingerprint != "":
+			log.Infof("reload: updating job %s", job.Name)
+			adopting = append(adopting, job)
+		default:
+			log.Infof("reload: restarting job %s", job.Name)
+			started = append(started, job)
+		}
+		result = append(result, job)
+	}
+
+	// we need to subscribe the new Jobs before we stop any of the old
+	// ones, so that the bus never runs out of subscribers and shuts down
+	// and so that no events from a handed off process get lost
+	for _, job := range adopting {
+		job.Subscribe(bus)
+	}
+	for _, job := range started {
+		job.Subscribe(bus)
+	}
+
+	for _, job := range running {
+		if !current[job.Name] {
+			log.Infof("reload: stopping removed job %s", job.Name)
+			job.Quit()
+		}
+	}
+	for _, job := range adopting {
+		old := previous[job.Name]
+		old.handoff()
+		if discoveryChanged && old.Service != nil {
+			old.Service.Deregister()
+		}
+		if !job.adopt(old) {
+			job.Unsubscribe(bus)
+			continue
+		}
+		job.Run()
+	}
+	for _, job := range started {
+		if old, ok := previous[job.Name]; ok {
+			old.Quit()
+		}
+	}
+	for _, job := range started {
+		job.Run()
+		// we don't publish this because the jobs that are already
+		// running have seen it once
+		job.Receive(events.GlobalStartup)
+	}
+	return result
+}
+
+// handoff stops the Job's event loop but leaves its processes running
+// and its service registered, and waits until the event loop is done
+func (job *Job) handoff() {
+	job.Receive(handoffEvent)
+	job.Quit()
+}
+
+// adopt takes over the processes and progress of the old Job after it's
+// been handed off. It returns false if the old Job had already stopped on
+// its own, in which case there's nothing to take over and the new Job
+// shouldn't run.
+func (job *Job) adopt(old *Job) bool {
+	if !old.handedOff {
+		return false
+	}
+	job.exec = old.exec
+	job.execCtx, job.execCancel = old.execCtx, old.execCancel
+	job.restartsRemain = old.restartsRemain
+	job.startsRemain = old.startsRemain
+	if old.startEvent == events.NonEvent {
+		job.startEvent = events.NonEvent
+	}
+	if old.startTimeoutEvent == events.NonEvent {
+		// the old Job already started, or never had a timeout
+		job.startTimeout = 0
+	}
+	job.warmUntil = old.warmUntil
+	job.restarts = old.restarts
+	job.restartDelay = old.restartDelay
+	job.checksFailed = old.checksFailed
+	job.checksPassed = old.checksPassed
+	job.execStartedAt = old.execStartedAt
+	if job.onHealthy != nil && old.onHealthy != nil {
+		job.onHealthy.ran = old.onHealthy.ran
+		job.onHealthy.lastRun = old.onHealthy.lastRun
+	}
+	if old.restartPending {
+		// the old Job's backoff timer stopped with its event loop, so
+		// we restart without waiting out the rest of it
+		job.Receive(events.Event{Code: events.TimerExpired,
+			Source: job.Name + ".restart"})
+	}
+	job.setStatus(old.GetStatus())
+	return true
+}
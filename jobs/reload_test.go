@@ -0,0 +1,148 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/events"
+	"github.com/joyent/containerpilot/tests"
+)
+
+func reloadTestJobs(t *testing.T, raw string) []*Job {
+	cfgs, err := NewConfigs(tests.DecodeRawToSlice(raw), noop)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return FromConfigs(cfgs)
+}
+
+// Reloading should only stop and start the Jobs that have changed, and a
+// Job whose process config hasn't changed should keep its process
+func TestJobReload(t *testing.T) {
+	bus := events.NewEventBus()
+	running := reloadTestJobs(t, `[
+	{name: "keep", exec: "sleep 10"},
+	{name: "update", exec: "sleep 10", port: 80, interfaces: "inet",
+	 health: {exec: "true", interval: 5, ttl: 10}},
+	{name: "restart", exec: "sleep 10"},
+	{name: "remove", exec: "sleep 10"}]`)
+	for _, job := range running {
+		job.Subscribe(bus)
+		job.Run()
+	}
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(100 * time.Millisecond)
+	updatedPid := running[1].exec.Pid()
+	restartedPid := running[2].exec.Pid()
+
+	updated := reloadTestJobs(t, `[
+	{name: "keep", exec: "sleep 10"},
+	{name: "update", exec: "sleep 10", port: 8080, interfaces: "inet",
+	 health: {exec: "true", interval: 2, ttl: 5}},
+	{name: "restart", exec: "sleep 20"},
+	{name: "add", exec: "sleep 10"}]`)
+	result := Reload(running, updated, bus, false)
+	time.Sleep(100 * time.Millisecond)
+
+	names := []string{}
+	for _, job := range result {
+		names = append(names, job.Name)
+	}
+	assert.Equal(t, []string{"keep", "update", "restart", "add"}, names)
+	assert.True(t, result[0] == running[0], "expected unchanged job to keep running")
+	assert.True(t, result[1] == updated[1], "expected changed job to be replaced")
+	assert.Equal(t, 8080, result[1].Service.Port)
+	assert.Equal(t, updatedPid, result[1].exec.Pid(),
+		"expected updated job to keep its process running")
+	assert.NotEqual(t, restartedPid, result[2].exec.Pid(),
+		"expected restarted job to have a new process")
+	assert.NotEqual(t, 0, result[3].exec.Pid(), "expected new job to be started")
+
+	assert.NotEqual(t, 0, running[0].exec.Pid(),
+		"expected unchanged job's process to still be running")
+	assert.Equal(t, 0, running[2].exec.Pid(),
+		"expected restarted job's old process to be stopped")
+	assert.Equal(t, 0, running[3].exec.Pid(),
+		"expected removed job's process to be stopped")
+
+	for _, job := range result {
+		job.Quit()
+	}
+	bus.Wait()
+}
+
+// A Job that has finished on its own shouldn't run again when its
+// config changes without changing its process
+func TestJobReloadFinished(t *testing.T) {
+	bus := events.NewEventBus()
+	running := reloadTestJobs(t, `[
+	{name: "once", exec: "true"},
+	{name: "app", exec: "sleep 10"}]`)
+	for _, job := range running {
+		job.Subscribe(bus)
+		job.Run()
+	}
+	bus.Publish(events.GlobalStartup)
+	time.Sleep(100 * time.Millisecond)
+
+	updated := reloadTestJobs(t, `[
+	{name: "once", exec: "true", port: 80, interfaces: "inet",
+	 health: {exec: "true", interval: 5, ttl: 10}},
+	{name: "app", exec: "sleep 10"}]`)
+	result := Reload(running, updated, bus, false)
+	result[1].Quit()
+	bus.Wait()
+
+	got := map[events.Event]int{}
+	for _, event := range bus.DebugEvents() {
+		got[event]++
+	}
+	assert.Equal(t, 1, got[events.Event{events.ExitSuccess, "once"}],
+		"expected finished job not to run again")
+}
+
+// Changing the tags or metadata of a service should re-register it under
+// the same ID so that the old registration is updated, not orphaned, and
+// without losing its weights
+func TestJobReloadServiceTags(t *testing.T) {
+	backend := &registrationBackend{}
+	load := func(raw string) []*Job {
+		cfgs, err := NewConfigs(tests.DecodeRawToSlice(raw), backend)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return FromConfigs(cfgs)
+	}
+	bus := events.NewEventBus()
+	running := load(`[{name: "app", exec: "sleep 10", port: 80,
+	 interfaces: "inet", tags: ["v1"], meta: {version: "1"},
+	 weights: {passing: 10, warning: 1},
+	 health: {exec: "true", interval: 5, ttl: 10}}]`)
+	running[0].Subscribe(bus)
+	running[0].Run()
+	bus.Publish(events.GlobalStartup)
+	running[0].Service.SendHeartbeat()
+
+	updated := load(`[{name: "app", exec: "sleep 10", port: 80,
+	 interfaces: "inet", tags: ["v2"], meta: {version: "2"},
+	 weights: {passing: 10, warning: 1},
+	 health: {exec: "true", interval: 5, ttl: 10}}]`)
+	result := Reload(running, updated, bus, false)
+	result[0].Service.SendHeartbeat()
+	result[0].Quit()
+	bus.Wait()
+
+	if len(backend.registrations) != 2 {
+		t.Fatalf("expected 2 registrations, got %d", len(backend.registrations))
+	}
+	before, after := backend.registrations[0], backend.registrations[1]
+	assert.Equal(t, before.ID, after.ID, "expected the same service ID")
+	assert.Equal(t, []string{"v1"}, before.Tags)
+	assert.Equal(t, []string{"v2"}, after.Tags)
+	assert.Equal(t, map[string]string{"version": "2"}, after.Meta)
+	assert.Equal(t, &api.AgentWeights{Passing: 10, Warning: 1}, after.Weights,
+		"expected the weights to be preserved")
+}
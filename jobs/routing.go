@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var validRoutingHost = regexp.MustCompile(
+	`^[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?)*$`)
+
+// RoutingConfig describes how an HTTP router that reads its routes from
+// the Consul catalog (like Fabio or Traefik) should route requests to the
+// service. It is translated into the service tags that router expects.
+type RoutingConfig struct {
+	Router      string `mapstructure:"router"`
+	Prefix      string `mapstructure:"prefix"`
+	Host        string `mapstructure:"host"`
+	StripPrefix bool   `mapstructure:"stripPrefix"`
+}
+
+// validate checks the RoutingConfig fields and returns the service tags
+// for the configured router
+func (routing *RoutingConfig) validate(name string) ([]string, error) {
+	if routing.Prefix == "" && routing.Host == "" {
+		return nil, fmt.Errorf(
+			"job[%s].routing must have at least one of 'prefix' or 'host'", name)
+	}
+	if routing.Prefix != "" {
+		if !strings.HasPrefix(routing.Prefix, "/") {
+			return nil, fmt.Errorf(
+				"job[%s].routing.prefix must start with '/': %s",
+				name, routing.Prefix)
+		}
+		if strings.ContainsAny(routing.Prefix, " \t\n;,") {
+			return nil, fmt.Errorf(
+				"job[%s].routing.prefix contains invalid characters: %s",
+				name, routing.Prefix)
+		}
+	}
+	if routing.Host != "" && !validRoutingHost.MatchString(routing.Host) {
+		return nil, fmt.Errorf("job[%s].routing.host is not a valid hostname: %s",
+			name, routing.Host)
+	}
+	if routing.StripPrefix && routing.Prefix == "" {
+		return nil, fmt.Errorf(
+			"job[%s].routing.stripPrefix requires 'prefix' to be set", name)
+	}
+	switch strings.ToLower(routing.Router) {
+	case "fabio":
+		return routing.fabioTags(), nil
+	case "traefik":
+		return routing.traefikTags(), nil
+	case "":
+		return nil, fmt.Errorf("job[%s].routing.router must be set", name)
+	default:
+		return nil, fmt.Errorf(
+			"job[%s].routing.router must be one of 'fabio' or 'traefik': %s",
+			name, routing.Router)
+	}
+}
+
+// fabioTags returns the `urlprefix-` tag for Fabio, ex.
+// `urlprefix-example.com/api strip=/api`
+func (routing *RoutingConfig) fabioTags() []string {
+	prefix := routing.Prefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	tag := "urlprefix-" + routing.Host + prefix
+	if routing.StripPrefix {
+		tag = tag + " strip=" + routing.Prefix
+	}
+	return []string{tag}
+}
+
+// traefikTags returns the Consul catalog tags for Traefik, ex.
+// `traefik.frontend.rule=Host:example.com;PathPrefix:/api`
+func (routing *RoutingConfig) traefikTags() []string {
+	rules := []string{}
+	if routing.Host != "" {
+		rules = append(rules, "Host:"+routing.Host)
+	}
+	if routing.Prefix != "" {
+		matcher := "PathPrefix:"
+		if routing.StripPrefix {
+			matcher = "PathPrefixStrip:"
+		}
+		rules = append(rules, matcher+routing.Prefix)
+	}
+	return []string{
+		"traefik.enable=true",
+		"traefik.frontend.rule=" + strings.Join(rules, ";"),
+	}
+}
@@ -11,6 +11,7 @@ const (
 	statusUnhealthy
 	statusMaintenance
 	statusAlwaysHealthy
+	statusWarming
 )
 
 func (i JobStatus) String() string {
@@ -24,6 +25,8 @@ func (i JobStatus) String() string {
 	case 5:
 		// for hardcoded "always healthy" jobs
 		return "healthy"
+	case 6:
+		return "warming"
 	default:
 		// both idle and unknown return unknown for purposes of serialization
 		return "unknown"
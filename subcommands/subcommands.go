@@ -18,6 +18,7 @@ type Params struct {
 	ConfigPath      string
 	RenderFlag      string
 	MaintenanceFlag string
+	StrictFlag      bool
 
 	Metrics map[string]string
 	Env     map[string]string
@@ -38,6 +39,36 @@ func RenderHandler(params Params) error {
 	return config.RenderConfig(params.ConfigPath, params.RenderFlag)
 }
 
+// ValidateHandler asks the configuration package to validate the
+// configuration without running it, and prints any warnings
+func ValidateHandler(params Params) error {
+	warnings, err := config.ValidateConfig(params.ConfigPath, params.StrictFlag)
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	if err != nil {
+		return fmt.Errorf("-validate: %v", err)
+	}
+	fmt.Printf("configuration %s is valid\n", params.ConfigPath)
+	return nil
+}
+
+// DryRunHandler asks the configuration package to load the configuration
+// and select each service's IP as it would at startup, and prints the
+// registrations it would send to Consul without sending them
+func DryRunHandler(params Params) error {
+	registrations, err := config.DryRunConfig(params.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("-dry-run: %v", err)
+	}
+	out, err := json.MarshalIndent(registrations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("-dry-run: %v", err)
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
+
 // ReloadHandler fires a Reload request through the HTTPClient.
 func ReloadHandler(params Params) error {
 	client, err := initClient(params.ConfigPath)
@@ -112,6 +143,21 @@ func GetPingHandler(params Params) error {
 	return nil
 }
 
+// GetStatusHandler prints the health status of each job through the
+// HTTPClient.
+func GetStatusHandler(params Params) error {
+	client, err := initClient(params.ConfigPath)
+	if err != nil {
+		return err
+	}
+	status, err := client.GetStatus()
+	if err != nil {
+		return fmt.Errorf("-status: failed: %v", err)
+	}
+	fmt.Print(status)
+	return nil
+}
+
 // loads the configuration so we can get the control socket and
 // initializes the HTTPClient which callers will use for sending
 // it commands
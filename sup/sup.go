@@ -7,10 +7,12 @@ import (
 	"os/exec"
 	"os/signal"
 	"syscall"
+
+	"github.com/joyent/containerpilot/config"
 )
 
 // Run forks the ContainerPilot process and then starts signal handlers
-// that will reap child processes and pass-thru SIGINT and SIGKILL to
+// that will reap child processes and pass-thru all other signals to
 // the ContainerPilot worker process.
 func Run() {
 	self, err := exec.LookPath(os.Args[0])
@@ -26,22 +28,25 @@ func Run() {
 	proc.Wait()
 }
 
-// handleSignals listens for signals used to gracefully shutdown and
-// passes them thru to the ContainerPilot worker process.
+// handleSignals listens for signals and passes them thru to the
+// ContainerPilot worker process, which decides what to do with them
+// according to its 'signals' config. Only the signals that can be
+// configured are forwarded; the rest keep their default behavior.
 func handleSignals(pid int) {
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGCHLD, syscall.SIGUSR1)
+	signal.Notify(sig, syscall.SIGCHLD)
+	for _, s := range config.HandledSignals() {
+		signal.Notify(sig, s)
+	}
 	go func() {
 		for signal := range sig {
 			switch signal {
-			case syscall.SIGINT:
-				syscall.Kill(pid, syscall.SIGINT)
-			case syscall.SIGTERM:
-				syscall.Kill(pid, syscall.SIGTERM)
-			case syscall.SIGUSR1:
-				syscall.Kill(pid, syscall.SIGUSR1)
 			case syscall.SIGCHLD:
 				go reap()
+			default:
+				if s, ok := signal.(syscall.Signal); ok {
+					syscall.Kill(pid, s)
+				}
 			}
 		}
 	}()
@@ -0,0 +1,221 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/joyent/containerpilot/config/timing"
+)
+
+const (
+	defaultStatsdAddress  = "127.0.0.1:8125"
+	defaultStatsdInterval = 10 * time.Second
+
+	// keeps each packet under the MTU of most networks
+	maxStatsdPacketSize = 1432
+)
+
+// StatsdConfig configures a sink that pushes the same metrics that are
+// served on the '/metrics' endpoint to a StatsD server over UDP
+type StatsdConfig struct {
+	Address  string      `mapstructure:"address"`
+	Prefix   string      `mapstructure:"prefix"`
+	Tags     []string    `mapstructure:"tags"`
+	Interval interface{} `mapstructure:"interval"`
+
+	interval time.Duration
+}
+
+// Validate sets the defaults for the StatsdConfig and checks its address
+// and interval
+func (cfg *StatsdConfig) Validate() error {
+	if cfg.Address == "" {
+		cfg.Address = defaultStatsdAddress
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return fmt.Errorf("statsd.address must be in the form 'host:port': '%s'",
+			cfg.Address)
+	}
+	cfg.interval = defaultStatsdInterval
+	if cfg.Interval != nil {
+		interval, err := timing.ParseDuration(cfg.Interval)
+		if err != nil {
+			return fmt.Errorf("unable to parse statsd.interval '%v': %v",
+				cfg.Interval, err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("statsd.interval must be > 0")
+		}
+		cfg.interval = interval
+	}
+	return nil
+}
+
+// statsdSink periodically gathers the Prometheus metrics and sends them
+// to a StatsD server. Prometheus counters are cumulative but StatsD
+// counters are not, so we send the change since the last push.
+type statsdSink struct {
+	cfg      *StatsdConfig
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+	last     *statsdCounts
+}
+
+// statsdCounts are the values of the counters at the last push
+type statsdCounts struct {
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// the counts outlive each sink, so that the sink of a reloaded config
+// doesn't send the counts again that the previous one already sent
+var lastStatsdCounts = &statsdCounts{values: map[string]float64{}}
+
+func newStatsdSink(cfg *StatsdConfig) *statsdSink {
+	return &statsdSink{
+		cfg:      cfg,
+		gatherer: prometheus.DefaultGatherer,
+		last:     lastStatsdCounts,
+	}
+}
+
+// Run pushes the metrics every interval until the context is canceled
+func (s *statsdSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.interval)
+	defer ticker.Stop()
+	log.Infof("telemetry: sending metrics to statsd at %s", s.cfg.Address)
+	for {
+		select {
+		case <-ticker.C:
+			s.push()
+		case <-ctx.Done():
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// push sends all the metrics, batching as many lines into each packet
+// as will fit
+func (s *statsdSink) push() {
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.cfg.Address)
+		if err != nil {
+			log.Warnf("telemetry: unable to reach statsd at %s: %v",
+				s.cfg.Address, err)
+			return
+		}
+		s.conn = conn
+	}
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		// Gather returns the metrics it could gather even on error
+		log.Warnf("telemetry: error gathering metrics for statsd: %v", err)
+	}
+	var packet []byte
+	for _, line := range s.lines(families) {
+		if len(packet) > 0 && len(packet)+len(line)+1 > maxStatsdPacketSize {
+			s.write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		s.write(packet)
+	}
+}
+
+func (s *statsdSink) write(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		log.Debugf("telemetry: unable to send metrics to statsd: %v", err)
+	}
+}
+
+// lines formats the metrics as StatsD lines, with their labels and the
+// configured tags as DogStatsD tags. Histograms and summaries are sent
+// as counters of their number and sum of observations.
+func (s *statsdSink) lines(families []*dto.MetricFamily) []string {
+	s.last.lock.Lock()
+	defer s.last.lock.Unlock()
+	lines := []string{}
+	for _, family := range families {
+		name := s.cfg.Prefix + family.GetName()
+		for _, metric := range family.GetMetric() {
+			tags := append([]string{}, s.cfg.Tags...)
+			for _, label := range metric.GetLabel() {
+				tags = append(tags, label.GetName()+":"+label.GetValue())
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = s.appendCount(lines, name, metric.GetCounter().GetValue(), tags)
+			case dto.MetricType_GAUGE:
+				lines = appendGauge(lines, name, metric.GetGauge().GetValue(), tags)
+			case dto.MetricType_UNTYPED:
+				lines = appendGauge(lines, name, metric.GetUntyped().GetValue(), tags)
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				lines = s.appendCount(lines, name+".count",
+					float64(summary.GetSampleCount()), tags)
+				lines = s.appendCount(lines, name+".sum", summary.GetSampleSum(), tags)
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				lines = s.appendCount(lines, name+".count",
+					float64(histogram.GetSampleCount()), tags)
+				lines = s.appendCount(lines, name+".sum", histogram.GetSampleSum(), tags)
+			}
+		}
+	}
+	return lines
+}
+
+// appendCount appends a StatsD counter of how much the Prometheus
+// counter has changed since the last push, if it has
+func (s *statsdSink) appendCount(lines []string, name string, value float64, tags []string) []string {
+	key := name + "|" + strings.Join(tags, ",")
+	delta := value - s.last.values[key]
+	if delta < 0 {
+		// the counter was reset, as when a metric is replaced on reload
+		delta = value
+	}
+	s.last.values[key] = value
+	if delta == 0 || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return lines
+	}
+	return append(lines, formatStatsd(name, delta, "c", tags))
+}
+
+// appendGauge appends a StatsD gauge. StatsD reads a gauge value with a
+// sign as a change to the gauge, so a negative value has to be sent as
+// a change from zero.
+func appendGauge(lines []string, name string, value float64, tags []string) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return lines
+	}
+	if value < 0 {
+		lines = append(lines, formatStatsd(name, 0, "g", tags))
+	}
+	return append(lines, formatStatsd(name, value, "g", tags))
+}
+
+func formatStatsd(name string, value float64, statType string, tags []string) string {
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + statType
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
@@ -0,0 +1,102 @@
+package telemetry
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/containerpilot/tests"
+	"github.com/joyent/containerpilot/tests/mocks"
+)
+
+func TestStatsdConfig(t *testing.T) {
+	cfg, err := NewConfig(tests.DecodeRaw(`{"interfaces": ["inet", "lo0"],
+		"statsd": {}}`), &mocks.NoopDiscoveryBackend{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, defaultStatsdAddress, cfg.Statsd.Address)
+	assert.Equal(t, defaultStatsdInterval, cfg.Statsd.interval)
+
+	cfg, err = NewConfig(tests.DecodeRaw(`{"interfaces": ["inet", "lo0"],
+		"statsd": {"address": "statsd:9125", "prefix": "app.",
+		"tags": ["env:prod"], "interval": "1m"}}`), &mocks.NoopDiscoveryBackend{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "statsd:9125", cfg.Statsd.Address)
+	assert.Equal(t, "app.", cfg.Statsd.Prefix)
+	assert.Equal(t, []string{"env:prod"}, cfg.Statsd.Tags)
+	assert.Equal(t, time.Minute, cfg.Statsd.interval)
+
+	testErr := func(raw, expected string) {
+		_, err := NewConfig(tests.DecodeRaw(raw), &mocks.NoopDiscoveryBackend{})
+		assert.EqualError(t, err, "telemetry validation error: "+expected)
+	}
+	testErr(`{"interfaces": ["inet", "lo0"], "statsd": {"address": "statsd"}}`,
+		"statsd.address must be in the form 'host:port': 'statsd'")
+	testErr(`{"interfaces": ["inet", "lo0"], "statsd": {"interval": "-1s"}}`,
+		"statsd.interval must be > 0")
+	testErr(`{"interfaces": ["inet", "lo0"], "statsd": {"interval": "x"}}`,
+		"unable to parse statsd.interval 'x': time: invalid duration \"x\"")
+}
+
+func TestStatsdPush(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "requests", Help: "help"}, []string{"code"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "temperature", Help: "help"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "latency", Help: "help"})
+	registry.MustRegister(counter, gauge, histogram)
+
+	sink := &statsdSink{
+		cfg: &StatsdConfig{Address: server.LocalAddr().String(),
+			Prefix: "app.", Tags: []string{"env:test"}},
+		gatherer: registry,
+		last:     &statsdCounts{values: map[string]float64{}},
+	}
+	receive := func() []string {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxStatsdPacketSize)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unable to read from statsd sink: %v", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	counter.WithLabelValues("200").Add(3)
+	gauge.Set(21.5)
+	histogram.Observe(0.25)
+	sink.push()
+	defer sink.conn.Close()
+	assert.Equal(t, []string{
+		"app.latency.count:1|c|#env:test",
+		"app.latency.sum:0.25|c|#env:test",
+		"app.requests:3|c|#env:test,code:200",
+		"app.temperature:21.5|g|#env:test",
+	}, receive())
+
+	// counters only send what changed since the last push, and a
+	// negative gauge needs to be reset to zero first
+	counter.WithLabelValues("200").Add(2)
+	gauge.Set(-4)
+	sink.push()
+	assert.Equal(t, []string{
+		"app.requests:2|c|#env:test,code:200",
+		"app.temperature:0|g|#env:test",
+		"app.temperature:-4|g|#env:test",
+	}, receive())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/joyent/containerpilot/jobs"
 	"github.com/joyent/containerpilot/watches"
@@ -24,6 +25,19 @@ type jobStatusResponse struct {
 	Address string
 	Port    int
 	Status  string
+
+	LastHealthCheckFailure *healthCheckFailure `json:",omitempty"`
+}
+
+// healthCheckFailure describes the last time a job's health check failed,
+// so that we can see why a flapping check failed and not just that it did
+type healthCheckFailure struct {
+	Time     time.Time
+	Duration string
+	ExitCode int
+	Signal   string `json:",omitempty"`
+	Error    string
+	Output   string
 }
 
 // StatusHandler implements http.Handler
@@ -46,9 +60,21 @@ func (sh StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, job := range sh.telem.Status.jobs {
 		status := fmt.Sprintf("%s", job.GetStatus())
+		var failure *healthCheckFailure
+		if result, ok := job.LastHealthCheckFailure(); ok {
+			failure = &healthCheckFailure{
+				Time:     result.Time,
+				Duration: result.Duration.String(),
+				ExitCode: result.ExitCode,
+				Signal:   result.Signal,
+				Error:    result.Error,
+				Output:   result.Output,
+			}
+		}
 		for _, service := range sh.telem.Status.Services {
 			if service.Name == job.Name {
 				service.Status = status
+				service.LastHealthCheckFailure = failure
 			}
 		}
 	}
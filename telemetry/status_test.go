@@ -93,4 +93,6 @@ func TestStatusServerGet(t *testing.T) {
 	assert.Equal(t, len(out.Services), 1, "unexpected count of services")
 	assert.Equal(t, out.Services[0].Port, 80, "unexpected job port")
 	assert.Equal(t, out.Services[0].Status, "unknown", "unexpected job status")
+	assert.Nil(t, out.Services[0].LastHealthCheckFailure,
+		"expected no health check failure before the check has run")
 }
@@ -24,6 +24,10 @@ type Telemetry struct {
 	// server
 	router *http.ServeMux
 	addr   net.TCPAddr
+
+	// optional sink that pushes the metrics to StatsD
+	statsd       *statsdSink
+	statsdCancel context.CancelFunc
 	http.Server
 	events.EventHandler // Event handling
 }
@@ -38,6 +42,9 @@ func NewTelemetry(cfg *Config) *Telemetry {
 		Status:  &Status{Version: version.Version},
 	}
 	t.addr = cfg.addr
+	if cfg.Statsd != nil {
+		t.statsd = newStatsdSink(cfg.Statsd)
+	}
 	router := http.NewServeMux()
 	router.Handle("/metrics", prometheus.Handler())
 	router.Handle("/status", NewStatusHandler(t))
@@ -56,6 +63,11 @@ func (t *Telemetry) Run(bus *events.EventBus) {
 	t.Subscribe(bus, true)
 	t.Bus = bus
 	t.Start()
+	if t.statsd != nil {
+		var ctx context.Context
+		ctx, t.statsdCancel = context.WithCancel(context.Background())
+		go t.statsd.Run(ctx)
+	}
 
 	go func() {
 		defer t.Stop()
@@ -103,13 +115,19 @@ func (t *Telemetry) listenWithRetry() net.Listener {
 // Stop shuts down the telemetry service
 func (t *Telemetry) Stop() {
 	log.Debug("telemetry: stopping server")
+	if t.statsdCancel != nil {
+		t.statsdCancel()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 	defer cancel()
 	if err := t.Shutdown(ctx); err != nil {
 		log.Warnf("telemetry: failed to gracefully shutdown server: %v", err)
-		return
+		// we still need to release the port and unsubscribe so that
+		// a reload can start the new server
+		t.Close()
+	} else {
+		log.Debug("telemetry: completed graceful shutdown of server")
 	}
 	t.Unsubscribe(t.Bus, true)
 	close(t.Rx)
-	log.Debug("telemetry: completed graceful shutdown of server")
 }
@@ -3,6 +3,8 @@ package telemetry
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/joyent/containerpilot/config/decode"
 	"github.com/joyent/containerpilot/config/services"
@@ -16,8 +18,10 @@ import (
 type Config struct {
 	Port       int           `mapstructure:"port"`
 	Interfaces []interface{} `mapstructure:"interfaces"` // optional override
+	Listen     string        `mapstructure:"listen"`     // optional override
 	Tags       []string      `mapstructure:"tags"`
 	Metrics    []interface{} `mapstructure:"metrics"`
+	Statsd     *StatsdConfig `mapstructure:"statsd"` // optional push sink
 
 	// derived in Validate
 	MetricConfigs []*MetricConfig
@@ -36,7 +40,7 @@ func NewConfig(raw interface{}, disc discovery.Backend) (*Config, error) {
 		return nil, fmt.Errorf("telemetry configuration error: %v", err)
 	}
 	if err := cfg.Validate(disc); err != nil {
-		return nil, fmt.Errorf("telemetry validation error: %v", err)
+		return nil, fmt.Errorf("telemetry validation error: %w", err)
 	}
 	if cfg.Metrics != nil {
 		// note that we don't return an error if there are no metrics
@@ -53,8 +57,19 @@ func NewConfig(raw interface{}, disc discovery.Backend) (*Config, error) {
 
 // Validate ...
 func (cfg *Config) Validate(disc discovery.Backend) error {
+	if err := cfg.validateListen(); err != nil {
+		return err
+	}
+	if cfg.Statsd != nil {
+		if err := cfg.Statsd.Validate(); err != nil {
+			return err
+		}
+	}
 	ipAddress, err := services.IPFromInterfaces(cfg.Interfaces)
 	if err != nil {
+		if cfg.Listen != "" {
+			return fmt.Errorf("listen '%s' doesn't match an IP: %w", cfg.Listen, err)
+		}
 		return err
 	}
 	ip := net.ParseIP(ipAddress)
@@ -67,6 +82,37 @@ func (cfg *Config) Validate(disc discovery.Backend) error {
 	return nil
 }
 
+// validateListen splits the listen address into the interface spec and
+// port that replace the interfaces and port. The port is always the last
+// part of the address, because interface specs can have colons in them.
+// An exclusion on its own would fall back to the default specs, so we
+// don't allow them; the listen address must always choose the IP.
+func (cfg *Config) validateListen() error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	if len(cfg.Interfaces) > 0 {
+		return fmt.Errorf("listen '%s' can't be used with interfaces", cfg.Listen)
+	}
+	sep := strings.LastIndex(cfg.Listen, ":")
+	if sep < 1 {
+		return fmt.Errorf("listen '%s' must be in the form "+
+			"'<interface spec>:<port>'", cfg.Listen)
+	}
+	spec, rawPort := cfg.Listen[:sep], cfg.Listen[sep+1:]
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("listen '%s' has an invalid port '%s'", cfg.Listen, rawPort)
+	}
+	if strings.HasPrefix(spec, "!") {
+		return fmt.Errorf("listen '%s' can't use an excluded interface spec",
+			cfg.Listen)
+	}
+	cfg.Interfaces = []interface{}{spec}
+	cfg.Port = port
+	return nil
+}
+
 // ToJobConfig ...
 func (cfg *Config) ToJobConfig() *jobs.Config {
 	if version.Version != "" {
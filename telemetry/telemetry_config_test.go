@@ -1,13 +1,16 @@
 package telemetry
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 
+	"github.com/joyent/containerpilot/config/services"
 	"github.com/joyent/containerpilot/tests"
 	"github.com/joyent/containerpilot/tests/mocks"
 )
@@ -45,3 +48,32 @@ func TestTelemetryConfigBadInterface(t *testing.T) {
 		t.Fatalf("expected '%v' in error from bad metric type but got %v", expected, err)
 	}
 }
+
+func TestTelemetryConfigListen(t *testing.T) {
+	testCfg := tests.DecodeRaw(`{"listen": "static:127.0.0.1:9191"}`)
+	telem, err := NewConfig(testCfg, &mocks.NoopDiscoveryBackend{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "127.0.0.1:9191", telem.addr.String())
+	assert.Equal(t, 9191, telem.JobConfig.Port)
+	assert.Equal(t, []interface{}{"static:127.0.0.1"}, telem.JobConfig.Interfaces,
+		"expected the service to advertise the listen address")
+
+	testErr := func(raw, expected string) {
+		_, err := NewConfig(tests.DecodeRaw(raw), &mocks.NoopDiscoveryBackend{})
+		assert.EqualError(t, err, "telemetry validation error: "+expected)
+	}
+	testErr(`{"listen": "lo:inet"}`, "listen 'lo:inet' has an invalid port 'inet'")
+	testErr(`{"listen": "9090"}`,
+		"listen '9090' must be in the form '<interface spec>:<port>'")
+	testErr(`{"listen": "!eth0:9090"}`,
+		"listen '!eth0:9090' can't use an excluded interface spec")
+	testErr(`{"listen": "lo:9090", "interfaces": ["inet"]}`,
+		"listen 'lo:9090' can't be used with interfaces")
+
+	_, err = NewConfig(tests.DecodeRaw(`{"listen": "198.51.100.0/24:9090"}`),
+		&mocks.NoopDiscoveryBackend{})
+	assert.True(t, errors.Is(err, services.ErrNoMatch),
+		"expected an unmatched listen address to fail with ErrNoMatch, got %v", err)
+}
@@ -3,7 +3,13 @@ package telemetry
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
 
 	"github.com/joyent/containerpilot/events"
 	"github.com/joyent/containerpilot/tests/mocks"
@@ -40,3 +46,67 @@ func checkServerIsListening(t *testing.T, telem *Telemetry) {
 		t.Fatalf("got %v status from telemetry server", resp.StatusCode)
 	}
 }
+
+func TestTelemetryScrape(t *testing.T) {
+	cfg, err := NewConfig(map[string]interface{}{
+		"port":       9092,
+		"interfaces": []interface{}{"lo", "lo0", "inet"},
+		"metrics": []interface{}{map[string]interface{}{
+			"namespace": "telemetry",
+			"subsystem": "scrape",
+			"name":      "TestTelemetryScrape",
+			"help":      "scraped by the test",
+			"type":      "gauge",
+		}},
+	}, &mocks.NoopDiscoveryBackend{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	telem := NewTelemetry(cfg)
+	bus := events.NewEventBus()
+	for _, metric := range telem.Metrics {
+		metric.Run(bus)
+	}
+	telem.Run(bus)
+	defer telem.Stop()
+	bus.Publish(events.Event{events.Metric, "telemetry_scrape_TestTelemetryScrape|42"})
+	time.Sleep(100 * time.Millisecond)
+
+	// the endpoint must be safe to scrape concurrently
+	url := fmt.Sprintf("http://%v:%v/metrics", telem.addr.IP, telem.addr.Port)
+	var wg sync.WaitGroup
+	results := make(chan map[string]*dto.MetricFamily, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Errorf("could not connect to telemetry server: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			parser := &expfmt.TextParser{}
+			families, err := parser.TextToMetricFamilies(resp.Body)
+			if err != nil {
+				t.Errorf("could not parse metrics: %v", err)
+				return
+			}
+			results <- families
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	for families := range results {
+		family, ok := families["telemetry_scrape_TestTelemetryScrape"]
+		if !ok {
+			t.Fatalf("expected user-defined metric in %v", families)
+		}
+		assert.Equal(t, "scraped by the test", family.GetHelp())
+		assert.Equal(t, dto.MetricType_GAUGE, family.GetType())
+		assert.Equal(t, 42.0, family.GetMetric()[0].GetGauge().GetValue())
+		_, ok = families["containerpilot_events"]
+		assert.True(t, ok, "expected built-in containerpilot_events metric")
+	}
+}
@@ -0,0 +1,91 @@
+package mocks
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a mock events.Clock whose time only moves when Advance is
+// called, so that tests can control exactly when timers fire
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	changed chan struct{}
+}
+
+type fakeWaiter struct {
+	until time.Time
+	ch    chan time.Time
+}
+
+// NewFakeClock creates a FakeClock set to an arbitrary fixed time
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0), changed: make(chan struct{})}
+}
+
+// Now returns the time of the FakeClock
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the FakeClock has
+// been advanced by at least d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{until: c.now.Add(d), ch: ch})
+	c.notify()
+	return ch
+}
+
+// Advance moves the time of the FakeClock forward by d and fires every
+// timer that has expired
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	remaining := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.until.After(c.now) {
+			remaining = append(remaining, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = remaining
+	c.notify()
+}
+
+// BlockUntil waits until there are n timers waiting on the FakeClock, so
+// that a test can advance it after the code under test has set its timers.
+// It returns false if that doesn't happen before the (real time) timeout.
+func (c *FakeClock) BlockUntil(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.lock.Lock()
+		count, changed := len(c.waiters), c.changed
+		c.lock.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// notify wakes up BlockUntil. The caller must hold the lock.
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
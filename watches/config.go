@@ -2,9 +2,12 @@ package watches
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/joyent/containerpilot/config/decode"
 	"github.com/joyent/containerpilot/config/services"
+	"github.com/joyent/containerpilot/config/timing"
 	"github.com/joyent/containerpilot/discovery"
 )
 
@@ -12,9 +15,16 @@ import (
 type Config struct {
 	Name             string `mapstructure:"name"`
 	serviceName      string
-	Poll             int    `mapstructure:"interval"` // time in seconds
-	Tag              string `mapstructure:"tag"`
-	DC               string `mapstructure:"dc"` // Consul datacenter
+	Poll             int      `mapstructure:"interval"` // time in seconds
+	Tag              string   `mapstructure:"tag"`
+	DC               string   `mapstructure:"dc"`  // Consul datacenter
+	DCs              []string `mapstructure:"dcs"` // Consul datacenters to merge
+	KV               string   `mapstructure:"kv"`  // Consul key or key prefix
+	Debounce         string   `mapstructure:"debounce"`
+	debounce         time.Duration
+	Splay            string `mapstructure:"splay"`
+	splay            time.Duration
+	WaitOnStartup    bool `mapstructure:"waitOnStartup"`
 	discoveryService discovery.Backend
 }
 
@@ -47,10 +57,105 @@ func (cfg *Config) Validate(disc discovery.Backend) error {
 	if cfg.Poll < 1 {
 		return fmt.Errorf("watch[%s].interval must be > 0", cfg.serviceName)
 	}
+	debounce, err := timing.GetTimeout(cfg.Debounce)
+	if err != nil {
+		return fmt.Errorf("unable to parse watch[%s].debounce '%s': %v",
+			cfg.serviceName, cfg.Debounce, err)
+	}
+	if debounce < 0 {
+		return fmt.Errorf("watch[%s].debounce '%s' cannot be negative",
+			cfg.serviceName, cfg.Debounce)
+	}
+	cfg.debounce = debounce
+	splay, err := timing.ParseSplay(cfg.Splay,
+		time.Duration(cfg.Poll)*time.Second)
+	if err != nil {
+		return fmt.Errorf("unable to parse watch[%s].splay '%s': %v",
+			cfg.serviceName, cfg.Splay, err)
+	}
+	if splay < 0 {
+		return fmt.Errorf("watch[%s].splay '%s' cannot be negative",
+			cfg.serviceName, cfg.Splay)
+	}
+	cfg.splay = splay
+	if err := cfg.validateDCs(disc); err != nil {
+		return err
+	}
+	if err := cfg.validateDC(disc); err != nil {
+		return err
+	}
+	if err := cfg.validateKV(disc); err != nil {
+		return err
+	}
 	cfg.discoveryService = disc
 	return nil
 }
 
+// validateDC checks that a watch of a service or key in another
+// datacenter has a backend that won't ignore the datacenter
+func (cfg *Config) validateDC(disc discovery.Backend) error {
+	if cfg.DC == "" || disc == nil {
+		return nil
+	}
+	if selector, ok := disc.(discovery.DatacenterSelector); !ok || !selector.SupportsDatacenter() {
+		return fmt.Errorf("watch[%s].dc requires a discovery backend that can "+
+			"watch other datacenters", cfg.serviceName)
+	}
+	return nil
+}
+
+// validateDCs checks that a watch that merges the instances of its
+// service across datacenters has a backend that can do so
+func (cfg *Config) validateDCs(disc discovery.Backend) error {
+	if len(cfg.DCs) == 0 {
+		return nil
+	}
+	if cfg.DC != "" {
+		return fmt.Errorf("watch[%s].dc can't be used with 'dcs'", cfg.serviceName)
+	}
+	if cfg.KV != "" {
+		return fmt.Errorf("watch[%s].kv can't be used with 'dcs'", cfg.serviceName)
+	}
+	for _, dc := range cfg.DCs {
+		if dc == "" {
+			return fmt.Errorf("watch[%s].dcs must not include an empty datacenter",
+				cfg.serviceName)
+		}
+	}
+	if disc == nil {
+		return nil
+	}
+	if _, ok := disc.(discovery.DatacenterWatcher); !ok {
+		return fmt.Errorf("watch[%s].dcs requires a discovery backend that can "+
+			"watch several datacenters", cfg.serviceName)
+	}
+	return nil
+}
+
+// validateKV checks that a watch of a key or key prefix, instead of a
+// service, has a backend that can watch it
+func (cfg *Config) validateKV(disc discovery.Backend) error {
+	if cfg.KV == "" {
+		return nil
+	}
+	cfg.KV = strings.TrimPrefix(cfg.KV, "/")
+	if cfg.KV == "" {
+		return fmt.Errorf("watch[%s].kv must not be the root of the store",
+			cfg.serviceName)
+	}
+	if cfg.Tag != "" {
+		return fmt.Errorf("watch[%s].tag can't be used with 'kv'", cfg.serviceName)
+	}
+	if disc == nil {
+		return nil
+	}
+	if _, ok := disc.(discovery.KVWatcher); !ok {
+		return fmt.Errorf("watch[%s].kv requires a discovery backend that can "+
+			"watch keys", cfg.serviceName)
+	}
+	return nil
+}
+
 // String implements the stdlib fmt.Stringer interface for pretty-printing
 func (cfg *Config) String() string {
 	return "watches.Config[" + cfg.Name + "]"
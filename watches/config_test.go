@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/joyent/containerpilot/tests"
+	"github.com/joyent/containerpilot/tests/mocks"
 )
 
 func TestWatchesParse(t *testing.T) {
@@ -28,6 +30,11 @@ func TestWatchesParse(t *testing.T) {
 	assert.Equal(watches[1].Name, "watch.upstreamB", "config for Name")
 	assert.Equal(watches[1].Poll, 79, "config for Poll")
 	assert.Equal(watches[1].DC, "us-east-1", "config for DC")
+	assert.Equal(watches[0].debounce, time.Duration(0), "config for debounce")
+	assert.Equal(watches[1].debounce, 5*time.Second, "config for debounce")
+	assert.Equal(watches[0].splay, time.Duration(0), "config for splay")
+	assert.Equal(watches[1].splay, 2*time.Second, "config for splay")
+	assert.Equal(watches[2].DCs, []string{"us-east-1", "eu-west-1"}, "config for DCs")
 }
 
 func TestWatchesConfigError(t *testing.T) {
@@ -38,4 +45,64 @@ func TestWatchesConfigError(t *testing.T) {
 	_, err = NewConfigs(tests.DecodeRawToSlice(
 		`[{"name": "myName"}]`), nil)
 	assert.Error(t, err, "watch[myName].interval must be > 0")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "debounce": "x"}]`), nil)
+	assert.EqualError(t, err,
+		"unable to parse watch[myName].debounce 'x': time: invalid duration \"x\"")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "debounce": "-1s"}]`), nil)
+	assert.EqualError(t, err, "watch[myName].debounce '-1s' cannot be negative")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "splay": "-1s"}]`), nil)
+	assert.EqualError(t, err, "watch[myName].splay '-1s' cannot be negative")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "dc": "dc1", "dcs": ["dc2"]}]`), nil)
+	assert.EqualError(t, err, "watch[myName].dc can't be used with 'dcs'")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "kv": "flags", "dcs": ["dc2"]}]`), nil)
+	assert.EqualError(t, err, "watch[myName].kv can't be used with 'dcs'")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "dcs": ["dc1", ""]}]`), nil)
+	assert.EqualError(t, err, "watch[myName].dcs must not include an empty datacenter")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "dcs": ["dc1", "dc2"]}]`),
+		&mocks.NoopDiscoveryBackend{})
+	assert.EqualError(t, err,
+		"watch[myName].dcs requires a discovery backend that can watch several datacenters")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "dc": "dc1"}]`),
+		&mocks.NoopDiscoveryBackend{})
+	assert.EqualError(t, err,
+		"watch[myName].dc requires a discovery backend that can watch other datacenters")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "kv": "flags", "tag": "dev"}]`), nil)
+	assert.EqualError(t, err, "watch[myName].tag can't be used with 'kv'")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "kv": "/"}]`), nil)
+	assert.EqualError(t, err, "watch[myName].kv must not be the root of the store")
+
+	_, err = NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 1, "kv": "flags"}]`),
+		&mocks.NoopDiscoveryBackend{})
+	assert.EqualError(t, err,
+		"watch[myName].kv requires a discovery backend that can watch keys")
+}
+
+func TestWatchesConfigSplayPercent(t *testing.T) {
+	watches, err := NewConfigs(tests.DecodeRawToSlice(
+		`[{"name": "myName", "interval": 10, "splay": "20%"}]`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, 2*time.Second, watches[0].splay)
 }
@@ -5,20 +5,54 @@ package watches
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/events"
 )
 
+var (
+	instancesLock sync.RWMutex
+	instances     = map[string]int{}
+	values        = map[string]string{}
+)
+
+// Instances returns the number of healthy instances the named watch saw
+// when it last emitted a change, if its discovery backend can count them
+func Instances(name string) (int, bool) {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	count, ok := instances[name]
+	return count, ok
+}
+
+// Value returns the value of the key the named watch saw when it last
+// emitted a change, and false if it doesn't watch a key or the key
+// didn't exist
+func Value(name string) (string, bool) {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	value, ok := values[name]
+	return value, ok
+}
+
 // Watch represents an event to signal when something changes
 type Watch struct {
 	Name             string
+	WaitOnStartup    bool
 	serviceName      string
 	tag              string
 	dc               string
+	dcs              []string
+	kv               string
+	kvValue          *string // nil if the key doesn't exist
 	poll             int
+	debounce         time.Duration
+	splay            time.Duration
 	discoveryService discovery.Backend
+	clock            events.Clock
 
 	events.EventHandler // Event handling
 }
@@ -27,11 +61,17 @@ type Watch struct {
 func NewWatch(cfg *Config) *Watch {
 	watch := &Watch{
 		Name:             cfg.Name,
+		WaitOnStartup:    cfg.WaitOnStartup,
 		serviceName:      cfg.serviceName,
 		tag:              cfg.Tag,
 		dc:               cfg.DC,
+		dcs:              cfg.DCs,
+		kv:               cfg.KV,
 		poll:             cfg.Poll,
+		debounce:         cfg.debounce,
+		splay:            cfg.splay,
 		discoveryService: cfg.discoveryService,
+		clock:            events.RealClock,
 	}
 	watch.InitRx()
 	return watch
@@ -50,9 +90,35 @@ func FromConfigs(cfgs []*Config) []*Watch {
 // CheckForUpstreamChanges checks the service discovery endpoint for any changes
 // in a dependent backend. Returns true when there has been a change.
 func (watch *Watch) CheckForUpstreamChanges() (bool, bool) {
+	if watch.kv != "" {
+		return watch.checkForKVChanges()
+	}
+	if len(watch.dcs) > 0 {
+		if watcher, ok := watch.discoveryService.(discovery.DatacenterWatcher); ok {
+			return watcher.CheckForUpstreamChangesInDCs(watch.serviceName, watch.tag, watch.dcs)
+		}
+		return false, false
+	}
 	return watch.discoveryService.CheckForUpstreamChanges(watch.serviceName, watch.tag, watch.dc)
 }
 
+// checkForKVChanges checks the watched key for a new value. The watch is
+// healthy while the key exists.
+func (watch *Watch) checkForKVChanges() (bool, bool) {
+	watcher, ok := watch.discoveryService.(discovery.KVWatcher)
+	if !ok {
+		return false, false
+	}
+	didChange, exists, value := watcher.CheckForKVChanges(watch.kv, watch.dc)
+	if didChange {
+		watch.kvValue = nil
+		if exists {
+			watch.kvValue = &value
+		}
+	}
+	return didChange, exists
+}
+
 // Run executes the event loop for the Watch
 func (watch *Watch) Run(bus *events.EventBus) {
 	watch.Subscribe(bus)
@@ -60,8 +126,27 @@ func (watch *Watch) Run(bus *events.EventBus) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	timerSource := fmt.Sprintf("%s.poll", watch.Name)
-	events.NewEventTimer(ctx, watch.Rx,
-		time.Duration(watch.poll)*time.Second, timerSource)
+	events.NewEventTimerWithSplay(ctx, watch.clock, watch.Rx,
+		time.Duration(watch.poll)*time.Second, watch.splay, timerSource)
+
+	// when debouncing, each change restarts the debounce timer under a new
+	// name so that we can ignore a timer that fired before it was reset
+	var (
+		debounceCancel context.CancelFunc
+		debounceSource string
+		debounceCount  int
+		pendingHealthy bool
+	)
+	resetDebounce := func() {
+		if debounceCancel != nil {
+			debounceCancel()
+		}
+		debounceCount++
+		debounceSource = fmt.Sprintf("%s.debounce.%d", watch.Name, debounceCount)
+		var debounceCtx context.Context
+		debounceCtx, debounceCancel = context.WithCancel(ctx)
+		events.NewEventTimeout(debounceCtx, watch.clock, watch.Rx, watch.debounce, debounceSource)
+	}
 
 	go func() {
 		defer func() {
@@ -77,16 +162,24 @@ func (watch *Watch) Run(bus *events.EventBus) {
 				switch event {
 				case events.Event{events.TimerExpired, timerSource}:
 					didChange, isHealthy := watch.CheckForUpstreamChanges()
-					if didChange {
-						watch.Bus.Publish(events.Event{events.StatusChanged, watch.Name})
-						// we only send the StatusHealthy and StatusUnhealthy
-						// events if there was a change
-						if isHealthy {
-							watch.Bus.Publish(events.Event{events.StatusHealthy, watch.Name})
-						} else {
-							watch.Bus.Publish(events.Event{events.StatusUnhealthy, watch.Name})
-						}
+					if !didChange {
+						continue
+					}
+					if watch.debounce == 0 {
+						watch.publishChange(isHealthy)
+						continue
 					}
+					pendingHealthy = isHealthy
+					resetDebounce()
+				case events.Event{events.TimerExpired, debounceSource}:
+					if debounceCancel == nil {
+						continue
+					}
+					// the changes have settled so we send the latest status
+					debounceCancel()
+					debounceCancel = nil
+					debounceSource = ""
+					watch.publishChange(pendingHealthy)
 				case
 					events.Event{events.Quit, watch.Name},
 					events.QuitByClose,
@@ -100,7 +193,87 @@ func (watch *Watch) Run(bus *events.EventBus) {
 	}()
 }
 
+// publishChange sends the StatusChanged event along with the current
+// status of the watched service
+func (watch *Watch) publishChange(isHealthy bool) {
+	// record the count before publishing so that it's ready for any
+	// job that starts on the change
+	if watch.kv != "" {
+		instancesLock.Lock()
+		delete(values, watch.Name)
+		if watch.kvValue != nil {
+			values[watch.Name] = *watch.kvValue
+		}
+		instancesLock.Unlock()
+	} else if counter, ok := watch.discoveryService.(discovery.InstanceCounter); ok {
+		instancesLock.Lock()
+		instances[watch.Name] = counter.InstanceCount(watch.serviceName)
+		instancesLock.Unlock()
+	}
+	watch.Bus.Publish(events.Event{events.StatusChanged, watch.Name})
+	// we only send the StatusHealthy and StatusUnhealthy
+	// events if there was a change
+	if isHealthy {
+		watch.Bus.Publish(events.Event{events.StatusHealthy, watch.Name})
+	} else {
+		watch.Bus.Publish(events.Event{events.StatusUnhealthy, watch.Name})
+	}
+}
+
 // String implements the stdlib fmt.Stringer interface for pretty-printing
 func (watch *Watch) String() string {
 	return "watches.Watch[" + watch.Name + "]"
 }
+
+// Reload applies the Watches from a reloaded config to the running
+// Watches on the bus and returns the Watches that replace them. Unchanged
+// Watches keep running; changed, added, and removed Watches are started
+// or stopped. If the discovery backend has changed, every Watch is
+// replaced so that it polls the new backend.
+func Reload(running, updated []*Watch, bus *events.EventBus, discoveryChanged bool) []*Watch {
+	previous := make(map[string]*Watch, len(running))
+	for _, watch := range running {
+		previous[watch.Name] = watch
+	}
+	var (
+		result   []*Watch
+		replaced []*Watch
+	)
+	for _, watch := range updated {
+		old, ok := previous[watch.Name]
+		delete(previous, watch.Name)
+		if ok && !discoveryChanged && old.sameConfig(watch) {
+			result = append(result, old)
+			continue
+		}
+		// start the new Watch before we stop the old one so that the bus
+		// never runs out of subscribers and shuts down
+		watch.Run(bus)
+		if ok {
+			replaced = append(replaced, old)
+		}
+		result = append(result, watch)
+	}
+	for _, watch := range replaced {
+		watch.Quit()
+	}
+	for _, watch := range running {
+		if _, removed := previous[watch.Name]; removed {
+			watch.Quit()
+		}
+	}
+	return result
+}
+
+// sameConfig returns true if the other Watch polls the same service or key in
+// the same way
+func (watch *Watch) sameConfig(other *Watch) bool {
+	return watch.serviceName == other.serviceName &&
+		watch.tag == other.tag &&
+		watch.dc == other.dc &&
+		strings.Join(watch.dcs, ",") == strings.Join(other.dcs, ",") &&
+		watch.kv == other.kv &&
+		watch.poll == other.poll &&
+		watch.debounce == other.debounce &&
+		watch.splay == other.splay
+}
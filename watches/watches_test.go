@@ -3,6 +3,7 @@ package watches
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/joyent/containerpilot/discovery"
 	"github.com/joyent/containerpilot/events"
@@ -58,3 +59,125 @@ func runWatchTest(cfg *Config, count int, disc discovery.Backend) map[events.Eve
 	}
 	return got
 }
+
+// changingBackend reports a change on every poll, and reports the
+// service as healthy only on every other poll
+type changingBackend struct {
+	mocks.NoopDiscoveryBackend
+	polls int
+}
+
+func (b *changingBackend) CheckForUpstreamChanges(_, _, _ string) (bool, bool) {
+	b.polls++
+	return true, b.polls%2 == 1
+}
+
+// kvBackend returns the next of its values for the watched key on each
+// poll, with an empty value for a key that doesn't exist
+type kvBackend struct {
+	mocks.NoopDiscoveryBackend
+	values []string
+	last   string
+}
+
+func (b *kvBackend) CheckForKVChanges(key, _ string) (bool, bool, string) {
+	value := b.values[0]
+	b.values = b.values[1:]
+	changed := value != b.last
+	b.last = value
+	return changed, value != "", value
+}
+
+func TestWatchKV(t *testing.T) {
+	cfg := &Config{Name: "flags", Poll: 1, KV: "/features/flags"}
+	backend := &kvBackend{values: []string{"on", "on"}}
+	got := runWatchTest(cfg, 4, backend)
+	changed := events.Event{events.StatusChanged, "watch.flags"}
+	healthy := events.Event{events.StatusHealthy, "watch.flags"}
+	if got[changed] != 1 || got[healthy] != 1 {
+		t.Fatalf("expected one change to the key but got %v", got)
+	}
+	if value, ok := Value("watch.flags"); !ok || value != "on" {
+		t.Fatalf("expected value 'on' for the key but got %q (%v)", value, ok)
+	}
+
+	// deleting the key is a change to unhealthy without a value
+	backend.values = []string{"", ""}
+	cfg = &Config{Name: "flags", Poll: 1, KV: "/features/flags"}
+	got = runWatchTest(cfg, 4, backend)
+	unhealthy := events.Event{events.StatusUnhealthy, "watch.flags"}
+	if got[changed] != 1 || got[unhealthy] != 1 {
+		t.Fatalf("expected the key to be deleted but got %v", got)
+	}
+	if _, ok := Value("watch.flags"); ok {
+		t.Fatalf("expected no value for a deleted key")
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	cfg := &Config{Name: "mywatchDebounce", Poll: 60, Debounce: "200ms"}
+	cfg.Validate(&changingBackend{})
+	bus := events.NewEventBus()
+	watch := NewWatch(cfg)
+	watch.Run(bus)
+
+	poll := events.Event{events.TimerExpired, "watch.mywatchDebounce.poll"}
+	for i := 0; i < 3; i++ {
+		bus.Publish(poll)
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	// a change after the window has settled starts a new window
+	bus.Publish(poll)
+	time.Sleep(300 * time.Millisecond)
+	watch.Quit()
+	bus.Wait()
+
+	got := map[events.Event]int{}
+	for _, result := range bus.DebugEvents() {
+		got[result]++
+	}
+	changed := events.Event{events.StatusChanged, "watch.mywatchDebounce"}
+	healthy := events.Event{events.StatusHealthy, "watch.mywatchDebounce"}
+	unhealthy := events.Event{events.StatusUnhealthy, "watch.mywatchDebounce"}
+	// 3rd poll is healthy, 4th poll is unhealthy
+	if got[changed] != 2 || got[healthy] != 1 || got[unhealthy] != 1 {
+		t.Fatalf("expected changes to be coalesced into 2 events but got %v", got)
+	}
+}
+
+func TestWatchReload(t *testing.T) {
+	newWatches := func(raw ...*Config) []*Watch {
+		for _, cfg := range raw {
+			cfg.Validate(&mocks.NoopDiscoveryBackend{})
+		}
+		return FromConfigs(raw)
+	}
+	bus := events.NewEventBus()
+	running := newWatches(
+		&Config{Name: "keep", Poll: 60},
+		&Config{Name: "change", Poll: 60},
+		&Config{Name: "remove", Poll: 60})
+	for _, watch := range running {
+		watch.Run(bus)
+	}
+	updated := newWatches(
+		&Config{Name: "keep", Poll: 60},
+		&Config{Name: "change", Poll: 30},
+		&Config{Name: "add", Poll: 60})
+
+	result := Reload(running, updated, bus, false)
+	if len(result) != 3 || result[0] != running[0] ||
+		result[1] != updated[1] || result[2] != updated[2] {
+		t.Fatalf("expected unchanged watch to be kept and others replaced: %v", result)
+	}
+
+	// a new discovery backend replaces every watch
+	replaced := newWatches(&Config{Name: "keep", Poll: 60})
+	result = Reload(result, replaced, bus, true)
+	if len(result) != 1 || result[0] != replaced[0] {
+		t.Fatalf("expected watch to be replaced for the new backend: %v", result)
+	}
+	result[0].Quit()
+	bus.Wait()
+}